@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"sync"
 	"time"
 
@@ -28,7 +29,20 @@ type BoltdbConfig struct {
 	MissingAppCacheTTL time.Duration
 	AppCacheTTL        time.Duration
 	OrgSpaceCacheTTL   time.Duration
+	OrgCacheTTL        time.Duration // overrides OrgSpaceCacheTTL for orgs when set
+	SpaceCacheTTL      time.Duration // overrides OrgSpaceCacheTTL for spaces when set
 	AppLimits          int
+	// Resolves the names of the org and space quotas of apps, refreshed every
+	// QuotaCacheTTL, or OrgSpaceCacheTTL when 0
+	ResolveQuotas bool
+	QuotaCacheTTL time.Duration
+	// Buffers app upserts in memory and writes them to the database in a single
+	// transaction at this interval. Writes through when 0
+	WriteInterval time.Duration
+	// JSON snapshot of the cached apps, imported on startup when the database is
+	// empty and written at SnapshotInterval and on close
+	SnapshotPath     string
+	SnapshotInterval time.Duration
 
 	Logger lager.Logger
 }
@@ -36,6 +50,7 @@ type BoltdbConfig struct {
 // Org is a CAPI org
 type Org struct {
 	Name        string
+	QuotaGUID   string
 	LastUpdated time.Time
 }
 
@@ -43,6 +58,7 @@ type Org struct {
 type Space struct {
 	Name        string
 	OrgGUID     string
+	QuotaGUID   string
 	LastUpdated time.Time
 }
 
@@ -57,6 +73,14 @@ type Boltdb struct {
 	orgNameCache   map[string]Org   // caches org guid->org name mapping
 	spaceNameCache map[string]Space // caches space guid->space name mapping
 
+	// caches org and space quota guid->quota name mapping, with ResolveQuotas
+	quotaNames    map[string]string
+	quotasUpdated time.Time
+
+	// app upserts not written to the database yet, with WriteInterval
+	writeLock     sync.Mutex
+	pendingWrites map[string]*App
+
 	closing chan struct{}
 	wg      sync.WaitGroup
 	config  *BoltdbConfig
@@ -69,6 +93,8 @@ func NewBoltdb(client AppClient, config *BoltdbConfig) (*Boltdb, error) {
 		missingApps:    make(map[string]struct{}),
 		orgNameCache:   make(map[string]Org),
 		spaceNameCache: make(map[string]Space),
+		quotaNames:     make(map[string]string),
+		pendingWrites:  make(map[string]*App),
 		closing:        make(chan struct{}),
 		config:         config,
 	}, nil
@@ -96,7 +122,19 @@ func (c *Boltdb) Open() error {
 		c.invalidateMissingAppCache()
 	}
 
-	return c.populateCache()
+	if c.config.WriteInterval != time.Duration(0) {
+		c.flushWritesPeriodically()
+	}
+
+	if err := c.populateCache(); err != nil {
+		return err
+	}
+
+	if c.config.SnapshotPath != "" && c.config.SnapshotInterval != time.Duration(0) {
+		c.snapshotPeriodically()
+	}
+
+	return nil
 }
 
 func (c *Boltdb) populateCache() error {
@@ -105,6 +143,10 @@ func (c *Boltdb) populateCache() error {
 		return err
 	}
 
+	if len(apps) == 0 && c.config.SnapshotPath != "" {
+		apps = c.importSnapshot()
+	}
+
 	if len(apps) == 0 {
 		// populate from remote
 		apps, err = c.getAllAppsFromRemote()
@@ -124,6 +166,10 @@ func (c *Boltdb) Close() error {
 	// Wait for background goroutine exit
 	c.wg.Wait()
 
+	if c.config.SnapshotPath != "" {
+		c.writeSnapshot()
+	}
+
 	return c.appdb.Close()
 }
 
@@ -233,6 +279,7 @@ func (c *Boltdb) getAppFromCache(appGuid string) (*App, error) {
 
 func (c *Boltdb) getAllAppsFromBoltDB() (map[string]*App, error) {
 	var allData [][]byte
+	pending := c.pendingApps()
 	c.appdb.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(APP_BUCKET))
 		b.ForEach(func(guid []byte, v []byte) error {
@@ -252,11 +299,23 @@ func (c *Boltdb) getAllAppsFromBoltDB() (map[string]*App, error) {
 		apps[app.Guid] = &app
 	}
 
+	// Not written to the database yet
+	for guid, app := range pending {
+		apps[guid] = app
+	}
+
 	return apps, nil
 }
 
 // getAppFromDatabase will try to get the app from the database and return it.
 func (c *Boltdb) getAppFromDatabase(appGuid string) (*App, error) {
+	c.writeLock.Lock()
+	pendingApp := c.pendingWrites[appGuid]
+	c.writeLock.Unlock()
+	if pendingApp != nil {
+		return pendingApp, nil
+	}
+
 	var appData []byte
 	c.appdb.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(APP_BUCKET))
@@ -318,7 +377,7 @@ func (c *Boltdb) createBucket() error {
 // invalidateMissingAppCache perodically cleanup inmemory house keeping for
 // not found apps. When the this cache is cleaned up, end clients have chance
 // to retry missing apps
-func (c *Boltdb) invalidateMissingAppCache() {  // nosemgrep false-positive : Execution of ticker `ticker` more times than desired will not be causing any issues for function "invalidateMissingAppCache".
+func (c *Boltdb) invalidateMissingAppCache() { // nosemgrep false-positive : Execution of ticker `ticker` more times than desired will not be causing any issues for function "invalidateMissingAppCache".
 	ticker := time.NewTicker(c.config.MissingAppCacheTTL)
 
 	c.wg.Add(1)
@@ -340,9 +399,9 @@ func (c *Boltdb) invalidateMissingAppCache() {  // nosemgrep false-positive : Ex
 
 // invalidateCache perodically fetches a full copy apps info from remote
 // and update boltdb and in-memory cache
-func (c *Boltdb) invalidateCache() {  // nosemgrep false-positive : Execution of ticker `ticker` and `orgSpaceTicker` more times than desired will not be causing any issues for function "invalidateCache".
+func (c *Boltdb) invalidateCache() { // nosemgrep false-positive : Execution of ticker `ticker` and `orgSpaceTicker` more times than desired will not be causing any issues for function "invalidateCache".
 	ticker := time.NewTicker(c.config.AppCacheTTL)
-	orgSpaceTicker := time.NewTicker(c.config.OrgSpaceCacheTTL)
+	orgSpaceTicker := time.NewTicker(minDuration(c.orgCacheTTL(), c.spaceCacheTTL()))
 
 	c.wg.Add(1)
 	go func() {
@@ -360,10 +419,7 @@ func (c *Boltdb) invalidateCache() {  // nosemgrep false-positive : Execution of
 					c.config.Logger.Error("Unable to fetch copy of cache from remote", err)
 				}
 			case <-orgSpaceTicker.C:
-				c.lock.Lock()
-				c.orgNameCache = make(map[string]Org)
-				c.spaceNameCache = make(map[string]Space)
-				c.lock.Unlock()
+				c.expireOrgsAndSpaces(time.Now())
 			case <-c.closing:
 				return
 			}
@@ -371,7 +427,62 @@ func (c *Boltdb) invalidateCache() {  // nosemgrep false-positive : Execution of
 	}()
 }
 
+// expireOrgsAndSpaces removes the orgs and spaces which are older than their TTL
+func (c *Boltdb) expireOrgsAndSpaces(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for guid, org := range c.orgNameCache {
+		if now.Sub(org.LastUpdated) >= c.orgCacheTTL() {
+			delete(c.orgNameCache, guid)
+		}
+	}
+
+	for guid, space := range c.spaceNameCache {
+		if now.Sub(space.LastUpdated) >= c.spaceCacheTTL() {
+			delete(c.spaceNameCache, guid)
+		}
+	}
+}
+
+func (c *Boltdb) orgCacheTTL() time.Duration {
+	if c.config.OrgCacheTTL > 0 {
+		return c.config.OrgCacheTTL
+	}
+	return c.config.OrgSpaceCacheTTL
+}
+
+func (c *Boltdb) spaceCacheTTL() time.Duration {
+	if c.config.SpaceCacheTTL > 0 {
+		return c.config.SpaceCacheTTL
+	}
+	return c.config.OrgSpaceCacheTTL
+}
+
+func (c *Boltdb) quotaCacheTTL() time.Duration {
+	if c.config.QuotaCacheTTL > 0 {
+		return c.config.QuotaCacheTTL
+	}
+	return c.config.OrgSpaceCacheTTL
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func (c *Boltdb) fillDatabase(apps map[string]*App) {
+	if c.config.WriteInterval != time.Duration(0) {
+		c.writeLock.Lock()
+		for guid, app := range apps {
+			c.pendingWrites[guid] = app
+		}
+		c.writeLock.Unlock()
+		return
+	}
+
 	for _, app := range apps {
 		c.appdb.Update(func(tx *bolt.Tx) error {
 			serialize, err := json.Marshal(app)
@@ -388,6 +499,123 @@ func (c *Boltdb) fillDatabase(apps map[string]*App) {
 	}
 }
 
+// writeApps writes the apps to the database in a single transaction
+func (c *Boltdb) writeApps(apps map[string]*App) error {
+	if len(apps) == 0 {
+		return nil
+	}
+
+	return c.appdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(APP_BUCKET))
+		for _, app := range apps {
+			serialize, err := json.Marshal(app)
+			if err != nil {
+				return fmt.Errorf("error Marshaling data: %s", err)
+			}
+
+			if err := b.Put([]byte(app.Guid), serialize); err != nil {
+				return fmt.Errorf("error inserting data: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+// pendingApps returns a copy of the app upserts not written to the database yet
+func (c *Boltdb) pendingApps() map[string]*App {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	apps := make(map[string]*App, len(c.pendingWrites))
+	for guid, app := range c.pendingWrites {
+		apps[guid] = app
+	}
+	return apps
+}
+
+// flushWrites writes the pending app upserts to the database. They stay pending, and
+// visible to reads, until they are written
+func (c *Boltdb) flushWrites() {
+	apps := c.pendingApps()
+	if err := c.writeApps(apps); err != nil {
+		c.config.Logger.Error("Failed to write apps to boltdb", err, lager.Data{"apps": len(apps)})
+		return
+	}
+
+	c.writeLock.Lock()
+	for guid, app := range apps {
+		// Unless upserted again in the meantime
+		if c.pendingWrites[guid] == app {
+			delete(c.pendingWrites, guid)
+		}
+	}
+	c.writeLock.Unlock()
+}
+
+func (c *Boltdb) flushWritesPeriodically() {
+	ticker := time.NewTicker(c.config.WriteInterval)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.flushWrites()
+			case <-c.closing:
+				// Last writes before the database is closed
+				c.flushWrites()
+				return
+			}
+		}
+	}()
+}
+
+// importSnapshot returns the apps of the snapshot, written to the database, or no
+// apps when there is no snapshot to import
+func (c *Boltdb) importSnapshot() map[string]*App {
+	apps, err := ReadSnapshot(c.config.SnapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.config.Logger.Error("Failed to import the cache snapshot", err)
+		}
+		return nil
+	}
+
+	c.fillDatabase(apps)
+	c.config.Logger.Info(fmt.Sprintf("Imported %d apps from the cache snapshot", len(apps)))
+	return apps
+}
+
+func (c *Boltdb) writeSnapshot() {
+	apps, _ := c.GetAllApps()
+	if err := WriteSnapshot(c.config.SnapshotPath, apps, time.Now()); err != nil {
+		c.config.Logger.Error("Failed to write the cache snapshot", err)
+	}
+}
+
+func (c *Boltdb) snapshotPeriodically() {
+	ticker := time.NewTicker(c.config.SnapshotInterval)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.writeSnapshot()
+			case <-c.closing:
+				// The last snapshot is written by Close
+				return
+			}
+		}
+	}()
+}
+
 func (c *Boltdb) fromPCFApp(app *cfclient.App) *App {
 	cachedApp := &App{
 		Name:       app.Name,
@@ -395,6 +623,13 @@ func (c *Boltdb) fromPCFApp(app *cfclient.App) *App {
 		SpaceGuid:  app.SpaceGuid,
 		IgnoredApp: c.isOptOut(app.Environment),
 		CfAppEnv:   app.Environment,
+		State:      app.State,
+		CreatedAt:  app.CreatedAt,
+		UpdatedAt:  app.UpdatedAt,
+		Instances:  app.Instances,
+		Memory:     app.Memory,
+
+		RefreshedAt: time.Now().Unix(),
 	}
 
 	c.fillOrgAndSpace(cachedApp)
@@ -409,7 +644,7 @@ func (c *Boltdb) fillOrgAndSpace(app *App) error {
 	space, ok := c.spaceNameCache[app.SpaceGuid]
 	c.lock.RUnlock()
 
-	if !ok || now.Sub(space.LastUpdated) > c.config.OrgSpaceCacheTTL {
+	if !ok || now.Sub(space.LastUpdated) > c.spaceCacheTTL() {
 		cfspace, err := c.appClient.GetSpaceByGuid(app.SpaceGuid)
 		if err != nil {
 			return err
@@ -418,6 +653,7 @@ func (c *Boltdb) fillOrgAndSpace(app *App) error {
 		space = Space{
 			Name:        cfspace.Name,
 			OrgGUID:     cfspace.OrganizationGuid,
+			QuotaGUID:   cfspace.QuotaDefinitionGuid,
 			LastUpdated: now,
 		}
 
@@ -432,7 +668,7 @@ func (c *Boltdb) fillOrgAndSpace(app *App) error {
 	c.lock.RLock()
 	org, ok := c.orgNameCache[space.OrgGUID]
 	c.lock.RUnlock()
-	if !ok || now.Sub(org.LastUpdated) > c.config.OrgSpaceCacheTTL {
+	if !ok || now.Sub(org.LastUpdated) > c.orgCacheTTL() {
 		cforg, err := c.appClient.GetOrgByGuid(space.OrgGUID)
 		if err != nil {
 			return err
@@ -440,6 +676,7 @@ func (c *Boltdb) fillOrgAndSpace(app *App) error {
 
 		org = Org{
 			Name:        cforg.Name,
+			QuotaGUID:   cforg.QuotaDefinitionGuid,
 			LastUpdated: now,
 		}
 
@@ -451,9 +688,63 @@ func (c *Boltdb) fillOrgAndSpace(app *App) error {
 	app.OrgGuid = space.OrgGUID
 	app.OrgName = org.Name
 
+	if c.config.ResolveQuotas {
+		app.OrgQuotaName = c.quotaName(org.QuotaGUID, now)
+		app.SpaceQuotaName = c.quotaName(space.QuotaGUID, now)
+	}
+
 	return nil
 }
 
+// quotaName returns the name of the org or space quota, or "" when it is unknown. The
+// names of all quotas are listed again once they are older than their TTL
+func (c *Boltdb) quotaName(quotaGUID string, now time.Time) string {
+	if quotaGUID == "" {
+		return ""
+	}
+
+	c.lock.RLock()
+	name, stale := c.quotaNames[quotaGUID], now.Sub(c.quotasUpdated) > c.quotaCacheTTL()
+	c.lock.RUnlock()
+	if !stale {
+		return name
+	}
+
+	c.refreshQuotas(now)
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.quotaNames[quotaGUID]
+}
+
+// refreshQuotas lists the names of all org and space quotas. The names listed before
+// are kept when listing fails, which is retried after the TTL rather than for every
+// app, since the quotas of a foundation may not be readable by the nozzle's user
+func (c *Boltdb) refreshQuotas(now time.Time) {
+	names := make(map[string]string)
+	orgQuotas, err := c.appClient.ListOrgQuotas()
+	for _, quota := range orgQuotas {
+		names[quota.Guid] = quota.Name
+	}
+	if err == nil {
+		var spaceQuotas []cfclient.SpaceQuota
+		spaceQuotas, err = c.appClient.ListSpaceQuotas()
+		for _, quota := range spaceQuotas {
+			names[quota.Guid] = quota.Name
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.quotasUpdated = now
+	if err != nil {
+		c.config.Logger.Error("Failed to list the org and space quotas, quota names are not updated", err)
+		return
+	}
+	c.quotaNames = names
+}
+
 func (c *Boltdb) getAppFromRemote(appGuid string) (*App, error) {
 	cfApp, err := c.appClient.AppByGuid(appGuid)
 	if err != nil {
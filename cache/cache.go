@@ -15,6 +15,19 @@ type App struct {
 	OrgGuid    string
 	CfAppEnv   map[string]interface{}
 	IgnoredApp bool
+	State      string // STARTED or STOPPED, as of the last refresh of the app
+	Instances  int    // desired number of instances, as of the last refresh of the app
+	Memory     int    // memory limit of an instance in MB, as of the last refresh of the app, 0 when unknown
+	// Unix time the app was last fetched from CF, 0 when unknown
+	RefreshedAt int64
+
+	// Creation and last update times of the app from the CF metadata, empty when unknown
+	CreatedAt string
+	UpdatedAt string
+
+	// Names of the org and space quotas, empty unless resolved with ResolveQuotas
+	OrgQuotaName   string
+	SpaceQuotaName string
 }
 
 type Cache interface {
@@ -30,4 +43,6 @@ type AppClient interface {
 	ListAppsByQueryWithLimits(query url.Values, totalPages int) ([]cfclient.App, error)
 	GetSpaceByGuid(spaceGUID string) (cfclient.Space, error)
 	GetOrgByGuid(orgGUID string) (cfclient.Org, error)
+	ListOrgQuotas() ([]cfclient.OrgQuota, error)
+	ListSpaceQuotas() ([]cfclient.SpaceQuota, error)
 }
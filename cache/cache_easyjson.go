@@ -64,6 +64,22 @@ func easyjsonA591d1bcDecodeGithubComCloudfoundryCommunitySplunkFirehoseNozzleCac
 			}
 		case "IgnoredApp":
 			out.IgnoredApp = bool(in.Bool())
+		case "State":
+			out.State = string(in.String())
+		case "Instances":
+			out.Instances = int(in.Int())
+		case "Memory":
+			out.Memory = int(in.Int())
+		case "RefreshedAt":
+			out.RefreshedAt = int64(in.Int64())
+		case "CreatedAt":
+			out.CreatedAt = string(in.String())
+		case "UpdatedAt":
+			out.UpdatedAt = string(in.String())
+		case "OrgQuotaName":
+			out.OrgQuotaName = string(in.String())
+		case "SpaceQuotaName":
+			out.SpaceQuotaName = string(in.String())
 		default:
 			in.SkipRecursive()
 		}
@@ -138,6 +154,54 @@ func easyjsonA591d1bcEncodeGithubComCloudfoundryCommunitySplunkFirehoseNozzleCac
 	first = false
 	out.RawString("\"IgnoredApp\":")
 	out.Bool(bool(in.IgnoredApp))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"State\":")
+	out.String(string(in.State))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Instances\":")
+	out.Int(int(in.Instances))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Memory\":")
+	out.Int(int(in.Memory))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"RefreshedAt\":")
+	out.Int64(int64(in.RefreshedAt))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CreatedAt\":")
+	out.String(string(in.CreatedAt))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"UpdatedAt\":")
+	out.String(string(in.UpdatedAt))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"OrgQuotaName\":")
+	out.String(string(in.OrgQuotaName))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"SpaceQuotaName\":")
+	out.String(string(in.SpaceQuotaName))
 	out.RawByte('}')
 }
 
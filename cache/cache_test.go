@@ -76,6 +76,9 @@ var _ = Describe("Cache", func() {
 
 			Expect(app).NotTo(Equal(nil))
 			Expect(app.Guid).To(Equal(guid))
+			Expect(app.State).To(Equal("STARTED"))
+			Expect(app.CreatedAt).To(Equal("2016-06-08T16:41:45Z"))
+			Expect(app.UpdatedAt).To(Equal("2016-06-08T16:41:46Z"))
 		})
 	})
 
@@ -225,6 +228,120 @@ var _ = Describe("Cache", func() {
 		})
 	})
 
+	Context("Separate org and space cache TTLs", func() {
+		var (
+			cache  *Boltdb
+			client *testing.AppClientMock
+		)
+
+		BeforeEach(func() {
+			boltdbPath := "/tmp/boltdb3"
+			config := &BoltdbConfig{
+				Path:               boltdbPath,
+				IgnoreMissingApps:  ignoreMissingApps,
+				AppCacheTTL:        48 * time.Hour,
+				MissingAppCacheTTL: missingAppCacheTTL,
+				OrgSpaceCacheTTL:   48 * time.Hour,
+				SpaceCacheTTL:      time.Second,
+				Logger:             lager.NewLogger("test"),
+			}
+
+			client = testing.NewAppClientMock(n)
+
+			os.Remove(boltdbPath)
+			cache, gerr = NewBoltdb(client, config)
+			Ω(gerr).ShouldNot(HaveOccurred())
+
+			gerr = cache.Open()
+			Ω(gerr).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			cache.Close()
+			os.Remove("/tmp/boltdb3")
+		})
+
+		It("Expects space calls but no org calls", func() {
+			client.ResetCallCounts()
+
+			// wait for the space cache to expire
+			time.Sleep(time.Second + (250 * time.Millisecond))
+
+			app, err := cache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.SpaceName).NotTo(BeEmpty())
+			Expect(app.OrgName).NotTo(BeEmpty())
+
+			Expect(client.GetSpaceByGUIDCallCount()).To(Equal(1))
+			Expect(client.GetOrgByGUIDCallCount()).To(Equal(0))
+		})
+	})
+
+	Context("Quota names", func() {
+		var (
+			cache  *Boltdb
+			client *testing.AppClientMock
+		)
+
+		open := func() {
+			boltdbPath := "/tmp/boltdb4"
+			config := &BoltdbConfig{
+				Path:               boltdbPath,
+				IgnoreMissingApps:  ignoreMissingApps,
+				AppCacheTTL:        48 * time.Hour,
+				MissingAppCacheTTL: missingAppCacheTTL,
+				OrgSpaceCacheTTL:   48 * time.Hour,
+				ResolveQuotas:      true,
+				Logger:             lager.NewLogger("test"),
+			}
+
+			os.Remove(boltdbPath)
+			cache, gerr = NewBoltdb(client, config)
+			Ω(gerr).ShouldNot(HaveOccurred())
+
+			gerr = cache.Open()
+			Ω(gerr).ShouldNot(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			client = testing.NewAppClientMock(n)
+		})
+
+		AfterEach(func() {
+			cache.Close()
+			os.Remove("/tmp/boltdb4")
+		})
+
+		It("Resolves the org and space quota names once", func() {
+			open()
+
+			app, err := cache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.OrgQuotaName).To(Equal("cf_org_quota_name"))
+			Expect(app.SpaceQuotaName).To(Equal("cf_space_quota_name"))
+
+			app, err = cache.GetApp("cf_app_id_1")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.OrgQuotaName).To(Equal("cf_org_quota_name"))
+			Expect(app.SpaceQuotaName).To(BeEmpty())
+
+			Expect(client.ListQuotasCallCount()).To(Equal(1))
+		})
+
+		It("Leaves the quota names out when quotas can't be listed", func() {
+			client.QuotasErr = fmt.Errorf("not authorized")
+			open()
+
+			app, err := cache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.OrgName).NotTo(BeEmpty())
+			Expect(app.OrgQuotaName).To(BeEmpty())
+			Expect(app.SpaceQuotaName).To(BeEmpty())
+
+			Expect(client.ListQuotasCallCount()).To(Equal(1))
+		})
+	})
+
 	Context("NewBoltdb error", func() {
 		It("Expect error", func() {
 			dup := *config
@@ -266,6 +383,82 @@ var _ = Describe("Cache", func() {
 		})
 	})
 
+	Context("Buffered writes", func() {
+		It("Writes the buffered apps on close", func() {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.AppCacheTTL = 0
+			dup.WriteInterval = time.Hour
+			defer os.Remove(dup.Path)
+
+			bcache, err := NewBoltdb(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).Should(Succeed())
+			Ω(bcache.Close()).Should(Succeed())
+
+			// Load from the database only, the client has no apps
+			bcache, err = NewBoltdb(testing.NewAppClientMock(0), &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).Should(Succeed())
+			defer bcache.Close()
+
+			apps, err := bcache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(len(apps)).To(Equal(n))
+		})
+	})
+
+	Context("Cache snapshot", func() {
+		It("Imports the snapshot into an empty database", func() {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.AppCacheTTL = 0
+			dup.SnapshotPath = dup.Path + ".json"
+			defer os.Remove(dup.Path)
+			defer os.Remove(dup.SnapshotPath)
+
+			bcache, err := NewBoltdb(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).Should(Succeed())
+			Ω(bcache.Close()).Should(Succeed())
+
+			snapshot, err := ReadSnapshot(dup.SnapshotPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(len(snapshot)).To(Equal(n))
+
+			// A fresh instance, the client has no apps
+			Ω(os.Remove(dup.Path)).Should(Succeed())
+			bcache, err = NewBoltdb(testing.NewAppClientMock(0), &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).Should(Succeed())
+			defer bcache.Close()
+
+			apps, err := bcache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(apps).To(Equal(snapshot))
+		})
+
+		It("Writes the snapshot periodically", func() {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.AppCacheTTL = 0
+			dup.SnapshotPath = dup.Path + ".json"
+			dup.SnapshotInterval = 10 * time.Millisecond
+			defer os.Remove(dup.Path)
+			defer os.Remove(dup.SnapshotPath)
+
+			bcache, err := NewBoltdb(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).Should(Succeed())
+			defer bcache.Close()
+
+			Eventually(func() int {
+				apps, _ := ReadSnapshot(dup.SnapshotPath)
+				return len(apps)
+			}).Should(Equal(n))
+		})
+	})
+
 	Context("No cache", func() {
 		It("No error", func() {
 			c := NewNoCache()
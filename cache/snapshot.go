@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshot is the portable export of the resolved app metadata, which a fresh
+// nozzle imports on startup to start with a warm cache
+type snapshot struct {
+	Created time.Time `json:"created"`
+	Apps    []*App    `json:"apps"`
+}
+
+// WriteSnapshot writes the apps to a JSON file at path. The file is written to a
+// temporary file first and renamed, so readers never see a partial snapshot
+func WriteSnapshot(path string, apps map[string]*App, now time.Time) error {
+	s := snapshot{Created: now.UTC(), Apps: make([]*App, 0, len(apps))}
+	for _, app := range apps {
+		s.Apps = append(s.Apps, app)
+	}
+	sort.Slice(s.Apps, func(i, j int) bool { return s.Apps[i].Guid < s.Apps[j].Guid })
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error marshaling cache snapshot: %s", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadSnapshot reads the apps of the snapshot at path, keyed by app GUID
+func ReadSnapshot(path string) (map[string]*App, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid cache snapshot %s: %s", path, err)
+	}
+
+	apps := make(map[string]*App, len(s.Apps))
+	for _, app := range s.Apps {
+		if app != nil && app.Guid != "" {
+			apps[app.Guid] = app
+		}
+	}
+	return apps, nil
+}
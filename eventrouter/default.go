@@ -1,9 +1,13 @@
 package eventrouter
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/cache"
 	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -14,6 +18,19 @@ type router struct {
 	sink           eventsink.Sink
 	selectedEvents map[string]bool
 	config         *Config
+
+	// HttpStartStop events seen per status class, for sampling
+	statusCounts [6]uint64
+
+	containerMetrics *containerMetricSampler
+
+	sampled    *monitoring.DropCounter
+	suppressed *monitoring.DropCounter
+
+	// events kept and dropped by each sampler
+	ratioSampling     *monitoring.SamplingCounter
+	httpSampling      *monitoring.SamplingCounter
+	containerSampling *monitoring.SamplingCounter
 }
 
 func New(appCache cache.Cache, sink eventsink.Sink, config *Config) (Router, error) {
@@ -23,12 +40,26 @@ func New(appCache cache.Cache, sink eventsink.Sink, config *Config) (Router, err
 		return nil, err
 	}
 
-	return &router{
+	r := &router{
 		appCache:       appCache,
 		sink:           sink,
 		selectedEvents: selectedEvents,
 		config:         config,
-	}, nil
+	}
+	if config.Metrics == nil {
+		config.Metrics = monitoring.NewMetrics()
+	}
+	r.sampled = config.Metrics.NewDropCounter(monitoring.DropSampled)
+	r.suppressed = config.Metrics.NewDropCounter(monitoring.DropSuppressed)
+	r.ratioSampling = config.Metrics.NewSamplingCounter(monitoring.SamplerRatios)
+	r.httpSampling = config.Metrics.NewSamplingCounter(monitoring.SamplerHttpStatus)
+	r.containerSampling = config.Metrics.NewSamplingCounter(monitoring.SamplerContainerMetric)
+
+	if config.ContainerMetricMaxSampleRate > 1 {
+		r.containerMetrics = newContainerMetricSampler(config.ContainerMetricMaxSampleRate,
+			config.ContainerMetricCpuDelta, config.ContainerMetricMemoryDelta)
+	}
+	return r, nil
 }
 
 func (r *router) Route(msg *events.Envelope) error {
@@ -38,8 +69,73 @@ func (r *router) Route(msg *events.Envelope) error {
 		// Ignore this event since we are not interested
 		return nil
 	}
-	
+
+	if ratio, ok := r.config.SampleRatios[eventType.String()]; ok && !r.keep(r.ratioSampling, eventType, sampleRatio(msg, ratio)) {
+		return nil
+	}
+
+	if eventType == events.Envelope_HttpStartStop {
+		statusCode := msg.GetHttpStartStop().GetStatusCode()
+		if r.httpStatusSampled(statusCode) && !r.keep(r.httpSampling, eventType, r.sampleHttpStatus(statusCode)) {
+			return nil
+		}
+	}
+
+	if eventType == events.Envelope_ContainerMetric && r.config.SuppressInactiveContainerMetrics &&
+		r.inactiveInstance(msg.GetContainerMetric(), time.Now()) {
+		r.suppressed.Add(eventType.String(), 1)
+		return nil
+	}
+
+	if eventType == events.Envelope_ContainerMetric && r.containerMetrics != nil &&
+		!r.keep(r.containerSampling, eventType, r.containerMetrics.sample(msg.GetContainerMetric(), time.Now())) {
+		return nil
+	}
+
 	_ = r.sink.Write(msg)
 
 	return nil
 }
+
+// keep counts the sampling decision of the sampler, and returns it
+func (r *router) keep(sampling *monitoring.SamplingCounter, eventType events.Envelope_EventType, kept bool) bool {
+	sampling.Add(eventType.String(), kept)
+	if !kept {
+		r.sampled.Add(eventType.String(), 1)
+	}
+	return kept
+}
+
+// inactiveInstance returns whether the app cache knows the app of the container metric
+// to be stopped, or its instance index to be beyond the instances of the app. Unknown
+// apps and apps fetched more than AppStateMaxAge ago are considered active
+func (r *router) inactiveInstance(containerMetric *events.ContainerMetric, now time.Time) bool {
+	app, err := r.appCache.GetApp(containerMetric.GetApplicationId())
+	if err != nil || app == nil || app.RefreshedAt == 0 ||
+		now.Sub(time.Unix(app.RefreshedAt, 0)) > r.config.AppStateMaxAge {
+		return false
+	}
+
+	if app.State == "STOPPED" {
+		return true
+	}
+	return app.Instances > 0 && int(containerMetric.GetInstanceIndex()) >= app.Instances
+}
+
+// httpStatusSampled returns whether the events of the status class of the status
+// code are sampled
+func (r *router) httpStatusSampled(statusCode int32) bool {
+	class := int(statusCode / 100)
+	rate, ok := r.config.HttpStatusSampleRates[class]
+	return ok && rate > 1 && class >= 0 && class < len(r.statusCounts)
+}
+
+// sampleHttpStatus keeps 1 of every N events of the status class of the status code
+func (r *router) sampleHttpStatus(statusCode int32) bool {
+	class := int(statusCode / 100)
+	rate, ok := r.config.HttpStatusSampleRates[class]
+	if !ok || rate <= 1 || class < 0 || class >= len(r.statusCounts) {
+		return true
+	}
+	return (atomic.AddUint64(&r.statusCounts[class], 1)-1)%rate == 0
+}
@@ -1,6 +1,9 @@
 package eventrouter_test
 
 import (
+	"fmt"
+	"time"
+
 	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventrouter"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
 	"github.com/cloudfoundry/sonde-go/events"
@@ -92,6 +95,136 @@ var _ = Describe("eventrouter", func() {
 		Expect(len(memSink.Events)).To(Equal(1))
 	})
 
+	It("Samples HttpStartStop by status class", func() {
+		config := &Config{
+			SelectedEvents:        "HttpStartStop",
+			HttpStatusSampleRates: map[int]uint64{2: 10},
+		}
+		r, err = New(noCache, memSink, config)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		eventType = events.Envelope_HttpStartStop
+		for _, status := range []int32{200, 500} {
+			statusCode := status
+			msg.HttpStartStop = &events.HttpStartStop{StatusCode: &statusCode}
+			for i := 0; i < 20; i++ {
+				err := r.Route(msg)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		}
+
+		// 2 of the 20 2xx and all of the 5xx
+		Expect(len(memSink.Events)).To(Equal(22))
+		Expect(config.Metrics.Snapshot()["splunk.drops.sampled.HttpStartStop"]).To(Equal(float64(18)))
+		Expect(config.Metrics.Snapshot()["splunk.sampling.http_sample_rates.kept.HttpStartStop"]).To(Equal(float64(2)))
+		Expect(config.Metrics.Snapshot()["splunk.sampling.http_sample_rates.dropped.HttpStartStop"]).To(Equal(float64(18)))
+	})
+
+	It("Samples a ratio of the events of an event type consistently per app", func() {
+		config := &Config{
+			SelectedEvents: "LogMessage,ValueMetric",
+			SampleRatios:   map[string]float64{"LogMessage": 0.5, "ValueMetric": 0},
+		}
+		r, err = New(noCache, memSink, config)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		eventType = events.Envelope_LogMessage
+		kept := map[string]int{}
+		for i := 0; i < 200; i++ {
+			appId := fmt.Sprintf("app-%d", i)
+			for j := 0; j < 2; j++ {
+				// The sink keeps the envelopes
+				envelope := *msg
+				envelope.LogMessage = &events.LogMessage{AppId: &appId}
+				Ω(r.Route(&envelope)).Should(Succeed())
+			}
+		}
+		for _, event := range memSink.Events {
+			kept[event.GetLogMessage().GetAppId()]++
+		}
+		for _, count := range kept {
+			Expect(count).To(Equal(2))
+		}
+		Expect(len(kept)).To(BeNumerically("~", 100, 25))
+
+		eventType = events.Envelope_ValueMetric
+		Ω(r.Route(msg)).Should(Succeed())
+		Expect(len(memSink.Events)).To(Equal(2 * len(kept)))
+		Expect(config.Metrics.Snapshot()["splunk.drops.sampled.ValueMetric"]).To(Equal(float64(1)))
+	})
+
+	It("Samples ContainerMetric less often while stable", func() {
+		config := &Config{
+			SelectedEvents:               "ContainerMetric",
+			ContainerMetricMaxSampleRate: 4,
+			ContainerMetricCpuDelta:      5,
+			ContainerMetricMemoryDelta:   0.1,
+		}
+		r, err = New(noCache, memSink, config)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		eventType = events.Envelope_ContainerMetric
+		route := func(cpu float64, memory uint64) {
+			appId, instance := "f964a41c-76ac-42c1-b2ba-663da3ec22d5", int32(0)
+			msg.ContainerMetric = &events.ContainerMetric{ApplicationId: &appId, InstanceIndex: &instance, CpuPercentage: &cpu, MemoryBytes: &memory}
+			Ω(r.Route(msg)).Should(Succeed())
+		}
+
+		// Keeps the 1st, 2nd, 4th and 8th of 11 stable events
+		for i := 0; i < 11; i++ {
+			route(10+float64(i%2), 1000)
+		}
+		Expect(len(memSink.Events)).To(Equal(4))
+
+		// A significant change keeps all events again
+		route(50, 1000)
+		route(50, 1050)
+		Expect(len(memSink.Events)).To(Equal(6))
+	})
+
+	It("Suppresses ContainerMetric of stopped apps and instances beyond the app instances", func() {
+		config := &Config{
+			SelectedEvents:                   "ContainerMetric",
+			SuppressInactiveContainerMetrics: true,
+			AppStateMaxAge:                   time.Minute,
+		}
+		r, err = New(noCache, memSink, config)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		eventType = events.Envelope_ContainerMetric
+		route := func(instance int32) {
+			appId := "f964a41c-76ac-42c1-b2ba-663da3ec22d5"
+			msg.ContainerMetric = &events.ContainerMetric{ApplicationId: &appId, InstanceIndex: &instance}
+			Ω(r.Route(msg)).Should(Succeed())
+		}
+
+		// Unknown refresh time and instances
+		route(5)
+		Expect(len(memSink.Events)).To(Equal(1))
+
+		noCache.SetAppState("STARTED", 2, time.Now())
+		route(0)
+		route(1)
+		route(2)
+		Expect(len(memSink.Events)).To(Equal(3))
+
+		noCache.SetAppState("STOPPED", 2, time.Now())
+		route(0)
+		Expect(len(memSink.Events)).To(Equal(3))
+
+		// A stale app may have been restarted or scaled up since
+		noCache.SetAppState("STOPPED", 2, time.Now().Add(-2*time.Minute))
+		route(0)
+		route(3)
+		Expect(len(memSink.Events)).To(Equal(5))
+
+		// Unavailable app
+		noCache.ReturnErr = true
+		route(3)
+		Expect(len(memSink.Events)).To(Equal(6))
+		Expect(config.Metrics.Snapshot()["splunk.drops.suppressed.ContainerMetric"]).To(Equal(float64(2)))
+	})
+
 	It("Invalid event", func() {
 		config := &Config{
 			SelectedEvents: "invalid-event",
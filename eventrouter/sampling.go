@@ -0,0 +1,133 @@
+package eventrouter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Instances not seen for this long are forgotten by the containerMetricSampler
+const sampledInstanceTTL = 10 * time.Minute
+
+// containerMetricSampler keeps fewer ContainerMetric events of an app instance while
+// its CPU and memory usage are stable. Every kept stable event doubles the sampling
+// rate of the instance up to maxRate, a significant change resets it to keep all
+type containerMetricSampler struct {
+	maxRate     uint64
+	cpuDelta    float64 // percentage points
+	memoryDelta float64 // fraction of the last kept memory usage
+
+	lock      sync.Mutex
+	instances map[string]*sampledInstance
+	lastPrune time.Time
+}
+
+type sampledInstance struct {
+	cpu      float64 // of the last kept event
+	memory   float64
+	rate     uint64 // keep 1 of every rate stable events
+	skipped  uint64
+	lastSeen time.Time
+}
+
+func newContainerMetricSampler(maxRate uint64, cpuDelta, memoryDelta float64) *containerMetricSampler {
+	return &containerMetricSampler{
+		maxRate:     maxRate,
+		cpuDelta:    cpuDelta,
+		memoryDelta: memoryDelta,
+		instances:   make(map[string]*sampledInstance),
+		lastPrune:   time.Now(),
+	}
+}
+
+func (s *containerMetricSampler) sample(metric *events.ContainerMetric, now time.Time) bool {
+	key := fmt.Sprintf("%s/%d", metric.GetApplicationId(), metric.GetInstanceIndex())
+	cpu := metric.GetCpuPercentage()
+	memory := float64(metric.GetMemoryBytes())
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.prune(now)
+
+	instance, ok := s.instances[key]
+	if !ok {
+		s.instances[key] = &sampledInstance{cpu: cpu, memory: memory, rate: 1, lastSeen: now}
+		return true
+	}
+	instance.lastSeen = now
+
+	if s.changed(instance, cpu, memory) {
+		instance.cpu, instance.memory = cpu, memory
+		instance.rate, instance.skipped = 1, 0
+		return true
+	}
+
+	instance.skipped++
+	if instance.skipped < instance.rate {
+		return false
+	}
+
+	instance.cpu, instance.memory = cpu, memory
+	instance.skipped = 0
+	if instance.rate*2 <= s.maxRate {
+		instance.rate *= 2
+	} else {
+		instance.rate = s.maxRate
+	}
+	return true
+}
+
+func (s *containerMetricSampler) changed(instance *sampledInstance, cpu, memory float64) bool {
+	if math.Abs(cpu-instance.cpu) > s.cpuDelta {
+		return true
+	}
+	if instance.memory == 0 {
+		return memory != 0
+	}
+	return math.Abs(memory-instance.memory)/instance.memory > s.memoryDelta
+}
+
+// prune forgets the instances of stopped apps
+func (s *containerMetricSampler) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < sampledInstanceTTL {
+		return
+	}
+	for key, instance := range s.instances {
+		if now.Sub(instance.lastSeen) >= sampledInstanceTTL {
+			delete(s.instances, key)
+		}
+	}
+	s.lastPrune = now
+}
+
+// sampleRatio keeps the ratio of events by hashing the app of the event, or the
+// component which emitted it for events without an app, so the same app is always
+// either kept or dropped
+func sampleRatio(msg *events.Envelope, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(sampleKey(msg)))
+	return float64(h.Sum32()) < ratio*(math.MaxUint32+1)
+}
+
+func sampleKey(msg *events.Envelope) string {
+	switch msg.GetEventType() {
+	case events.Envelope_LogMessage:
+		return msg.GetLogMessage().GetAppId()
+	case events.Envelope_ContainerMetric:
+		return msg.GetContainerMetric().GetApplicationId()
+	case events.Envelope_HttpStartStop:
+		if appId := msg.GetHttpStartStop().GetApplicationId(); appId != nil {
+			return utils.FormatUUID(appId)
+		}
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", msg.GetDeployment(), msg.GetJob(), msg.GetIndex(), msg.GetOrigin())
+}
@@ -1,13 +1,20 @@
 package events
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/cache"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/sirupsen/logrus"
@@ -26,7 +33,98 @@ type Config struct {
 	AddOrgGuid     bool
 	AddSpaceName   bool
 	AddSpaceGuid   bool
+	AddAppState    bool
+	AddCreatedAt   bool
+	AddUpdatedAt   bool
+	AddOrgQuota    bool
+	AddSpaceQuota  bool
 	AddTags        bool
+
+	// BoshInstanceField is set to the BOSH instance id tag of envelopes when both are set
+	BoshInstanceField string
+
+	// AddCpuCores adds cpu_cores_raw to ContainerMetric events, and cpu_entitlement_cores
+	// and cpu_cores when the CPU entitlement of the app is known. The entitlement is
+	// the memory limit of its instances divided by CpuEntitlementMBPerCore
+	AddCpuCores             bool
+	CpuEntitlementMBPerCore int
+
+	// AddVcapRequestId adds vcap_request_id to HttpStartStop events
+	AddVcapRequestId bool
+
+	// RequireEnrichment drops app events missing any of the app metadata fields
+	// selected by the Add* options
+	RequireEnrichment bool
+
+	// JsonLog merges the keys of LogMessage bodies which are JSON objects into the
+	// event fields, named with JsonLogPrefix. JsonLogCollision decides between keys
+	// and the fields already set. Bodies larger than JsonLogMaxBytes or nested deeper
+	// than JsonLogMaxDepth are kept as the message
+	JsonLog          bool
+	JsonLogPrefix    string
+	JsonLogCollision string
+	JsonLogMaxBytes  int
+	JsonLogMaxDepth  int
+
+	// Base64BinaryLogs moves LogMessage bodies which aren't valid UTF-8 to the
+	// msg_base64 field, base64 encoded, instead of sending them with their invalid
+	// bytes replaced
+	Base64BinaryLogs bool
+
+	// LogTimestampLayout is the Go time layout of timestamps prefixing LogMessage
+	// bodies, which are stripped. With LogTimestampAsTime, the stripped timestamp
+	// replaces the envelope timestamp
+	LogTimestampLayout string
+	LogTimestampAsTime bool
+
+	// FieldExtractors are applied in order to LogMessage bodies. Named capture
+	// groups of a matching pattern become event fields
+	FieldExtractors []*regexp.Regexp
+
+	// HttpStatusSampleRates keeps 1 of every N HttpStartStop events per status
+	// class (2 for 2xx, ...). Classes without a rate are all kept
+	HttpStatusSampleRates map[int]uint64
+
+	// SampleRatios keeps the ratio, from 0 to 1, of the events of an event type.
+	// Events of the same app, or of the same component for events without an app,
+	// are consistently kept or dropped. Event types without a ratio are all kept
+	SampleRatios map[string]float64
+
+	// ContainerMetricMaxSampleRate enables adaptive sampling of ContainerMetric events
+	// when above 1: an app instance whose CPU usage stays within ContainerMetricCpuDelta
+	// percentage points and memory usage within the ContainerMetricMemoryDelta fraction
+	// is sampled less and less often, down to 1 of every ContainerMetricMaxSampleRate events
+	ContainerMetricMaxSampleRate uint64
+	ContainerMetricCpuDelta      float64
+	ContainerMetricMemoryDelta   float64
+
+	// SuppressInactiveContainerMetrics drops the ContainerMetric events of apps the app
+	// cache knows to be stopped, and of instance indexes beyond the instances of the app.
+	// Only the apps fetched within AppStateMaxAge are trusted, so a stale cache doesn't
+	// suppress the metrics of restarted or scaled up apps
+	SuppressInactiveContainerMetrics bool
+	AppStateMaxAge                   time.Duration
+
+	// Filter drops the events for which it evaluates to false, optional
+	Filter *Filter
+
+	// Metrics counts the events dropped by the router, optional
+	Metrics *monitoring.Metrics
+
+	// PriorityRules set PriorityField to the priority of the first matching rule
+	PriorityRules []PriorityRule
+	PriorityField string
+}
+
+// PriorityRule matches events of an event type, optionally on the value of a field.
+// Equals compares the field value as a string, Min and Max are inclusive numeric bounds
+type PriorityRule struct {
+	Priority  string   `json:"priority"`
+	EventType string   `json:"event_type"`
+	Field     string   `json:"field"`
+	Equals    *string  `json:"equals"`
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
 }
 
 var AppMetadata = []string{
@@ -35,6 +133,11 @@ var AppMetadata = []string{
 	"OrgGuid",
 	"SpaceName",
 	"SpaceGuid",
+	"AppState",
+	"AppCreatedAt",
+	"AppUpdatedAt",
+	"OrgQuota",
+	"SpaceQuota",
 }
 
 func HttpStart(msg *events.Envelope) *Event {
@@ -77,6 +180,53 @@ func HttpStop(msg *events.Envelope) *Event {
 	}
 }
 
+// HasPayload reports whether the envelope carries the sub-event of its event type.
+// Malformed envelopes without it would otherwise be sent as empty events
+func HasPayload(msg *events.Envelope) bool {
+	switch msg.GetEventType() {
+	case events.Envelope_HttpStartStop:
+		return msg.GetHttpStartStop() != nil
+	case events.Envelope_LogMessage:
+		return msg.GetLogMessage() != nil
+	case events.Envelope_ValueMetric:
+		return msg.GetValueMetric() != nil
+	case events.Envelope_CounterEvent:
+		return msg.GetCounterEvent() != nil
+	case events.Envelope_Error:
+		return msg.GetError() != nil
+	case events.Envelope_ContainerMetric:
+		return msg.GetContainerMetric() != nil
+	case events.Envelope_HttpStart:
+		return msg.GetHttpStart() != nil
+	case events.Envelope_HttpStop:
+		return msg.GetHttpStop() != nil
+	}
+	return false
+}
+
+// FromEnvelope builds the event of the envelope's event type, nil for unknown types
+func FromEnvelope(msg *events.Envelope) *Event {
+	switch msg.GetEventType() {
+	case events.Envelope_HttpStartStop:
+		return HttpStartStop(msg)
+	case events.Envelope_LogMessage:
+		return LogMessage(msg)
+	case events.Envelope_ValueMetric:
+		return ValueMetric(msg)
+	case events.Envelope_CounterEvent:
+		return CounterEvent(msg)
+	case events.Envelope_Error:
+		return ErrorEvent(msg)
+	case events.Envelope_ContainerMetric:
+		return ContainerMetric(msg)
+	case events.Envelope_HttpStart:
+		return HttpStart(msg)
+	case events.Envelope_HttpStop:
+		return HttpStop(msg)
+	}
+	return nil
+}
+
 func HttpStartStop(msg *events.Envelope) *Event {
 	httpStartStop := msg.GetHttpStartStop()
 
@@ -104,6 +254,24 @@ func HttpStartStop(msg *events.Envelope) *Event {
 	}
 }
 
+// vcapRequestIdTags are the tags the X-Vcap-Request-Id may be carried in by envelopes
+// without a request id
+var vcapRequestIdTags = []string{"vcap_request_id", "x_vcap_request_id", "x-vcap-request-id"}
+
+// vcapRequestId returns the gorouter's X-Vcap-Request-Id, which is the request id of
+// the HttpStartStop event
+func vcapRequestId(httpStartStop *events.HttpStartStop, tags map[string]string) string {
+	if id := utils.FormatUUID(httpStartStop.GetRequestId()); id != "" {
+		return id
+	}
+	for _, tag := range vcapRequestIdTags {
+		if id := tags[tag]; id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
 func LogMessage(msg *events.Envelope) *Event {
 	logMessage := msg.GetLogMessage()
 
@@ -194,7 +362,40 @@ func ContainerMetric(msg *events.Envelope) *Event {
 	}
 }
 
-func (e *Event) AnnotateWithAppData(appCache cache.Cache, config *Config) {
+// AnnotateWithCpuCores adds the cpu_percentage of a ContainerMetric as a number of
+// cores, cpu_cores_raw. The percentage is relative to a single core, so 250% is 2.5
+// cores. AnnotateWithAppData normalizes it by the CPU entitlement of the app
+func (e *Event) AnnotateWithCpuCores() {
+	if cpu, ok := e.Fields["cpu_percentage"].(float64); ok && !math.IsNaN(cpu) && !math.IsInf(cpu, 0) {
+		e.Fields["cpu_cores_raw"] = cpu / 100
+	}
+}
+
+// annotateWithCpuEntitlement adds the CPU entitlement of an instance of the app in
+// cores, cpu_entitlement_cores, and cpu_cores, the cores used by the instance as a
+// fraction of its entitlement, to an event with cpu_cores_raw. Neither is added when
+// the memory limit of the app, or the memory per core of the config, is unknown
+func (e *Event) annotateWithCpuEntitlement(appInfo *cache.App, config *Config) {
+	raw, ok := e.Fields["cpu_cores_raw"].(float64)
+	if !ok || appInfo.Memory <= 0 || config.CpuEntitlementMBPerCore <= 0 {
+		return
+	}
+	entitlement := float64(appInfo.Memory) / float64(config.CpuEntitlementMBPerCore)
+	e.Fields["cpu_entitlement_cores"] = entitlement
+	e.Fields["cpu_cores"] = raw / entitlement
+}
+
+// AnnotateWithVcapRequestId adds the gorouter's X-Vcap-Request-Id of an HttpStartStop
+// envelope as vcap_request_id, omitted when the envelope has none
+func (e *Event) AnnotateWithVcapRequestId(msg *events.Envelope) {
+	if id := vcapRequestId(msg.GetHttpStartStop(), msg.GetTags()); id != "" {
+		e.Fields["vcap_request_id"] = id
+	}
+}
+
+// AnnotateWithAppData adds the app metadata from the cache to the event. It returns
+// the error of the cache lookup, in which case the event is left unannotated
+func (e *Event) AnnotateWithAppData(appCache cache.Cache, config *Config) error {
 	cf_app_id := e.Fields["cf_app_id"]
 	appGuid := fmt.Sprintf("%s", cf_app_id)
 
@@ -206,9 +407,9 @@ func (e *Event) AnnotateWithAppData(appCache cache.Cache, config *Config) {
 			} else {
 				logrus.Error("Failed to fetch application metadata from remote: ", err)
 			}
-			return
+			return err
 		} else if appInfo == nil {
-			return
+			return nil
 		}
 		cf_app_name := appInfo.Name
 		cf_space_id := appInfo.SpaceGuid
@@ -216,6 +417,7 @@ func (e *Event) AnnotateWithAppData(appCache cache.Cache, config *Config) {
 		cf_org_id := appInfo.OrgGuid
 		cf_org_name := appInfo.OrgName
 		cf_ignored_app := appInfo.IgnoredApp
+		app_state := appInfo.State
 		app_env := appInfo.CfAppEnv
 
 		if cf_app_name != "" && config.AddAppName {
@@ -238,6 +440,32 @@ func (e *Event) AnnotateWithAppData(appCache cache.Cache, config *Config) {
 			e.Fields["cf_org_name"] = cf_org_name
 		}
 
+		if app_state != "" && config.AddAppState {
+			e.Fields["app_state"] = app_state
+		}
+
+		// Timestamps are optional, so events of apps without them are still enriched
+		if appInfo.CreatedAt != "" && config.AddCreatedAt {
+			e.Fields["cf_app_created_at"] = appInfo.CreatedAt
+		}
+
+		if appInfo.UpdatedAt != "" && config.AddUpdatedAt {
+			e.Fields["cf_app_updated_at"] = appInfo.UpdatedAt
+		}
+
+		// Quotas are optional, so events without them are still enriched
+		if appInfo.OrgQuotaName != "" && config.AddOrgQuota {
+			e.Fields["cf_org_quota"] = appInfo.OrgQuotaName
+		}
+
+		if appInfo.SpaceQuotaName != "" && config.AddSpaceQuota {
+			e.Fields["cf_space_quota"] = appInfo.SpaceQuotaName
+		}
+
+		if config.AddCpuCores {
+			e.annotateWithCpuEntitlement(appInfo, config)
+		}
+
 		if app_env["SPLUNK_INDEX"] != nil {
 			e.Fields["info_splunk_index"] = app_env["SPLUNK_INDEX"]
 		}
@@ -247,6 +475,276 @@ func (e *Event) AnnotateWithAppData(appCache cache.Cache, config *Config) {
 		}
 
 	}
+	return nil
+}
+
+// IsEnriched reports whether the event has all the app metadata fields selected by
+// the Add* options of the config
+func (e *Event) IsEnriched(config *Config) bool {
+	required := map[string]bool{
+		"cf_app_name":   config.AddAppName,
+		"cf_org_name":   config.AddOrgName,
+		"cf_org_id":     config.AddOrgGuid,
+		"cf_space_name": config.AddSpaceName,
+		"cf_space_id":   config.AddSpaceGuid,
+		"app_state":     config.AddAppState,
+	}
+	for field, isRequired := range required {
+		if value, ok := e.Fields[field].(string); isRequired && (!ok || value == "") {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitMessage splits the message into parts of at most maxLines lines and maxChars
+// characters, 0 disables a limit. The line breaks between parts are dropped. At most
+// maxParts parts are returned, and truncated reports whether the rest was left out
+func SplitMessage(msg string, maxChars, maxLines, maxParts int) (parts []string, truncated bool) {
+	for msg != "" {
+		if len(parts) == maxParts {
+			return parts, true
+		}
+
+		part := msg
+		if maxLines > 0 {
+			lines, end := 0, -1
+			for i := 0; i < len(part) && lines < maxLines; i++ {
+				if part[i] == '\n' {
+					lines, end = lines+1, i
+				}
+			}
+			if lines == maxLines {
+				part = part[:end]
+			}
+		}
+		if maxChars > 0 && len(part) > maxChars {
+			chars := 0
+			for i := range part {
+				if chars == maxChars {
+					part = part[:i]
+					break
+				}
+				chars++
+			}
+		}
+
+		parts = append(parts, part)
+		msg = strings.TrimPrefix(msg[len(part):], "\n")
+	}
+	return parts, false
+}
+
+// EncodeBinaryMessage moves a message which isn't valid UTF-8 to the msg_base64 field,
+// base64 encoded so its bytes are preserved, and sets msg_binary. It returns false and
+// leaves the event unchanged for text messages
+func (e *Event) EncodeBinaryMessage() bool {
+	if utf8.ValidString(e.Msg) {
+		return false
+	}
+	e.Fields["msg_base64"] = base64.StdEncoding.EncodeToString([]byte(e.Msg))
+	e.Fields["msg_binary"] = true
+	e.Msg = ""
+	return true
+}
+
+// StripTimestamp removes a leading timestamp of the layout, followed by whitespace,
+// from the event message. It returns false and leaves the event unchanged when the
+// message doesn't start with such a timestamp. Timestamps without a zone are UTC
+func (e *Event) StripTimestamp(layout string, asTime bool) bool {
+	// The timestamp has as many space separated words as the layout
+	words := len(strings.Fields(layout))
+	msg := strings.TrimLeft(e.Msg, " \t")
+	end := 0
+	for i := 0; i < words; i++ {
+		for end < len(msg) && msg[end] == ' ' {
+			end++
+		}
+		next := strings.IndexAny(msg[end:], " \t")
+		if next < 0 {
+			if i < words-1 {
+				return false
+			}
+			end = len(msg)
+			break
+		}
+		end += next
+	}
+
+	timestamp, err := time.Parse(layout, msg[:end])
+	if err != nil {
+		return false
+	}
+
+	e.Msg = strings.TrimLeft(msg[end:], " \t")
+	if asTime {
+		e.Fields["timestamp"] = timestamp.UnixNano()
+	}
+	return true
+}
+
+// ExtractFields applies the extractors in order to the event message and adds the
+// named capture groups of every matching extractor as event fields. Fields which
+// are already set, including the ones set by a previous extractor, are not overwritten
+func (e *Event) ExtractFields(extractors []*regexp.Regexp) {
+	for _, extractor := range extractors {
+		match := extractor.FindStringSubmatch(e.Msg)
+		if match == nil {
+			continue
+		}
+
+		for i, name := range extractor.SubexpNames() {
+			if name == "" || match[i] == "" {
+				continue
+			}
+			if _, ok := e.Fields[name]; !ok {
+				e.Fields[name] = match[i]
+			}
+		}
+	}
+}
+
+// What happens to a key of a JSON log message when the event already has the field
+const (
+	JsonLogCollisionKeep      = "keep"      // the key is dropped
+	JsonLogCollisionOverwrite = "overwrite" // the key replaces the field, unless protected
+	JsonLogCollisionPrefix    = "prefix"    // the key is renamed with JsonLogCollisionKeyPrefix
+)
+
+// JsonLogCollisionKeyPrefix prefixes the keys of JSON log messages colliding with a
+// field with JsonLogCollisionPrefix, or a protected field with JsonLogCollisionOverwrite
+const JsonLogCollisionKeyPrefix = "json_"
+
+// protectedFields are the fields the nozzle routes, enriches and timestamps events
+// with, which keys of JSON log messages never set, whether or not the event has them
+var protectedFields = map[string]bool{
+	"cf_app_id":         true,
+	"cf_app_name":       true,
+	"cf_org_id":         true,
+	"cf_org_name":       true,
+	"cf_space_id":       true,
+	"cf_space_name":     true,
+	"cf_ignored_app":    true,
+	"cf_quarantined":    true,
+	"info_splunk_index": true,
+	"event_type":        true,
+	"timestamp":         true,
+	"origin":            true,
+	"deployment":        true,
+	"job":               true,
+	"ip":                true,
+}
+
+// MergeJsonMessage merges the keys of the message into the fields when the message is
+// a JSON object within the size and depth limits of the config, and clears the message.
+// It returns whether the message was merged
+func (e *Event) MergeJsonMessage(config *Config) bool {
+	trimmed := strings.TrimSpace(e.Msg)
+	if !strings.HasPrefix(trimmed, "{") || !strings.HasSuffix(trimmed, "}") {
+		return false
+	}
+	if config.JsonLogMaxBytes > 0 && len(trimmed) > config.JsonLogMaxBytes {
+		return false
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &object); err != nil {
+		return false
+	}
+	if config.JsonLogMaxDepth > 0 && jsonDepth(object) > config.JsonLogMaxDepth {
+		return false
+	}
+
+	for key, value := range object {
+		name := config.JsonLogPrefix + key
+		if _, ok := e.Fields[name]; ok || protectedFields[name] {
+			if name = e.collidingKeyName(name, config.JsonLogCollision); name == "" {
+				continue
+			}
+		}
+		e.Fields[name] = value
+	}
+	e.Msg = ""
+	return true
+}
+
+// collidingKeyName returns the field name of a key of a JSON log message colliding with
+// the field name, or named as a protected field, with the collision policy, "" when
+// the key is dropped
+func (e *Event) collidingKeyName(name string, policy string) string {
+	switch {
+	case policy == JsonLogCollisionOverwrite && !protectedFields[name]:
+		return name
+	case policy == JsonLogCollisionOverwrite || policy == JsonLogCollisionPrefix:
+		renamed := JsonLogCollisionKeyPrefix + name
+		if _, ok := e.Fields[renamed]; !ok {
+			return renamed
+		}
+	}
+	return ""
+}
+
+// jsonDepth returns the nesting depth of a decoded JSON value, 1 for a flat object
+func jsonDepth(value interface{}) int {
+	var children []interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			children = append(children, child)
+		}
+	case []interface{}:
+		children = v
+	default:
+		return 0
+	}
+
+	max := 0
+	for _, child := range children {
+		if depth := jsonDepth(child); depth > max {
+			max = depth
+		}
+	}
+	return max + 1
+}
+
+// AnnotateWithPriority sets the field to the priority of the first matching rule.
+// Events which match no rule are left unchanged
+func (e *Event) AnnotateWithPriority(rules []PriorityRule, field string) {
+	for _, rule := range rules {
+		if rule.matches(e) {
+			e.Fields[field] = rule.Priority
+			return
+		}
+	}
+}
+
+func (r *PriorityRule) matches(e *Event) bool {
+	if r.EventType != "" && r.EventType != e.Type {
+		return false
+	}
+	if r.Field == "" {
+		return true
+	}
+
+	value, ok := e.Fields[r.Field]
+	if !ok {
+		return false
+	}
+
+	if r.Equals != nil && fmt.Sprint(value) != *r.Equals {
+		return false
+	}
+
+	if r.Min != nil || r.Max != nil {
+		number, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return false
+		}
+		if (r.Min != nil && number < *r.Min) || (r.Max != nil && number > *r.Max) {
+			return false
+		}
+	}
+	return true
 }
 
 func (e *Event) AnnotateWithCFMetaData() {
@@ -264,6 +762,24 @@ func (e *Event) AnnotateWithEnvelopeData(msg *events.Envelope, config *Config) {
 	if config.AddTags {
 		e.Fields["tags"] = msg.GetTags()
 	}
+
+	if config.BoshInstanceField != "" {
+		if id := boshInstanceId(msg.GetTags()); id != "" {
+			e.Fields[config.BoshInstanceField] = id
+		}
+	}
+}
+
+// boshInstanceIdTags are the tags the GUID of the BOSH instance emitting an envelope may be carried in
+var boshInstanceIdTags = []string{"bosh_instance_id", "instance_guid"}
+
+func boshInstanceId(tags map[string]string) string {
+	for _, tag := range boshInstanceIdTags {
+		if id := tags[tag]; id != "" {
+			return id
+		}
+	}
+	return ""
 }
 
 func IsAuthorizedEvent(wantedEvent string) bool {
@@ -328,6 +844,214 @@ func ParseExtraFields(extraEventsString string) (map[string]string, error) {
 	return extraEvents, nil
 }
 
+// CheckExtraFieldSizes returns an error for the first extra field, in name order, whose
+// value is longer than maxBytes, since extra fields are added to every event. 0 disables
+// the check
+func CheckExtraFieldSizes(fields map[string]string, maxBytes int) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if size := len(fields[name]); size > maxBytes {
+			return fmt.Errorf("value of extra field [%s] is %d bytes, over the maximum of %d bytes", name, size, maxBytes)
+		}
+	}
+	return nil
+}
+
+// ParseHttpStatusSampleRates parses a comma separated list of status class and
+// sample rate pairs, for example "2xx:10,3xx:10" keeps 1 of every 10 2xx and 3xx
+func ParseHttpStatusSampleRates(sampleRatesString string) (map[int]uint64, error) {
+	sampleRates := map[int]uint64{}
+
+	for _, kvPair := range strings.Split(sampleRatesString, ",") {
+		if strings.TrimSpace(kvPair) == "" {
+			continue
+		}
+
+		k, v, err := getKeyValueFromString(strings.TrimSpace(kvPair))
+		if err != nil {
+			return nil, err
+		}
+
+		k = strings.ToLower(k)
+		if len(k) != 3 || k[0] < '1' || k[0] > '5' || k[1:] != "xx" {
+			return nil, fmt.Errorf("invalid status class [%s], expected one of 1xx, 2xx, 3xx, 4xx, 5xx", k)
+		}
+
+		rate, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || rate == 0 {
+			return nil, fmt.Errorf("invalid sample rate [%s] for status class %s, expected a positive integer", v, k)
+		}
+		sampleRates[int(k[0]-'0')] = rate
+	}
+	return sampleRates, nil
+}
+
+// ParseSampleRatios parses a comma separated list of event type and sample ratio
+// pairs, for example "ContainerMetric=0.1,ValueMetric=0.25"
+func ParseSampleRatios(sampleRatiosString string) (map[string]float64, error) {
+	sampleRatios := map[string]float64{}
+
+	for _, kvPair := range strings.Split(sampleRatiosString, ",") {
+		if strings.TrimSpace(kvPair) == "" {
+			continue
+		}
+
+		values := strings.Split(kvPair, "=")
+		if len(values) != 2 {
+			return nil, fmt.Errorf("invalid sample ratio [%s], expected <event type>=<ratio>", strings.TrimSpace(kvPair))
+		}
+		eventType, v := strings.TrimSpace(values[0]), strings.TrimSpace(values[1])
+
+		if !IsAuthorizedEvent(eventType) {
+			return nil, fmt.Errorf("rejected event name [%s] - valid events: %s", eventType, AuthorizedEvents())
+		}
+
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid sample ratio [%s] for event type %s, expected a number from 0 to 1", v, eventType)
+		}
+		sampleRatios[eventType] = ratio
+	}
+	return sampleRatios, nil
+}
+
+// ParsePriorityRules parses a JSON array of priority rules, for example
+// [{"event_type": "HttpStartStop", "field": "status_code", "min": 500, "priority": "high"}]
+func ParsePriorityRules(rulesString string) ([]PriorityRule, error) {
+	rulesString = strings.TrimSpace(rulesString)
+	if rulesString == "" {
+		return nil, nil
+	}
+
+	var rules []PriorityRule
+	if err := json.Unmarshal([]byte(rulesString), &rules); err != nil {
+		return nil, fmt.Errorf("priority rules must be a JSON array of rules: %s", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Priority == "" {
+			return nil, errors.New("priority rule without priority")
+		}
+		if rule.EventType != "" && !IsAuthorizedEvent(rule.EventType) {
+			return nil, fmt.Errorf("priority rule with invalid event type [%s] - valid events: %s", rule.EventType, AuthorizedEvents())
+		}
+		if rule.Field == "" && (rule.Equals != nil || rule.Min != nil || rule.Max != nil) {
+			return nil, fmt.Errorf("priority rule [%s] has a condition without field", rule.Priority)
+		}
+	}
+	return rules, nil
+}
+
+// ParseIndexExtraFields parses a JSON object mapping index names to the extra fields
+// which are only added to events sent to that index
+func ParseIndexExtraFields(indexExtraFieldsString string) (map[string]map[string]string, error) {
+	indexExtraFieldsString = strings.TrimSpace(indexExtraFieldsString)
+	if indexExtraFieldsString == "" {
+		return nil, nil
+	}
+
+	var indexExtraFields map[string]map[string]string
+	if err := json.Unmarshal([]byte(indexExtraFieldsString), &indexExtraFields); err != nil {
+		return nil, fmt.Errorf("index extra fields must be a JSON object of index name to fields, for example {\"app_index\": {\"team\": \"payments\"}}: %s", err)
+	}
+	return indexExtraFields, nil
+}
+
+// ParseMessageTypeIndexes parses a JSON object mapping the LogMessage message types,
+// OUT and ERR, to the index their log lines are sent to, for example {"ERR": "app_errors"}
+func ParseMessageTypeIndexes(messageTypeIndexesString string) (map[string]string, error) {
+	messageTypeIndexesString = strings.TrimSpace(messageTypeIndexesString)
+	if messageTypeIndexesString == "" {
+		return nil, nil
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(messageTypeIndexesString), &raw); err != nil {
+		return nil, fmt.Errorf("message type indexes must be a JSON object of message type to index name, for example {\"ERR\": \"app_errors\"}: %s", err)
+	}
+
+	messageTypeIndexes := make(map[string]string, len(raw))
+	for messageType, index := range raw {
+		messageType = strings.ToUpper(strings.TrimSpace(messageType))
+		if _, ok := events.LogMessage_MessageType_value[messageType]; !ok {
+			return nil, fmt.Errorf("invalid message type %q, must be OUT or ERR", messageType)
+		}
+		if index = strings.TrimSpace(index); index == "" {
+			return nil, fmt.Errorf("empty index for message type %s", messageType)
+		}
+		messageTypeIndexes[messageType] = index
+	}
+	return messageTypeIndexes, nil
+}
+
+// ParseOrgTokens parses a JSON object mapping org GUIDs to the HEC token of their
+// tenant, for example {"2f8d-...": "00000000-0000-0000-0000-000000000000"}
+func ParseOrgTokens(orgTokensString string) (map[string]string, error) {
+	orgTokensString = strings.TrimSpace(orgTokensString)
+	if orgTokensString == "" {
+		return nil, nil
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(orgTokensString), &raw); err != nil {
+		// The error of a JSON string could quote a token
+		return nil, errors.New("org tokens must be a JSON object of org GUID to HEC token, for example {\"<org guid>\": \"<token>\"}")
+	}
+
+	orgTokens := make(map[string]string, len(raw))
+	for org, token := range raw {
+		if org = strings.TrimSpace(org); org == "" {
+			return nil, errors.New("empty org GUID in org tokens")
+		}
+		if token = strings.TrimSpace(token); token == "" {
+			return nil, fmt.Errorf("empty token for org %s", org)
+		}
+		orgTokens[org] = token
+	}
+	return orgTokens, nil
+}
+
+// ParseFieldExtractors parses a JSON array of regular expressions, or a single regular
+// expression, used to extract fields from log messages. Every expression must
+// contain at least one named capture group
+func ParseFieldExtractors(extractorsString string) ([]*regexp.Regexp, error) {
+	extractorsString = strings.TrimSpace(extractorsString)
+	if extractorsString == "" {
+		return nil, nil
+	}
+
+	var patterns []string
+	if err := json.Unmarshal([]byte(extractorsString), &patterns); err != nil {
+		patterns = []string{extractorsString}
+	}
+
+	var extractors []*regexp.Regexp
+	for _, pattern := range patterns {
+		extractor, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field extractor [%s]: %s", pattern, err)
+		}
+
+		named := false
+		for _, name := range extractor.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return nil, fmt.Errorf("field extractor [%s] has no named capture group", pattern)
+		}
+		extractors = append(extractors, extractor)
+	}
+	return extractors, nil
+}
+
 func AuthorizedMetadata() string {
 	return strings.Join(AppMetadata, ", ")
 }
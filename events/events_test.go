@@ -2,6 +2,8 @@ package events_test
 
 import (
 	"math"
+	"strings"
+	"time"
 
 	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
@@ -77,6 +79,30 @@ var _ = Describe("Events", func() {
 		Expect(evt.Fields["uri"]).To(Equal(uri))
 		Expect(evt.Fields["user_agent"]).To(Equal(userAgent))
 		Expect(evt.Fields["forwarded"]).To(BeNil())
+		Expect(evt.Fields).ToNot(HaveKey("vcap_request_id"))
+	})
+
+	Describe("AnnotateWithVcapRequestId", func() {
+		It("adds the request id, which is the gorouter's X-Vcap-Request-Id", func() {
+			msg = NewHttpStartStop()
+			evt := fevents.HttpStartStop(msg)
+			evt.AnnotateWithVcapRequestId(msg)
+			Expect(evt.Fields["vcap_request_id"]).To(Equal(uuidStr))
+		})
+
+		It("adds the tag of envelopes without a request id", func() {
+			msg = NewHttpStartStop()
+			msg.HttpStartStop.RequestId = nil
+			evt := fevents.HttpStartStop(msg)
+			evt.AnnotateWithVcapRequestId(msg)
+			Expect(evt.Fields).ToNot(HaveKey("vcap_request_id"))
+
+			msg.Tags = map[string]string{"tag": "value", "x_vcap_request_id": "a0a1a2a3-b0b1-c0c1-d0d1-e0e1e2e3e4e5"}
+			defer func() { msg.Tags = tags }()
+			evt = fevents.HttpStartStop(msg)
+			evt.AnnotateWithVcapRequestId(msg)
+			Expect(evt.Fields["vcap_request_id"]).To(Equal("a0a1a2a3-b0b1-c0c1-d0d1-e0e1e2e3e4e5"))
+		})
 	})
 
 	It("ValueMetric", func() {
@@ -207,6 +233,49 @@ var _ = Describe("Events", func() {
 			event.AnnotateWithEnvelopeData(msg, config)
 			Expect(event.Fields["tags"]).To(Equal(msg.GetTags()))
 		})
+
+		It("adds the app state when configured", func() {
+			event.AnnotateWithAppData(fcache, &fevents.Config{AddAppName: true})
+			Expect(event.Fields).NotTo(HaveKey("app_state"))
+
+			config := &fevents.Config{AddAppState: true}
+			event.AnnotateWithAppData(fcache, config)
+			Expect(event.Fields["app_state"]).To(Equal("STARTED"))
+			Expect(event.IsEnriched(config)).To(BeTrue())
+		})
+
+		It("adds the app timestamps when configured and known", func() {
+			event.AnnotateWithAppData(fcache, &fevents.Config{AddAppName: true})
+			Expect(event.Fields).NotTo(HaveKey("cf_app_created_at"))
+
+			config := &fevents.Config{AddCreatedAt: true, AddUpdatedAt: true}
+			event.AnnotateWithAppData(fcache, config)
+			Expect(event.Fields["cf_app_created_at"]).To(Equal("2016-06-08T16:41:45Z"))
+			Expect(event.Fields).NotTo(HaveKey("cf_app_updated_at"))
+			Expect(event.IsEnriched(config)).To(BeTrue())
+		})
+
+		It("adds the quota names when configured and known", func() {
+			config := &fevents.Config{AddOrgQuota: true, AddSpaceQuota: true}
+			event.AnnotateWithAppData(fcache, config)
+			Expect(event.Fields["cf_org_quota"]).To(Equal("testing-org-quota"))
+			Expect(event.Fields).NotTo(HaveKey("cf_space_quota"))
+			Expect(event.IsEnriched(config)).To(BeTrue())
+		})
+	})
+
+	It("promotes the BOSH instance id tag when configured", func() {
+		msg.Tags = map[string]string{"bosh_instance_id": "6e6f6f9c-4a6c-4b1f-9b4e-2f1d3c0a5e7b"}
+		event.AnnotateWithEnvelopeData(msg, &fevents.Config{BoshInstanceField: "bosh_id"})
+		Expect(event.Fields["bosh_id"]).To(Equal("6e6f6f9c-4a6c-4b1f-9b4e-2f1d3c0a5e7b"))
+
+		event = fevents.LogMessage(msg)
+		event.AnnotateWithEnvelopeData(msg, &fevents.Config{})
+		Expect(event.Fields).ToNot(HaveKey("bosh_id"))
+
+		msg.Tags = nil
+		event.AnnotateWithEnvelopeData(msg, &fevents.Config{BoshInstanceField: "bosh_id"})
+		Expect(event.Fields).ToNot(HaveKey("bosh_id"))
 	})
 
 	It("HttpStart", func() {
@@ -259,6 +328,495 @@ var _ = Describe("Events", func() {
 		})
 	})
 
+	Describe("ParseHttpStatusSampleRates", func() {
+		It("parses rates per status class", func() {
+			rates, err := fevents.ParseHttpStatusSampleRates("2xx:10, 3XX:5")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(rates).To(Equal(map[int]uint64{2: 10, 3: 5}))
+		})
+
+		It("returns no rates for an empty string", func() {
+			rates, err := fevents.ParseHttpStatusSampleRates("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(rates).To(BeEmpty())
+		})
+
+		It("rejects invalid classes and rates", func() {
+			_, err := fevents.ParseHttpStatusSampleRates("200:10")
+			Ω(err).Should(HaveOccurred())
+			_, err = fevents.ParseHttpStatusSampleRates("2xx:0")
+			Ω(err).Should(HaveOccurred())
+			_, err = fevents.ParseHttpStatusSampleRates("2xx")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("ParseSampleRatios", func() {
+		It("parses ratios per event type", func() {
+			ratios, err := fevents.ParseSampleRatios("ContainerMetric=0.1, ValueMetric=0.25,LogMessage=1.0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(ratios).To(Equal(map[string]float64{"ContainerMetric": 0.1, "ValueMetric": 0.25, "LogMessage": 1}))
+		})
+
+		It("returns no ratios for an empty string", func() {
+			ratios, err := fevents.ParseSampleRatios("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(ratios).To(BeEmpty())
+		})
+
+		It("rejects invalid event types and ratios", func() {
+			for _, ratios := range []string{"Metric=0.1", "ValueMetric=1.5", "ValueMetric=-1", "ValueMetric", "ValueMetric:0.1"} {
+				_, err := fevents.ParseSampleRatios(ratios)
+				Ω(err).Should(HaveOccurred(), ratios)
+			}
+		})
+	})
+
+	Describe("ParseIndexExtraFields", func() {
+		It("parses fields per index", func() {
+			fields, err := fevents.ParseIndexExtraFields(`{"app_logs": {"team": "payments"}, "main": {"env": "prod"}}`)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(fields).To(Equal(map[string]map[string]string{
+				"app_logs": {"team": "payments"},
+				"main":     {"env": "prod"},
+			}))
+		})
+
+		It("returns no fields for an empty string", func() {
+			fields, err := fevents.ParseIndexExtraFields(" ")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(fields).To(BeEmpty())
+		})
+
+		It("rejects invalid JSON", func() {
+			_, err := fevents.ParseIndexExtraFields("app_logs:team:payments")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("CheckExtraFieldSizes", func() {
+		fields := map[string]string{"env": "prod", "owner": "payments-team"}
+
+		It("accepts values up to the maximum size", func() {
+			Ω(fevents.CheckExtraFieldSizes(fields, 13)).Should(Succeed())
+		})
+
+		It("rejects the field over the maximum size", func() {
+			err := fevents.CheckExtraFieldSizes(fields, 12)
+			Ω(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("[owner]"))
+		})
+
+		It("accepts any size when disabled", func() {
+			Ω(fevents.CheckExtraFieldSizes(fields, 0)).Should(Succeed())
+		})
+	})
+
+	Describe("ParseMessageTypeIndexes", func() {
+		It("parses the index per message type", func() {
+			indexes, err := fevents.ParseMessageTypeIndexes(`{"err": "app_errors", "OUT": "app_logs"}`)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(indexes).To(Equal(map[string]string{"ERR": "app_errors", "OUT": "app_logs"}))
+		})
+
+		It("returns no indexes for an empty string", func() {
+			indexes, err := fevents.ParseMessageTypeIndexes("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(indexes).To(BeEmpty())
+		})
+
+		It("rejects unknown message types and empty indexes", func() {
+			for _, indexes := range []string{`{"STDERR": "app_errors"}`, `{"ERR": " "}`, "ERR=app_errors"} {
+				_, err := fevents.ParseMessageTypeIndexes(indexes)
+				Ω(err).Should(HaveOccurred(), indexes)
+			}
+		})
+	})
+
+	Describe("ParseOrgTokens", func() {
+		It("parses the token per org", func() {
+			orgTokens, err := fevents.ParseOrgTokens(`{"org-a": "token-a", " org-b ": "token-b"}`)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(orgTokens).To(Equal(map[string]string{"org-a": "token-a", "org-b": "token-b"}))
+		})
+
+		It("returns no tokens for an empty string", func() {
+			orgTokens, err := fevents.ParseOrgTokens("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(orgTokens).To(BeNil())
+		})
+
+		It("rejects empty orgs and tokens without quoting the tokens", func() {
+			for _, orgTokens := range []string{`{"org-a": " "}`, `{"": "token-a"}`, `{"org-a": 1}`, "org-a:secret"} {
+				_, err := fevents.ParseOrgTokens(orgTokens)
+				Ω(err).Should(HaveOccurred(), orgTokens)
+				Expect(err.Error()).NotTo(ContainSubstring("secret"))
+			}
+		})
+	})
+
+	Describe("SplitMessage", func() {
+		It("splits by lines and characters", func() {
+			parts, truncated := fevents.SplitMessage("a\nb\nc\n", 0, 2, 10)
+			Expect(parts).To(Equal([]string{"a\nb", "c\n"}))
+			Expect(truncated).To(BeFalse())
+
+			parts, truncated = fevents.SplitMessage("abcdefg\nh", 3, 0, 10)
+			Expect(parts).To(Equal([]string{"abc", "def", "g\nh"}))
+			Expect(truncated).To(BeFalse())
+
+			parts, _ = fevents.SplitMessage("héllo wörld", 4, 0, 10)
+			Expect(parts).To(Equal([]string{"héll", "o wö", "rld"}))
+		})
+
+		It("keeps short messages whole", func() {
+			parts, truncated := fevents.SplitMessage("a\nb", 3, 2, 1)
+			Expect(parts).To(Equal([]string{"a\nb"}))
+			Expect(truncated).To(BeFalse())
+		})
+
+		It("reports the parts left out", func() {
+			parts, truncated := fevents.SplitMessage("a\nb\nc", 0, 1, 2)
+			Expect(parts).To(Equal([]string{"a", "b"}))
+			Expect(truncated).To(BeTrue())
+		})
+	})
+
+	Describe("ParseFieldExtractors", func() {
+		It("parses a JSON array of expressions in order", func() {
+			extractors, err := fevents.ParseFieldExtractors(`["trace_id=(?P<trace_id>\\w+)", "user=(?P<user>\\w+)"]`)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(extractors).To(HaveLen(2))
+			Expect(extractors[0].String()).To(Equal(`trace_id=(?P<trace_id>\w+)`))
+		})
+
+		It("parses a single expression", func() {
+			extractors, err := fevents.ParseFieldExtractors(`trace_id=(?P<trace_id>\w+)`)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(extractors).To(HaveLen(1))
+		})
+
+		It("returns no extractors for an empty string", func() {
+			extractors, err := fevents.ParseFieldExtractors("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(extractors).To(BeEmpty())
+		})
+
+		It("rejects invalid expressions", func() {
+			_, err := fevents.ParseFieldExtractors(`["(?P<trace_id>"]`)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("rejects expressions without named capture groups", func() {
+			_, err := fevents.ParseFieldExtractors(`["trace_id=(\\w+)"]`)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("ParsePriorityRules", func() {
+		It("parses rules in order", func() {
+			rules, err := fevents.ParsePriorityRules(`[{"event_type": "Error", "priority": "high"}, {"field": "status_code", "min": 500, "priority": "high"}]`)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[0].EventType).To(Equal("Error"))
+			Expect(*rules[1].Min).To(Equal(float64(500)))
+		})
+
+		It("returns no rules for an empty string", func() {
+			rules, err := fevents.ParsePriorityRules("")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(rules).To(BeEmpty())
+		})
+
+		It("rejects invalid rules", func() {
+			_, err := fevents.ParsePriorityRules(`[{"event_type": "Error"}]`)
+			Ω(err).Should(HaveOccurred())
+			_, err = fevents.ParsePriorityRules(`[{"event_type": "Invalid", "priority": "high"}]`)
+			Ω(err).Should(HaveOccurred())
+			_, err = fevents.ParsePriorityRules(`[{"min": 500, "priority": "high"}]`)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("AnnotateWithPriority", func() {
+		var rules []fevents.PriorityRule
+
+		BeforeEach(func() {
+			rules, _ = fevents.ParsePriorityRules(`[
+				{"event_type": "HttpStartStop", "field": "status_code", "min": 500, "max": 599, "priority": "high"},
+				{"event_type": "LogMessage", "field": "message_type", "equals": "ERR", "priority": "medium"},
+				{"event_type": "Error", "priority": "high"}
+			]`)
+		})
+
+		It("sets the priority of the first matching rule", func() {
+			statusCode := int32(503)
+			msg = NewHttpStartStop()
+			msg.HttpStartStop.StatusCode = &statusCode
+			evt := fevents.HttpStartStop(msg)
+			evt.Type = "HttpStartStop"
+
+			evt.AnnotateWithPriority(rules, "priority")
+			Expect(evt.Fields["priority"]).To(Equal("high"))
+		})
+
+		It("leaves events matching no rule unchanged", func() {
+			event.Type = "LogMessage"
+			event.AnnotateWithPriority(rules, "priority")
+			Expect(event.Fields).ToNot(HaveKey("priority"))
+
+			event.Fields["message_type"] = "ERR"
+			event.AnnotateWithPriority(rules, "severity")
+			Expect(event.Fields["severity"]).To(Equal("medium"))
+		})
+	})
+
+	Describe("MergeJsonMessage", func() {
+		var config *fevents.Config
+		var evt *fevents.Event
+
+		BeforeEach(func() {
+			config = &fevents.Config{JsonLog: true, JsonLogMaxBytes: 1024, JsonLogMaxDepth: 2}
+			evt = &fevents.Event{
+				Fields: map[string]interface{}{"cf_app_id": "app-guid"},
+				Msg:    `{"level": "error", "cf_app_id": "other", "http": {"status": 500}}`,
+			}
+		})
+
+		It("merges the keys and clears the message", func() {
+			Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+			Expect(evt.Msg).To(BeEmpty())
+			Expect(evt.Fields["level"]).To(Equal("error"))
+			Expect(evt.Fields["http"]).To(Equal(map[string]interface{}{"status": float64(500)}))
+			Expect(evt.Fields["cf_app_id"]).To(Equal("app-guid"))
+		})
+
+		It("prefixes the keys and overwrites fields when configured", func() {
+			config.JsonLogPrefix = "app_"
+			config.JsonLogCollision = fevents.JsonLogCollisionOverwrite
+			evt.Fields["app_level"] = "info"
+			Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+			Expect(evt.Fields["app_level"]).To(Equal("error"))
+			Expect(evt.Fields["app_cf_app_id"]).To(Equal("other"))
+		})
+
+		Context("when a key collides with a field", func() {
+			BeforeEach(func() {
+				evt.Fields["level"] = "info"
+				evt.Msg = `{"level": "error", "cf_app_id": "other", "info_splunk_index": "other_index"}`
+				evt.Fields["info_splunk_index"] = "app_index"
+			})
+
+			It("drops the key with keep", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionKeep
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields).To(Equal(map[string]interface{}{
+					"cf_app_id": "app-guid", "level": "info", "info_splunk_index": "app_index",
+				}))
+			})
+
+			It("renames the key with prefix", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionPrefix
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields).To(Equal(map[string]interface{}{
+					"cf_app_id": "app-guid", "level": "info", "info_splunk_index": "app_index",
+					"json_cf_app_id": "other", "json_level": "error", "json_info_splunk_index": "other_index",
+				}))
+			})
+
+			It("replaces the field with overwrite, but renames the keys of protected fields", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionOverwrite
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields).To(Equal(map[string]interface{}{
+					"cf_app_id": "app-guid", "level": "error", "info_splunk_index": "app_index",
+					"json_cf_app_id": "other", "json_info_splunk_index": "other_index",
+				}))
+			})
+
+			It("drops the key when the renamed key is already set", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionPrefix
+				evt.Fields["json_level"] = "debug"
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields["level"]).To(Equal("info"))
+				Expect(evt.Fields["json_level"]).To(Equal("debug"))
+			})
+		})
+
+		Context("when a key is named as a protected field the event does not have", func() {
+			BeforeEach(func() {
+				evt.Fields = map[string]interface{}{"cf_app_id": "app-guid"}
+				evt.Msg = `{"level": "error", "info_splunk_index": "other_index", "cf_org_id": "other-org", "cf_quarantined": false}`
+			})
+
+			It("drops the key with keep", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionKeep
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields).To(Equal(map[string]interface{}{
+					"cf_app_id": "app-guid", "level": "error",
+				}))
+			})
+
+			It("renames the key with prefix", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionPrefix
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields).To(Equal(map[string]interface{}{
+					"cf_app_id": "app-guid", "level": "error", "json_info_splunk_index": "other_index",
+					"json_cf_org_id": "other-org", "json_cf_quarantined": false,
+				}))
+			})
+
+			It("renames the key with overwrite", func() {
+				config.JsonLogCollision = fevents.JsonLogCollisionOverwrite
+				Expect(evt.MergeJsonMessage(config)).To(BeTrue())
+				Expect(evt.Fields).To(Equal(map[string]interface{}{
+					"cf_app_id": "app-guid", "level": "error", "json_info_splunk_index": "other_index",
+					"json_cf_org_id": "other-org", "json_cf_quarantined": false,
+				}))
+			})
+		})
+
+		It("keeps messages which are not JSON objects or are too large or deep", func() {
+			for _, msg := range []string{
+				"plain text",
+				`["a", "b"]`,
+				`{"a": {"b": {"c": 1}}}`,
+				`{"a": "` + strings.Repeat("x", 1024) + `"}`,
+			} {
+				evt.Msg = msg
+				Expect(evt.MergeJsonMessage(config)).To(BeFalse())
+				Expect(evt.Msg).To(Equal(msg))
+			}
+		})
+	})
+
+	Describe("IsEnriched", func() {
+		It("requires the selected app metadata fields", func() {
+			config := &fevents.Config{AddAppName: true, AddOrgGuid: true}
+			evt := &fevents.Event{Fields: map[string]interface{}{"cf_app_name": "app"}}
+			Expect(evt.IsEnriched(config)).To(BeFalse())
+
+			evt.Fields["cf_org_id"] = "org-guid"
+			Expect(evt.IsEnriched(config)).To(BeTrue())
+		})
+	})
+
+	Describe("AnnotateWithCpuCores", func() {
+		var (
+			evt    *fevents.Event
+			config *fevents.Config
+		)
+
+		BeforeEach(func() {
+			msg = NewContainerMetric()
+			evt = fevents.ContainerMetric(msg)
+			evt.Fields["cpu_percentage"] = 250.0
+			config = &fevents.Config{AddCpuCores: true, CpuEntitlementMBPerCore: 1024}
+		})
+
+		It("adds the cpu usage in cores and keeps the percentage", func() {
+			evt.AnnotateWithCpuCores()
+			Expect(evt.Fields["cpu_cores_raw"]).To(Equal(2.5))
+			Expect(evt.Fields["cpu_percentage"]).To(Equal(250.0))
+		})
+
+		It("normalizes the cpu usage by the entitlement of the app", func() {
+			fcache.SetAppMemory(4096)
+			evt.AnnotateWithCpuCores()
+			Ω(evt.AnnotateWithAppData(fcache, config)).Should(Succeed())
+			Expect(evt.Fields["cpu_entitlement_cores"]).To(Equal(4.0))
+			Expect(evt.Fields["cpu_cores"]).To(Equal(0.625))
+			Expect(evt.Fields["cpu_cores_raw"]).To(Equal(2.5))
+		})
+
+		It("omits the normalized usage when the entitlement is unknown", func() {
+			evt.AnnotateWithCpuCores()
+			Ω(evt.AnnotateWithAppData(fcache, config)).Should(Succeed())
+			Expect(evt.Fields).ToNot(HaveKey("cpu_cores"))
+			Expect(evt.Fields).ToNot(HaveKey("cpu_entitlement_cores"))
+			Expect(evt.Fields["cpu_cores_raw"]).To(Equal(2.5))
+
+			fcache.SetAppMemory(4096)
+			config.CpuEntitlementMBPerCore = 0
+			Ω(evt.AnnotateWithAppData(fcache, config)).Should(Succeed())
+			Expect(evt.Fields).ToNot(HaveKey("cpu_cores"))
+		})
+
+		It("skips events without a cpu percentage", func() {
+			event.AnnotateWithCpuCores()
+			Expect(event.Fields).ToNot(HaveKey("cpu_cores_raw"))
+		})
+	})
+
+	Describe("ExtractFields", func() {
+		BeforeEach(func() {
+			event.Msg = "GET /orders trace_id=abc123 user=bob"
+		})
+
+		It("adds named capture groups as fields", func() {
+			extractors, _ := fevents.ParseFieldExtractors(`["trace_id=(?P<trace_id>\\w+)", "user=(?P<user>\\w+)"]`)
+			event.ExtractFields(extractors)
+			Expect(event.Fields["trace_id"]).To(Equal("abc123"))
+			Expect(event.Fields["user"]).To(Equal("bob"))
+		})
+
+		It("doesn't overwrite fields set by earlier extractors or the event", func() {
+			extractors, _ := fevents.ParseFieldExtractors(`["trace_id=(?P<trace_id>\\w+)", "(?P<trace_id>GET)", "(?P<origin>GET)"]`)
+			event.ExtractFields(extractors)
+			Expect(event.Fields["trace_id"]).To(Equal("abc123"))
+			Expect(event.Fields["origin"]).To(Equal("yomomma__0"))
+		})
+
+		It("leaves unmatched messages unchanged", func() {
+			extractors, _ := fevents.ParseFieldExtractors(`["span_id=(?P<span_id>\\w+)"]`)
+			fields := len(event.Fields)
+			event.ExtractFields(extractors)
+			Expect(event.Fields).To(HaveLen(fields))
+			Expect(event.Msg).To(Equal("GET /orders trace_id=abc123 user=bob"))
+		})
+	})
+
+	Describe("EncodeBinaryMessage", func() {
+		It("base64 encodes messages which aren't valid UTF-8", func() {
+			event.Msg = "\x00\xff\xfeheader"
+			Expect(event.EncodeBinaryMessage()).To(BeTrue())
+			Expect(event.Msg).To(BeEmpty())
+			Expect(event.Fields["msg_base64"]).To(Equal("AP/+aGVhZGVy"))
+			Expect(event.Fields["msg_binary"]).To(Equal(true))
+		})
+
+		It("leaves text messages unchanged", func() {
+			event.Msg = "héllo wörld"
+			Expect(event.EncodeBinaryMessage()).To(BeFalse())
+			Expect(event.Msg).To(Equal("héllo wörld"))
+			Expect(event.Fields).NotTo(HaveKey("msg_base64"))
+		})
+	})
+
+	Describe("StripTimestamp", func() {
+		It("strips a leading timestamp of the layout", func() {
+			event.Msg = "2021-05-04T10:11:12.345Z  GET /orders"
+			Expect(event.StripTimestamp("2006-01-02T15:04:05.000Z07:00", false)).To(BeTrue())
+			Expect(event.Msg).To(Equal("GET /orders"))
+			Expect(event.Fields["timestamp"]).To(Equal(int64(1)))
+		})
+
+		It("strips timestamps with spaces and uses them as the event time", func() {
+			event.Msg = "[2021-05-04 10:11:12] GET /orders"
+			Expect(event.StripTimestamp("[2006-01-02 15:04:05]", true)).To(BeTrue())
+			Expect(event.Msg).To(Equal("GET /orders"))
+			Expect(event.Fields["timestamp"]).To(Equal(int64(1620123072000000000)))
+		})
+
+		It("leaves messages without a leading timestamp unchanged", func() {
+			for _, msg := range []string{"GET /orders 2021-05-04T10:11:12Z", "", "2021-05-04"} {
+				event.Msg = msg
+				Expect(event.StripTimestamp(time.RFC3339, true)).To(BeFalse())
+				Expect(event.Msg).To(Equal(msg))
+				Expect(event.Fields["timestamp"]).To(Equal(int64(1)))
+			}
+		})
+	})
+
 	Describe("ParseExtraFields", func() {
 		Context("called with a empty string", func() {
 			It("should return a empty hash", func() {
@@ -0,0 +1,533 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a compiled boolean expression over the fields of events, which decides
+// whether events are kept. For example:
+//
+//	event_type == "LogMessage" && cf_org_name in ["dev", "test"] && msg contains "health"
+//
+// Identifiers are event fields, and fields missing from an event are nil.
+// Operators are ==, !=, <, <=, >, >=, in, contains, startsWith, endsWith, matches
+// (with a regular expression literal), &&, ||, ! and their aliases and, or, not.
+// Ordering and string operators are false when an operand is nil
+type Filter struct {
+	expression string
+	root       node
+}
+
+// CompileFilter compiles the expression. Syntax errors and invalid regular
+// expressions are returned, type errors are only detected when evaluating
+func CompileFilter(expression string) (*Filter, error) {
+	p := &parser{}
+	if err := p.tokenize(expression); err != nil {
+		return nil, fmt.Errorf("invalid filter expression [%s]: %v", expression, err)
+	}
+
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression [%s]: %v", expression, err)
+	}
+	return &Filter{expression: expression, root: root}, nil
+}
+
+// String returns the expression of the filter
+func (f *Filter) String() string {
+	return f.expression
+}
+
+// Keep evaluates the filter with the fields of the event. The msg identifier is the
+// message of the event when it isn't a field
+func (f *Filter) Keep(e *Event) (bool, error) {
+	lookup := func(name string) interface{} {
+		if value, ok := e.Fields[name]; ok {
+			return value
+		}
+		if name == "msg" && len(e.Msg) > 0 {
+			return e.Msg
+		}
+		return nil
+	}
+
+	value, err := f.root.eval(lookup)
+	if err != nil {
+		return false, err
+	}
+	keep, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("filter evaluated to %v instead of a boolean", value)
+	}
+	return keep, nil
+}
+
+type node interface {
+	eval(lookup func(string) interface{}) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(func(string) interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type identifier struct {
+	name string
+}
+
+func (n *identifier) eval(lookup func(string) interface{}) (interface{}, error) {
+	return normalize(lookup(n.name)), nil
+}
+
+type list struct {
+	items []node
+}
+
+func (n *list) eval(lookup func(string) interface{}) (interface{}, error) {
+	values := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := item.eval(lookup)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+type not struct {
+	operand node
+}
+
+func (n *not) eval(lookup func(string) interface{}) (interface{}, error) {
+	value, err := evalBool(n.operand, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return !value, nil
+}
+
+type logical struct {
+	and         bool
+	left, right node
+}
+
+func (n *logical) eval(lookup func(string) interface{}) (interface{}, error) {
+	left, err := evalBool(n.left, lookup)
+	if err != nil {
+		return nil, err
+	}
+	// Short-circuit
+	if left != n.and {
+		return left, nil
+	}
+	return evalBool(n.right, lookup)
+}
+
+type comparison struct {
+	op          string
+	left, right node
+	pattern     *regexp.Regexp // for matches
+}
+
+func (n *comparison) eval(lookup func(string) interface{}) (interface{}, error) {
+	left, err := n.left.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		items, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("in requires a list, got %v", right)
+		}
+		for _, item := range items {
+			if equal(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	switch n.op {
+	case "<", "<=", ">", ">=":
+		var cmp int
+		switch l := left.(type) {
+		case float64:
+			r, ok := right.(float64)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+			}
+			cmp = compareFloat(l, r)
+		case string:
+			r, ok := right.(string)
+			if !ok {
+				return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+			}
+			cmp = strings.Compare(l, r)
+		default:
+			return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	}
+
+	l, ok := left.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s requires strings, got %v", n.op, left)
+	}
+	if n.op == "matches" {
+		return n.pattern.MatchString(l), nil
+	}
+	r, ok := right.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s requires strings, got %v", n.op, right)
+	}
+	switch n.op {
+	case "contains":
+		return strings.Contains(l, r), nil
+	case "startsWith":
+		return strings.HasPrefix(l, r), nil
+	default:
+		return strings.HasSuffix(l, r), nil
+	}
+}
+
+func evalBool(n node, lookup func(string) interface{}) (bool, error) {
+	value, err := n.eval(lookup)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %v", value)
+	}
+	return b, nil
+}
+
+// normalize converts the numbers of event fields to float64, and messages to strings
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []byte:
+		return string(v)
+	}
+	return value
+}
+
+func equal(left, right interface{}) bool {
+	switch left.(type) {
+	case nil, bool, float64, string:
+		return left == right
+	}
+	return false
+}
+
+func compareFloat(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+type tokenKind int
+
+const (
+	tokenOperator tokenKind = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+var wordOperators = map[string]string{
+	"and":        "&&",
+	"or":         "||",
+	"not":        "!",
+	"in":         "in",
+	"contains":   "contains",
+	"startsWith": "startsWith",
+	"endsWith":   "endsWith",
+	"matches":    "matches",
+}
+
+func (p *parser) tokenize(expression string) error {
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(runes) && runes[j] != c {
+				if runes[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(runes) {
+				return fmt.Errorf("unterminated string")
+			}
+			text := string(runes[i : j+1])
+			quoted := text
+			if c == '\'' {
+				quoted = `"` + strings.ReplaceAll(strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return fmt.Errorf("invalid string %s", text)
+			}
+			p.tokens = append(p.tokens, token{kind: tokenString, text: text, value: value})
+			i = j + 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			text := string(runes[i:j])
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %s", text)
+			}
+			p.tokens = append(p.tokens, token{kind: tokenNumber, text: text, value: value})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			text := string(runes[i:j])
+			if op, ok := wordOperators[text]; ok {
+				p.tokens = append(p.tokens, token{kind: tokenOperator, text: op})
+			} else {
+				p.tokens = append(p.tokens, token{kind: tokenIdentifier, text: text})
+			}
+			i = j
+		default:
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					p.tokens = append(p.tokens, token{kind: tokenOperator, text: two})
+					i += 2
+					continue
+				}
+			}
+			switch c {
+			case '<', '>', '!', '(', ')', '[', ']', ',':
+				p.tokens = append(p.tokens, token{kind: tokenOperator, text: string(c)})
+				i++
+			default:
+				return fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return nil
+}
+
+// accept consumes the next token if it is one of the operators
+func (p *parser) accept(operators ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range operators {
+		if p.tokens[p.pos].text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(operator string) error {
+	if _, ok := p.accept(operator); ok {
+		return nil
+	}
+	if p.pos >= len(p.tokens) {
+		return fmt.Errorf("expected %s at the end", operator)
+	}
+	return fmt.Errorf("expected %s, got %s", operator, p.tokens[p.pos].text)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{and: false, left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logical{and: true, left: left, right: right}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	if _, ok := p.accept("!"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &not{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "in", "contains", "startsWith", "endsWith", "matches")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &comparison{op: op, left: left, right: right}
+	if op == "matches" {
+		pattern, _ := right.(*literal)
+		if pattern == nil {
+			return nil, fmt.Errorf("matches requires a regular expression string")
+		}
+		s, ok := pattern.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches requires a regular expression string")
+		}
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokenString, tokenNumber:
+		return &literal{value: t.value}, nil
+	case tokenIdentifier:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "nil":
+			return &literal{value: nil}, nil
+		}
+		return &identifier{name: t.text}, nil
+	}
+
+	switch t.text {
+	case "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case "[":
+		l := &list{}
+		if _, ok := p.accept("]"); ok {
+			return l, nil
+		}
+		for {
+			item, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			l.items = append(l.items, item)
+			if _, ok := p.accept("]"); ok {
+				return l, nil
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s", t.text)
+}
@@ -0,0 +1,220 @@
+package events_test
+
+import (
+	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filter", func() {
+	var event *fevents.Event
+
+	BeforeEach(func() {
+		event = &fevents.Event{
+			Fields: map[string]interface{}{
+				"event_type":  "HttpStartStop",
+				"cf_org_name": "dev",
+				"status_code": int32(503),
+				"duration":    uint64(1500),
+			},
+			Msg: "GET /health failed",
+		}
+	})
+
+	keep := func(expression string) bool {
+		filter, err := fevents.CompileFilter(expression)
+		Expect(err).ToNot(HaveOccurred())
+		keep, err := filter.Keep(event)
+		Expect(err).ToNot(HaveOccurred())
+		return keep
+	}
+
+	It("compares fields with literals", func() {
+		Expect(keep(`event_type == "HttpStartStop"`)).To(BeTrue())
+		Expect(keep(`event_type != 'HttpStartStop'`)).To(BeFalse())
+		Expect(keep(`status_code >= 500 && status_code < 600`)).To(BeTrue())
+		Expect(keep(`duration > 1500.5`)).To(BeFalse())
+		Expect(keep(`cf_org_name in ["prod", "dev"]`)).To(BeTrue())
+		Expect(keep(`cf_org_name <= "abc"`)).To(BeFalse())
+	})
+
+	It("matches strings", func() {
+		Expect(keep(`msg contains "/health"`)).To(BeTrue())
+		Expect(keep(`msg startsWith "GET"`)).To(BeTrue())
+		Expect(keep(`msg endsWith "GET"`)).To(BeFalse())
+		Expect(keep(`msg matches "^(GET|POST) /health"`)).To(BeTrue())
+	})
+
+	It("combines conditions", func() {
+		Expect(keep(`!(event_type == "LogMessage") and (cf_org_name == "prod" or status_code == 503)`)).To(BeTrue())
+		Expect(keep(`not true || false`)).To(BeFalse())
+		Expect(keep(`event_type == "LogMessage" && missing > 1`)).To(BeFalse())
+	})
+
+	It("treats missing fields as nil", func() {
+		Expect(keep(`cf_app_name == nil`)).To(BeTrue())
+		Expect(keep(`cf_app_name != "app"`)).To(BeTrue())
+		Expect(keep(`cf_app_name contains "app" || cf_app_name < 1`)).To(BeFalse())
+	})
+
+	It("binds ! tighter than && and && tighter than ||", func() {
+		Expect(keep(`true || false && false`)).To(BeTrue())
+		Expect(keep(`(true || false) && false`)).To(BeFalse())
+		Expect(keep(`false && false || true`)).To(BeTrue())
+		Expect(keep(`false && (false || true)`)).To(BeFalse())
+		Expect(keep(`!false && false`)).To(BeFalse())
+		Expect(keep(`!(false && false)`)).To(BeTrue())
+		Expect(keep(`not not true`)).To(BeTrue())
+		Expect(keep(`false or false or true and true`)).To(BeTrue())
+		Expect(keep(`false or true and false`)).To(BeFalse())
+	})
+
+	It("binds comparisons tighter than !", func() {
+		Expect(keep(`!status_code == 503`)).To(BeFalse())
+		Expect(keep(`not cf_org_name in ["dev"]`)).To(BeFalse())
+		Expect(keep(`!msg contains "POST"`)).To(BeTrue())
+		Expect(keep(`status_code == 503 && cf_org_name == "dev"`)).To(BeTrue())
+		Expect(keep(`status_code == 404 || cf_org_name == "dev" && duration == 1500`)).To(BeTrue())
+	})
+
+	It("short-circuits && and ||", func() {
+		Expect(keep(`true || cf_org_name > 1`)).To(BeTrue())
+		Expect(keep(`false && cf_org_name > 1`)).To(BeFalse())
+		Expect(keep(`false and status_code contains "5"`)).To(BeFalse())
+	})
+
+	It("unescapes string literals", func() {
+		event.Fields["msg"] = "say \"hi\" it's a\ttab \\ é"
+		Expect(keep(`msg == "say \"hi\" it's a\ttab \\ \u00e9"`)).To(BeTrue())
+		Expect(keep(`msg == 'say "hi" it\'s a\ttab \\ é'`)).To(BeTrue())
+		Expect(keep(`msg contains "\"hi\""`)).To(BeTrue())
+		Expect(keep(`msg contains '\'s'`)).To(BeTrue())
+		Expect(keep(`msg endsWith '\\ é'`)).To(BeTrue())
+		Expect(keep(`"" == ''`)).To(BeTrue())
+		Expect(keep(`"a b" == 'a b'`)).To(BeTrue())
+	})
+
+	It("compares numbers of any type as floats", func() {
+		for name, value := range map[string]interface{}{
+			"int":     int(503),
+			"int32":   int32(503),
+			"int64":   int64(503),
+			"uint32":  uint32(503),
+			"uint64":  uint64(503),
+			"float32": float32(503),
+			"float64": float64(503),
+		} {
+			event.Fields["status_code"] = value
+			Expect(keep(`status_code == 503`)).To(BeTrue(), name)
+			Expect(keep(`status_code == 503.0`)).To(BeTrue(), name)
+			Expect(keep(`status_code > 502.9 && status_code <= 503`)).To(BeTrue(), name)
+			Expect(keep(`status_code in [500, 502, 503]`)).To(BeTrue(), name)
+			Expect(keep(`status_code in [500, 502]`)).To(BeFalse(), name)
+		}
+	})
+
+	It("looks up values in lists", func() {
+		Expect(keep(`status_code in [503]`)).To(BeTrue())
+		Expect(keep(`status_code in [1.5, "503", 503]`)).To(BeTrue())
+		Expect(keep(`status_code in ["503"]`)).To(BeFalse())
+		Expect(keep(`cf_org_name in []`)).To(BeFalse())
+		Expect(keep(`cf_app_name in [nil]`)).To(BeTrue())
+		Expect(keep(`"dev" in [event_type, cf_org_name]`)).To(BeTrue())
+		Expect(keep(`true in [false, true]`)).To(BeTrue())
+		Expect(keep(`status_code in [(503), (cf_org_name == "dev")]`)).To(BeTrue())
+		Expect(keep(`cf_org_name in [["dev"]]`)).To(BeFalse())
+	})
+
+	It("compares values of different types as not equal", func() {
+		Expect(keep(`status_code == "503"`)).To(BeFalse())
+		Expect(keep(`status_code != "503"`)).To(BeTrue())
+		Expect(keep(`cf_org_name == true`)).To(BeFalse())
+		Expect(keep(`nil == nil`)).To(BeTrue())
+		Expect(keep(`"b" > "a" && "a" >= "a" && "B" < "a"`)).To(BeTrue())
+	})
+
+	It("reads the message from the event when it isn't a field", func() {
+		event.Msg = "raw message"
+		Expect(keep(`msg == "raw message"`)).To(BeTrue())
+
+		event.Fields["msg"] = []byte("field message")
+		Expect(keep(`msg == "field message"`)).To(BeTrue())
+
+		delete(event.Fields, "msg")
+		event.Msg = ""
+		Expect(keep(`msg == nil`)).To(BeTrue())
+	})
+
+	It("tokenizes word operators only as whole words", func() {
+		event.Fields["order"] = "first"
+		event.Fields["index_name"] = "main"
+		event.Fields["notes"] = "none"
+		Expect(keep(`order == "first" and index_name == "main" and notes == "none"`)).To(BeTrue())
+		Expect(keep(`(cf_org_name=="dev")&&(status_code>=503)`)).To(BeTrue())
+	})
+
+	It("keeps the expression", func() {
+		filter, err := fevents.CompileFilter(` status_code > 1 `)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filter.String()).To(Equal(` status_code > 1 `))
+	})
+
+	It("rejects invalid expressions", func() {
+		for _, expression := range []string{
+			``,
+			`event_type ==`,
+			`(status_code > 1`,
+			`status_code > 1 status_code`,
+			`msg matches "("`,
+			`msg matches cf_org_name`,
+			`msg == "unterminated`,
+			`status_code # 1`,
+			`cf_org_name in ["dev",]`,
+			`cf_org_name in ["dev" "test"]`,
+			`cf_org_name in ["dev"`,
+			`1 < 2 < 3`,
+			`status_code == 5.0.3`,
+			`status_code > -1`,
+			`msg == "\q"`,
+			`msg == 'unterminated\'`,
+			`msg matches 1`,
+			`msg == "a" AND true`,
+			`!`,
+			`true &&`,
+			`|| true`,
+			`()`,
+			`)`,
+			`status_code = 503`,
+			`status_code & 1`,
+		} {
+			_, err := fevents.CompileFilter(expression)
+			Expect(err).To(HaveOccurred(), expression)
+			Expect(err.Error()).To(ContainSubstring("invalid filter expression [" + expression + "]"))
+		}
+	})
+
+	It("returns evaluation errors", func() {
+		for _, expression := range []string{
+			`cf_org_name > 1`,
+			`cf_org_name && true`,
+			`status_code contains "5"`,
+			`cf_org_name in "dev"`,
+			`cf_org_name`,
+			`status_code`,
+			`nil`,
+			`[true]`,
+			`!cf_org_name`,
+			`false || cf_org_name`,
+			`cf_org_name < true`,
+			`msg matches "x" || cf_org_name > 1`,
+			`status_code matches "5"`,
+			`cf_org_name endsWith 1`,
+			`cf_org_name in [(status_code > "1")]`,
+		} {
+			filter, err := fevents.CompileFilter(expression)
+			Expect(err).ToNot(HaveOccurred(), expression)
+			_, err = filter.Keep(event)
+			Expect(err).To(HaveOccurred(), expression)
+		}
+	})
+})
@@ -0,0 +1,140 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// EventMapping is the destination of the events of an event type. Empty values keep
+// the index and sourcetype the events are sent with otherwise
+type EventMapping struct {
+	Index      string `json:"index"`
+	Sourcetype string `json:"sourcetype"`
+}
+
+// ReadEventMappings reads the event mapping file at path, see ParseEventMappings. It
+// returns nil mappings when path is empty
+func ReadEventMappings(path string) (map[string]EventMapping, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading event mapping file: %s", err)
+	}
+	mappings, err := ParseEventMappings(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event mapping file %s: %s", path, err)
+	}
+	return mappings, nil
+}
+
+// ParseEventMappings parses a JSON object mapping the event types to send to their
+// index and sourcetype, for example
+// {"LogMessage": {"index": "cf_logs", "sourcetype": "cf:app"}, "ContainerMetric": {}}
+func ParseEventMappings(data []byte) (map[string]EventMapping, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of event type to mapping, for example {\"LogMessage\": {\"index\": \"cf_logs\"}}: %s", err)
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("no event type is mapped")
+	}
+
+	eventTypes := make([]string, 0, len(raw))
+	for eventType := range raw {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+
+	mappings := make(map[string]EventMapping, len(raw))
+	for _, eventType := range eventTypes {
+		if !IsAuthorizedEvent(eventType) {
+			return nil, fmt.Errorf("entry [%s]: invalid event type - valid events: %s", eventType, AuthorizedEvents())
+		}
+
+		var mapping EventMapping
+		decoder := json.NewDecoder(bytes.NewReader(raw[eventType]))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&mapping); err != nil {
+			return nil, fmt.Errorf("entry [%s]: must be an object with optional index and sourcetype: %s", eventType, err)
+		}
+		if strings.ContainsAny(mapping.Index, " \t\r\n") {
+			return nil, fmt.Errorf("entry [%s]: invalid index name %q", eventType, mapping.Index)
+		}
+		if strings.TrimSpace(mapping.Sourcetype) != mapping.Sourcetype {
+			return nil, fmt.Errorf("entry [%s]: invalid sourcetype %q", eventType, mapping.Sourcetype)
+		}
+		mappings[eventType] = mapping
+	}
+	return mappings, nil
+}
+
+// IndexMappingByAppNameRegex maps the events of the apps whose name matches a regular
+// expression
+const IndexMappingByAppNameRegex = "app_name_regex"
+
+// IndexMapping is a rule choosing the index of events by the value of their By
+// attribute
+type IndexMapping struct {
+	By    string `json:"by"`
+	Match string `json:"match"`
+	Index string `json:"index"`
+
+	regexp *regexp.Regexp
+}
+
+// Matches returns whether the app name matches the mapping
+func (m *IndexMapping) Matches(appName string) bool {
+	return m.regexp.MatchString(appName)
+}
+
+// ParseIndexMappings parses a JSON array of index mappings, applied in order, for
+// example [{"by": "app_name_regex", "match": "^prod-", "index": "prod_logs"}]
+func ParseIndexMappings(indexMappingsString string) ([]IndexMapping, error) {
+	indexMappingsString = strings.TrimSpace(indexMappingsString)
+	if indexMappingsString == "" {
+		return nil, nil
+	}
+
+	var mappings []IndexMapping
+	decoder := json.NewDecoder(strings.NewReader(indexMappingsString))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&mappings); err != nil {
+		return nil, fmt.Errorf("index mappings must be a JSON array of by, match and index objects, for example [{\"by\": \"app_name_regex\", \"match\": \"^prod-\", \"index\": \"prod_logs\"}]: %s", err)
+	}
+
+	for i := range mappings {
+		mapping := &mappings[i]
+		if mapping.By != IndexMappingByAppNameRegex {
+			return nil, fmt.Errorf("index mapping %d: invalid by %q, must be %s", i+1, mapping.By, IndexMappingByAppNameRegex)
+		}
+		re, err := regexp.Compile(mapping.Match)
+		if err != nil {
+			return nil, fmt.Errorf("index mapping %d: invalid match: %s", i+1, err)
+		}
+		mapping.regexp = re
+		if mapping.Index == "" || strings.ContainsAny(mapping.Index, " \t\r\n") {
+			return nil, fmt.Errorf("index mapping %d: invalid index name %q", i+1, mapping.Index)
+		}
+	}
+	return mappings, nil
+}
+
+// MappedEventTypes returns the event types of the mappings in the format of
+// ParseSelectedEvents
+func MappedEventTypes(mappings map[string]EventMapping) string {
+	eventTypes := make([]string, 0, len(mappings))
+	for eventType := range mappings {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	return strings.Join(eventTypes, ",")
+}
@@ -0,0 +1,98 @@
+package events_test
+
+import (
+	"os"
+	"path/filepath"
+
+	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event mappings", func() {
+	It("parses the index and sourcetype per event type", func() {
+		mappings, err := fevents.ParseEventMappings([]byte(`{
+			"LogMessage": {"index": "cf_logs", "sourcetype": "cf:app"},
+			"ContainerMetric": {"index": "cf_metrics"},
+			"Error": {}
+		}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(mappings).To(Equal(map[string]fevents.EventMapping{
+			"LogMessage":      {Index: "cf_logs", Sourcetype: "cf:app"},
+			"ContainerMetric": {Index: "cf_metrics"},
+			"Error":           {},
+		}))
+		Expect(fevents.MappedEventTypes(mappings)).To(Equal("ContainerMetric,Error,LogMessage"))
+	})
+
+	It("points at the offending entry", func() {
+		for data, message := range map[string]string{
+			`{"LogMessage": {}, "Logs": {}}`:             "entry [Logs]: invalid event type",
+			`{"LogMessage": {"idx": "cf_logs"}}`:         "entry [LogMessage]: must be an object",
+			`{"LogMessage": "cf_logs"}`:                  "entry [LogMessage]: must be an object",
+			`{"LogMessage": {"index": "cf logs"}}`:       "entry [LogMessage]: invalid index name",
+			`{"LogMessage": {"sourcetype": " cf:app "}}`: "entry [LogMessage]: invalid sourcetype",
+			`{}`:                 "no event type is mapped",
+			`LogMessage=cf_logs`: "must be a JSON object",
+		} {
+			_, err := fevents.ParseEventMappings([]byte(data))
+			Ω(err).Should(MatchError(ContainSubstring(message)), data)
+		}
+	})
+
+	It("reads the mapping file", func() {
+		mappings, err := fevents.ReadEventMappings("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(mappings).To(BeNil())
+
+		dir, err := os.MkdirTemp("", "mapping")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "mapping.json")
+		Ω(os.WriteFile(path, []byte(`{"Error": {"index": "cf_errors"}}`), 0600)).Should(Succeed())
+		mappings, err = fevents.ReadEventMappings(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(mappings).To(HaveKeyWithValue("Error", fevents.EventMapping{Index: "cf_errors"}))
+
+		Ω(os.WriteFile(path, []byte(`{"Errors": {}}`), 0600)).Should(Succeed())
+		_, err = fevents.ReadEventMappings(path)
+		Ω(err).Should(MatchError(ContainSubstring(path)))
+
+		_, err = fevents.ReadEventMappings(filepath.Join(dir, "missing.json"))
+		Ω(err).Should(HaveOccurred())
+	})
+})
+
+var _ = Describe("Index mappings", func() {
+	It("parses the mappings in order", func() {
+		mappings, err := fevents.ParseIndexMappings(`[
+			{"by": "app_name_regex", "match": "^prod-", "index": "prod_logs"},
+			{"by": "app_name_regex", "match": "^dev-", "index": "dev_logs"}
+		]`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(mappings).To(HaveLen(2))
+		Expect(mappings[0].Index).To(Equal("prod_logs"))
+		Expect(mappings[0].Matches("prod-payments")).To(BeTrue())
+		Expect(mappings[0].Matches("dev-payments")).To(BeFalse())
+		Expect(mappings[1].Matches("dev-payments")).To(BeTrue())
+
+		mappings, err = fevents.ParseIndexMappings(" ")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(mappings).To(BeNil())
+	})
+
+	It("points at the offending mapping", func() {
+		for data, message := range map[string]string{
+			`[{"by": "app_guid", "match": "^prod-", "index": "prod"}]`:      "index mapping 1: invalid by",
+			`[{"by": "app_name_regex", "match": "(", "index": "prod"}]`:     "index mapping 1: invalid match",
+			`[{"by": "app_name_regex", "match": "^prod-", "index": "p d"}]`: "index mapping 1: invalid index name",
+			`[{"by": "app_name_regex", "match": "^prod-"}]`:                 "index mapping 1: invalid index name",
+			`[{"by": "app_name_regex", "match": "^prod-", "idx": "prod"}]`:  "must be a JSON array",
+			`{"by": "app_name_regex", "match": "^prod-", "index": "prod"}`:  "must be a JSON array",
+		} {
+			_, err := fevents.ParseIndexMappings(data)
+			Ω(err).Should(MatchError(ContainSubstring(message)), data)
+		}
+	})
+})
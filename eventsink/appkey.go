@@ -0,0 +1,37 @@
+package eventsink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Modes of the app_key field, a salted hash of the app GUID to group the events of an
+// app without indexing its GUID
+const (
+	AppKeyOff     = "off"
+	AppKeyAdd     = "add"     // add app_key alongside cf_app_id
+	AppKeyReplace = "replace" // add app_key and remove cf_app_id
+)
+
+// addAppKey adds the app_key of the app of the event, and removes its GUID with the
+// AppKeyReplace mode
+func (s *Splunk) addAppKey(fields map[string]interface{}) {
+	appId, _ := fields["cf_app_id"].(string)
+	if appId == "" {
+		return
+	}
+
+	fields["app_key"] = appKey(s.config.AppKeySalt, appId)
+	if s.config.AppKeyMode == AppKeyReplace {
+		delete(fields, "cf_app_id")
+	}
+}
+
+// appKey returns the first 128 bits of the HMAC-SHA256 of the app GUID keyed with
+// the salt, hex encoded, which is stable for a salt and can't be reversed without it
+func appKey(salt, appId string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(appId))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,113 @@
+package eventsink
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+// workerScaler holds the writers of the parked consumers and the HEC write latency
+// the number of running consumers is adjusted on
+type workerScaler struct {
+	idle chan eventwriter.Writer // writers of the parked consumers
+	park chan struct{}           // parks the next consumer waiting for events
+
+	lock     sync.Mutex
+	writes   int
+	duration time.Duration // of the writes since the last adjustment
+}
+
+func newWorkerScaler(writers []eventwriter.Writer) *workerScaler {
+	w := &workerScaler{
+		idle: make(chan eventwriter.Writer, len(writers)),
+		park: make(chan struct{}, 1),
+	}
+	for _, writer := range writers {
+		w.idle <- writer
+	}
+	return w
+}
+
+// observe records the duration of a HEC write
+func (w *workerScaler) observe(duration time.Duration) {
+	w.lock.Lock()
+	w.writes++
+	w.duration += duration
+	w.lock.Unlock()
+}
+
+// latency returns the average duration of the HEC writes since the last call
+func (w *workerScaler) latency() time.Duration {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.writes == 0 {
+		return 0
+	}
+	latency := w.duration / time.Duration(w.writes)
+	w.writes, w.duration = 0, 0
+	return latency
+}
+
+// autoscale adjusts the number of consumers at every ScaleInterval until the sink closes
+func (s *Splunk) autoscale() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.ScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.scale(s.queueLength(), s.scaler.latency())
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// scale starts a consumer, up to MaxWorkers, when the queues are at least half full
+// or hold events while HEC writes are slower than ScaleLatency. It parks one, down
+// to MinWorkers, when the queues are empty
+func (s *Splunk) scale(queued int, latency time.Duration) {
+	workers := int(atomic.LoadInt32(&s.activeWorkers))
+	slow := s.config.ScaleLatency > 0 && latency > s.config.ScaleLatency
+
+	switch {
+	case workers < s.config.MaxWorkers && (queued*2 >= s.queueCapacity() || (queued > 0 && slow)):
+		// Cancel a pending park, the consumers are busy again
+		select {
+		case <-s.scaler.park:
+		default:
+		}
+		s.startWorker()
+		s.config.Logger.Info("Started HEC worker", lager.Data{
+			"workers":    workers + 1,
+			"queued":     queued,
+			"latency_ms": latency.Milliseconds(),
+		})
+
+	case workers > s.config.MinWorkers && queued == 0:
+		select {
+		case s.scaler.park <- struct{}{}:
+			s.config.Logger.Info("Parking idle HEC worker", lager.Data{"workers": workers - 1})
+		default:
+		}
+	}
+}
+
+// startWorker starts a consumer with the writer of a parked consumer. The writer
+// is handed back once the consumer is parked
+func (s *Splunk) startWorker() {
+	writer := <-s.scaler.idle
+	atomic.AddInt32(&s.activeWorkers, 1)
+	s.wg.Add(1)
+	go func() {
+		s.consume(writer)
+		atomic.AddInt32(&s.activeWorkers, -1)
+		s.scaler.idle <- writer
+	}()
+}
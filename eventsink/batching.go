@@ -0,0 +1,208 @@
+package eventsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+// IndexBatchConfig overrides the flush interval, batch size and retries of the events
+// sent to an index. Zero values use the sink's FlushInterval, BatchSize and Retries.
+// With DeadLetter, the batches dropped after the last retry are written to the sink's
+// DeadLetter writer
+type IndexBatchConfig struct {
+	FlushInterval time.Duration
+	BatchSize     int
+	Retries       int
+	DeadLetter    bool
+}
+
+// ParseIndexBatchConfigs parses a JSON object mapping index names to their batching,
+// for example {"alerts": {"flush_interval": "1s", "batch_size": 10, "retries": 20, "dead_letter": true}}
+func ParseIndexBatchConfigs(indexBatchingString string) (map[string]IndexBatchConfig, error) {
+	indexBatchingString = strings.TrimSpace(indexBatchingString)
+	if indexBatchingString == "" {
+		return nil, nil
+	}
+
+	var raw map[string]struct {
+		FlushInterval string `json:"flush_interval"`
+		BatchSize     int    `json:"batch_size"`
+		Retries       int    `json:"retries"`
+		DeadLetter    bool   `json:"dead_letter"`
+	}
+	if err := json.Unmarshal([]byte(indexBatchingString), &raw); err != nil {
+		return nil, fmt.Errorf("invalid index batching %q: %v", indexBatchingString, err)
+	}
+
+	configs := make(map[string]IndexBatchConfig, len(raw))
+	for index, config := range raw {
+		if config.BatchSize < 0 {
+			return nil, fmt.Errorf("invalid batch size %d for index %q", config.BatchSize, index)
+		}
+		if config.Retries < 0 {
+			return nil, fmt.Errorf("invalid retries %d for index %q", config.Retries, index)
+		}
+
+		var flushInterval time.Duration
+		if config.FlushInterval != "" {
+			var err error
+			flushInterval, err = time.ParseDuration(config.FlushInterval)
+			if err != nil || flushInterval <= 0 {
+				return nil, fmt.Errorf("invalid flush interval %q for index %q", config.FlushInterval, index)
+			}
+		}
+		configs[index] = IndexBatchConfig{
+			FlushInterval: flushInterval,
+			BatchSize:     config.BatchSize,
+			Retries:       config.Retries,
+			DeadLetter:    config.DeadLetter,
+		}
+	}
+	return configs, nil
+}
+
+// lane is a batch of events flushed at its own interval and size, and retried its own
+// number of times. Indexes without an IndexBatchConfig share the default lane, so a
+// HEC request holds the events of several indexes, set per event, unless SplitByIndex
+// gives them a lane per index. The events of the orgs of OrgWriters have a lane per
+// org, sent with the writer of the org
+type lane struct {
+	batch         []map[string]interface{}
+	latest        map[string]int
+	flushInterval time.Duration
+	batchSize     int
+	retries       int
+	deadLetter    bool // write the batches dropped after the last retry to the DeadLetter writer
+	flushAt       time.Time
+	writer        eventwriter.Writer // nil for the writer of the consumer
+}
+
+// writerOr returns the writer of the lane, or the writer of the consumer
+func (l *lane) writerOr(writer eventwriter.Writer) eventwriter.Writer {
+	if l.writer != nil {
+		return l.writer
+	}
+	return writer
+}
+
+// indexLane indexes the batch of the lane with its retries and dead letter policy
+func (s *Splunk) indexLane(l *lane, writer eventwriter.Writer) []map[string]interface{} {
+	return s.indexEvents(l.writerOr(writer), l.batch, l.retries, l.deadLetter)
+}
+
+func (l *lane) reset(now time.Time) {
+	l.latest = make(map[string]int)
+	l.flushAt = now.Add(l.flushInterval)
+}
+
+// orgIndex is an org of OrgWriters and an index of IndexBatching
+type orgIndex struct {
+	org   string
+	index string
+}
+
+// lanes holds the batching lanes of a consumer, keyed by org or destination index.
+// The events of an org sent to an index of IndexBatching have a lane per org and
+// index, with the policy of the index and the writer of the org
+type lanes struct {
+	defaultLane  *lane
+	byIndex      map[string]*lane
+	byOrg        map[string]*lane
+	byOrgIndex   map[orgIndex]*lane
+	splitByIndex bool // add a lane like the default lane per index instead of sharing it
+}
+
+func (s *Splunk) newLanes(now time.Time) *lanes {
+	l := &lanes{
+		defaultLane: &lane{flushInterval: s.config.FlushInterval, batchSize: s.config.BatchSize, retries: s.config.Retries},
+		byIndex:     make(map[string]*lane),
+		byOrg:       make(map[string]*lane, len(s.config.OrgWriters)),
+		byOrgIndex:  make(map[orgIndex]*lane, len(s.config.OrgWriters)*len(s.config.IndexBatching)),
+
+		splitByIndex: s.config.SplitByIndex,
+	}
+	l.defaultLane.reset(now)
+
+	for org, writer := range s.config.OrgWriters {
+		orgLane := &lane{flushInterval: s.config.FlushInterval, batchSize: s.config.BatchSize, retries: s.config.Retries, writer: writer}
+		orgLane.reset(now)
+		l.byOrg[org] = orgLane
+	}
+
+	for index, config := range s.config.IndexBatching {
+		indexLane := &lane{flushInterval: config.FlushInterval, batchSize: config.BatchSize, retries: config.Retries, deadLetter: config.DeadLetter}
+		if indexLane.flushInterval <= 0 {
+			indexLane.flushInterval = s.config.FlushInterval
+		}
+		if indexLane.batchSize <= 0 {
+			indexLane.batchSize = s.config.BatchSize
+		}
+		if indexLane.retries <= 0 {
+			indexLane.retries = s.config.Retries
+		}
+		indexLane.reset(now)
+		l.byIndex[index] = indexLane
+
+		for org, writer := range s.config.OrgWriters {
+			orgIndexLane := *indexLane
+			orgIndexLane.writer = writer
+			orgIndexLane.reset(now)
+			l.byOrgIndex[orgIndex{org: org, index: index}] = &orgIndexLane
+		}
+	}
+	return l
+}
+
+// forEvent returns the lane of the org of the event, or else of its destination index
+func (l *lanes) forEvent(org, index string) *lane {
+	if orgIndexLane, ok := l.byOrgIndex[orgIndex{org: org, index: index}]; ok {
+		return orgIndexLane
+	}
+	if orgLane, ok := l.byOrg[org]; ok {
+		return orgLane
+	}
+	if indexLane, ok := l.byIndex[index]; ok {
+		return indexLane
+	}
+	if l.splitByIndex {
+		// Flushed after the next flush of the default lane, which the timer of
+		// the consumer fires at the latest, so the timer doesn't need a reset
+		indexLane := &lane{flushInterval: l.defaultLane.flushInterval, batchSize: l.defaultLane.batchSize, retries: l.defaultLane.retries}
+		indexLane.reset(time.Now())
+		l.byIndex[index] = indexLane
+		return indexLane
+	}
+	return l.defaultLane
+}
+
+func (l *lanes) all() []*lane {
+	all := []*lane{l.defaultLane}
+	for _, indexLane := range l.byIndex {
+		all = append(all, indexLane)
+	}
+	for _, orgLane := range l.byOrg {
+		all = append(all, orgLane)
+	}
+	for _, orgIndexLane := range l.byOrgIndex {
+		all = append(all, orgIndexLane)
+	}
+	return all
+}
+
+// nextFlush returns the time until the earliest flush of the lanes
+func (l *lanes) nextFlush(now time.Time) time.Duration {
+	next := l.defaultLane.flushAt
+	for _, other := range l.all()[1:] {
+		if other.flushAt.Before(next) {
+			next = other.flushAt
+		}
+	}
+	if d := next.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
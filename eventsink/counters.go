@@ -0,0 +1,89 @@
+package eventsink
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Counters not seen for this long are forgotten by the counterResetDetector
+const trackedCounterTTL = 10 * time.Minute
+
+// How often forgotten counters are pruned when maxCounters are tracked
+const fullPruneInterval = time.Minute
+
+// counterResetDetector detects CounterEvent totals which decreased, which happens when
+// the emitting component restarts. Counters are tracked per emitting instance, since
+// every instance of a job has its own totals for the same origin and name
+type counterResetDetector struct {
+	maxCounters int
+
+	lock      sync.Mutex
+	counters  map[string]*trackedCounter
+	lastPrune time.Time
+}
+
+type trackedCounter struct {
+	total     uint64
+	timestamp int64 // of the envelope of total
+	lastSeen  time.Time
+}
+
+func newCounterResetDetector(maxCounters int) *counterResetDetector {
+	return &counterResetDetector{
+		maxCounters: maxCounters,
+		counters:    make(map[string]*trackedCounter),
+		lastPrune:   time.Now(),
+	}
+}
+
+// reset returns true when the total of the counter is lower than the total of the
+// previous event of the counter. Events older than the previous event, which the
+// workers may parse out of order, are ignored. New counters aren't tracked once
+// maxCounters are tracked
+func (d *counterResetDetector) reset(msg *events.Envelope, now time.Time) bool {
+	counter := msg.GetCounterEvent()
+	key := fmt.Sprintf("%s/%s/%s/%s/%s", msg.GetDeployment(), msg.GetJob(), msg.GetIndex(), msg.GetOrigin(), counter.GetName())
+	total := counter.GetTotal()
+	timestamp := msg.GetTimestamp()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.prune(now, trackedCounterTTL)
+
+	tracked, ok := d.counters[key]
+	if !ok {
+		if len(d.counters) >= d.maxCounters {
+			d.prune(now, fullPruneInterval)
+			if len(d.counters) >= d.maxCounters {
+				return false
+			}
+		}
+		d.counters[key] = &trackedCounter{total: total, timestamp: timestamp, lastSeen: now}
+		return false
+	}
+
+	if timestamp < tracked.timestamp {
+		return false
+	}
+
+	reset := total < tracked.total
+	tracked.total, tracked.timestamp, tracked.lastSeen = total, timestamp, now
+	return reset
+}
+
+// prune forgets the counters of stopped components, at most once per interval
+func (d *counterResetDetector) prune(now time.Time, interval time.Duration) {
+	if now.Sub(d.lastPrune) < interval {
+		return
+	}
+	for key, tracked := range d.counters {
+		if now.Sub(tracked.lastSeen) >= trackedCounterTTL {
+			delete(d.counters, key)
+		}
+	}
+	d.lastPrune = now
+}
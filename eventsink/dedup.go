@@ -0,0 +1,122 @@
+package eventsink
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type DedupConfig struct {
+	Window     time.Duration // how long the identity of an envelope is remembered
+	MaxEntries int           // the least recently seen identities are forgotten beyond this many
+	Metrics    *monitoring.Metrics
+}
+
+// Dedup drops the envelopes identical to an envelope written to it within the Window,
+// such as the ones the firehose redelivers after a reconnect, and writes the others
+// to its sink. Envelopes are identified by their timestamp, origin, index and a hash
+// of their content
+type Dedup struct {
+	sink   Sink
+	config *DedupConfig
+
+	lock  sync.Mutex
+	seen  map[envelopeID]*list.Element
+	order *list.List // of *seenEnvelope, least recently seen first
+
+	duplicateCounter *monitoring.Counter
+	drops            *monitoring.DropCounter
+}
+
+type envelopeID struct {
+	timestamp int64
+	origin    string
+	index     string
+	hash      uint64
+}
+
+type seenEnvelope struct {
+	id   envelopeID
+	seen time.Time
+}
+
+func NewDedup(sink Sink, config *DedupConfig) *Dedup {
+	if config.Metrics == nil {
+		config.Metrics = monitoring.NewMetrics()
+	}
+
+	return &Dedup{
+		sink:             sink,
+		config:           config,
+		seen:             make(map[envelopeID]*list.Element),
+		order:            list.New(),
+		duplicateCounter: config.Metrics.NewCounter("dedup.duplicates.dropped"),
+		drops:            config.Metrics.NewDropCounter(monitoring.DropDuplicate),
+	}
+}
+
+// Open does nothing, the sink is opened by its creator
+func (d *Dedup) Open() error {
+	return nil
+}
+
+// Close closes the sink
+func (d *Dedup) Close() error {
+	return d.sink.Close()
+}
+
+func (d *Dedup) Write(msg *events.Envelope) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return d.sink.Write(msg)
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	id := envelopeID{
+		timestamp: msg.GetTimestamp(),
+		origin:    msg.GetOrigin(),
+		index:     msg.GetIndex(),
+		hash:      hash.Sum64(),
+	}
+
+	if d.duplicate(id, time.Now()) {
+		d.duplicateCounter.Add(1)
+		d.drops.Add(msg.GetEventType().String(), 1)
+		return nil
+	}
+	return d.sink.Write(msg)
+}
+
+// duplicate reports whether the envelope was seen within the window, and remembers
+// it as the most recently seen
+func (d *Dedup) duplicate(id envelopeID, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Forget the identities seen before the window
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		oldest := front.Value.(*seenEnvelope)
+		if now.Sub(oldest.seen) < d.config.Window {
+			break
+		}
+		d.order.Remove(front)
+		delete(d.seen, oldest.id)
+	}
+
+	if elem, ok := d.seen[id]; ok {
+		elem.Value.(*seenEnvelope).seen = now
+		d.order.MoveToBack(elem)
+		return true
+	}
+
+	d.seen[id] = d.order.PushBack(&seenEnvelope{id: id, seen: now})
+	if d.config.MaxEntries > 0 && d.order.Len() > d.config.MaxEntries {
+		oldest := d.order.Remove(d.order.Front()).(*seenEnvelope)
+		delete(d.seen, oldest.id)
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package eventsink_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/sonde-go/events"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+var _ = Describe("Dedup", func() {
+	var (
+		memSink *timestampSink
+		config  *eventsink.DedupConfig
+		sink    *eventsink.Dedup
+	)
+
+	envelope := func(timestamp int64, origin, msg string) *events.Envelope {
+		eventType := events.Envelope_LogMessage
+		messageType := events.LogMessage_OUT
+		return &events.Envelope{
+			Origin:    &origin,
+			EventType: &eventType,
+			Timestamp: &timestamp,
+			LogMessage: &events.LogMessage{
+				Message:     []byte(msg),
+				MessageType: &messageType,
+				Timestamp:   &timestamp,
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		memSink = &timestampSink{}
+		config = &eventsink.DedupConfig{
+			Window:     time.Hour,
+			MaxEntries: 100,
+			Metrics:    monitoring.NewMetrics(),
+		}
+	})
+
+	JustBeforeEach(func() {
+		sink = eventsink.NewDedup(memSink, config)
+	})
+
+	It("drops the duplicate events", func() {
+		Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+		Ω(sink.Write(envelope(2, "router", "hello"))).Should(Succeed())
+		Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+		Ω(sink.Write(envelope(2, "router", "hello"))).Should(Succeed())
+
+		Expect(memSink.Timestamps()).To(Equal([]int64{1, 2}))
+		Expect(config.Metrics.Snapshot()["dedup.duplicates.dropped"]).To(Equal(float64(2)))
+		Expect(config.Metrics.Snapshot()["splunk.drops.duplicate.LogMessage"]).To(Equal(float64(2)))
+	})
+
+	It("writes the events differing by origin or content", func() {
+		Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+		Ω(sink.Write(envelope(1, "rep", "hello"))).Should(Succeed())
+		Ω(sink.Write(envelope(1, "router", "world"))).Should(Succeed())
+
+		Expect(memSink.Timestamps()).To(Equal([]int64{1, 1, 1}))
+		Expect(config.Metrics.Snapshot()["dedup.duplicates.dropped"]).To(Equal(float64(0)))
+	})
+
+	Context("when the events were seen before the window", func() {
+		BeforeEach(func() {
+			config.Window = 10 * time.Millisecond
+		})
+
+		It("writes them again", func() {
+			Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+			time.Sleep(20 * time.Millisecond)
+			Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+
+			Expect(memSink.Timestamps()).To(Equal([]int64{1, 1}))
+		})
+	})
+
+	Context("when more than MaxEntries events are seen", func() {
+		BeforeEach(func() {
+			config.MaxEntries = 2
+		})
+
+		It("forgets the least recently seen", func() {
+			Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+			Ω(sink.Write(envelope(2, "router", "hello"))).Should(Succeed())
+			Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+			Ω(sink.Write(envelope(3, "router", "hello"))).Should(Succeed())
+			Ω(sink.Write(envelope(2, "router", "hello"))).Should(Succeed())
+			Ω(sink.Write(envelope(1, "router", "hello"))).Should(Succeed())
+
+			Expect(memSink.Timestamps()).To(Equal([]int64{1, 2, 3, 2, 1}))
+		})
+	})
+})
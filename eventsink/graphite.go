@@ -0,0 +1,144 @@
+package eventsink
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type GraphiteConfig struct {
+	FlushInterval time.Duration
+	QueueSize     int
+	BatchSize     int
+	Prefix        string // prepended to every metric name
+	Logger        lager.Logger
+}
+
+// Graphite sends ValueMetric and CounterEvent envelopes to a Graphite writer.
+// Other event types are ignored
+type Graphite struct {
+	writer eventwriter.Writer
+	config *GraphiteConfig
+	events chan *events.Envelope
+	wg     sync.WaitGroup
+}
+
+func NewGraphite(writer eventwriter.Writer, config *GraphiteConfig) *Graphite {
+	return &Graphite{
+		writer: writer,
+		config: config,
+		events: make(chan *events.Envelope, config.QueueSize),
+	}
+}
+
+func (g *Graphite) Open() error {
+	g.wg.Add(1)
+	go g.consume()
+	return nil
+}
+
+func (g *Graphite) Close() error {
+	close(g.events)
+	g.wg.Wait()
+
+	if closer, ok := g.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (g *Graphite) Write(msg *events.Envelope) error {
+	switch msg.GetEventType() {
+	case events.Envelope_ValueMetric, events.Envelope_CounterEvent:
+	default:
+		return nil
+	}
+
+	select {
+	case g.events <- msg:
+	default:
+		// Don't slow down the Splunk path because of a slow carbon endpoint
+	}
+	return nil
+}
+
+func (g *Graphite) consume() {
+	defer g.wg.Done()
+
+	var batch []map[string]interface{}
+	ticker := time.NewTicker(g.config.FlushInterval)
+	defer ticker.Stop()
+
+LOOP:
+	for {
+		select {
+		case msg, ok := <-g.events:
+			if !ok {
+				break LOOP
+			}
+
+			if metric := g.toMetric(msg); metric != nil {
+				batch = append(batch, metric)
+				if len(batch) >= g.config.BatchSize {
+					batch = g.flush(batch)
+				}
+			}
+		case <-ticker.C:
+			batch = g.flush(batch)
+		}
+	}
+	g.flush(batch)
+}
+
+func (g *Graphite) flush(batch []map[string]interface{}) []map[string]interface{} {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	if err, _ := g.writer.Write(batch); err != nil {
+		g.config.Logger.Error("Unable to send metrics to Graphite, dropping metrics", err, lager.Data{"metrics": len(batch)})
+	}
+	return nil
+}
+
+// toMetric converts the envelope to a metric named <prefix>.<origin>.<name>.
+// CounterEvent reports its total
+func (g *Graphite) toMetric(msg *events.Envelope) map[string]interface{} {
+	var name string
+	var value float64
+
+	switch msg.GetEventType() {
+	case events.Envelope_ValueMetric:
+		name = msg.GetValueMetric().GetName()
+		value = msg.GetValueMetric().GetValue()
+	case events.Envelope_CounterEvent:
+		name = msg.GetCounterEvent().GetName()
+		value = float64(msg.GetCounterEvent().GetTotal())
+	}
+
+	if name == "" || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+
+	parts := []string{msg.GetOrigin(), name}
+	if g.config.Prefix != "" {
+		parts = append([]string{g.config.Prefix}, parts...)
+	}
+
+	timestamp := msg.GetTimestamp()
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano()
+	}
+
+	return map[string]interface{}{
+		"name":  utils.ConcatFormat(parts),
+		"value": value,
+		"time":  timestamp / int64(time.Second),
+	}
+}
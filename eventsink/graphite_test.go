@@ -0,0 +1,99 @@
+package eventsink_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
+)
+
+var _ = Describe("Graphite", func() {
+	var (
+		timestamp  int64
+		origin     string
+		sink       *eventsink.Graphite
+		mockClient *testing.EventWriterMock
+	)
+
+	BeforeEach(func() {
+		timestamp = 1467040874046121775
+		origin = "gorouter"
+		mockClient = &testing.EventWriterMock{}
+		sink = eventsink.NewGraphite(mockClient, &eventsink.GraphiteConfig{
+			FlushInterval: time.Millisecond,
+			QueueSize:     100,
+			BatchSize:     10,
+			Prefix:        "cf",
+			Logger:        lager.NewLogger("test"),
+		})
+		sink.Open()
+	})
+
+	It("sends ValueMetric", func() {
+		eventType := events.Envelope_ValueMetric
+		name := "latency.uaa"
+		value := 12.5
+		sink.Write(&events.Envelope{
+			Origin:      &origin,
+			EventType:   &eventType,
+			Timestamp:   &timestamp,
+			ValueMetric: &events.ValueMetric{Name: &name, Value: &value},
+		})
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(Equal([]map[string]interface{}{
+			{"name": "cf.gorouter.latency_uaa", "value": 12.5, "time": int64(1467040874)},
+		}))
+	})
+
+	It("sends the total of CounterEvent", func() {
+		eventType := events.Envelope_CounterEvent
+		name := "requests"
+		var delta, total uint64 = 1, 42
+		sink.Write(&events.Envelope{
+			Origin:       &origin,
+			EventType:    &eventType,
+			Timestamp:    &timestamp,
+			CounterEvent: &events.CounterEvent{Name: &name, Delta: &delta, Total: &total},
+		})
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(Equal([]map[string]interface{}{
+			{"name": "cf.gorouter.requests", "value": float64(42), "time": int64(1467040874)},
+		}))
+	})
+
+	It("ignores other events", func() {
+		eventType := events.Envelope_LogMessage
+		sink.Write(&events.Envelope{
+			Origin:     &origin,
+			EventType:  &eventType,
+			Timestamp:  &timestamp,
+			LogMessage: &events.LogMessage{},
+		})
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Multi", func() {
+	It("writes to every sink", func() {
+		first := testing.NewMemorySinkMock()
+		second := testing.NewMemorySinkMock()
+		multi := eventsink.NewMulti(first, second)
+
+		eventType := events.Envelope_LogMessage
+		err := multi.Write(&events.Envelope{EventType: &eventType, LogMessage: &events.LogMessage{}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first.Events).To(HaveLen(1))
+		Expect(second.Events).To(HaveLen(1))
+		Expect(multi.Close()).To(Succeed())
+	})
+})
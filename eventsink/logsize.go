@@ -0,0 +1,76 @@
+package eventsink
+
+import (
+	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Policies of the LogMessages over LogMaxChars or LogMaxLines
+const (
+	LogOverflowTruncate = "truncate" // send the first part of the message
+	LogOverflowDrop     = "drop"     // drop the event
+	LogOverflowSplit    = "split"    // send every part of the message as an event
+)
+
+// maxMessageParts bounds the events a LogMessage is split into, the rest of the
+// message is truncated
+const maxMessageParts = 100
+
+// parseEvents parses the envelope into the events sent in its place, which are
+// several when a LogMessage is split
+func (s *Splunk) parseEvents(msg *events.Envelope) []map[string]interface{} {
+	parsedEvent := s.parseEvent(msg)
+	if parsedEvent == nil {
+		return nil
+	}
+	if msg.GetEventType() == events.Envelope_LogMessage && (s.config.LogMaxChars > 0 || s.config.LogMaxLines > 0) {
+		return s.limitMessage(parsedEvent)
+	}
+	return []map[string]interface{}{parsedEvent}
+}
+
+// limitMessage applies the LogOverflow policy to a LogMessage whose message is over
+// LogMaxChars characters or LogMaxLines lines. Parts of a split message are marked
+// with msg_part and msg_parts, truncated messages with msg_truncated
+func (s *Splunk) limitMessage(parsedEvent map[string]interface{}) []map[string]interface{} {
+	msg, _ := parsedEvent["msg"].(string)
+	maxParts := 1
+	if s.config.LogOverflow == LogOverflowSplit {
+		maxParts = maxMessageParts
+	}
+
+	parts, truncated := fevents.SplitMessage(msg, s.config.LogMaxChars, s.config.LogMaxLines, maxParts)
+	if len(parts) <= 1 && !truncated {
+		return []map[string]interface{}{parsedEvent}
+	}
+	s.oversizedCounter.Add(1)
+
+	switch s.config.LogOverflow {
+	case LogOverflowDrop:
+		s.drops[monitoring.DropOversized].Add(events.Envelope_LogMessage.String(), 1)
+		return nil
+
+	case LogOverflowSplit:
+		split := make([]map[string]interface{}, len(parts))
+		for i, part := range parts {
+			fields := make(map[string]interface{}, len(parsedEvent)+3)
+			for k, v := range parsedEvent {
+				fields[k] = v
+			}
+			fields["msg"] = part
+			fields["msg_part"] = i + 1
+			fields["msg_parts"] = len(parts)
+			split[i] = fields
+		}
+		if truncated {
+			split[len(split)-1]["msg_truncated"] = true
+		}
+		return split
+
+	default:
+		parsedEvent["msg"] = parts[0]
+		parsedEvent["msg_truncated"] = true
+		return []map[string]interface{}{parsedEvent}
+	}
+}
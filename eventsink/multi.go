@@ -0,0 +1,43 @@
+package eventsink
+
+import "github.com/cloudfoundry/sonde-go/events"
+
+// Multi writes every event to all of its sinks
+type Multi struct {
+	sinks []Sink
+}
+
+func NewMulti(sinks ...Sink) *Multi {
+	return &Multi{
+		sinks: sinks,
+	}
+}
+
+func (m *Multi) Open() error {
+	for _, sink := range m.sinks {
+		if err := sink.Open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Multi) Close() error {
+	var lastErr error
+	for _, sink := range m.sinks {
+		if err := sink.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (m *Multi) Write(msg *events.Envelope) error {
+	var lastErr error
+	for _, sink := range m.sinks {
+		if err := sink.Write(msg); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,60 @@
+package eventsink
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// containerMetricValues are the fields of a ContainerMetric sent as measurements
+// of a multiple-metric HEC event, the other fields are its dimensions
+var containerMetricValues = map[string]bool{
+	"cpu_percentage":        true,
+	"cpu_cores_raw":         true,
+	"cpu_cores":             true,
+	"cpu_entitlement_cores": true,
+	"disk_bytes":            true,
+	"disk_bytes_quota":      true,
+	"memory_bytes":          true,
+	"memory_bytes_quota":    true,
+}
+
+// multiMetric returns whether the event is sent as a multiple-metric HEC event
+func (s *Splunk) multiMetric(fields map[string]interface{}) bool {
+	return s.config.ContainerMultiMetric && fields["event_type"] == events.Envelope_ContainerMetric.String()
+}
+
+// toMultiMetric turns the event into a multiple-metric HEC event holding all the
+// measurements of the ContainerMetric as container.<field> metrics, with the other
+// fields of the event and the extra fields as dimensions
+func (s *Splunk) toMultiMetric(event map[string]interface{}, fields map[string]interface{}, extraFields map[string]interface{}) {
+	for name, value := range fields {
+		if containerMetricValues[name] {
+			extraFields["metric_name:container."+name] = value
+			continue
+		}
+		switch value.(type) {
+		case string:
+			if value != "" && name != "msg" {
+				extraFields[name] = value
+			}
+		case bool, int, int32, int64, uint32, uint64, float64:
+			if name != "timestamp" {
+				extraFields[name] = value
+			}
+		}
+	}
+
+	event["event"] = "metric"
+	if s.config.MetricIndex != "" {
+		event["index"] = s.config.MetricIndex
+	}
+}
+
+// eventFields returns the fields of the event, which are the dimensions of a
+// multiple-metric HEC event
+func eventFields(event map[string]interface{}) map[string]interface{} {
+	if fields, ok := event["event"].(map[string]interface{}); ok {
+		return fields
+	}
+	fields, _ := event["fields"].(map[string]interface{})
+	return fields
+}
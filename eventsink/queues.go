@@ -0,0 +1,229 @@
+package eventsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Event classes with their own queue, in order of priority
+const (
+	ClassErrors  = "errors"
+	ClassLogs    = "logs"
+	ClassMetrics = "metrics"
+)
+
+var eventClasses = []string{ClassErrors, ClassLogs, ClassMetrics}
+
+// EventClass returns the queue class of events of the event type
+func EventClass(eventType events.Envelope_EventType) string {
+	switch eventType {
+	case events.Envelope_Error:
+		return ClassErrors
+	case events.Envelope_ValueMetric, events.Envelope_CounterEvent, events.Envelope_ContainerMetric:
+		return ClassMetrics
+	}
+	return ClassLogs
+}
+
+// ClassQueueConfig is the queue of an event class. A zero QueueSize uses the sink's
+// QueueSize. When the queue is full, new events are dropped unless DropOldest is set
+type ClassQueueConfig struct {
+	QueueSize  int
+	DropOldest bool
+}
+
+// ParseClassQueueConfigs parses a JSON object mapping event classes to their queue,
+// for example {"errors": {"queue_size": 1000}, "metrics": {"drop": "oldest"}}
+func ParseClassQueueConfigs(classQueuesString string) (map[string]ClassQueueConfig, error) {
+	classQueuesString = strings.TrimSpace(classQueuesString)
+	if classQueuesString == "" {
+		return nil, nil
+	}
+
+	var raw map[string]struct {
+		QueueSize int    `json:"queue_size"`
+		Drop      string `json:"drop"`
+	}
+	if err := json.Unmarshal([]byte(classQueuesString), &raw); err != nil {
+		return nil, fmt.Errorf("invalid class queues %q: %v", classQueuesString, err)
+	}
+
+	configs := make(map[string]ClassQueueConfig, len(raw))
+	for class, config := range raw {
+		if class != ClassErrors && class != ClassLogs && class != ClassMetrics {
+			return nil, fmt.Errorf("invalid event class %q, expected one of %s", class, strings.Join(eventClasses, ", "))
+		}
+		if config.QueueSize < 0 {
+			return nil, fmt.Errorf("invalid queue size %d for class %q", config.QueueSize, class)
+		}
+		if config.Drop != "" && config.Drop != "newest" && config.Drop != "oldest" {
+			return nil, fmt.Errorf("invalid drop policy %q for class %q, expected newest or oldest", config.Drop, class)
+		}
+		configs[class] = ClassQueueConfig{QueueSize: config.QueueSize, DropOldest: config.Drop == "oldest"}
+	}
+	return configs, nil
+}
+
+// queuedEvent is an event with the time it was written to the sink
+type queuedEvent struct {
+	msg      *events.Envelope
+	received int64  // unix nano, only set with AddIngestTime or MaxQueueAge
+	sequence uint64 // first nozzle_sequence of the events of msg, only set with AddSequence
+}
+
+// eventQueue buffers the events of one or all classes between Write and the consumers
+type eventQueue struct {
+	events     chan queuedEvent
+	dropOldest bool
+	dropped    *monitoring.Counter // per class, nil for the single queue
+}
+
+// newQueues creates a queue per class in order of priority when ClassQueues is set,
+// and a single queue for all classes otherwise
+func (s *Splunk) newQueues() {
+	s.classQueues = make(map[string]*eventQueue, len(eventClasses))
+	if len(s.config.ClassQueues) == 0 {
+		queue := &eventQueue{events: make(chan queuedEvent, s.config.QueueSize)}
+		s.queues = []*eventQueue{queue}
+		for _, class := range eventClasses {
+			s.classQueues[class] = queue
+		}
+		return
+	}
+
+	for _, class := range eventClasses {
+		config := s.config.ClassQueues[class]
+		if config.QueueSize == 0 {
+			config.QueueSize = s.config.QueueSize
+		}
+		queue := &eventQueue{
+			events:     make(chan queuedEvent, config.QueueSize),
+			dropOldest: config.DropOldest,
+			dropped:    s.config.Metrics.NewCounter("splunk.events.dropped." + class),
+		}
+		s.queues = append(s.queues, queue)
+		s.classQueues[class] = queue
+	}
+}
+
+// enqueue adds the event to the queue of its class, dropping the oldest or the new
+// event when the queue is full
+func (s *Splunk) enqueue(msg *events.Envelope) {
+	event := queuedEvent{msg: msg, sequence: s.reserveSequence(msg)}
+	if s.config.AddIngestTime || s.config.MaxQueueAge > 0 {
+		event.received = time.Now().UnixNano()
+	}
+
+	queue := s.classQueues[EventClass(msg.GetEventType())]
+	select {
+	case queue.events <- event:
+		return
+	default:
+	}
+
+	if queue.dropOldest {
+		select {
+		case oldest := <-queue.events:
+			s.dropped(queue, oldest.msg)
+		default:
+		}
+		select {
+		case queue.events <- event:
+			return
+		default:
+		}
+	}
+	s.dropped(queue, msg)
+}
+
+// queueLength returns the number of events in all queues
+func (s *Splunk) queueLength() int {
+	length := 0
+	for _, queue := range s.queues {
+		length += len(queue.events)
+	}
+	return length
+}
+
+// queueCapacity returns the number of events all queues can hold
+func (s *Splunk) queueCapacity() int {
+	capacity := 0
+	for _, queue := range s.queues {
+		capacity += cap(queue.events)
+	}
+	return capacity
+}
+
+// receiver receives the events of the queues for a consumer, higher priority classes first
+type receiver struct {
+	queues [3]chan queuedEvent // nil once closed and drained
+	park   chan struct{}       // nil without autoscaling
+}
+
+func (s *Splunk) newReceiver() *receiver {
+	r := &receiver{}
+	if s.scaler != nil {
+		r.park = s.scaler.park
+	}
+	for i, queue := range s.queues {
+		r.queues[i] = queue.events
+	}
+	return r
+}
+
+// next returns the next event, or fired when the timer fired first. It returns an
+// event without msg once all queues are closed and drained, or when the consumer is
+// parked while waiting for events
+func (r *receiver) next(timer <-chan time.Time) (event queuedEvent, fired bool) {
+	for {
+		select {
+		case <-timer:
+			return queuedEvent{}, true
+		default:
+		}
+
+		open := false
+		for i, queue := range r.queues {
+			if queue == nil {
+				continue
+			}
+			select {
+			case event, ok := <-queue:
+				if ok {
+					return event, false
+				}
+				r.queues[i] = nil
+			default:
+				open = true
+			}
+		}
+		if !open {
+			return queuedEvent{}, false
+		}
+
+		// All queues are empty, wait for any of them. Receiving from a nil queue blocks
+		var ok bool
+		var from int
+		select {
+		case event, ok = <-r.queues[0]:
+			from = 0
+		case event, ok = <-r.queues[1]:
+			from = 1
+		case event, ok = <-r.queues[2]:
+			from = 2
+		case <-timer:
+			return queuedEvent{}, true
+		case <-r.park:
+			return queuedEvent{}, false
+		}
+		if ok {
+			return event, false
+		}
+		r.queues[from] = nil
+	}
+}
@@ -0,0 +1,134 @@
+package eventsink
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type ReorderConfig struct {
+	Window    time.Duration // how long events are held
+	MaxEvents int           // all events are written early when this many are held
+	Metrics   *monitoring.Metrics
+}
+
+// Reorder holds the events written to it for the Window and writes them to its sink
+// in timestamp order, smoothing out the firehose's out of order delivery. Events are
+// checked every half Window, so they are delayed by up to 1.5 Window
+type Reorder struct {
+	sink   Sink
+	config *ReorderConfig
+
+	lock   sync.Mutex
+	buffer []heldEvent
+
+	fullCounter *monitoring.Counter
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+type heldEvent struct {
+	msg     *events.Envelope
+	arrived time.Time
+}
+
+func NewReorder(sink Sink, config *ReorderConfig) *Reorder {
+	if config.Metrics == nil {
+		config.Metrics = monitoring.NewMetrics()
+	}
+
+	return &Reorder{
+		sink:        sink,
+		config:      config,
+		fullCounter: config.Metrics.NewCounter("reorder.buffer.full"),
+		closing:     make(chan struct{}),
+	}
+}
+
+// Open starts writing the held events. The sink is opened by its creator
+func (r *Reorder) Open() error {
+	r.wg.Add(1)
+	go r.run()
+	return nil
+}
+
+// Close writes all held events and closes the sink
+func (r *Reorder) Close() error {
+	close(r.closing)
+	r.wg.Wait()
+
+	r.lock.Lock()
+	r.flush(time.Time{}, true)
+	r.lock.Unlock()
+	return r.sink.Close()
+}
+
+func (r *Reorder) Write(msg *events.Envelope) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.buffer = append(r.buffer, heldEvent{msg: msg, arrived: time.Now()})
+	if r.config.MaxEvents > 0 && len(r.buffer) >= r.config.MaxEvents {
+		r.fullCounter.Add(1)
+		r.flush(time.Time{}, true)
+	}
+	return nil
+}
+
+func (r *Reorder) run() {
+	defer r.wg.Done()
+
+	interval := r.config.Window / 2
+	if interval <= 0 {
+		interval = r.config.Window
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.lock.Lock()
+			r.flush(now.Add(-r.config.Window), false)
+			r.lock.Unlock()
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// flush writes the events which arrived before due, along with the events with an
+// older timestamp which arrived since, in timestamp order. It writes all events when
+// all is set. Must be called with the lock held, so writes aren't interleaved
+func (r *Reorder) flush(due time.Time, all bool) {
+	if len(r.buffer) == 0 {
+		return
+	}
+	sort.SliceStable(r.buffer, func(i, j int) bool {
+		return r.buffer[i].msg.GetTimestamp() < r.buffer[j].msg.GetTimestamp()
+	})
+
+	n := len(r.buffer)
+	if !all {
+		// The newest timestamp of the events due, older events are written with them
+		n = 0
+		for i, held := range r.buffer {
+			if !held.arrived.After(due) {
+				n = i + 1
+			}
+		}
+	}
+
+	for _, held := range r.buffer[:n] {
+		_ = r.sink.Write(held.msg)
+	}
+	remaining := copy(r.buffer, r.buffer[n:])
+	for i := remaining; i < len(r.buffer); i++ {
+		r.buffer[i] = heldEvent{}
+	}
+	r.buffer = r.buffer[:remaining]
+}
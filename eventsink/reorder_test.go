@@ -0,0 +1,100 @@
+package eventsink_test
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/sonde-go/events"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+// timestampSink records the timestamps of the events written to it
+type timestampSink struct {
+	lock       sync.Mutex
+	timestamps []int64
+}
+
+func (s *timestampSink) Open() error  { return nil }
+func (s *timestampSink) Close() error { return nil }
+func (s *timestampSink) Write(msg *events.Envelope) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.timestamps = append(s.timestamps, msg.GetTimestamp())
+	return nil
+}
+
+func (s *timestampSink) Timestamps() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int64(nil), s.timestamps...)
+}
+
+var _ = Describe("Reorder", func() {
+	var (
+		memSink *timestampSink
+		config  *eventsink.ReorderConfig
+		sink    *eventsink.Reorder
+	)
+
+	write := func(timestamps ...int64) {
+		for _, timestamp := range timestamps {
+			timestamp := timestamp
+			Ω(sink.Write(&events.Envelope{Timestamp: &timestamp})).Should(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		memSink = &timestampSink{}
+		config = &eventsink.ReorderConfig{
+			Window:    time.Hour,
+			MaxEvents: 100,
+			Metrics:   monitoring.NewMetrics(),
+		}
+	})
+
+	JustBeforeEach(func() {
+		sink = eventsink.NewReorder(memSink, config)
+		sink.Open()
+	})
+
+	It("writes the events held on close in timestamp order", func() {
+		write(3, 1, 2)
+		Expect(memSink.Timestamps()).To(BeEmpty())
+
+		Ω(sink.Close()).Should(Succeed())
+		Expect(memSink.Timestamps()).To(Equal([]int64{1, 2, 3}))
+	})
+
+	It("writes all held events when the buffer is full", func() {
+		config.MaxEvents = 3
+		write(3, 1)
+		Expect(memSink.Timestamps()).To(BeEmpty())
+
+		write(2)
+		Expect(memSink.Timestamps()).To(Equal([]int64{1, 2, 3}))
+		Expect(config.Metrics.Snapshot()["reorder.buffer.full"]).To(Equal(float64(1)))
+		Ω(sink.Close()).Should(Succeed())
+	})
+
+	Context("with a short window", func() {
+		BeforeEach(func() {
+			config.Window = 100 * time.Millisecond
+		})
+
+		It("writes the events after the window", func() {
+			write(30, 10)
+			Consistently(memSink.Timestamps, 50*time.Millisecond).Should(BeEmpty())
+			Eventually(memSink.Timestamps).Should(Equal([]int64{10, 30}))
+
+			// An event arriving after its window is written late
+			write(20)
+			Eventually(memSink.Timestamps).Should(Equal([]int64{10, 30, 20}))
+			Ω(sink.Close()).Should(Succeed())
+		})
+	})
+})
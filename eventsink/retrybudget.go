@@ -0,0 +1,42 @@
+package eventsink
+
+import (
+	"sync"
+	"time"
+)
+
+// Policies of the batches retried over the RetryBudget
+const (
+	RetryBudgetDefer = "defer" // wait for the budget of the next second
+	RetryBudgetDrop  = "drop"  // drop the batch, not applied with SyncSend
+)
+
+// retryBudget caps the retries of all the consumers sharing it to maxPerSecond, so
+// they don't pile on a flapping HEC during an outage
+type retryBudget struct {
+	maxPerSecond int
+
+	lock   sync.Mutex
+	second int64 // unix second of spent
+	spent  int
+}
+
+func newRetryBudget(maxPerSecond int) *retryBudget {
+	return &retryBudget{maxPerSecond: maxPerSecond}
+}
+
+// take spends a retry of the budget of the current second. When the budget is
+// exhausted, it returns false and the time the budget of the next second is available
+func (b *retryBudget) take(now time.Time) (bool, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if second := now.Unix(); second != b.second {
+		b.second, b.spent = second, 0
+	}
+	if b.spent >= b.maxPerSecond {
+		return false, time.Unix(b.second+1, 0)
+	}
+	b.spent++
+	return true, now
+}
@@ -7,3 +7,9 @@ type Sink interface {
 	Close() error
 	Write(fields *events.Envelope) error
 }
+
+// Stopper is implemented by the sinks which must know about a shutdown before the
+// writes to them stop, such as a sink blocking its writers until HEC accepts a batch
+type Stopper interface {
+	Stop()
+}
@@ -15,26 +15,117 @@ import (
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/cache"
 	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
 const SPLUNK_HEC_FIELDS_SUPPORT_VERSION = "6.4"
 
+// SchemaVersion is the version of the layout of the events sent to Splunk, added to
+// events as the nozzle_schema_version field. Bump it whenever fields are renamed, moved
+// or change type, so consumers can detect the change
+const SchemaVersion = "1"
+
+// ErrEventsAbandoned is returned by Close when events were dropped while draining,
+// or were still queued when CloseTimeout expired
+var ErrEventsAbandoned = errors.New("events abandoned on shutdown")
+
 type SplunkConfig struct {
-	FlushInterval         time.Duration
-	QueueSize             int // consumer queue buffer size
-	BatchSize             int
-	Retries               int // No of retries to post events to HEC before dropping events
-	Hostname              string
-	SubscriptionID        string
-	ExtraFields           map[string]string
-	TraceLogging          bool
-	UUID                  string
-	Logger                lager.Logger
-	StatusMonitorInterval time.Duration
-	DropWarnThreshold     int
-	LoggingIndex          string
+	FlushInterval           time.Duration
+	QueueSize               int // consumer queue buffer size
+	BatchSize               int
+	Retries                 int    // No of retries to post events to HEC before dropping events
+	RetryBudget             int    // Retries per second shared by all consumers, 0 disables the budget
+	RetryBudgetPolicy       string // RetryBudgetDefer or RetryBudgetDrop the batches retried over the budget
+	Hostname                string
+	SubscriptionID          string
+	ExtraFields             map[string]string
+	TraceLogging            bool
+	TraceAppGUIDs           map[string]bool // Add the trace logging fields only to the events of these apps, to all events when empty
+	UUID                    string
+	Logger                  lager.Logger
+	StatusMonitorInterval   time.Duration
+	DropWarnThreshold       int
+	LoggingIndex            string
+	SyncSend                bool // Write blocks until the batch containing the event is delivered
+	DropNozzleLogs          bool // Don't forward the nozzle's own log events to Splunk
+	NozzleLogSampleRate     int  // Forward 1 of every N nozzle info/debug log events
+	Metrics                 *monitoring.Metrics
+	WarmUp                  bool // Establish HEC connections of all writers in Open
+	AddSequence             bool // Add a monotonically increasing nozzle_sequence field to events
+	AddSchemaVersion        bool // Add the nozzle_schema_version field to events
+	AddSubscriptionID       bool // Add the subscription-id field to events, also added with trace logging
+	AddIngestTime           bool // Add a nozzle_ingest_time field with the time the sink received events
+	AddDeliveryTime         bool // Add a nozzle_delivery_time field with the time events were sent to HEC
+	AddRouteField           bool // Add a _route field explaining the index and the filters of events, for debugging
+	Index                   string
+	IndexExtraFields        map[string]map[string]string // Extra fields only added to events sent to the index
+	MaxExtraFieldBytes      int                          // Extra fields with longer values are not added, 0 disables the limit
+	MessageTypeIndexes      map[string]string            // Index of the LogMessages per message type, OUT or ERR, unless the app sets SPLUNK_INDEX or IndexMappings match
+	IndexMappings           []fevents.IndexMapping       // Index of the events of the apps matching the first mapping, unless the app sets SPLUNK_INDEX
+	QuarantineIndex         string                       // Index of the app events missing app metadata, which take no other index, "" disables
+	LookupFailureInterval   time.Duration                // Send at most one diagnostic event per interval on app metadata lookup failures
+	CompactContainerMetrics bool                         // Keep only the latest ContainerMetric per app instance in a batch
+	OrgSpaceMetricsLimit    int                          // Count events per org and space for up to N orgs and N spaces, 0 disables
+	CounterResetLimit       int                          // Detect CounterEvent total resets of up to N counters, 0 disables
+	IndexBatching           map[string]IndexBatchConfig  // Flush interval, batch size and retries per destination index, not applied with SyncSend
+	SplitByIndex            bool                         // Batch the events of each destination index apart, instead of setting the index per event of a batch, not applied with SyncSend
+	DeadLetter              eventwriter.Writer           // Writer of the batches of the IndexBatching indexes with DeadLetter dropped after the last retry
+	ClassQueues             map[string]ClassQueueConfig  // Separate queue per event class, consumed in order of priority, not applied with SyncSend
+
+	// LogMessages over LogMaxChars characters or LogMaxLines lines, 0 disables a
+	// limit, are truncated, dropped or split by the LogOverflow policy
+	LogMaxChars int
+	LogMaxLines int
+	LogOverflow string
+
+	// With AppKeyAdd or AppKeyReplace, events of apps get an app_key field, a hash of
+	// the app GUID salted with AppKeySalt. Off when empty
+	AppKeyMode string
+	AppKeySalt string
+
+	// Events queued for longer than MaxQueueAge are dropped instead of sent, as they
+	// would arrive too late to be useful. 0 disables, not applied with SyncSend
+	MaxQueueAge time.Duration
+
+	// Writer of the events of each org GUID, with the HEC token of the org's tenant.
+	// Events of other orgs use the default token. Not applied with SyncSend
+	OrgWriters map[string]eventwriter.Writer
+
+	// With MaxWorkers, the number of consumers is adjusted at every ScaleInterval
+	// between MinWorkers and MaxWorkers, up to the number of writers but the last,
+	// on the queue depth and on the HEC write latency over ScaleLatency when set.
+	// Not applied with SyncSend
+	MinWorkers    int
+	MaxWorkers    int
+	ScaleInterval time.Duration
+	ScaleLatency  time.Duration
+
+	// Index and sourcetype per event type, from the EVENT_MAPPING_FILE. The index applies
+	// to events without an app SPLUNK_INDEX, an IndexMappings or a MessageTypeIndexes index
+	EventMappings map[string]fevents.EventMapping
+
+	// Optional hooks for embedders, called from the sending goroutines after a batch
+	// has been accepted by Splunk or dropped after the last retry
+	OnDelivered func(events []map[string]interface{})
+	OnDropped   func(events []map[string]interface{})
+
+	// OnHECFailing is called with true after HECFailureThreshold consecutive failed
+	// HEC writes, and with false on the next successful write
+	OnHECFailing        func(failing bool)
+	HECFailureThreshold int
+
+	// Send ContainerMetric events as multiple-metric HEC events, to MetricIndex when set
+	ContainerMultiMetric bool
+	MetricIndex          string
+
+	// How long Close waits for the queued events to be sent, 0 waits until they are
+	CloseTimeout time.Duration
+
+	// Count the requests, events, errors and latency of each consumer in the
+	// splunk.worker.<n>.* metrics
+	WorkerMetrics bool
 }
 
 type ParseConfig = fevents.Config
@@ -44,45 +135,275 @@ type Splunk struct {
 	config        *SplunkConfig
 	parseConfig   *ParseConfig
 	appCache      cache.Cache
-	events        chan *events.Envelope
 	wg            sync.WaitGroup
 	eventCount    uint64
+	logCount      uint64
+	sequence      uint64
 	sentCountChan chan uint64
 	DroppedEvents uint64
 
+	// synchronous send mode state
+	syncLock   sync.Mutex
+	syncBatch  []map[string]interface{}
+	syncLatest map[string]int
+	closing    chan struct{}
+	stopping   chan struct{}
+	stopOnce   sync.Once
+
+	// running consumers, and the writers of the parked ones when autoscaling
+	activeWorkers int32
+	scaler        *workerScaler
+
+	// queues of the events, in order of priority, and the queue of each event class
+	queues      []*eventQueue
+	classQueues map[string]*eventQueue
+
 	// cached IP
 	ip string
+
+	// consecutive failed HEC writes, atomic
+	failedWrites int32
+
+	// events dropped after the last retry since the sink is closing, atomic
+	abandoned uint64
+
+	// counters of the writer of each consumer, with WorkerMetrics
+	workerMetrics map[eventwriter.Writer]*workerMetrics
+
+	sentCounter    *monitoring.Counter
+	droppedCounter *monitoring.Counter
+	retryCounter   *monitoring.Counter
+
+	compactedCounter  *monitoring.Counter
+	malformedCounter  *monitoring.Counter
+	unenrichedCounter *monitoring.Counter
+	quarantineCounter *monitoring.Counter
+	oversizedCounter  *monitoring.Counter
+	expiredCounter    *monitoring.Counter
+	deadLetterCounter *monitoring.Counter
+	filteredCounter   *monitoring.Counter
+	filterErrCounter  *monitoring.Counter
+	orgCounters       *monitoring.CounterVec
+	spaceCounters     *monitoring.CounterVec
+
+	// dropped events per event type, by reason
+	drops map[string]*monitoring.DropCounter
+
+	// nil when CounterResetLimit is 0
+	counterResets *counterResetDetector
+
+	// nil when RetryBudget is 0
+	retryBudget     *retryBudget
+	budgetExhausted *monitoring.Counter
+
+	// app metadata lookup failures
+	lookupFailureCounter *monitoring.Counter
+	lookupFailures       uint64 // since the last diagnostic event
+	lastDiagnostic       int64  // unix nano
+	diagnostics          chan map[string]interface{}
 }
 
 func NewSplunk(writers []eventwriter.Writer, config *SplunkConfig, parseConfig *ParseConfig, appCache cache.Cache) *Splunk {
 	hostname, ip, _ := utils.GetHostIPInfo(config.Hostname)
 	config.Hostname = hostname
 
-	return &Splunk{
+	if config.Metrics == nil {
+		config.Metrics = monitoring.NewMetrics()
+	}
+
+	s := &Splunk{
 		writers:       writers,
 		config:        config,
 		parseConfig:   parseConfig,
 		appCache:      appCache,
-		events:        make(chan *events.Envelope, config.QueueSize),
 		ip:            ip,
 		eventCount:    0,
 		sentCountChan: make(chan uint64, 100),
 		DroppedEvents: 0,
+		closing:       make(chan struct{}),
+		stopping:      make(chan struct{}),
+		// Seeded with the start time so the sequence keeps increasing across restarts
+		sequence: uint64(time.Now().UnixNano()),
+
+		sentCounter:    config.Metrics.NewCounter("splunk.events.sent"),
+		droppedCounter: config.Metrics.NewCounter("splunk.events.dropped"),
+		retryCounter:   config.Metrics.NewCounter("splunk.retries"),
+
+		lookupFailureCounter: config.Metrics.NewCounter("cache.lookup.failures"),
+		diagnostics:          make(chan map[string]interface{}, 1),
+		budgetExhausted:      config.Metrics.NewCounter("splunk.retry_budget.exhausted"),
+		compactedCounter:     config.Metrics.NewCounter("splunk.events.compacted"),
+		malformedCounter:     config.Metrics.NewCounter("splunk.events.malformed"),
+		unenrichedCounter:    config.Metrics.NewCounter("splunk.events.unenriched"),
+		quarantineCounter:    config.Metrics.NewCounter("splunk.events.quarantined"),
+		oversizedCounter:     config.Metrics.NewCounter("splunk.events.oversized"),
+		expiredCounter:       config.Metrics.NewCounter("splunk.events.expired"),
+		deadLetterCounter:    config.Metrics.NewCounter("splunk.events.dead_lettered"),
+		filteredCounter:      config.Metrics.NewCounter("splunk.events.filtered"),
+		filterErrCounter:     config.Metrics.NewCounter("splunk.filter.errors"),
+		orgCounters:          config.Metrics.NewCounterVec("splunk.events.org", config.OrgSpaceMetricsLimit),
+		spaceCounters:        config.Metrics.NewCounterVec("splunk.events.space", config.OrgSpaceMetricsLimit),
+		syncLatest:           make(map[string]int),
+		drops:                make(map[string]*monitoring.DropCounter),
+	}
+	for _, reason := range []string{monitoring.DropFiltered, monitoring.DropIgnoredApp, monitoring.DropUnenriched,
+		monitoring.DropMalformed, monitoring.DropCompacted, monitoring.DropOversized, monitoring.DropQueueFull, monitoring.DropExpired, monitoring.DropSendFailed} {
+		s.drops[reason] = config.Metrics.NewDropCounter(reason)
+	}
+	if config.CounterResetLimit > 0 {
+		s.counterResets = newCounterResetDetector(config.CounterResetLimit)
+	}
+	if config.RetryBudget > 0 {
+		s.retryBudget = newRetryBudget(config.RetryBudget)
+	}
+	if config.MaxExtraFieldBytes > 0 {
+		config.ExtraFields = s.limitExtraFields(config.ExtraFields, "")
+		for index, fields := range config.IndexExtraFields {
+			config.IndexExtraFields[index] = s.limitExtraFields(fields, index)
+		}
+	}
+
+	s.newQueues()
+
+	if config.MaxWorkers > 0 && !config.SyncSend {
+		if workers := len(writers) - 1; config.MaxWorkers > workers {
+			config.MaxWorkers = workers
+		}
+		if config.MinWorkers < 1 {
+			config.MinWorkers = 1
+		}
+		if config.MinWorkers > config.MaxWorkers {
+			config.MinWorkers = config.MaxWorkers
+		}
+		s.scaler = newWorkerScaler(writers[:config.MaxWorkers])
+	}
+	if config.WorkerMetrics && len(writers) > 1 {
+		s.workerMetrics = newWorkerMetrics(writers[:len(writers)-1], config.Metrics)
+	}
+	config.Metrics.RegisterGauge("splunk.workers.active", func() float64 {
+		return float64(atomic.LoadInt32(&s.activeWorkers))
+	})
+
+	queueDepth := func() float64 {
+		return float64(s.queueLength())
 	}
+	config.Metrics.RegisterGauge("splunk.events.queue_depth", queueDepth)
+
+	// Distribution of the queue occupancy, in buckets of 10% up to 100% of the capacity of the queues
+	var bounds []float64
+	for _, pct := range []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 1} {
+		bounds = append(bounds, math.Ceil(pct*float64(s.queueCapacity())))
+	}
+	config.Metrics.RegisterGaugeHistogram("splunk.events.queue_depth", bounds, queueDepth)
+	return s
+}
+
+// limitExtraFields returns the extra fields without the fields whose value is longer
+// than MaxExtraFieldBytes, which would bloat every event. They are checked when parsed
+// by the nozzle, this guards embedders setting the fields directly
+func (s *Splunk) limitExtraFields(fields map[string]string, index string) map[string]string {
+	limited := make(map[string]string, len(fields))
+	for name, value := range fields {
+		if len(value) > s.config.MaxExtraFieldBytes {
+			s.config.Logger.Error("Ignoring oversized extra field", nil, lager.Data{
+				"field":     name,
+				"index":     index,
+				"bytes":     len(value),
+				"max_bytes": s.config.MaxExtraFieldBytes,
+			})
+			continue
+		}
+		limited[name] = value
+	}
+	return limited
 }
 
 func (s *Splunk) Open() error {
+	if s.config.WarmUp {
+		s.warmUp()
+	}
+
+	if s.config.LookupFailureInterval > 0 {
+		s.wg.Add(1)
+		go s.sendDiagnostics()
+	}
+
+	if s.config.SyncSend {
+		// One batch in flight at a time, flushed by the caller of Write or by the flush window
+		s.wg.Add(1)
+		go s.flushSync()
+		return nil
+	}
+
+	if s.scaler != nil {
+		for i := 0; i < s.config.MinWorkers; i++ {
+			s.startWorker()
+		}
+		s.wg.Add(1)
+		go s.autoscale()
+		return nil
+	}
+
 	for _, client := range s.writers[:len(s.writers)-1] {
 		s.wg.Add(1)
+		atomic.AddInt32(&s.activeWorkers, 1)
 		go s.consume(client)
 	}
 	return nil
 }
 
+// warmUp establishes the HEC connections of all writers concurrently. Failures are
+// logged by the writers and don't prevent the sink from opening
+func (s *Splunk) warmUp() {
+	var wg sync.WaitGroup
+	for _, writer := range s.writers {
+		if w, ok := writer.(eventwriter.WarmUpWriter); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.WarmUp()
+			}()
+		}
+	}
+	wg.Wait()
+}
+
 func (s *Splunk) Close() error {
 	// Notify the consume loop to drain events and exit
-	close(s.events)
-	s.wg.Wait()
+	close(s.closing)
+	for _, queue := range s.queues {
+		close(queue.events)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		if s.config.SyncSend {
+			// Last batch
+			s.syncLock.Lock()
+			s.syncBatch = s.deliverEvents(s.writers[0], s.syncBatch)
+			s.syncLock.Unlock()
+		}
+		close(drained)
+	}()
+
+	var timeout <-chan time.Time
+	if s.config.CloseTimeout > 0 {
+		timer := time.NewTimer(s.config.CloseTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-drained:
+	case <-timeout:
+		queued := s.queueLength()
+		s.config.Logger.Error("Timed out draining events", ErrEventsAbandoned, lager.Data{"queued": queued, "timeout": s.config.CloseTimeout.String()})
+		return fmt.Errorf("%w: %d events still queued after %s", ErrEventsAbandoned, queued, s.config.CloseTimeout)
+	}
+
+	if abandoned := atomic.LoadUint64(&s.abandoned); abandoned > 0 {
+		return fmt.Errorf("%w: %d events dropped while draining", ErrEventsAbandoned, abandoned)
+	}
 	return nil
 }
 
@@ -90,45 +411,107 @@ func (s *Splunk) Close() error {
 func (s *Splunk) parseEvent(msg *events.Envelope) map[string]interface{} {
 	eventType := msg.GetEventType()
 
-	var event *fevents.Event
-	switch eventType {
-	case events.Envelope_HttpStartStop:
-		event = fevents.HttpStartStop(msg)
-	case events.Envelope_LogMessage:
-		event = fevents.LogMessage(msg)
-	case events.Envelope_ValueMetric:
-		event = fevents.ValueMetric(msg)
-	case events.Envelope_CounterEvent:
-		event = fevents.CounterEvent(msg)
-	case events.Envelope_Error:
-		event = fevents.ErrorEvent(msg)
-	case events.Envelope_ContainerMetric:
-		event = fevents.ContainerMetric(msg)
-	case events.Envelope_HttpStart:
-		event = fevents.HttpStart(msg)
-	case events.Envelope_HttpStop:
-		event = fevents.HttpStop(msg)
+	if !fevents.HasPayload(msg) {
+		if _, known := events.Envelope_EventType_name[int32(eventType)]; known {
+			s.malformedCounter.Add(1)
+			s.drops[monitoring.DropMalformed].Add(eventType.String(), 1)
+			s.config.Logger.Debug("Dropped malformed envelope without its sub-event", lager.Data{"event_type": eventType.String()})
+		}
+		return nil
+	}
 
-	default:
+	event := fevents.FromEnvelope(msg)
+	if event == nil {
 		return nil
 	}
 
 	event.AnnotateWithEnvelopeData(msg, s.parseConfig)
 	event.AnnotateWithCFMetaData()
 
-	if _, hasAppId := event.Fields["cf_app_id"]; hasAppId {
-		event.AnnotateWithAppData(s.appCache, s.parseConfig)
+	// The delta of the first event after a restart of the emitting component is meaningless
+	if eventType == events.Envelope_CounterEvent && s.counterResets != nil && s.counterResets.reset(msg, time.Now()) {
+		event.Fields["counter_reset"] = true
+		delete(event.Fields, "delta")
+	}
+
+	if eventType == events.Envelope_ContainerMetric && s.parseConfig.AddCpuCores {
+		event.AnnotateWithCpuCores()
+	}
+
+	if eventType == events.Envelope_HttpStartStop && s.parseConfig.AddVcapRequestId {
+		event.AnnotateWithVcapRequestId(msg)
+	}
+
+	if eventType == events.Envelope_LogMessage && s.parseConfig.Base64BinaryLogs {
+		event.EncodeBinaryMessage()
+	}
+
+	if eventType == events.Envelope_LogMessage && s.parseConfig.LogTimestampLayout != "" {
+		event.StripTimestamp(s.parseConfig.LogTimestampLayout, s.parseConfig.LogTimestampAsTime)
+	}
+
+	if eventType == events.Envelope_LogMessage && len(s.parseConfig.FieldExtractors) > 0 {
+		event.ExtractFields(s.parseConfig.FieldExtractors)
+	}
+
+	if appId, hasAppId := event.Fields["cf_app_id"]; hasAppId {
+		if err := event.AnnotateWithAppData(s.appCache, s.parseConfig); err != nil && err != cache.ErrMissingAndIgnored {
+			s.lookupFailed(appId, err)
+		}
+
+		// Events of apps whose metadata couldn't be resolved aren't sent partially, or
+		// only to the quarantine index
+		if id, _ := appId.(string); id != "" && (s.parseConfig.RequireEnrichment || s.config.QuarantineIndex != "") &&
+			!event.IsEnriched(s.parseConfig) {
+			if s.config.QuarantineIndex == "" {
+				s.unenrichedCounter.Add(1)
+				s.drops[monitoring.DropUnenriched].Add(eventType.String(), 1)
+				return nil
+			}
+			s.quarantineCounter.Add(1)
+			event.Fields["cf_quarantined"] = true
+		}
+	}
+
+	if eventType == events.Envelope_LogMessage && s.parseConfig.JsonLog {
+		event.MergeJsonMessage(s.parseConfig)
+	}
+
+	if len(s.parseConfig.PriorityRules) > 0 {
+		event.AnnotateWithPriority(s.parseConfig.PriorityRules, s.parseConfig.PriorityField)
 	}
 
 	if ignored, ok := event.Fields["cf_ignored_app"]; ok {
 		if ignoreApp, ok := ignored.(bool); ok && ignoreApp {
 			// Ignore events from this app since end user tag to ignore this app
+			s.drops[monitoring.DropIgnoredApp].Add(eventType.String(), 1)
+			return nil
+		}
+	}
+
+	if s.parseConfig.Filter != nil {
+		// Events for which the filter fails are kept, so a mistyped field doesn't drop everything
+		keep, err := s.parseConfig.Filter.Keep(event)
+		if err != nil {
+			s.filterErrCounter.Add(1)
+			s.config.Logger.Debug("Failed to evaluate event filter", lager.Data{"event_type": eventType.String(), "error": err.Error()})
+		} else if !keep {
+			s.filteredCounter.Add(1)
+			s.drops[monitoring.DropFiltered].Add(eventType.String(), 1)
 			return nil
 		}
 	}
 
 	parsedEvent := event.Fields
 
+	if s.config.AddRouteField {
+		parsedEvent["_route"] = s.route(eventType, parsedEvent)
+	}
+
+	if s.config.OrgSpaceMetricsLimit > 0 {
+		s.countOrgSpace(parsedEvent)
+	}
+
 	if len(event.Msg) > 0 {
 		parsedEvent["msg"] = event.Msg
 	}
@@ -137,78 +520,421 @@ func (s *Splunk) parseEvent(msg *events.Envelope) map[string]interface{} {
 }
 
 func (s *Splunk) Write(fields *events.Envelope) error {
-	select {
-	case s.events <- fields:
-	default:
-		s.DroppedEvents += 1
-		if int(s.DroppedEvents)%s.config.DropWarnThreshold == 0 {
-			s.config.Logger.Error("Downstream is slow, dropped Total of "+strconv.FormatUint(s.DroppedEvents, 10)+" events",
-				errors.New("dropped more "+strconv.FormatUint(uint64(s.config.DropWarnThreshold), 10)+" events, Total of "+strconv.FormatUint(s.DroppedEvents, 10)+" dropped events"))
-		}
+	if s.config.SyncSend {
+		return s.writeSync(fields)
 	}
+
+	s.enqueue(fields)
 	return nil
 }
 
+// dropped counts an event dropped because its queue is full
+func (s *Splunk) dropped(queue *eventQueue, msg *events.Envelope) {
+	// Atomic, as events may be written by several routing goroutines
+	droppedEvents := atomic.AddUint64(&s.DroppedEvents, 1)
+	s.droppedCounter.Add(1)
+	s.drops[monitoring.DropQueueFull].Add(msg.GetEventType().String(), 1)
+	if queue.dropped != nil {
+		queue.dropped.Add(1)
+	}
+	if int(droppedEvents)%s.config.DropWarnThreshold == 0 {
+		s.config.Logger.Error("Downstream is slow, dropped Total of "+strconv.FormatUint(droppedEvents, 10)+" events",
+			errors.New("dropped more "+strconv.FormatUint(uint64(s.config.DropWarnThreshold), 10)+" events, Total of "+strconv.FormatUint(droppedEvents, 10)+" dropped events"))
+	}
+}
+
 func (s *Splunk) consume(writer eventwriter.Writer) {
 	defer s.wg.Done()
 
-	var batch []map[string]interface{}
-	timer := time.NewTimer(s.config.FlushInterval)
+	now := time.Now()
+	lanes := s.newLanes(now)
+	timer := time.NewTimer(lanes.nextFlush(now))
+	receiver := s.newReceiver()
 
-	// Flush takes place when 1) batch limit is reached. 2) flush window expires
+	// Flush of a lane takes place when 1) its batch limit is reached. 2) its flush window expires
 LOOP:
 	for {
-		select {
-		case event, ok := <-s.events:
-			if !ok {
-				// events chan has closed and we have drained all events in it
-				break LOOP
+		event, fired := receiver.next(timer.C)
+		switch {
+		case event.msg != nil:
+			if s.expired(event) {
+				continue
+			}
+			for i, parsedEvent := range s.parseEvents(event.msg) {
+				org, _ := parsedEvent["cf_org_id"].(string)
+				lane := lanes.forEvent(org, s.destinationIndex(parsedEvent))
+				finalEvent := s.buildEvent(parsedEvent, event.received, event.sequence+uint64(i))
+				lane.batch = s.addToBatch(lane.batch, lane.latest, finalEvent)
+				if len(lane.batch) >= lane.batchSize {
+					now = time.Now()
+					lane.batch = s.indexLane(lane, writer)
+					lane.reset(now)
+					resetTimer(timer, lanes.nextFlush(now))
+				}
 			}
 
-			parsedEvent := s.parseEvent(event)
-			if parsedEvent != nil {
-				finalEvent := s.buildEvent(parsedEvent)
-				batch = append(batch, finalEvent)
-				if len(batch) >= s.config.BatchSize {
-					batch = s.indexEvents(writer, batch)
-					timer.Reset(s.config.FlushInterval) // reset channel timer
+		case fired:
+			now = time.Now()
+			for _, lane := range lanes.all() {
+				if !now.Before(lane.flushAt) {
+					lane.batch = s.indexLane(lane, writer)
+					lane.reset(now)
 				}
 			}
+			timer.Reset(lanes.nextFlush(now))
+
+		default:
+			// All queues have closed and we have drained all events in them, or
+			// the consumer is parked
+			break LOOP
+		}
+	}
+	// Last batches
+	for _, lane := range lanes.all() {
+		s.indexLane(lane, writer)
+	}
+}
 
+// expired drops and counts the event when it was queued for longer than MaxQueueAge
+func (s *Splunk) expired(event queuedEvent) bool {
+	if s.config.MaxQueueAge <= 0 || time.Since(time.Unix(0, event.received)) <= s.config.MaxQueueAge {
+		return false
+	}
+	s.expiredCounter.Add(1)
+	s.drops[monitoring.DropExpired].Add(event.msg.GetEventType().String(), 1)
+	return true
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
 		case <-timer.C:
-			batch = s.indexEvents(writer, batch)
-			timer.Reset(s.config.FlushInterval)
+		default:
 		}
+	}
+	timer.Reset(d)
+}
+
+// countOrgSpace counts the event for its org and space, by name when app info adds
+// the names and by guid otherwise. Events without app are not counted
+func (s *Splunk) countOrgSpace(fields map[string]interface{}) {
+	org := firstString(fields, "cf_org_name", "cf_org_id")
+	if org == "" {
+		return
+	}
+	s.orgCounters.WithLabel(org).Add(1)
 
+	if space := firstString(fields, "cf_space_name", "cf_space_id"); space != "" {
+		// Space names are only unique within an org
+		s.spaceCounters.WithLabel(org + "/" + space).Add(1)
+	}
+}
+
+func firstString(fields map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if value, ok := fields[name].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// addToBatch appends the event to the batch. With CompactContainerMetrics, a
+// ContainerMetric replaces the one of the same app instance already in the batch,
+// latest holds the position of each app instance in the batch
+func (s *Splunk) addToBatch(batch []map[string]interface{}, latest map[string]int, event map[string]interface{}) []map[string]interface{} {
+	if !s.config.CompactContainerMetrics {
+		return append(batch, event)
+	}
+
+	fields := eventFields(event)
+	if fields["event_type"] != events.Envelope_ContainerMetric.String() {
+		return append(batch, event)
+	}
+
+	// The app GUID is replaced with the app key with AppKeyReplace
+	key := fmt.Sprintf("%v/%v", firstString(fields, "cf_app_id", "app_key"), fields["instance_index"])
+	if i, ok := latest[key]; ok {
+		batch[i] = event
+		s.compactedCounter.Add(1)
+		s.drops[monitoring.DropCompacted].Add(events.Envelope_ContainerMetric.String(), 1)
+		return batch
 	}
-	// Last batch
-	s.indexEvents(writer, batch)
+	latest[key] = len(batch)
+	return append(batch, event)
 }
 
 // indexEvents indexes events to Splunk
 // return nil when successful which clears all outstanding events
 // return what the batch has if there is an error for next retry cycle
-func (s *Splunk) indexEvents(writer eventwriter.Writer, batch []map[string]interface{}) []map[string]interface{} {
+func (s *Splunk) indexEvents(writer eventwriter.Writer, batch []map[string]interface{}, retries int, deadLetter bool) []map[string]interface{} {
 	if len(batch) == 0 {
 		return batch
 	}
 	var err error
-	for i := 0; i < s.config.Retries; i++ {
-		err, sentCount := writer.Write(batch)
+	for i := 0; i < retries; i++ {
+		if s.config.AddDeliveryTime {
+			stampDeliveryTime(batch, time.Now())
+		}
+		err, sentCount := s.write(writer, batch)
 		if err == nil {
+			s.sentCounter.Add(uint64(len(batch)))
 			if s.config.StatusMonitorInterval > time.Second*0 {
 				s.sentCountChan <- sentCount
 			}
+			if s.config.OnDelivered != nil {
+				s.config.OnDelivered(batch)
+			}
 			return nil
 		}
 		s.config.Logger.Error("Unable to talk to Splunk", err, lager.Data{"Retry attempt": i + 1})
+		s.retryCounter.Add(1)
 		time.Sleep(getRetryInterval(i))
+		if i+1 < retries && !s.spendRetry(true) {
+			s.config.Logger.Error("Retry budget exhausted, dropping events", nil, lager.Data{"events": len(batch)})
+			break
+		}
+	}
+	s.dropBatch(batch, err)
+	if deadLetter {
+		s.writeDeadLetter(batch)
 	}
-	s.config.Logger.Error("Finish retrying and dropping events", err, lager.Data{"events": len(batch)})
 	return nil
 }
 
-func (s *Splunk) buildEvent(fields map[string]interface{}) map[string]interface{} {
+// writeDeadLetter writes the dropped batch, or the events rejected by HEC, to the
+// DeadLetter writer. A batch the writer fails to write is only counted as send_failed,
+// like without dead_letter
+func (s *Splunk) writeDeadLetter(batch []map[string]interface{}) {
+	if s.config.DeadLetter == nil {
+		return
+	}
+	if err, _ := s.config.DeadLetter.Write(batch); err != nil {
+		s.config.Logger.Error("Failed to write dropped events to the dead letter file", err, lager.Data{"events": len(batch)})
+		return
+	}
+	s.deadLetterCounter.Add(uint64(len(batch)))
+}
+
+// writeSync adds the event to the pending batch and, when the batch is full,
+// blocks the caller until the batch has been accepted by Splunk
+func (s *Splunk) writeSync(msg *events.Envelope) error {
+	sequence := s.reserveSequence(msg)
+	parsedEvents := s.parseEvents(msg)
+	if len(parsedEvents) == 0 {
+		return nil
+	}
+
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	var received int64
+	if s.config.AddIngestTime {
+		received = time.Now().UnixNano()
+	}
+	for i, parsedEvent := range parsedEvents {
+		s.syncBatch = s.addToBatch(s.syncBatch, s.syncLatest, s.buildEvent(parsedEvent, received, sequence+uint64(i)))
+		if len(s.syncBatch) >= s.config.BatchSize {
+			s.syncBatch = s.deliverEvents(s.writers[0], s.syncBatch)
+			s.syncLatest = make(map[string]int)
+		}
+	}
+	return nil
+}
+
+// flushSync delivers the pending batch at every flush window in synchronous send mode
+func (s *Splunk) flushSync() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.syncLock.Lock()
+			s.syncBatch = s.deliverEvents(s.writers[0], s.syncBatch)
+			s.syncLatest = make(map[string]int)
+			s.syncLock.Unlock()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// deliverEvents keeps retrying the batch until Splunk accepts it. Once the sink
+// is stopped or closing, it gives up after the configured number of retries so
+// shutdown can't hang
+func (s *Splunk) deliverEvents(writer eventwriter.Writer, batch []map[string]interface{}) []map[string]interface{} {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	for i := 0; ; i++ {
+		if s.config.AddDeliveryTime {
+			stampDeliveryTime(batch, time.Now())
+		}
+		err, sentCount := s.write(writer, batch)
+		if err == nil {
+			s.sentCounter.Add(uint64(len(batch)))
+			if s.config.StatusMonitorInterval > time.Second*0 {
+				s.sentCountChan <- sentCount
+			}
+			if s.config.OnDelivered != nil {
+				s.config.OnDelivered(batch)
+			}
+			return nil
+		}
+		s.config.Logger.Error("Unable to talk to Splunk", err, lager.Data{"Retry attempt": i + 1})
+
+		if i+1 >= s.config.Retries && s.isClosing() {
+			s.dropBatch(batch, err)
+			return nil
+		}
+		s.retryCounter.Add(1)
+		time.Sleep(getRetryInterval(minInt(i, s.config.Retries)))
+		s.spendRetry(false)
+	}
+}
+
+// write sends the batch with the writer, recording the write for autoscaling,
+// the worker metrics and HEC failure detection
+func (s *Splunk) write(writer eventwriter.Writer, batch []map[string]interface{}) (error, uint64) {
+	start := time.Now()
+	err, sentCount := writer.Write(batch)
+	duration := time.Since(start)
+	var rejected *eventwriter.RejectedEventsError
+	if errors.As(err, &rejected) {
+		// The other events of the batch were accepted
+		s.writeDeadLetter(rejected.Events)
+		err = nil
+	}
+	if s.scaler != nil {
+		s.scaler.observe(duration)
+	}
+	if metrics := s.workerMetrics[writer]; metrics != nil {
+		metrics.observe(len(batch), duration, err)
+	}
+	s.recordWrite(err)
+	return err, sentCount
+}
+
+// recordWrite counts the consecutive failed HEC writes, and calls OnHECFailing when
+// they reach HECFailureThreshold and on the first successful write after
+func (s *Splunk) recordWrite(err error) {
+	if s.config.OnHECFailing == nil || s.config.HECFailureThreshold <= 0 {
+		return
+	}
+
+	threshold := int32(s.config.HECFailureThreshold)
+	if err != nil {
+		if atomic.AddInt32(&s.failedWrites, 1) == threshold {
+			s.config.OnHECFailing(true)
+		}
+		return
+	}
+	if atomic.SwapInt32(&s.failedWrites, 0) >= threshold {
+		s.config.OnHECFailing(false)
+	}
+}
+
+// spendRetry waits until the RetryBudget allows a retry. With the RetryBudgetDrop
+// policy, it returns false instead of waiting when the batch can be dropped
+func (s *Splunk) spendRetry(canDrop bool) bool {
+	if s.retryBudget == nil {
+		return true
+	}
+
+	ok, next := s.retryBudget.take(time.Now())
+	if ok {
+		return true
+	}
+	s.budgetExhausted.Add(1)
+	if canDrop && s.config.RetryBudgetPolicy == RetryBudgetDrop {
+		return false
+	}
+	for !ok {
+		time.Sleep(time.Until(next))
+		ok, next = s.retryBudget.take(time.Now())
+	}
+	return true
+}
+
+// stampDeliveryTime sets the nozzle_delivery_time field of the events of the batch
+// to the time of the attempt to send it
+func stampDeliveryTime(batch []map[string]interface{}, now time.Time) {
+	deliveryTime := utils.NanoSecondsToSeconds(now.UnixNano())
+	for _, event := range batch {
+		if fields, ok := event["fields"].(map[string]interface{}); ok {
+			fields["nozzle_delivery_time"] = deliveryTime
+		}
+	}
+}
+
+// dropBatch drops the batch after the last retry failed with err
+func (s *Splunk) dropBatch(batch []map[string]interface{}, err error) {
+	s.config.Logger.Error("Finish retrying and dropping events", err, lager.Data{"events": len(batch)})
+	s.droppedCounter.Add(uint64(len(batch)))
+	if s.isClosing() {
+		atomic.AddUint64(&s.abandoned, uint64(len(batch)))
+	}
+	s.countSendFailed(batch)
+	if s.config.OnDropped != nil {
+		s.config.OnDropped(batch)
+	}
+}
+
+// countSendFailed counts the events of the batch dropped after the last retry per event type
+func (s *Splunk) countSendFailed(batch []map[string]interface{}) {
+	counts := make(map[string]uint64)
+	for _, event := range batch {
+		eventType, _ := eventFields(event)["event_type"].(string)
+		if eventType == "" {
+			eventType = "unknown"
+		}
+		counts[eventType]++
+	}
+	for eventType, count := range counts {
+		s.drops[monitoring.DropSendFailed].Add(eventType, count)
+	}
+}
+
+func (s *Splunk) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop tells the sink the nozzle is shutting down, before the events stop being
+// written to it, so in synchronous send mode a write blocked on an unreachable HEC
+// drops its batch after the last retry instead of blocking the shutdown
+func (s *Splunk) Stop() {
+	s.stopOnce.Do(func() { close(s.stopping) })
+}
+
+// reserveSequence returns the first nozzle_sequence of the events of the envelope, with
+// a number reserved for each message part a LogMessage can be split into, so the
+// sequence follows the order the envelopes are written to the sink, whatever the order
+// the consumers build their events in
+func (s *Splunk) reserveSequence(msg *events.Envelope) uint64 {
+	if !s.config.AddSequence {
+		return 0
+	}
+	n := uint64(1)
+	if msg.GetEventType() == events.Envelope_LogMessage && s.config.LogOverflow == LogOverflowSplit {
+		n = maxMessageParts
+	}
+	return atomic.AddUint64(&s.sequence, n) - n + 1
+}
+
+// buildEvent builds the HEC event of the parsed event received by the sink at the
+// received unix nano time, with the nozzle_sequence of the event
+func (s *Splunk) buildEvent(fields map[string]interface{}, received int64, sequence uint64) map[string]interface{} {
 	if msg, ok := fields["msg"]; ok {
 		if msgStr, ok := msg.(string); ok && len(msgStr) > 0 {
 			fields["msg"] = utils.ToJson(msgStr)
@@ -232,28 +958,286 @@ func (s *Splunk) buildEvent(fields map[string]interface{}) map[string]interface{
 
 	event["host"] = fields["ip"]
 	event["source"] = fields["job"]
+	if index, _ := s.mappedIndex(fields); index != "" {
+		event["index"] = index
+	}
 
 	if eventType, ok := fields["event_type"].(string); ok {
 		event["sourcetype"] = fmt.Sprintf("cf:%s", strings.ToLower(eventType))
+		if sourcetype := s.config.EventMappings[eventType].Sourcetype; sourcetype != "" {
+			event["sourcetype"] = sourcetype
+		}
 	}
 
 	extraFields := make(map[string]interface{})
 
-	if s.config.TraceLogging {
+	if s.traced(fields) {
 		extraFields["nozzle-event-counter"] = strconv.FormatUint(atomic.AddUint64(&s.eventCount, 1), 10)
 		extraFields["subscription-id"] = s.config.SubscriptionID
 		extraFields["uuid"] = s.config.UUID
 	}
+	if s.config.AddSequence {
+		extraFields["nozzle_sequence"] = strconv.FormatUint(sequence, 10)
+	}
+	if s.config.AddSchemaVersion {
+		extraFields["nozzle_schema_version"] = SchemaVersion
+	}
+	if s.config.AddSubscriptionID {
+		extraFields["subscription-id"] = s.config.SubscriptionID
+	}
+	if s.config.AddIngestTime {
+		extraFields["nozzle_ingest_time"] = utils.NanoSecondsToSeconds(received)
+	}
 	for k, v := range s.config.ExtraFields {
 		extraFields[k] = v
 	}
+	for k, v := range s.config.IndexExtraFields[s.destinationIndex(fields)] {
+		extraFields[k] = v
+	}
+	// Last, as the trace logging and the index extra fields may need the app GUID
+	if s.config.AppKeyMode != "" && s.config.AppKeyMode != AppKeyOff {
+		s.addAppKey(fields)
+	}
 	event["fields"] = extraFields
+	if s.multiMetric(fields) {
+		s.toMultiMetric(event, fields, extraFields)
+		return event
+	}
 	event["event"] = fields
 	return event
 }
 
+// traced returns whether trace logging fields are added to the event, which with
+// TraceAppGUIDs is only the case for the events of these apps
+func (s *Splunk) traced(fields map[string]interface{}) bool {
+	if !s.config.TraceLogging {
+		return false
+	}
+	if len(s.config.TraceAppGUIDs) == 0 {
+		return true
+	}
+	appId, _ := fields["cf_app_id"].(string)
+	return s.config.TraceAppGUIDs[appId]
+}
+
+// destinationIndex returns the index the event will be sent to, which is the
+// quarantine index of the events missing app metadata, the app's SPLUNK_INDEX if
+// set, the index of the app name, the index of the message type, the index of the
+// event type or the default index
+func (s *Splunk) destinationIndex(fields map[string]interface{}) string {
+	if s.quarantined(fields) {
+		return s.config.QuarantineIndex
+	}
+	if index, ok := fields["info_splunk_index"].(string); ok && index != "" {
+		return index
+	}
+	if index, _ := s.mappedIndex(fields); index != "" {
+		return index
+	}
+	return s.config.Index
+}
+
+// mappedIndex returns the index the event is routed to by the index settings, and
+// the name of the setting, or "" when the app sets SPLUNK_INDEX or no setting applies.
+// Quarantined events are routed to the quarantine index whatever their app sets
+func (s *Splunk) mappedIndex(fields map[string]interface{}) (string, string) {
+	if s.quarantined(fields) {
+		return s.config.QuarantineIndex, "QUARANTINE_INDEX"
+	}
+	if index := s.appNameIndex(fields); index != "" {
+		return index, "INDEX_MAPPINGS"
+	}
+	if index := s.messageTypeIndex(fields); index != "" {
+		return index, "MESSAGE_TYPE_INDEXES"
+	}
+	if index := s.eventTypeIndex(fields); index != "" {
+		return index, "EVENT_MAPPING_FILE"
+	}
+	return "", ""
+}
+
+// quarantined returns whether the event is sent to the quarantine index, as it is
+// missing app metadata
+func (s *Splunk) quarantined(fields map[string]interface{}) bool {
+	quarantined, _ := fields["cf_quarantined"].(bool)
+	return quarantined && s.config.QuarantineIndex != ""
+}
+
+// appNameIndex returns the index of the first index mapping matching the app name of
+// an event without an app SPLUNK_INDEX, or "" when no mapping matches. Events whose
+// app name isn't known, because the app isn't in the cache yet, aren't routed by name
+func (s *Splunk) appNameIndex(fields map[string]interface{}) string {
+	if len(s.config.IndexMappings) == 0 {
+		return ""
+	}
+	if index, ok := fields["info_splunk_index"].(string); ok && index != "" {
+		return ""
+	}
+	appName, _ := fields["cf_app_name"].(string)
+	if appName == "" {
+		return ""
+	}
+	for i := range s.config.IndexMappings {
+		if s.config.IndexMappings[i].Matches(appName) {
+			return s.config.IndexMappings[i].Index
+		}
+	}
+	return ""
+}
+
+// messageTypeIndex returns the index of the message type of a LogMessage without an
+// app SPLUNK_INDEX, or "" when the event isn't routed by its message type
+func (s *Splunk) messageTypeIndex(fields map[string]interface{}) string {
+	if len(s.config.MessageTypeIndexes) == 0 {
+		return ""
+	}
+	if index, ok := fields["info_splunk_index"].(string); ok && index != "" {
+		return ""
+	}
+	messageType, _ := fields["message_type"].(string)
+	return s.config.MessageTypeIndexes[messageType]
+}
+
+// eventTypeIndex returns the index of the event type in the event mapping file for
+// events without an app SPLUNK_INDEX, or "" when the event type isn't mapped to an index
+func (s *Splunk) eventTypeIndex(fields map[string]interface{}) string {
+	if len(s.config.EventMappings) == 0 {
+		return ""
+	}
+	if index, ok := fields["info_splunk_index"].(string); ok && index != "" {
+		return ""
+	}
+	eventType, _ := fields["event_type"].(string)
+	return s.config.EventMappings[eventType].Index
+}
+
+// route explains the destination index of the event and the filters it passed
+func (s *Splunk) route(eventType events.Envelope_EventType, fields map[string]interface{}) map[string]interface{} {
+	rule := "SPLUNK_INDEX"
+	if s.quarantined(fields) {
+		rule = "QUARANTINE_INDEX"
+	} else if index, ok := fields["info_splunk_index"].(string); ok && index != "" {
+		rule = "app SPLUNK_INDEX"
+	} else if _, mapped := s.mappedIndex(fields); mapped != "" {
+		rule = mapped
+	} else if s.config.Index == "" {
+		rule = "HEC token default index"
+	}
+
+	filters := []string{"EVENTS"}
+	if ratio, ok := s.parseConfig.SampleRatios[eventType.String()]; ok && ratio < 1 {
+		filters = append(filters, "SAMPLE_RATIOS")
+	}
+	switch eventType {
+	case events.Envelope_HttpStartStop:
+		statusCode, _ := fields["status_code"].(int32)
+		if s.parseConfig.HttpStatusSampleRates[int(statusCode/100)] > 1 {
+			filters = append(filters, "HTTP_SAMPLE_RATES")
+		}
+	case events.Envelope_ContainerMetric:
+		if s.parseConfig.ContainerMetricMaxSampleRate > 1 {
+			filters = append(filters, "CONTAINER_METRIC_MAX_SAMPLE_RATE")
+		}
+	}
+	if appId, _ := fields["cf_app_id"].(string); appId != "" {
+		filters = append(filters, "F2S_DISABLE_LOGGING")
+		if s.parseConfig.RequireEnrichment {
+			filters = append(filters, "REQUIRE_ENRICHMENT")
+		}
+	}
+	if s.parseConfig.Filter != nil {
+		filters = append(filters, "EVENT_FILTER")
+	}
+
+	return map[string]interface{}{
+		"index":      s.destinationIndex(fields),
+		"index_rule": rule,
+		"filters":    filters,
+	}
+}
+
+// lookupFailed counts the failed app metadata lookup and sends a diagnostic event to
+// Splunk, at most once per LookupFailureInterval, so enrichment outages are visible
+// next to the unannotated events
+func (s *Splunk) lookupFailed(appId interface{}, err error) {
+	s.lookupFailureCounter.Add(1)
+	atomic.AddUint64(&s.lookupFailures, 1)
+
+	if s.config.LookupFailureInterval <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastDiagnostic)
+	if now-last < int64(s.config.LookupFailureInterval) || !atomic.CompareAndSwapInt64(&s.lastDiagnostic, last, now) {
+		return
+	}
+
+	event := map[string]interface{}{
+		"host":       s.config.Hostname,
+		"sourcetype": "cf:splunknozzle:diagnostic",
+		"time":       utils.NanoSecondsToSeconds(now),
+		"event": map[string]interface{}{
+			"message":   s.lookupFailureMessage(),
+			"error":     err.Error(),
+			"failures":  atomic.SwapUint64(&s.lookupFailures, 0),
+			"cf_app_id": appId,
+			"ip":        s.ip,
+			"origin":    "splunk_nozzle",
+		},
+	}
+
+	if s.config.LoggingIndex != "" {
+		event["index"] = s.config.LoggingIndex
+	}
+
+	// Sent apart, so an unreachable HEC doesn't hold up the consumer. The event is
+	// dropped while the previous one is still being sent
+	select {
+	case s.diagnostics <- event:
+	default:
+	}
+}
+
+// lookupFailureMessage tells what happens to the events of apps whose metadata can't
+// be fetched
+func (s *Splunk) lookupFailureMessage() string {
+	switch {
+	case s.parseConfig.RequireEnrichment:
+		return "Failed to fetch app metadata, events without app info are dropped"
+	case s.config.QuarantineIndex != "":
+		return "Failed to fetch app metadata, events without app info are sent to the quarantine index"
+	default:
+		return "Failed to fetch app metadata, events are sent without app info"
+	}
+}
+
+// sendDiagnostics sends the diagnostic events of lookupFailed, and the pending one
+// once the sink is closing
+func (s *Splunk) sendDiagnostics() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case event := <-s.diagnostics:
+			s.writers[len(s.writers)-1].Write([]map[string]interface{}{event})
+		case <-s.closing:
+			select {
+			case event := <-s.diagnostics:
+				s.writers[len(s.writers)-1].Write([]map[string]interface{}{event})
+			default:
+			}
+			return
+		}
+	}
+}
+
 // Log implements lager.Sink required interface
 func (s *Splunk) Log(message lager.LogFormat) {
+	if !s.forwardLog(message) {
+		return
+	}
+
 	e := map[string]interface{}{
 		"logger_source": message.Source,
 		"message":       message.Message,
@@ -288,13 +1272,26 @@ func (s *Splunk) Log(message lager.LogFormat) {
 	s.writers[len(s.writers)-1].Write(events)
 }
 
+// forwardLog decides if the nozzle's own log event is sent to Splunk. Errors are
+// always forwarded unless forwarding is disabled, other levels are downsampled
+func (s *Splunk) forwardLog(message lager.LogFormat) bool {
+	if s.config.DropNozzleLogs {
+		return false
+	}
+	if message.LogLevel >= lager.ERROR || s.config.NozzleLogSampleRate <= 1 {
+		return true
+	}
+	return (atomic.AddUint64(&s.logCount, 1)-1)%uint64(s.config.NozzleLogSampleRate) == 0
+}
+
 func (s *Splunk) LogStatus() {
 	timer := time.NewTimer(s.config.StatusMonitorInterval)
 	var sent uint64 = 0
 	for {
 		select {
 		case <-timer.C:
-			percent := float64(len(s.events)) / float64(s.config.QueueSize) * 100.0
+			length := s.queueLength()
+			percent := float64(length) / float64(s.queueCapacity()) * 100.0
 			status := "low"
 			switch {
 			case percent > 99.9:
@@ -304,7 +1301,7 @@ func (s *Splunk) LogStatus() {
 			case percent > 50:
 				status = "medium"
 			}
-			s.config.Logger.Info("Memory_Queue_Pressure", lager.Data{"events_in_consumer_queue": len(s.events), "percentage": int(percent), "status": status})
+			s.config.Logger.Info("Memory_Queue_Pressure", lager.Data{"events_in_consumer_queue": length, "percentage": int(percent), "status": status})
 			s.config.Logger.Info("Event_Count", lager.Data{"event_count_sent": sent})
 			sent = 0
 			timer.Reset(s.config.StatusMonitorInterval)
@@ -318,6 +1315,13 @@ func (s *Splunk) LogStatus() {
 	}
 }
 
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func getRetryInterval(attempt int) time.Duration {
 	// algorithm taken from https://en.wikipedia.org/wiki/Exponential_backoff
 	timeInSec := 5 + (0.5 * (math.Exp2(float64(attempt)) - 1.0))
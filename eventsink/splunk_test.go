@@ -1,8 +1,14 @@
 package eventsink_test
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -11,10 +17,12 @@ import (
 	"code.cloudfoundry.org/lager"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/cache"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventrouter"
+	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
 	"github.com/cloudfoundry/sonde-go/events"
 
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
 )
 
@@ -60,6 +68,7 @@ var _ = Describe("Splunk", func() {
 			Job:        &job,
 			Index:      &jobIndex,
 			Ip:         &ip,
+			Error:      &events.Error{},
 		}
 
 		//using routing to serialize envelope
@@ -177,6 +186,714 @@ var _ = Describe("Splunk", func() {
 		Expect(sink.DroppedEvents).To(Equal(uint64(1)))
 	})
 
+	It("scales the workers between MinWorkers and MaxWorkers on the queue depth", func() {
+		release := make(chan struct{})
+		var writers []eventwriter.Writer
+		for i := 0; i < 3; i++ {
+			writers = append(writers, &testing.EventWriterMock{PostBatchFn: func([]map[string]interface{}) error {
+				<-release
+				return nil
+			}})
+		}
+		writers = append(writers, mockClient2)
+		config.QueueSize = 4
+		config.MinWorkers = 1
+		config.MaxWorkers = 3
+		config.ScaleInterval = 5 * time.Millisecond
+		config.Metrics = monitoring.NewMetrics()
+		sink = eventsink.NewSplunk(writers, config, rconfig, cache.NewNoCache())
+		active := func() float64 {
+			return config.Metrics.Snapshot()["splunk.workers.active"]
+		}
+
+		eventType = events.Envelope_Error
+		for i := 0; i < 4; i++ {
+			eventRouter.Route(envelope)
+		}
+		sink.Open()
+		Expect(active()).To(Equal(float64(1)))
+		for _, event := range memSink.Events {
+			sink.Write(event)
+		}
+		Eventually(active).Should(Equal(float64(3)))
+		Consistently(active, 50*time.Millisecond).Should(BeNumerically("<=", 3))
+
+		close(release)
+		Eventually(active).Should(Equal(float64(1)))
+		Ω(sink.Close()).Should(Succeed())
+		Expect(active()).To(Equal(float64(0)))
+	})
+
+	Context("When sync send is enabled", func() {
+		BeforeEach(func() {
+			config.SyncSend = true
+			config.BatchSize = 2
+			config.FlushInterval = time.Hour
+			eventType = events.Envelope_Error
+			eventRouter.Route(envelope)
+			eventRouter.Route(envelope)
+			sink.Open()
+		})
+
+		It("delivers the batch before Write returns", func() {
+			sink.Write(memSink.Events[0])
+			Expect(mockClient.CapturedEvents()).To(HaveLen(0))
+
+			sink.Write(memSink.Events[1])
+			Expect(mockClient.CapturedEvents()).To(HaveLen(2))
+		})
+
+		It("retries until the batch is delivered", func() {
+			attempts := 0
+			mockClient.PostBatchFn = func(events []map[string]interface{}) error {
+				attempts++
+				if attempts < 2 {
+					return errors.New("mockup error")
+				}
+				return nil
+			}
+
+			sink.Write(memSink.Events[0])
+			sink.Write(memSink.Events[1])
+			Expect(attempts).To(Equal(2))
+		})
+
+		It("flushes the pending events on close", func() {
+			sink.Write(memSink.Events[0])
+			Expect(sink.Close()).To(Succeed())
+			Expect(mockClient.CapturedEvents()).To(HaveLen(1))
+		})
+
+		It("drops the batch after the last retry once stopped", func() {
+			mockClient.ReturnErr = true
+			sink.Stop()
+
+			done := make(chan struct{})
+			go func() {
+				sink.Write(memSink.Events[0])
+				sink.Write(memSink.Events[1])
+				close(done)
+			}()
+			Eventually(done).Should(BeClosed())
+			Expect(errors.Is(sink.Close(), eventsink.ErrEventsAbandoned)).To(BeTrue())
+		})
+	})
+
+	It("warms up writers on open", func() {
+		config.WarmUp = true
+
+		sink.Open()
+
+		Expect(mockClient.WarmedUp()).To(BeTrue())
+		Expect(mockClient2.WarmedUp()).To(BeTrue())
+	})
+
+	It("doesn't warm up writers by default", func() {
+		sink.Open()
+
+		Expect(mockClient.WarmedUp()).To(BeFalse())
+	})
+
+	It("adds an increasing sequence when enabled", func() {
+		config.AddSequence = true
+		start := uint64(time.Now().UnixNano())
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(2))
+
+		first, _ := strconv.ParseUint(mockClient.CapturedEvents()[0]["fields"].(map[string]interface{})["nozzle_sequence"].(string), 10, 64)
+		second, _ := strconv.ParseUint(mockClient.CapturedEvents()[1]["fields"].(map[string]interface{})["nozzle_sequence"].(string), 10, 64)
+		Expect(first).To(BeNumerically(">", start))
+		Expect(second).To(Equal(first + 1))
+	})
+
+	It("numbers the events in the order they are written with CLASS_QUEUES", func() {
+		config.AddSequence = true
+		config.ClassQueues = map[string]eventsink.ClassQueueConfig{eventsink.ClassErrors: {}}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		// Queued before the consumers start, the error is sent first
+		name, delta, total := "requests", uint64(1), uint64(1)
+		counter := *envelope
+		counter.EventType = events.Envelope_CounterEvent.Enum()
+		counter.CounterEvent = &events.CounterEvent{Name: &name, Delta: &delta, Total: &total}
+		sink.Write(&counter)
+		eventType = events.Envelope_Error
+		sink.Write(envelope)
+
+		sink.Open()
+		sink.Close()
+
+		sequences := map[string]uint64{}
+		for _, event := range mockClient.CapturedEvents() {
+			sequences[event["sourcetype"].(string)], _ = strconv.ParseUint(event["fields"].(map[string]interface{})["nozzle_sequence"].(string), 10, 64)
+		}
+		Expect(mockClient.CapturedEvents()[0]["sourcetype"]).To(Equal("cf:error"))
+		Expect(sequences["cf:error"]).To(Equal(sequences["cf:counterevent"] + 1))
+	})
+
+	It("doesn't add a sequence by default", func() {
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(1))
+		Expect(mockClient.CapturedEvents()[0]["fields"]).NotTo(HaveKey("nozzle_sequence"))
+	})
+
+	It("adds the trace logging fields only to the events of the traced apps", func() {
+		config.TraceLogging = true
+		config.TraceAppGUIDs = map[string]bool{"traced-app": true}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_LogMessage
+		for _, appId := range []string{"traced-app", "other-app"} {
+			appId := appId
+			logEnvelope := *envelope
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte("log line"), AppId: &appId}
+			eventRouter.Route(&logEnvelope)
+		}
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+		traced, other := mockClient.CapturedEvents()[0], mockClient.CapturedEvents()[1]
+		Expect(traced["fields"]).To(HaveKeyWithValue("uuid", config.UUID))
+		Expect(traced["fields"]).To(HaveKey("nozzle-event-counter"))
+		Expect(other["fields"]).NotTo(HaveKey("uuid"))
+		Expect(other["fields"]).NotTo(HaveKey("nozzle-event-counter"))
+	})
+
+	It("adds the ingest and delivery times when enabled", func() {
+		config.AddIngestTime = true
+		config.AddDeliveryTime = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		before := float64(time.Now().UnixNano()) / 1e9
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(1))
+		fields := mockClient.CapturedEvents()[0]["fields"].(map[string]interface{})
+		ingestTime, err := strconv.ParseFloat(fields["nozzle_ingest_time"].(string), 64)
+		Ω(err).ShouldNot(HaveOccurred())
+		deliveryTime, err := strconv.ParseFloat(fields["nozzle_delivery_time"].(string), 64)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(ingestTime).To(BeNumerically(">=", before))
+		Expect(deliveryTime).To(BeNumerically(">=", ingestTime))
+	})
+
+	It("doesn't add the ingest and delivery times by default", func() {
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(1))
+		fields := mockClient.CapturedEvents()[0]["fields"]
+		Expect(fields).NotTo(HaveKey("nozzle_ingest_time"))
+		Expect(fields).NotTo(HaveKey("nozzle_delivery_time"))
+	})
+
+	It("adds the schema version when enabled", func() {
+		config.AddSchemaVersion = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(1))
+		Expect(mockClient.CapturedEvents()[0]["fields"]).To(HaveKeyWithValue("nozzle_schema_version", eventsink.SchemaVersion))
+	})
+
+	It("adds the subscription ID when enabled", func() {
+		config.AddSubscriptionID = true
+		config.SubscriptionID = "splunk-firehose-a"
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(1))
+		fields := mockClient.CapturedEvents()[0]["fields"]
+		Expect(fields).To(HaveKeyWithValue("subscription-id", "splunk-firehose-a"))
+		Expect(fields).NotTo(HaveKey("uuid"))
+	})
+
+	It("adds extra fields scoped to the destination index", func() {
+		config.Index = "main"
+		config.IndexExtraFields = map[string]map[string]string{
+			"main":     {"team": "payments", "env": "prod"},
+			"app_logs": {"tier": "gold"},
+		}
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() []map[string]interface{} {
+			return mockClient.CapturedEvents()
+		}).Should(HaveLen(1))
+
+		fields := mockClient.CapturedEvents()[0]["fields"].(map[string]interface{})
+		Expect(fields["team"]).To(Equal("payments"))
+		Expect(fields["env"]).To(Equal("prod"))
+		Expect(fields["test"]).To(Equal("field"))
+		Expect(fields).NotTo(HaveKey("tier"))
+	})
+
+	It("sends log lines to the index of their message type", func() {
+		config.Index = "main"
+		config.MessageTypeIndexes = map[string]string{"ERR": "app_errors"}
+		config.IndexExtraFields = map[string]map[string]string{"app_errors": {"severity": "high"}}
+		eventType = events.Envelope_LogMessage
+		for _, messageType := range []events.LogMessage_MessageType{events.LogMessage_ERR, events.LogMessage_OUT} {
+			messageType := messageType
+			logEnvelope := *envelope
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte("log line"), MessageType: &messageType}
+			eventRouter.Route(&logEnvelope)
+		}
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+		stderr, stdout := mockClient.CapturedEvents()[0], mockClient.CapturedEvents()[1]
+		Expect(stderr["index"]).To(Equal("app_errors"))
+		Expect(stderr["fields"]).To(HaveKeyWithValue("severity", "high"))
+		Expect(stdout).NotTo(HaveKey("index"))
+		Expect(stdout["fields"]).NotTo(HaveKey("severity"))
+	})
+
+	It("sends events to the index and sourcetype of their event type", func() {
+		config.Index = "main"
+		config.MessageTypeIndexes = map[string]string{"ERR": "app_errors"}
+		config.EventMappings = map[string]fevents.EventMapping{
+			"LogMessage": {Index: "cf_logs", Sourcetype: "cf:app"},
+		}
+		eventType = events.Envelope_LogMessage
+		for _, messageType := range []events.LogMessage_MessageType{events.LogMessage_ERR, events.LogMessage_OUT} {
+			messageType := messageType
+			logEnvelope := *envelope
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte("log line"), MessageType: &messageType}
+			eventRouter.Route(&logEnvelope)
+		}
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+		stderr, stdout := mockClient.CapturedEvents()[0], mockClient.CapturedEvents()[1]
+		Expect(stderr["index"]).To(Equal("app_errors"))
+		Expect(stdout["index"]).To(Equal("cf_logs"))
+		Expect(stderr["sourcetype"]).To(Equal("cf:app"))
+		Expect(stdout["sourcetype"]).To(Equal("cf:app"))
+	})
+
+	It("drops the events queued for longer than MaxQueueAge", func() {
+		posted, release := make(chan struct{}, 2), make(chan struct{})
+		blocked := &testing.EventWriterMock{PostBatchFn: func([]map[string]interface{}) error {
+			posted <- struct{}{}
+			<-release
+			return nil
+		}}
+		config.MaxQueueAge = 20 * time.Millisecond
+		config.Metrics = monitoring.NewMetrics()
+		sink = eventsink.NewSplunk([]eventwriter.Writer{blocked, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		eventRouter.Route(envelope)
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		Eventually(posted).Should(Receive())
+		sink.Write(memSink.Events[1])
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		Eventually(func() float64 {
+			return config.Metrics.Snapshot()["splunk.events.expired"]
+		}).Should(Equal(float64(1)))
+		Expect(config.Metrics.Snapshot()["splunk.drops.expired.Error"]).To(Equal(float64(1)))
+		Consistently(posted, 50*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("counts the writes of each worker with WorkerMetrics", func() {
+		failing := &testing.EventWriterMock{ReturnErr: true}
+		config.WorkerMetrics = true
+		config.Metrics = monitoring.NewMetrics()
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, failing, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		for i := 0; i < 10; i++ {
+			eventRouter.Route(envelope)
+		}
+		sink.Open()
+		for _, event := range memSink.Events {
+			sink.Write(event)
+		}
+
+		Eventually(func() float64 {
+			snapshot := config.Metrics.Snapshot()
+			return snapshot["splunk.worker.0.events"] + snapshot["splunk.worker.1.errors"]
+		}).Should(Equal(float64(10)))
+		snapshot := config.Metrics.Snapshot()
+		Expect(snapshot["splunk.worker.0.requests"]).To(Equal(snapshot["splunk.worker.0.events"]))
+		Expect(snapshot["splunk.worker.0.errors"]).To(Equal(float64(0)))
+		Expect(snapshot["splunk.worker.1.events"]).To(Equal(float64(0)))
+		Expect(snapshot).To(HaveKey("splunk.worker.1.latency_ms"))
+		Expect(snapshot).NotTo(HaveKey("splunk.worker.2.requests"))
+	})
+
+	Context("with LogMaxChars", func() {
+		var logMessage = func(message string) {
+			eventType = events.Envelope_LogMessage
+			logEnvelope := *envelope
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte(message), MessageType: events.LogMessage_OUT.Enum()}
+			eventRouter.Route(&logEnvelope)
+			sink.Open()
+			sink.Write(memSink.Events[0])
+		}
+
+		BeforeEach(func() {
+			config.LogMaxChars = 4
+		})
+
+		It("truncates long messages", func() {
+			logMessage("abcdefghij")
+			Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+			event := mockClient.CapturedEvents()[0]["event"].(map[string]interface{})
+			Expect(event["msg"]).To(Equal("abcd"))
+			Expect(event["msg_truncated"]).To(BeTrue())
+			Expect(config.Metrics.Snapshot()["splunk.events.oversized"]).To(Equal(float64(1)))
+		})
+
+		It("drops long messages", func() {
+			config.LogOverflow = eventsink.LogOverflowDrop
+			logMessage("abcdefghij")
+			Consistently(mockClient.CapturedEvents, 200*time.Millisecond).Should(BeEmpty())
+			Expect(config.Metrics.Snapshot()["splunk.drops.oversized.LogMessage"]).To(Equal(float64(1)))
+		})
+
+		It("splits long messages", func() {
+			config.LogOverflow = eventsink.LogOverflowSplit
+			logMessage("abcdefghij")
+			Eventually(mockClient.CapturedEvents).Should(HaveLen(3))
+			for i, msg := range []string{"abcd", "efgh", "ij"} {
+				event := mockClient.CapturedEvents()[i]["event"].(map[string]interface{})
+				Expect(event["msg"]).To(Equal(msg))
+				Expect(event["msg_part"]).To(Equal(i + 1))
+				Expect(event["msg_parts"]).To(Equal(3))
+				Expect(event).NotTo(HaveKey("msg_truncated"))
+			}
+		})
+
+		It("keeps short messages", func() {
+			logMessage("abc")
+			Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+			event := mockClient.CapturedEvents()[0]["event"].(map[string]interface{})
+			Expect(event["msg"]).To(Equal("abc"))
+			Expect(event).NotTo(HaveKey("msg_truncated"))
+		})
+	})
+
+	It("drops extra fields over the maximum size", func() {
+		config.Index = "main"
+		config.MaxExtraFieldBytes = 4
+		config.ExtraFields = map[string]string{"env": "dev", "notes": "far too long"}
+		config.IndexExtraFields = map[string]map[string]string{
+			"main": {"team": "payments", "tier": "gold"},
+		}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+		fields := mockClient.CapturedEvents()[0]["fields"].(map[string]interface{})
+		Expect(fields["env"]).To(Equal("dev"))
+		Expect(fields["tier"]).To(Equal("gold"))
+		Expect(fields).NotTo(HaveKey("notes"))
+		Expect(fields).NotTo(HaveKey("team"))
+	})
+
+	It("flushes the destination index at its own interval", func() {
+		config.Index = "main"
+		config.FlushInterval = time.Hour
+		config.BatchSize = 100
+		config.IndexBatching = map[string]eventsink.IndexBatchConfig{
+			"main": {FlushInterval: 10 * time.Millisecond},
+		}
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+	})
+
+	It("batches other indexes in the default lane", func() {
+		config.Index = "main"
+		config.FlushInterval = time.Hour
+		config.BatchSize = 2
+		config.IndexBatching = map[string]eventsink.IndexBatchConfig{
+			"alerts": {FlushInterval: 10 * time.Millisecond, BatchSize: 1},
+		}
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		Consistently(mockClient.CapturedEvents, 100*time.Millisecond).Should(BeEmpty())
+
+		sink.Write(memSink.Events[0])
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+	})
+
+	It("batches the events of several indexes together unless split by index", func() {
+		config.Index = "main"
+		config.FlushInterval = time.Hour
+		config.BatchSize = 10
+		config.MessageTypeIndexes = map[string]string{"ERR": "app_errors"}
+		eventType = events.Envelope_LogMessage
+		for _, messageType := range []events.LogMessage_MessageType{events.LogMessage_ERR, events.LogMessage_OUT} {
+			messageType := messageType
+			logEnvelope := *envelope
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte("log line"), MessageType: &messageType}
+			eventRouter.Route(&logEnvelope)
+		}
+
+		batches := func(splitByIndex bool) [][]string {
+			var lock sync.Mutex
+			var batches [][]string
+			writer := &testing.EventWriterMock{PostBatchFn: func(events []map[string]interface{}) error {
+				var indexes []string
+				for _, event := range events {
+					index, _ := event["index"].(string)
+					indexes = append(indexes, index)
+				}
+				lock.Lock()
+				batches = append(batches, indexes)
+				lock.Unlock()
+				return nil
+			}}
+			config.SplitByIndex = splitByIndex
+			// A single consumer, the last writer isn't consumed with
+			sink := eventsink.NewSplunk([]eventwriter.Writer{writer, &testing.EventWriterMock{}}, config, rconfig, cache.NewNoCache())
+			sink.Open()
+			sink.Write(memSink.Events[0])
+			sink.Write(memSink.Events[1])
+			Ω(sink.Close()).Should(Succeed())
+			return batches
+		}
+
+		// The default index isn't set per event
+		Expect(batches(false)).To(Equal([][]string{{"app_errors", ""}}))
+		Expect(batches(true)).To(ConsistOf([]string{"app_errors"}, []string{""}))
+	})
+
+	It("parses index batching", func() {
+		configs, err := eventsink.ParseIndexBatchConfigs(`{"alerts": {"flush_interval": "1s", "batch_size": 10, "retries": 20, "dead_letter": true}, "archive": {"batch_size": 1000}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(configs).To(Equal(map[string]eventsink.IndexBatchConfig{
+			"alerts":  {FlushInterval: time.Second, BatchSize: 10, Retries: 20, DeadLetter: true},
+			"archive": {BatchSize: 1000},
+		}))
+
+		configs, err = eventsink.ParseIndexBatchConfigs(" ")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(configs).To(BeNil())
+
+		_, err = eventsink.ParseIndexBatchConfigs(`{"alerts": {"flush_interval": "soon"}}`)
+		Ω(err).Should(HaveOccurred())
+
+		_, err = eventsink.ParseIndexBatchConfigs(`{"alerts": {"retries": -1}}`)
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("retries and dead letters the batches of an index with its own policy", func() {
+		var attempts int32
+		failing := &testing.EventWriterMock{PostBatchFn: func([]map[string]interface{}) error {
+			atomic.AddInt32(&attempts, 1)
+			return testing.MockupErr
+		}}
+		deadLetter := &testing.EventWriterMock{}
+		config.Index = "compliance"
+		config.Retries = 3
+		config.Metrics = monitoring.NewMetrics()
+		config.DeadLetter = deadLetter
+		config.IndexBatching = map[string]eventsink.IndexBatchConfig{
+			"compliance": {Retries: 1, DeadLetter: true},
+		}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{failing, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(deadLetter.CapturedEvents, 10*time.Second).Should(HaveLen(1))
+		Expect(deadLetter.CapturedEvents()[0]["event"]).To(HaveKeyWithValue("event_type", "Error"))
+		Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(1)))
+		Expect(config.Metrics.Snapshot()["splunk.events.dead_lettered"]).To(Equal(float64(1)))
+	})
+
+	It("dead letters the events rejected by HEC without retrying the batch", func() {
+		var attempts int32
+		rejecting := &testing.EventWriterMock{PostBatchFn: func(batch []map[string]interface{}) error {
+			atomic.AddInt32(&attempts, 1)
+			return &eventwriter.RejectedEventsError{Events: batch[:1]}
+		}}
+		deadLetter := &testing.EventWriterMock{}
+		config.Metrics = monitoring.NewMetrics()
+		config.DeadLetter = deadLetter
+		sink = eventsink.NewSplunk([]eventwriter.Writer{rejecting, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		Ω(sink.Close()).Should(Succeed())
+
+		Expect(deadLetter.CapturedEvents()).To(HaveLen(1))
+		Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(1)))
+		Expect(config.Metrics.Snapshot()["splunk.events.dead_lettered"]).To(Equal(float64(1)))
+	})
+
+	It("counts the batches the dead letter writer fails to write only as send_failed", func() {
+		failing := &testing.EventWriterMock{ReturnErr: true}
+		deadLetter := &testing.EventWriterMock{PostBatchFn: func([]map[string]interface{}) error {
+			return errors.New("disk full")
+		}}
+		config.Index = "compliance"
+		config.Metrics = monitoring.NewMetrics()
+		config.DeadLetter = deadLetter
+		config.IndexBatching = map[string]eventsink.IndexBatchConfig{
+			"compliance": {Retries: 1, DeadLetter: true},
+		}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{failing, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(func() float64 {
+			return config.Metrics.Snapshot()["splunk.drops.send_failed.Error"]
+		}, 10*time.Second).Should(Equal(float64(1)))
+		Consistently(func() float64 {
+			return config.Metrics.Snapshot()["splunk.events.dead_lettered"]
+		}).Should(BeZero())
+	})
+
+	It("queues event classes separately and sends errors first", func() {
+		config.Metrics = monitoring.NewMetrics()
+		config.BatchSize = 10
+		config.ClassQueues = map[string]eventsink.ClassQueueConfig{
+			eventsink.ClassMetrics: {QueueSize: 2, DropOldest: true},
+		}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		// Queued before the consumers start
+		for _, name := range []string{"first", "second", "third"} {
+			name, delta, total := name, uint64(1), uint64(1)
+			msg := *envelope
+			msg.EventType = events.Envelope_CounterEvent.Enum()
+			msg.CounterEvent = &events.CounterEvent{Name: &name, Delta: &delta, Total: &total}
+			sink.Write(&msg)
+		}
+		eventType = events.Envelope_Error
+		sink.Write(envelope)
+
+		sink.Open()
+		sink.Close()
+
+		var names []interface{}
+		for _, event := range mockClient.CapturedEvents() {
+			names = append(names, event["event"].(map[string]interface{})["name"])
+		}
+		Expect(names).To(Equal([]interface{}{nil, "second", "third"}))
+		Expect(config.Metrics.Snapshot()["splunk.events.dropped.metrics"]).To(Equal(float64(1)))
+		Expect(config.Metrics.Snapshot()["splunk.drops.queue_full.CounterEvent"]).To(Equal(float64(1)))
+		Expect(config.Metrics.Snapshot()["splunk.events.dropped.errors"]).To(Equal(float64(0)))
+	})
+
+	It("parses class queues", func() {
+		configs, err := eventsink.ParseClassQueueConfigs(`{"errors": {"queue_size": 100}, "metrics": {"drop": "oldest"}, "logs": {"drop": "newest"}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(configs).To(Equal(map[string]eventsink.ClassQueueConfig{
+			"errors":  {QueueSize: 100},
+			"logs":    {},
+			"metrics": {DropOldest: true},
+		}))
+
+		configs, err = eventsink.ParseClassQueueConfigs("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(configs).To(BeNil())
+
+		for _, invalid := range []string{`{"traces": {}}`, `{"logs": {"queue_size": -1}}`, `{"logs": {"drop": "random"}}`, `[]`} {
+			_, err = eventsink.ParseClassQueueConfigs(invalid)
+			Ω(err).Should(HaveOccurred(), invalid)
+		}
+
+		Expect(eventsink.EventClass(events.Envelope_Error)).To(Equal(eventsink.ClassErrors))
+		Expect(eventsink.EventClass(events.Envelope_HttpStartStop)).To(Equal(eventsink.ClassLogs))
+		Expect(eventsink.EventClass(events.Envelope_ContainerMetric)).To(Equal(eventsink.ClassMetrics))
+	})
+
+	It("adds the route of events when enabled", func() {
+		config.Index = "main"
+		config.AddRouteField = true
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+		route := mockClient.CapturedEvents()[0]["event"].(map[string]interface{})["_route"]
+		Expect(route).To(Equal(map[string]interface{}{
+			"index":      "main",
+			"index_rule": "SPLUNK_INDEX",
+			"filters":    []string{"EVENTS"},
+		}))
+	})
+
 	It("job_index is present, index is not", func() {
 		eventType = events.Envelope_Error
 		eventRouter.Route(envelope)
@@ -598,6 +1315,28 @@ var _ = Describe("Splunk", func() {
 		sink.Close()
 	})
 
+	It("drops the batches retried over the retry budget", func() {
+		dropped := make(chan []map[string]interface{}, 2)
+		config.Retries = 2
+		config.RetryBudget = 1
+		config.RetryBudgetPolicy = eventsink.RetryBudgetDrop
+		config.OnDropped = func(events []map[string]interface{}) {
+			dropped <- events
+		}
+		writers := []eventwriter.Writer{&testing.EventWriterMock{ReturnErr: true}, &testing.EventWriterMock{ReturnErr: true}, mockClient2}
+		sink = eventsink.NewSplunk(writers, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		Ω(sink.Open()).Should(Succeed())
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[0])
+
+		// Both workers retry after the first retry interval, only one is in the budget
+		Eventually(dropped, 8*time.Second).Should(Receive())
+		Expect(config.Metrics.Snapshot()["splunk.retry_budget.exhausted"]).To(Equal(float64(1)))
+	})
+
 	It("Close no error", func() {
 		eventType = events.Envelope_Error
 		eventRouter.Route(envelope)
@@ -612,6 +1351,532 @@ var _ = Describe("Splunk", func() {
 		Ω(err).ShouldNot(HaveOccurred())
 	})
 
+	It("calls OnDelivered with the delivered batch", func() {
+		delivered := make(chan []map[string]interface{}, 1)
+		config.OnDelivered = func(events []map[string]interface{}) {
+			delivered <- events
+		}
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		err := sink.Open()
+		Ω(err).ShouldNot(HaveOccurred())
+		err = sink.Write(memSink.Events[0])
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var batch []map[string]interface{}
+		Eventually(delivered).Should(Receive(&batch))
+		Expect(batch).To(HaveLen(1))
+		Expect(batch[0]["sourcetype"]).To(Equal("cf:error"))
+
+		sink.Close()
+	})
+
+	It("calls OnDropped with the dropped batch", func() {
+		dropped := make(chan []map[string]interface{}, 1)
+		config.OnDropped = func(events []map[string]interface{}) {
+			dropped <- events
+		}
+		mockClient.ReturnErr = true
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		err := sink.Open()
+		Ω(err).ShouldNot(HaveOccurred())
+		err = sink.Write(memSink.Events[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		sink.Close()
+
+		Expect(dropped).To(Receive(HaveLen(1)))
+	})
+
+	It("returns ErrEventsAbandoned when events are dropped while draining", func() {
+		mockClient.ReturnErr = true
+		config.FlushInterval = time.Hour
+		config.BatchSize = 10
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		err := sink.Close()
+		Expect(errors.Is(err, eventsink.ErrEventsAbandoned)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("1 events dropped")))
+	})
+
+	It("returns ErrEventsAbandoned when CloseTimeout expires", func() {
+		release := make(chan struct{})
+		written := make(chan int, 2)
+		blocked := &testing.EventWriterMock{PostBatchFn: func(events []map[string]interface{}) error {
+			<-release
+			written <- len(events)
+			return nil
+		}}
+		config.CloseTimeout = 20 * time.Millisecond
+		sink = eventsink.NewSplunk([]eventwriter.Writer{blocked, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+		eventRouter.Route(envelope)
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		err := sink.Close()
+		Expect(errors.Is(err, eventsink.ErrEventsAbandoned)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("still queued after 20ms")))
+
+		// The consumer reads the envelopes until it has written both events
+		close(release)
+		for count := 0; count < 2; {
+			count += <-written
+		}
+	})
+
+	It("calls OnHECFailing when HEC fails and recovers", func() {
+		failing := make(chan bool, 2)
+		config.Retries = 2
+		config.HECFailureThreshold = 1
+		config.OnHECFailing = func(f bool) {
+			failing <- f
+		}
+		var writes int32
+		mockClient.PostBatchFn = func(events []map[string]interface{}) error {
+			if atomic.AddInt32(&writes, 1) == 1 {
+				return testing.MockupErr
+			}
+			return nil
+		}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient}, config, rconfig, cache.NewNoCache())
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		Ω(sink.Open()).Should(Succeed())
+		sink.Write(memSink.Events[0])
+
+		Eventually(failing).Should(Receive(BeTrue()))
+		Eventually(failing, 8*time.Second).Should(Receive(BeFalse()))
+		sink.Close()
+	})
+
+	It("sends one diagnostic event per interval on app lookup failures", func() {
+		appCache := testing.NewMemoryCacheMock()
+		appCache.ReturnErr = true
+		config.LookupFailureInterval = time.Hour
+		config.Metrics = monitoring.NewMetrics()
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, appCache)
+
+		appId := "8463ec45-543c-4492-9ec6-f52707f7dd2b"
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = &events.LogMessage{AppId: &appId}
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		for i := 0; i < 3; i++ {
+			sink.Write(memSink.Events[0])
+		}
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(3))
+		sink.Close()
+
+		Expect(config.Metrics.Snapshot()["cache.lookup.failures"]).To(Equal(float64(3)))
+		Expect(mockClient2.CapturedEvents()).To(HaveLen(1))
+		diagnostic := mockClient2.CapturedEvents()[0]
+		Expect(diagnostic["sourcetype"]).To(Equal("cf:splunknozzle:diagnostic"))
+		Expect(diagnostic["event"].(map[string]interface{})["cf_app_id"]).To(Equal(appId))
+		Expect(diagnostic["event"].(map[string]interface{})["message"]).To(ContainSubstring("events are sent without app info"))
+	})
+
+	It("doesn't hold up the events while sending a diagnostic event", func() {
+		appCache := testing.NewMemoryCacheMock()
+		appCache.ReturnErr = true
+		config.LookupFailureInterval = time.Hour
+		config.QuarantineIndex = "quarantine"
+		release := make(chan struct{})
+		var diagnostics []map[string]interface{}
+		diagnosticClient := &testing.EventWriterMock{PostBatchFn: func(events []map[string]interface{}) error {
+			<-release
+			diagnostics = append(diagnostics, events...)
+			return nil
+		}}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, diagnosticClient}, config, rconfig, appCache)
+
+		appId := "8463ec45-543c-4492-9ec6-f52707f7dd2b"
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = &events.LogMessage{AppId: &appId}
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		for i := 0; i < 3; i++ {
+			sink.Write(memSink.Events[0])
+		}
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(3))
+		close(release)
+		sink.Close()
+
+		Expect(diagnostics).To(HaveLen(1))
+		Expect(diagnostics[0]["event"].(map[string]interface{})["message"]).To(ContainSubstring("sent to the quarantine index"))
+	})
+
+	It("sends the events of mapped orgs with the writer of their org", func() {
+		orgClient := &testing.EventWriterMock{}
+		rconfig.AddOrgGuid = true
+		config.OrgWriters = map[string]eventwriter.Writer{"f964a41c-76ac-42c1-b2ba-663da3ec22d7": orgClient}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, testing.NewMemoryCacheMock())
+
+		appId := "f964a41c-76ac-42c1-b2ba-663da3ec22d5"
+		logType := events.Envelope_LogMessage
+		logEnvelope := *envelope
+		logEnvelope.EventType = &logType
+		logEnvelope.LogMessage = &events.LogMessage{Message: []byte("tenant log"), AppId: &appId}
+		eventRouter.Route(&logEnvelope)
+		eventType = events.Envelope_Error
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		Eventually(orgClient.CapturedEvents).Should(HaveLen(1))
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+		Expect(orgClient.CapturedEvents()[0]["event"].(map[string]interface{})["msg"]).To(Equal("tenant log"))
+		Expect(mockClient.CapturedEvents()[0]["sourcetype"]).To(Equal("cf:error"))
+	})
+
+	It("applies the batching policy of the index to the events of mapped orgs", func() {
+		failing := &testing.EventWriterMock{ReturnErr: true}
+		deadLetter := &testing.EventWriterMock{}
+		rconfig.AddOrgGuid = true
+		config.Index = "compliance"
+		config.Retries = 3
+		config.DeadLetter = deadLetter
+		config.IndexBatching = map[string]eventsink.IndexBatchConfig{
+			"compliance": {Retries: 1, DeadLetter: true},
+		}
+		config.OrgWriters = map[string]eventwriter.Writer{"f964a41c-76ac-42c1-b2ba-663da3ec22d7": failing}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, testing.NewMemoryCacheMock())
+
+		appId := "f964a41c-76ac-42c1-b2ba-663da3ec22d5"
+		logType := events.Envelope_LogMessage
+		logEnvelope := *envelope
+		logEnvelope.EventType = &logType
+		logEnvelope.LogMessage = &events.LogMessage{Message: []byte("tenant log"), AppId: &appId}
+		eventRouter.Route(&logEnvelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(deadLetter.CapturedEvents, 10*time.Second).Should(HaveLen(1))
+		Expect(deadLetter.CapturedEvents()[0]["event"].(map[string]interface{})["msg"]).To(Equal("tenant log"))
+		Expect(mockClient.CapturedEvents()).To(BeEmpty())
+	})
+
+	It("adds a salted hash of the app GUID as app_key", func() {
+		appId := "f964a41c-76ac-42c1-b2ba-663da3ec22d5"
+		mac := hmac.New(sha256.New, []byte("pepper"))
+		mac.Write([]byte(appId))
+		key := hex.EncodeToString(mac.Sum(nil)[:16])
+
+		for mode, hasGUID := range map[string]bool{eventsink.AppKeyAdd: true, eventsink.AppKeyReplace: false} {
+			mockClient = &testing.EventWriterMock{}
+			config.AppKeyMode = mode
+			config.AppKeySalt = "pepper"
+			sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient}, config, rconfig, cache.NewNoCache())
+
+			logType := events.Envelope_LogMessage
+			logEnvelope := *envelope
+			logEnvelope.EventType = &logType
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte("log line"), AppId: &appId}
+
+			sink.Open()
+			sink.Write(&logEnvelope)
+			Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+			sink.Close()
+
+			fields := mockClient.CapturedEvents()[0]["event"].(map[string]interface{})
+			Expect(fields).To(HaveKeyWithValue("app_key", key), mode)
+			if hasGUID {
+				Expect(fields).To(HaveKeyWithValue("cf_app_id", appId), mode)
+			} else {
+				Expect(fields).NotTo(HaveKey("cf_app_id"), mode)
+			}
+		}
+	})
+
+	It("sends the events of apps to the index of their app name", func() {
+		mappings, err := fevents.ParseIndexMappings(`[{"by": "app_name_regex", "match": "^prod-", "index": "prod_logs"}, {"by": "app_name_regex", "match": "^testing-", "index": "testing_logs"}]`)
+		Ω(err).ShouldNot(HaveOccurred())
+		config.Index = "main"
+		config.IndexMappings = mappings
+		config.MessageTypeIndexes = map[string]string{"OUT": "app_out"}
+		rconfig.AddAppName = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, testing.NewMemoryCacheMock())
+
+		// The app of the first event is in the cache as testing-app, the second has no app
+		eventType = events.Envelope_LogMessage
+		for _, appId := range []string{"f964a41c-76ac-42c1-b2ba-663da3ec22d5", ""} {
+			appId := appId
+			logEnvelope := *envelope
+			logEnvelope.LogMessage = &events.LogMessage{Message: []byte("log line"), AppId: &appId, MessageType: events.LogMessage_OUT.Enum()}
+			eventRouter.Route(&logEnvelope)
+		}
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[1])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+		Expect(mockClient.CapturedEvents()[0]["index"]).To(Equal("testing_logs"))
+		Expect(mockClient.CapturedEvents()[1]["index"]).To(Equal("app_out"))
+	})
+
+	It("strips leading timestamps from log messages", func() {
+		rconfig.LogTimestampLayout = time.RFC3339
+		rconfig.LogTimestampAsTime = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = &events.LogMessage{Message: []byte("2021-05-04T10:11:12Z Started")}
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(1))
+		event = mockClient.CapturedEvents()[0]
+		Expect(event["time"]).To(Equal("1620123072.000000000"))
+		Expect(event["event"].(map[string]interface{})["msg"]).To(Equal("Started"))
+	})
+
+	It("counts events per org and space", func() {
+		config.OrgSpaceMetricsLimit = 10
+		config.Metrics = monitoring.NewMetrics()
+		rconfig.AddOrgName = true
+		rconfig.AddSpaceName = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, testing.NewMemoryCacheMock())
+
+		appId := "8463ec45-543c-4492-9ec6-f52707f7dd2b"
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = &events.LogMessage{AppId: &appId}
+		eventRouter.Route(envelope)
+
+		sink.Open()
+		sink.Write(memSink.Events[0])
+		sink.Write(memSink.Events[0])
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+		sink.Close()
+
+		snapshot := config.Metrics.Snapshot()
+		Expect(snapshot["splunk.events.org.testing-org"]).To(Equal(float64(2)))
+		Expect(snapshot["splunk.events.space.testing-org/testing-space"]).To(Equal(float64(2)))
+	})
+
+	It("keeps only the latest ContainerMetric per app instance in a batch", func() {
+		config.CompactContainerMetrics = true
+		config.FlushInterval = time.Hour
+		config.BatchSize = 3
+		config.Metrics = monitoring.NewMetrics()
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		sink.Open()
+
+		eventType = events.Envelope_ContainerMetric
+		samples := []struct {
+			app      string
+			instance int32
+			cpu      float64
+		}{
+			{"app-a", 0, 1}, {"app-a", 0, 2}, {"app-a", 1, 3}, {"app-a", 0, 4}, {"app-b", 0, 5},
+		}
+		for _, sample := range samples {
+			app, instance, cpu := sample.app, sample.instance, sample.cpu
+			envelope.ContainerMetric = &events.ContainerMetric{ApplicationId: &app, InstanceIndex: &instance, CpuPercentage: &cpu}
+			dup := *envelope
+			sink.Write(&dup)
+		}
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(3))
+		sink.Close()
+
+		var cpus []interface{}
+		for _, event := range mockClient.CapturedEvents() {
+			cpus = append(cpus, event["event"].(map[string]interface{})["cpu_percentage"])
+		}
+		Expect(cpus).To(Equal([]interface{}{float64(4), float64(3), float64(5)}))
+		Expect(config.Metrics.Snapshot()["splunk.events.compacted"]).To(Equal(float64(2)))
+	})
+
+	It("sends ContainerMetric events as multiple-metric events with ContainerMultiMetric", func() {
+		config.ContainerMultiMetric = true
+		config.MetricIndex = "cf_metrics"
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+		sink.Open()
+
+		app, instance, cpu, memory := "app-a", int32(2), 1.5, uint64(1024)
+		metricType := events.Envelope_ContainerMetric
+		metricEnvelope := *envelope
+		metricEnvelope.EventType = &metricType
+		metricEnvelope.ContainerMetric = &events.ContainerMetric{ApplicationId: &app, InstanceIndex: &instance, CpuPercentage: &cpu, MemoryBytes: &memory}
+		sink.Write(&metricEnvelope)
+		eventType = events.Envelope_Error
+		sink.Write(envelope)
+
+		Eventually(mockClient.CapturedEvents).Should(HaveLen(2))
+		var metric, other map[string]interface{}
+		for _, event := range mockClient.CapturedEvents() {
+			if event["event"] == "metric" {
+				metric = event
+			} else {
+				other = event
+			}
+		}
+		Expect(metric["index"]).To(Equal("cf_metrics"))
+		Expect(metric["sourcetype"]).To(Equal("cf:containermetric"))
+		fields := metric["fields"].(map[string]interface{})
+		Expect(fields["metric_name:container.cpu_percentage"]).To(Equal(cpu))
+		Expect(fields["metric_name:container.memory_bytes"]).To(Equal(memory))
+		Expect(fields["cf_app_id"]).To(Equal(app))
+		Expect(fields["instance_index"]).To(Equal(instance))
+		Expect(fields["env"]).To(Equal("dev"))
+		Expect(fields).NotTo(HaveKey("timestamp"))
+		Expect(other).NotTo(BeNil())
+		Expect(other).NotTo(HaveKey("index"))
+		Expect(other["event"]).To(HaveKey("event_type"))
+	})
+
+	It("drops and counts app events missing the required enrichment", func() {
+		appCache := testing.NewMemoryCacheMock()
+		appCache.ReturnErr = true
+		config.Metrics = monitoring.NewMetrics()
+		rconfig.AddAppName = true
+		rconfig.RequireEnrichment = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, appCache)
+
+		appId := "8463ec45-543c-4492-9ec6-f52707f7dd2b"
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = &events.LogMessage{AppId: &appId}
+
+		sink.Open()
+		sink.Write(envelope)
+		sink.Close()
+		Expect(mockClient.CapturedEvents()).To(BeEmpty())
+		Expect(config.Metrics.Snapshot()["splunk.events.unenriched"]).To(Equal(float64(1)))
+
+		mockClient = &testing.EventWriterMock{}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, testing.NewMemoryCacheMock())
+		sink.Open()
+		sink.Write(envelope)
+		sink.Close()
+		Expect(mockClient.CapturedEvents()).To(HaveLen(1))
+	})
+
+	It("sends app events missing the enrichment to the quarantine index", func() {
+		appCache := testing.NewMemoryCacheMock()
+		appCache.ReturnErr = true
+		config.Metrics = monitoring.NewMetrics()
+		config.QuarantineIndex = "quarantine"
+		config.MessageTypeIndexes = map[string]string{"OUT": "app_out"}
+		rconfig.AddAppName = true
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, appCache)
+
+		appId := "8463ec45-543c-4492-9ec6-f52707f7dd2b"
+		messageType := events.LogMessage_OUT
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = &events.LogMessage{AppId: &appId, MessageType: &messageType}
+
+		sink.Open()
+		sink.Write(envelope)
+		sink.Close()
+		Expect(mockClient.CapturedEvents()).To(HaveLen(1))
+		event := mockClient.CapturedEvents()[0]
+		Expect(event["index"]).To(Equal("quarantine"))
+		Expect(event["event"].(map[string]interface{})["cf_quarantined"]).To(BeTrue())
+		Expect(config.Metrics.Snapshot()["splunk.events.quarantined"]).To(Equal(float64(1)))
+
+		// Enriched events are routed as usual
+		mockClient = &testing.EventWriterMock{}
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, testing.NewMemoryCacheMock())
+		sink.Open()
+		sink.Write(envelope)
+		sink.Close()
+		Expect(mockClient.CapturedEvents()).To(HaveLen(1))
+		event = mockClient.CapturedEvents()[0]
+		Expect(event["index"]).To(Equal("app_out"))
+		Expect(event["event"]).NotTo(HaveKey("cf_quarantined"))
+	})
+
+	It("drops events rejected by the filter and keeps events it fails to evaluate", func() {
+		var err error
+		config.Metrics = monitoring.NewMetrics()
+		rconfig.Filter, err = fevents.CompileFilter(`msg contains "keep" || (msg contains "error" && source_type > 1)`)
+		Expect(err).ToNot(HaveOccurred())
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_LogMessage
+		sink.Open()
+		sourceType := "APP"
+		for _, message := range []string{"keep me", "drop me", "error"} {
+			msg := *envelope
+			msg.LogMessage = &events.LogMessage{Message: []byte(message), SourceType: &sourceType}
+			sink.Write(&msg)
+		}
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(HaveLen(2))
+		Expect(config.Metrics.Snapshot()["splunk.events.filtered"]).To(Equal(float64(1)))
+		Expect(config.Metrics.Snapshot()["splunk.drops.filtered.LogMessage"]).To(Equal(float64(1)))
+		Expect(config.Metrics.Snapshot()["splunk.filter.errors"]).To(Equal(float64(1)))
+	})
+
+	It("marks counter events whose total was reset", func() {
+		config.CounterResetLimit = 1
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_CounterEvent
+		sink.Open()
+		for _, counter := range []struct {
+			name      string
+			total     uint64
+			timestamp int64
+		}{
+			{"requests", 10, 1}, {"requests", 15, 2}, {"requests", 3, 3}, {"requests", 1, 0},
+			{"untracked", 10, 1}, {"untracked", 3, 2},
+		} {
+			name, total, timestamp, delta := counter.name, counter.total, counter.timestamp, uint64(1)
+			msg := *envelope
+			msg.Timestamp = &timestamp
+			msg.CounterEvent = &events.CounterEvent{Name: &name, Total: &total, Delta: &delta}
+			sink.Write(&msg)
+		}
+		sink.Close()
+
+		var resets, deltas []interface{}
+		for _, event := range mockClient.CapturedEvents() {
+			fields := event["event"].(map[string]interface{})
+			resets = append(resets, fields["counter_reset"])
+			deltas = append(deltas, fields["delta"])
+		}
+		Expect(resets).To(Equal([]interface{}{nil, nil, true, nil, nil, nil}))
+		Expect(deltas).To(Equal([]interface{}{uint64(1), uint64(1), nil, uint64(1), uint64(1), uint64(1)}))
+	})
+
+	It("drops and counts envelopes without their sub-event", func() {
+		config.Metrics = monitoring.NewMetrics()
+		sink = eventsink.NewSplunk([]eventwriter.Writer{mockClient, mockClient2}, config, rconfig, cache.NewNoCache())
+
+		eventType = events.Envelope_LogMessage
+		envelope.LogMessage = nil
+
+		sink.Open()
+		Expect(func() { sink.Write(envelope) }).ToNot(Panic())
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(BeEmpty())
+		Expect(config.Metrics.Snapshot()["splunk.events.malformed"]).To(Equal(float64(1)))
+	})
+
 	// lager.Logger interface
 	It("posts to splunk", func() {
 		message := lager.LogFormat{}
@@ -624,6 +1889,25 @@ var _ = Describe("Splunk", func() {
 		Expect(mockClient2.CapturedEvents()).To(HaveLen(2))
 	})
 
+	It("does not post to splunk when nozzle logs are dropped", func() {
+		config.DropNozzleLogs = true
+
+		sink.Log(lager.LogFormat{LogLevel: lager.ERROR})
+
+		Expect(mockClient2.CapturedEvents()).To(BeNil())
+	})
+
+	It("samples nozzle logs but keeps errors", func() {
+		config.NozzleLogSampleRate = 3
+
+		for i := 0; i < 6; i++ {
+			sink.Log(lager.LogFormat{LogLevel: lager.INFO})
+		}
+		sink.Log(lager.LogFormat{LogLevel: lager.ERROR})
+
+		Expect(mockClient2.CapturedEvents()).To(HaveLen(3))
+	})
+
 	It("translates log message metadata to splunk format", func() {
 		message := lager.LogFormat{
 			Timestamp: "1473180363",
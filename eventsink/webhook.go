@@ -0,0 +1,101 @@
+package eventsink
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type WebhookConfig struct {
+	QueueSize int
+	// Events whose ParseConfig.PriorityField has one of the priorities are sent
+	// besides Error events
+	Priorities  map[string]bool
+	ParseConfig *ParseConfig
+	Logger      lager.Logger
+}
+
+// Webhook sends Error events, and optionally events of the given priorities, to an
+// alert webhook writer
+type Webhook struct {
+	writer eventwriter.Writer
+	config *WebhookConfig
+	events chan *events.Envelope
+	wg     sync.WaitGroup
+}
+
+func NewWebhook(writer eventwriter.Writer, config *WebhookConfig) *Webhook {
+	return &Webhook{
+		writer: writer,
+		config: config,
+		events: make(chan *events.Envelope, config.QueueSize),
+	}
+}
+
+func (w *Webhook) Open() error {
+	w.wg.Add(1)
+	go w.consume()
+	return nil
+}
+
+func (w *Webhook) Close() error {
+	close(w.events)
+	w.wg.Wait()
+	return nil
+}
+
+func (w *Webhook) Write(msg *events.Envelope) error {
+	// The priority is only known after parsing
+	if msg.GetEventType() != events.Envelope_Error && len(w.config.Priorities) == 0 {
+		return nil
+	}
+
+	select {
+	case w.events <- msg:
+	default:
+		// Don't slow down the Splunk path because of a slow webhook
+	}
+	return nil
+}
+
+func (w *Webhook) consume() {
+	defer w.wg.Done()
+
+	for msg := range w.events {
+		alert := w.toAlert(msg)
+		if alert == nil {
+			continue
+		}
+
+		if err, _ := w.writer.Write([]map[string]interface{}{alert}); err != nil {
+			w.config.Logger.Error("Unable to send alert to webhook, dropping alert", err, lager.Data{"event_type": alert["event_type"]})
+		}
+	}
+}
+
+// toAlert returns the fields of the event, nil if it isn't alerted on
+func (w *Webhook) toAlert(msg *events.Envelope) map[string]interface{} {
+	if !fevents.HasPayload(msg) {
+		return nil
+	}
+
+	event := fevents.FromEnvelope(msg)
+	event.AnnotateWithEnvelopeData(msg, w.config.ParseConfig)
+	event.AnnotateWithCFMetaData()
+
+	config := w.config.ParseConfig
+	if len(config.PriorityRules) > 0 {
+		event.AnnotateWithPriority(config.PriorityRules, config.PriorityField)
+	}
+
+	priority, _ := event.Fields[config.PriorityField].(string)
+	if msg.GetEventType() != events.Envelope_Error && !w.config.Priorities[priority] {
+		return nil
+	}
+
+	event.Fields["msg"] = event.Msg
+	return event.Fields
+}
@@ -0,0 +1,72 @@
+package eventsink_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	fevents "github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
+)
+
+var _ = Describe("Webhook", func() {
+	var (
+		origin     string
+		sink       *eventsink.Webhook
+		mockClient *testing.EventWriterMock
+	)
+
+	BeforeEach(func() {
+		origin = "cloud_controller"
+		mockClient = &testing.EventWriterMock{}
+		rules, err := fevents.ParsePriorityRules(`[{"event_type": "LogMessage", "field": "message_type", "equals": "ERR", "priority": "high"}]`)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sink = eventsink.NewWebhook(mockClient, &eventsink.WebhookConfig{
+			QueueSize:  100,
+			Priorities: map[string]bool{"high": true},
+			ParseConfig: &eventsink.ParseConfig{
+				PriorityRules: rules,
+				PriorityField: "priority",
+			},
+			Logger: lager.NewLogger("test"),
+		})
+		sink.Open()
+	})
+
+	It("sends Error events", func() {
+		eventType := events.Envelope_Error
+		source, code, message := "cc", int32(500), "database unavailable"
+		sink.Write(&events.Envelope{
+			Origin:    &origin,
+			EventType: &eventType,
+			Error:     &events.Error{Source: &source, Code: &code, Message: &message},
+		})
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(HaveLen(1))
+		alert := mockClient.CapturedEvents()[0]
+		Expect(alert["event_type"]).To(Equal("Error"))
+		Expect(alert["origin"]).To(Equal(origin))
+		Expect(alert["msg"]).To(Equal(message))
+	})
+
+	It("sends events of the alerted priorities only", func() {
+		eventType := events.Envelope_LogMessage
+		for _, messageType := range []events.LogMessage_MessageType{events.LogMessage_OUT, events.LogMessage_ERR} {
+			messageType := messageType
+			sink.Write(&events.Envelope{
+				Origin:     &origin,
+				EventType:  &eventType,
+				LogMessage: &events.LogMessage{MessageType: &messageType, Message: []byte("disk full")},
+			})
+		}
+		sink.Close()
+
+		Expect(mockClient.CapturedEvents()).To(HaveLen(1))
+		Expect(mockClient.CapturedEvents()[0]["priority"]).To(Equal("high"))
+	})
+})
@@ -0,0 +1,45 @@
+package eventsink
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+// workerMetrics counts the HEC writes of a single consumer, so a consumer lagging
+// behind the others, such as one stuck on a wedged connection, stands out
+type workerMetrics struct {
+	requests *monitoring.Counter
+	events   *monitoring.Counter
+	errors   *monitoring.Counter
+	latency  *monitoring.Counter // total duration of the writes, in milliseconds
+}
+
+// newWorkerMetrics creates the splunk.worker.<n>.* counters of the writers of the
+// consumers, numbered from 0 in the order of the writers
+func newWorkerMetrics(writers []eventwriter.Writer, metrics *monitoring.Metrics) map[eventwriter.Writer]*workerMetrics {
+	workers := make(map[eventwriter.Writer]*workerMetrics, len(writers))
+	for i, writer := range writers {
+		prefix := fmt.Sprintf("splunk.worker.%d.", i)
+		workers[writer] = &workerMetrics{
+			requests: metrics.NewCounter(prefix + "requests"),
+			events:   metrics.NewCounter(prefix + "events"),
+			errors:   metrics.NewCounter(prefix + "errors"),
+			latency:  metrics.NewCounter(prefix + "latency_ms"),
+		}
+	}
+	return workers
+}
+
+// observe records a HEC write of the batch of events
+func (w *workerMetrics) observe(events int, duration time.Duration, err error) {
+	w.requests.Add(1)
+	w.latency.Add(uint64(duration.Milliseconds()))
+	if err != nil {
+		w.errors.Add(1)
+		return
+	}
+	w.events.Add(uint64(events))
+}
@@ -4,6 +4,12 @@ import (
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
+// Types of event sources, named by the SOURCE_TYPE setting
+const (
+	SourceFirehose  = "firehose"
+	SourceSynthetic = "synthetic" // generated events, see Synthetic
+)
+
 //go:generate counterfeiter . Source
 
 type Source interface {
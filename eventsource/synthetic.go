@@ -0,0 +1,377 @@
+package eventsource
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// DefaultSyntheticMix is the share of each event type generated by default, roughly
+// that of a busy foundation
+const DefaultSyntheticMix = "LogMessage:60,HttpStartStop:20,ContainerMetric:10,ValueMetric:5,CounterEvent:5"
+
+const (
+	syntheticApps  = 100                   // number of apps the app events are spread over
+	syntheticTick  = 10 * time.Millisecond // pacing of the generation
+	syntheticQueue = 1024
+)
+
+// syntheticEventTypes are the event types the synthetic source can generate
+var syntheticEventTypes = map[string]events.Envelope_EventType{
+	"LogMessage":      events.Envelope_LogMessage,
+	"HttpStartStop":   events.Envelope_HttpStartStop,
+	"ContainerMetric": events.Envelope_ContainerMetric,
+	"ValueMetric":     events.Envelope_ValueMetric,
+	"CounterEvent":    events.Envelope_CounterEvent,
+}
+
+type SyntheticConfig struct {
+	Rate int            // events per second
+	Mix  map[string]int // weight of each event type, from ParseSyntheticMix
+	Seed int64
+}
+
+// syntheticWeight is an event type and the cumulative weight of the types up to it
+type syntheticWeight struct {
+	eventType events.Envelope_EventType
+	weight    int
+}
+
+// Synthetic generates events at a fixed rate instead of reading them from the
+// firehose, to load test the sink and Splunk. The same seed generates the same
+// events, apart from their timestamps
+type Synthetic struct {
+	config  *SyntheticConfig
+	rng     *rand.Rand
+	apps    []*events.UUID
+	zipf    *rand.Zipf
+	weights []syntheticWeight
+	total   int
+	totals  map[string]uint64 // totals of the counter events by name
+
+	lock    sync.Mutex
+	events  chan *events.Envelope
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewSynthetic(config *SyntheticConfig) *Synthetic {
+	rng := rand.New(rand.NewSource(config.Seed))
+
+	apps := make([]*events.UUID, syntheticApps)
+	for i := range apps {
+		low, high := rng.Uint64(), rng.Uint64()
+		apps[i] = &events.UUID{Low: &low, High: &high}
+	}
+
+	// Sorted, as the weighted choice must not depend on the map order
+	var eventTypes []string
+	for eventType := range config.Mix {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+
+	s := &Synthetic{
+		config: config,
+		rng:    rng,
+		apps:   apps,
+		// A few apps send most of the events
+		zipf:   rand.NewZipf(rng, 1.2, 1, syntheticApps-1),
+		totals: make(map[string]uint64),
+	}
+	for _, eventType := range eventTypes {
+		s.total += config.Mix[eventType]
+		s.weights = append(s.weights, syntheticWeight{eventType: syntheticEventTypes[eventType], weight: s.total})
+	}
+	return s
+}
+
+// ParseSyntheticMix parses a comma separated list of event type and weight pairs,
+// for example "LogMessage:80,ContainerMetric:20" generates 4 log messages for
+// every container metric
+func ParseSyntheticMix(mixString string) (map[string]int, error) {
+	mix := map[string]int{}
+
+	for _, kvPair := range strings.Split(mixString, ",") {
+		if strings.TrimSpace(kvPair) == "" {
+			continue
+		}
+
+		values := strings.Split(kvPair, ":")
+		if len(values) != 2 {
+			return nil, fmt.Errorf("invalid event weight [%s], expected <event type>:<weight>", strings.TrimSpace(kvPair))
+		}
+		eventType, v := strings.TrimSpace(values[0]), strings.TrimSpace(values[1])
+
+		if _, ok := syntheticEventTypes[eventType]; !ok {
+			return nil, fmt.Errorf("event type [%s] can't be generated - valid events: LogMessage, HttpStartStop, ContainerMetric, ValueMetric, CounterEvent", eventType)
+		}
+
+		weight, err := strconv.Atoi(v)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight [%s] for event type %s, expected a non negative integer", v, eventType)
+		}
+		mix[eventType] = weight
+	}
+
+	total := 0
+	for _, weight := range mix {
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no event type to generate in [%s]", mixString)
+	}
+	return mix, nil
+}
+
+func (s *Synthetic) Open() error {
+	return nil
+}
+
+// Close stops the generation and closes the events channel. Reading again
+// resumes the generation where it stopped
+func (s *Synthetic) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.events == nil {
+		return nil
+	}
+	close(s.closing)
+	s.wg.Wait()
+	close(s.events)
+	s.events = nil
+	return nil
+}
+
+func (s *Synthetic) Read() (<-chan *events.Envelope, <-chan error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.events == nil {
+		s.events = make(chan *events.Envelope, syntheticQueue)
+		s.closing = make(chan struct{})
+		s.wg.Add(1)
+		go s.generate(s.events, s.closing)
+	}
+	return s.events, make(chan error)
+}
+
+// generate sends Rate events per second until closing
+func (s *Synthetic) generate(out chan<- *events.Envelope, closing <-chan struct{}) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(syntheticTick)
+	defer ticker.Stop()
+
+	start := time.Now()
+	var sent int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-closing:
+			return
+		}
+
+		due := int64(time.Since(start).Seconds() * float64(s.config.Rate))
+		for ; sent < due; sent++ {
+			select {
+			case out <- s.next():
+			case <-closing:
+				return
+			}
+		}
+	}
+}
+
+// next generates an event of a type picked by the weights of the mix
+func (s *Synthetic) next() *events.Envelope {
+	n := s.rng.Intn(s.total)
+	eventType := s.weights[0].eventType
+	for _, w := range s.weights {
+		if n < w.weight {
+			eventType = w.eventType
+			break
+		}
+	}
+
+	now := time.Now().UnixNano()
+	envelope := &events.Envelope{
+		Origin:     stringPtr("synthetic"),
+		EventType:  &eventType,
+		Timestamp:  &now,
+		Deployment: stringPtr("cf"),
+		Index:      stringPtr(fmt.Sprintf("synthetic-%d", s.rng.Intn(4))),
+		Tags:       map[string]string{"source": "synthetic"},
+	}
+
+	switch eventType {
+	case events.Envelope_LogMessage:
+		envelope.Job = stringPtr("diego_cell")
+		envelope.LogMessage = s.logMessage(now)
+	case events.Envelope_HttpStartStop:
+		envelope.Job = stringPtr("router")
+		envelope.HttpStartStop = s.httpStartStop(now)
+	case events.Envelope_ContainerMetric:
+		envelope.Job = stringPtr("diego_cell")
+		envelope.ContainerMetric = s.containerMetric()
+	case events.Envelope_ValueMetric:
+		envelope.Job = stringPtr("doppler")
+		envelope.ValueMetric = s.valueMetric()
+	case events.Envelope_CounterEvent:
+		envelope.Job = stringPtr("doppler")
+		envelope.CounterEvent = s.counterEvent()
+	}
+	return envelope
+}
+
+func (s *Synthetic) app() *events.UUID {
+	return s.apps[s.zipf.Uint64()]
+}
+
+var syntheticLogLines = []string{
+	"Processed request in %d ms",
+	"Cache hit ratio %d%%",
+	"Connected to database pool, %d connections",
+	"Job %d completed",
+	"Retrying upstream call, attempt %d",
+}
+
+func (s *Synthetic) logMessage(now int64) *events.LogMessage {
+	messageType := events.LogMessage_OUT
+	if s.rng.Intn(10) == 0 {
+		messageType = events.LogMessage_ERR
+	}
+	sourceType := "APP/PROC/WEB"
+	if s.rng.Intn(5) == 0 {
+		sourceType = "RTR"
+	}
+	line := fmt.Sprintf(syntheticLogLines[s.rng.Intn(len(syntheticLogLines))], s.rng.Intn(1000))
+
+	return &events.LogMessage{
+		Message:        []byte(line),
+		MessageType:    &messageType,
+		Timestamp:      &now,
+		AppId:          stringPtr(utils.FormatUUID(s.app())),
+		SourceType:     &sourceType,
+		SourceInstance: stringPtr(strconv.Itoa(s.rng.Intn(3))),
+	}
+}
+
+var syntheticStatusCodes = []struct {
+	code   int32
+	weight int
+}{
+	{200, 85}, {201, 5}, {302, 4}, {404, 4}, {500, 2},
+}
+
+func (s *Synthetic) httpStartStop(now int64) *events.HttpStartStop {
+	n := s.rng.Intn(100)
+	var statusCode int32
+	for _, status := range syntheticStatusCodes {
+		if n < status.weight {
+			statusCode = status.code
+			break
+		}
+		n -= status.weight
+	}
+
+	method := events.Method_GET
+	switch n := s.rng.Intn(10); {
+	case n < 2:
+		method = events.Method_POST
+	case n < 3:
+		method = events.Method_PUT
+	}
+
+	// Log-normal latencies around 50ms, with a long tail
+	latency := time.Duration(math.Exp(s.rng.NormFloat64()*0.8) * float64(50*time.Millisecond))
+	low, high := s.rng.Uint64(), s.rng.Uint64()
+	peerType := events.PeerType_Server
+	contentLength := s.rng.Int63n(64 * 1024)
+	instanceIndex := int32(s.rng.Intn(3))
+	startTimestamp := now - int64(latency)
+
+	return &events.HttpStartStop{
+		StartTimestamp: &startTimestamp,
+		StopTimestamp:  &now,
+		RequestId:      &events.UUID{Low: &low, High: &high},
+		PeerType:       &peerType,
+		Method:         &method,
+		Uri:            stringPtr(fmt.Sprintf("https://app.example.com/api/v1/items/%d", s.rng.Intn(10000))),
+		RemoteAddress:  stringPtr(fmt.Sprintf("10.0.%d.%d:%d", s.rng.Intn(256), s.rng.Intn(256), 30000+s.rng.Intn(30000))),
+		UserAgent:      stringPtr("synthetic/1.0"),
+		StatusCode:     &statusCode,
+		ContentLength:  &contentLength,
+		ApplicationId:  s.app(),
+		InstanceIndex:  &instanceIndex,
+	}
+}
+
+func (s *Synthetic) containerMetric() *events.ContainerMetric {
+	instanceIndex := int32(s.rng.Intn(3))
+	cpuPercentage := math.Abs(s.rng.NormFloat64()*15 + 20)
+	memoryBytesQuota := uint64(1 << 30)
+	memoryBytes := uint64(s.rng.Int63n(int64(memoryBytesQuota)))
+	diskBytesQuota := uint64(1 << 30)
+	diskBytes := uint64(s.rng.Int63n(int64(diskBytesQuota)))
+
+	return &events.ContainerMetric{
+		ApplicationId:    stringPtr(utils.FormatUUID(s.app())),
+		InstanceIndex:    &instanceIndex,
+		CpuPercentage:    &cpuPercentage,
+		MemoryBytes:      &memoryBytes,
+		DiskBytes:        &diskBytes,
+		MemoryBytesQuota: &memoryBytesQuota,
+		DiskBytesQuota:   &diskBytesQuota,
+	}
+}
+
+var syntheticValueMetrics = []struct {
+	name string
+	unit string
+	max  float64
+}{
+	{"numCPUS", "count", 16},
+	{"memoryStats.numBytesAllocated", "bytes", 1 << 30},
+	{"latency", "ms", 500},
+	{"numGoRoutines", "count", 5000},
+}
+
+func (s *Synthetic) valueMetric() *events.ValueMetric {
+	metric := syntheticValueMetrics[s.rng.Intn(len(syntheticValueMetrics))]
+	value := s.rng.Float64() * metric.max
+
+	return &events.ValueMetric{
+		Name:  stringPtr(metric.name),
+		Value: &value,
+		Unit:  stringPtr(metric.unit),
+	}
+}
+
+var syntheticCounters = []string{"dropsondeListener.receivedMessageCount", "sentEnvelopes", "egress", "ingress"}
+
+func (s *Synthetic) counterEvent() *events.CounterEvent {
+	name := syntheticCounters[s.rng.Intn(len(syntheticCounters))]
+	delta := uint64(1 + s.rng.Intn(100))
+	s.totals[name] += delta
+	total := s.totals[name]
+
+	return &events.CounterEvent{
+		Name:  &name,
+		Delta: &delta,
+		Total: &total,
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
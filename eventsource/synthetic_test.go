@@ -0,0 +1,100 @@
+package eventsource_test
+
+import (
+	"time"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsource"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Synthetic", func() {
+	read := func(source *Synthetic, n int) []*events.Envelope {
+		envelopes, _ := source.Read()
+		var read []*events.Envelope
+		for i := 0; i < n; i++ {
+			var envelope *events.Envelope
+			Eventually(envelopes, 5*time.Second).Should(Receive(&envelope))
+			read = append(read, envelope)
+		}
+		return read
+	}
+
+	It("parses the event mix", func() {
+		mix, err := ParseSyntheticMix(DefaultSyntheticMix)
+		Expect(err).To(BeNil())
+		Expect(mix).To(HaveLen(5))
+		Expect(mix["LogMessage"]).To(Equal(60))
+
+		mix, err = ParseSyntheticMix(" LogMessage:1, ContainerMetric:0 ")
+		Expect(err).To(BeNil())
+		Expect(mix).To(Equal(map[string]int{"LogMessage": 1, "ContainerMetric": 0}))
+
+		for _, invalid := range []string{"", "LogMessage:0", "LogMessage", "LogMessage:-1", "LogMessage:x", "Error:1", "Foo:1"} {
+			_, err = ParseSyntheticMix(invalid)
+			Expect(err).NotTo(BeNil(), invalid)
+		}
+	})
+
+	It("generates only the event types of the mix", func() {
+		source := NewSynthetic(&SyntheticConfig{Rate: 10000, Mix: map[string]int{"HttpStartStop": 1, "ContainerMetric": 1}, Seed: 1})
+		defer source.Close()
+
+		seen := map[events.Envelope_EventType]int{}
+		for _, envelope := range read(source, 200) {
+			seen[envelope.GetEventType()]++
+			switch envelope.GetEventType() {
+			case events.Envelope_HttpStartStop:
+				Expect(envelope.GetHttpStartStop().GetStatusCode()).To(BeNumerically(">=", 200))
+				Expect(envelope.GetHttpStartStop().GetApplicationId()).NotTo(BeNil())
+			case events.Envelope_ContainerMetric:
+				Expect(envelope.GetContainerMetric().GetMemoryBytes()).To(BeNumerically("<=", envelope.GetContainerMetric().GetMemoryBytesQuota()))
+			}
+		}
+		Expect(seen).To(HaveLen(2))
+		Expect(seen[events.Envelope_HttpStartStop]).To(BeNumerically(">", 50))
+		Expect(seen[events.Envelope_ContainerMetric]).To(BeNumerically(">", 50))
+	})
+
+	It("generates the same events with the same seed", func() {
+		mix, _ := ParseSyntheticMix(DefaultSyntheticMix)
+		first := NewSynthetic(&SyntheticConfig{Rate: 10000, Mix: mix, Seed: 42})
+		defer first.Close()
+		second := NewSynthetic(&SyntheticConfig{Rate: 10000, Mix: mix, Seed: 42})
+		defer second.Close()
+
+		expected := read(first, 100)
+		for i, envelope := range read(second, 100) {
+			Expect(envelope.GetEventType()).To(Equal(expected[i].GetEventType()))
+			Expect(envelope.GetLogMessage().GetMessage()).To(Equal(expected[i].GetLogMessage().GetMessage()))
+			Expect(envelope.GetLogMessage().GetAppId()).To(Equal(expected[i].GetLogMessage().GetAppId()))
+			Expect(envelope.GetContainerMetric().GetCpuPercentage()).To(Equal(expected[i].GetContainerMetric().GetCpuPercentage()))
+		}
+	})
+
+	It("generates at the configured rate", func() {
+		source := NewSynthetic(&SyntheticConfig{Rate: 200, Mix: map[string]int{"ValueMetric": 1}, Seed: 1})
+		envelopes, _ := source.Read()
+		time.Sleep(500 * time.Millisecond)
+		source.Close()
+
+		count := 0
+		for range envelopes {
+			count++
+		}
+		Expect(count).To(BeNumerically("~", 100, 30))
+	})
+
+	It("resumes the generation when read after closing", func() {
+		source := NewSynthetic(&SyntheticConfig{Rate: 10000, Mix: map[string]int{"CounterEvent": 1}, Seed: 1})
+		envelopes, _ := source.Read()
+		Eventually(envelopes).Should(Receive())
+		Expect(source.Close()).To(BeNil())
+		Expect(source.Close()).To(BeNil())
+
+		Expect(read(source, 1)[0].GetCounterEvent().GetTotal()).To(BeNumerically(">", 0))
+		source.Close()
+	})
+})
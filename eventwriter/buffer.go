@@ -0,0 +1,58 @@
+package eventwriter
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+// BufferLimiter caps the bytes of request bodies held by all writers sharing it.
+// Writers wait for other requests to complete when the cap would be exceeded, so
+// the sink's queue fills up and sheds load instead of the memory growing
+type BufferLimiter struct {
+	maxBytes int64 // 0 is unlimited
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	buffered int64
+}
+
+// NewBufferLimiter creates a limiter of maxBytes and registers the
+// splunk.bytes.buffered gauge
+func NewBufferLimiter(maxBytes int64, metrics *monitoring.Metrics) *BufferLimiter {
+	l := &BufferLimiter{
+		maxBytes: maxBytes,
+	}
+	l.cond = sync.NewCond(&l.lock)
+
+	if metrics != nil {
+		metrics.RegisterGauge("splunk.bytes.buffered", func() float64 {
+			return float64(l.Buffered())
+		})
+	}
+	return l
+}
+
+// Acquire blocks until n bytes can be buffered. A body larger than the cap is
+// admitted alone, so it can't block forever
+func (l *BufferLimiter) Acquire(n int64) {
+	l.lock.Lock()
+	for l.maxBytes > 0 && l.buffered > 0 && l.buffered+n > l.maxBytes {
+		l.cond.Wait()
+	}
+	l.buffered += n
+	l.lock.Unlock()
+}
+
+func (l *BufferLimiter) Release(n int64) {
+	l.lock.Lock()
+	l.buffered -= n
+	l.lock.Unlock()
+	l.cond.Broadcast()
+}
+
+func (l *BufferLimiter) Buffered() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buffered
+}
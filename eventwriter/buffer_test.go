@@ -0,0 +1,43 @@
+package eventwriter_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+var _ = Describe("BufferLimiter", func() {
+	It("blocks until enough bytes are released", func() {
+		limiter := NewBufferLimiter(100, nil)
+		limiter.Acquire(60)
+
+		acquired := make(chan struct{})
+		go func() {
+			limiter.Acquire(60)
+			close(acquired)
+		}()
+		Consistently(acquired, 50*time.Millisecond).ShouldNot(BeClosed())
+
+		limiter.Release(60)
+		Eventually(acquired).Should(BeClosed())
+		Expect(limiter.Buffered()).To(Equal(int64(60)))
+	})
+
+	It("admits a body larger than the limit when nothing is buffered", func() {
+		limiter := NewBufferLimiter(100, nil)
+		limiter.Acquire(500)
+		Expect(limiter.Buffered()).To(Equal(int64(500)))
+		limiter.Release(500)
+		Expect(limiter.Buffered()).To(Equal(int64(0)))
+	})
+
+	It("never blocks when unlimited", func() {
+		limiter := NewBufferLimiter(0, nil)
+		limiter.Acquire(1000)
+		limiter.Acquire(1000)
+		Expect(limiter.Buffered()).To(Equal(int64(2000)))
+	})
+})
@@ -0,0 +1,383 @@
+package eventwriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+type DeadLetterConfig struct {
+	// The file is rotated to <path>.1, the earlier rotated files being shifted to
+	// <path>.2 and so on, once appending a batch would grow it past MaxBytes. 0 never
+	// rotates the file
+	MaxBytes int64
+
+	// Rotated files kept, the oldest file is removed when rotating beyond it. With 0,
+	// the file is emptied instead of rotated
+	MaxFiles int
+
+	// Files whose newest entry is older are removed, and the file emptied. 0 keeps them
+	MaxAge time.Duration
+
+	// Counts the entries removed by the rotation and MaxAge
+	Evicted *monitoring.Counter
+}
+
+// deadLetterSegment is the file at path or one of its rotated files
+type deadLetterSegment struct {
+	bytes   int64
+	entries int64
+	newest  time.Time // time of the newest entry
+}
+
+// DeadLetterFile appends the events written to it to a file, one JSON event per line,
+// so events which couldn't be delivered to Splunk can be inspected and replayed. The
+// file is rotated and its oldest entries removed by the limits of its config, so a
+// long Splunk outage doesn't fill the disk
+type DeadLetterFile struct {
+	path   string
+	config *DeadLetterConfig
+
+	lock     sync.Mutex
+	file     *os.File
+	segments []deadLetterSegment // the file at path first, then <path>.1 and so on
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDeadLetterFile opens the file at path for appending, creating it if needed, and
+// counts the entries of the file and of its rotated files. With MaxAge, the files
+// whose newest entry is older are removed right away and then once in a while
+func NewDeadLetterFile(path string, config *DeadLetterConfig) (*DeadLetterFile, error) {
+	if config.Evicted == nil {
+		config.Evicted = &monitoring.Counter{}
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DeadLetterFile{path: path, config: config, file: file, closing: make(chan struct{})}
+	for i := 0; i <= config.MaxFiles; i++ {
+		segment, err := countDeadLetterEntries(d.segmentPath(i))
+		if os.IsNotExist(err) && i > 0 {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		d.segments = append(d.segments, segment)
+	}
+
+	if config.MaxAge > 0 {
+		d.lock.Lock()
+		d.removeExpired(time.Now())
+		d.lock.Unlock()
+
+		d.wg.Add(1)
+		go d.sweep()
+	}
+	return d, nil
+}
+
+func countDeadLetterEntries(path string) (deadLetterSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return deadLetterSegment{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return deadLetterSegment{}, err
+	}
+	segment := deadLetterSegment{bytes: info.Size(), newest: info.ModTime()}
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buffer)
+		segment.entries += int64(bytes.Count(buffer[:n], []byte{'\n'}))
+		if err != nil {
+			break
+		}
+	}
+	return segment, nil
+}
+
+func (d *DeadLetterFile) segmentPath(i int) string {
+	if i == 0 {
+		return d.path
+	}
+	return fmt.Sprintf("%s.%d", d.path, i)
+}
+
+func (d *DeadLetterFile) Write(events []map[string]interface{}) (error, uint64) {
+	var lines []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err, 0
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	d.removeExpired(now)
+	active := &d.segments[0]
+	if d.config.MaxBytes > 0 && active.bytes > 0 && active.bytes+int64(len(lines)) > d.config.MaxBytes {
+		if err := d.rotate(); err != nil {
+			return err, 0
+		}
+		active = &d.segments[0]
+	}
+
+	n, err := d.file.Write(lines)
+	active.bytes += int64(n)
+	active.entries += int64(bytes.Count(lines[:n], []byte{'\n'}))
+	active.newest = now
+	if err != nil {
+		return err, 0
+	}
+	return nil, uint64(len(events))
+}
+
+// rotate renames the file to <path>.1 and the rotated files to the next number, removing
+// the oldest rotated file beyond MaxFiles, or empties the file without MaxFiles
+func (d *DeadLetterFile) rotate() error {
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+
+	if len(d.segments) > d.config.MaxFiles {
+		oldest := len(d.segments) - 1
+		if err := os.Remove(d.segmentPath(oldest)); err != nil && !os.IsNotExist(err) {
+			return d.reopen(err)
+		}
+		d.config.Evicted.Add(uint64(d.segments[oldest].entries))
+		d.segments = d.segments[:oldest]
+	}
+	for i := len(d.segments) - 1; i >= 0; i-- {
+		if err := os.Rename(d.segmentPath(i), d.segmentPath(i+1)); err != nil {
+			return d.reopen(err)
+		}
+	}
+	d.segments = append([]deadLetterSegment{{}}, d.segments...)
+	return d.reopen(nil)
+}
+
+// reopen opens the file at path again after its rotation, returning err or the error
+// at opening the file
+func (d *DeadLetterFile) reopen(err error) error {
+	file, openErr := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	d.file = file
+	return err
+}
+
+// removeExpired removes the rotated files whose newest entry is older than MaxAge,
+// and empties the file when its newest entry is older too
+func (d *DeadLetterFile) removeExpired(now time.Time) {
+	if d.config.MaxAge <= 0 {
+		return
+	}
+	expired := func(segment deadLetterSegment) bool {
+		return now.Sub(segment.newest) > d.config.MaxAge
+	}
+
+	for len(d.segments) > 1 && expired(d.segments[len(d.segments)-1]) {
+		oldest := len(d.segments) - 1
+		if err := os.Remove(d.segmentPath(oldest)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		d.config.Evicted.Add(uint64(d.segments[oldest].entries))
+		d.segments = d.segments[:oldest]
+	}
+	if len(d.segments) == 1 && d.segments[0].entries > 0 && expired(d.segments[0]) {
+		if err := d.file.Truncate(0); err != nil {
+			return
+		}
+		d.config.Evicted.Add(uint64(d.segments[0].entries))
+		d.segments[0] = deadLetterSegment{}
+	}
+}
+
+func (d *DeadLetterFile) sweep() {
+	defer d.wg.Done()
+
+	interval := d.config.MaxAge / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			d.lock.Lock()
+			d.removeExpired(now)
+			d.lock.Unlock()
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+// Stats returns the bytes and the number of entries of the file and its rotated files
+func (d *DeadLetterFile) Stats() (int64, int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var size, entries int64
+	for _, segment := range d.segments {
+		size += segment.bytes
+		entries += segment.entries
+	}
+	return size, entries
+}
+
+func (d *DeadLetterFile) Close() error {
+	close(d.closing)
+	d.wg.Wait()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.file.Close()
+}
+
+// deadLetterDefaultIndex names the file of the events without an index, sent to the
+// default index of the token, and deadLetterInvalidIndex the file of the events whose
+// index isn't a valid index name, which could escape the directory of the files.
+// Index names never start with an underscore
+const (
+	deadLetterDefaultIndex = "_default"
+	deadLetterInvalidIndex = "_invalid"
+)
+
+var indexNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// DeadLetterFiles appends the events written to it to one DeadLetterFile per index, at
+// <path>.<index>, so the events of an index can be replayed to it on their own. The
+// events without an index go to <path>._default, and those with an invalid index name
+// to <path>._invalid
+type DeadLetterFiles struct {
+	path   string
+	config *DeadLetterConfig
+
+	lock  sync.Mutex
+	files map[string]*DeadLetterFile
+}
+
+// NewDeadLetterFiles opens the files of the indexes already at <path>.<index>, so their
+// entries are counted and expired before events are written to them again
+func NewDeadLetterFiles(path string, config *DeadLetterConfig) (*DeadLetterFiles, error) {
+	if config.Evicted == nil {
+		config.Evicted = &monitoring.Counter{}
+	}
+	d := &DeadLetterFiles{path: path, config: config, files: make(map[string]*DeadLetterFile)}
+
+	paths, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range paths {
+		// index names have no dots, the rotated files are at <path>.<index>.<n>
+		index := strings.TrimPrefix(existing, path+".")
+		if strings.Contains(index, ".") {
+			continue
+		}
+		if _, err := d.file(index); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// file returns the file of the index, opening it on first use
+func (d *DeadLetterFiles) file(index string) (*DeadLetterFile, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if file, ok := d.files[index]; ok {
+		return file, nil
+	}
+	file, err := NewDeadLetterFile(d.path+"."+index, d.config)
+	if err != nil {
+		return nil, err
+	}
+	d.files[index] = file
+	return file, nil
+}
+
+func (d *DeadLetterFiles) Write(events []map[string]interface{}) (error, uint64) {
+	var indexes []string
+	byIndex := make(map[string][]map[string]interface{})
+	for _, event := range events {
+		index, _ := event["index"].(string)
+		if index == "" {
+			index = deadLetterDefaultIndex
+		} else if !indexNamePattern.MatchString(index) {
+			index = deadLetterInvalidIndex
+		}
+		if _, ok := byIndex[index]; !ok {
+			indexes = append(indexes, index)
+		}
+		byIndex[index] = append(byIndex[index], event)
+	}
+
+	var written uint64
+	for _, index := range indexes {
+		file, err := d.file(index)
+		if err != nil {
+			return err, written
+		}
+		err, count := file.Write(byIndex[index])
+		written += count
+		if err != nil {
+			return err, written
+		}
+	}
+	return nil, written
+}
+
+// Stats returns the bytes and the number of entries of the files of all indexes
+func (d *DeadLetterFiles) Stats() (int64, int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var size, entries int64
+	for _, file := range d.files {
+		fileSize, fileEntries := file.Stats()
+		size += fileSize
+		entries += fileEntries
+	}
+	return size, entries
+}
+
+func (d *DeadLetterFiles) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var err error
+	for _, file := range d.files {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
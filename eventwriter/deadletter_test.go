@@ -0,0 +1,179 @@
+package eventwriter_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+var _ = Describe("DeadLetterFile", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "dead-letter")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("appends the events as JSON lines", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		Ω(os.WriteFile(path, []byte("{\"event\":\"earlier\"}\n"), 0600)).Should(Succeed())
+
+		deadLetter, err := NewDeadLetterFile(path, &DeadLetterConfig{})
+		Ω(err).ShouldNot(HaveOccurred())
+		err, count := deadLetter.Write([]map[string]interface{}{{"event": "a", "index": "audit"}, {"event": "b"}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(count).To(Equal(uint64(2)))
+		Ω(deadLetter.Close()).Should(Succeed())
+
+		content, err := os.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"earlier\"}\n{\"event\":\"a\",\"index\":\"audit\"}\n{\"event\":\"b\"}\n"))
+	})
+
+	It("rotates the file and removes the oldest rotated file beyond the maximum", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		evicted := &monitoring.Counter{}
+		deadLetter, err := NewDeadLetterFile(path, &DeadLetterConfig{MaxBytes: 30, MaxFiles: 1, Evicted: evicted})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer deadLetter.Close()
+
+		for _, event := range []string{"a", "b", "c"} {
+			err, count := deadLetter.Write([]map[string]interface{}{{"event": event}})
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(1)))
+		}
+		err, _ = deadLetter.Write([]map[string]interface{}{{"event": "d"}, {"event": "e"}})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		content, err := os.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"d\"}\n{\"event\":\"e\"}\n"))
+		content, err = os.ReadFile(path + ".1")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"c\"}\n"))
+		Expect(path + ".2").NotTo(BeAnExistingFile())
+
+		Expect(evicted.Value()).To(Equal(uint64(2)))
+		size, entries := deadLetter.Stats()
+		Expect(size).To(Equal(int64(42)))
+		Expect(entries).To(Equal(int64(3)))
+	})
+
+	It("empties the file without rotated files", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		evicted := &monitoring.Counter{}
+		deadLetter, err := NewDeadLetterFile(path, &DeadLetterConfig{MaxBytes: 20, Evicted: evicted})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer deadLetter.Close()
+
+		deadLetter.Write([]map[string]interface{}{{"event": "a"}})
+		deadLetter.Write([]map[string]interface{}{{"event": "b"}})
+
+		content, err := os.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"b\"}\n"))
+		Expect(path + ".1").NotTo(BeAnExistingFile())
+		Expect(evicted.Value()).To(Equal(uint64(1)))
+	})
+
+	It("counts the entries of the existing files", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		Ω(os.WriteFile(path, []byte("{\"event\":\"c\"}\n"), 0600)).Should(Succeed())
+		Ω(os.WriteFile(path+".1", []byte("{\"event\":\"a\"}\n{\"event\":\"b\"}\n"), 0600)).Should(Succeed())
+
+		deadLetter, err := NewDeadLetterFile(path, &DeadLetterConfig{MaxBytes: 30, MaxFiles: 2})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer deadLetter.Close()
+
+		size, entries := deadLetter.Stats()
+		Expect(size).To(Equal(int64(42)))
+		Expect(entries).To(Equal(int64(3)))
+	})
+
+	It("removes the files whose newest entry is older than the maximum age", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		Ω(os.WriteFile(path, []byte("{\"event\":\"b\"}\n"), 0600)).Should(Succeed())
+		Ω(os.WriteFile(path+".1", []byte("{\"event\":\"a\"}\n"), 0600)).Should(Succeed())
+		old := time.Now().Add(-time.Hour)
+		Ω(os.Chtimes(path+".1", old, old)).Should(Succeed())
+
+		evicted := &monitoring.Counter{}
+		deadLetter, err := NewDeadLetterFile(path, &DeadLetterConfig{MaxFiles: 2, MaxAge: 200 * time.Millisecond, Evicted: evicted})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer deadLetter.Close()
+
+		Expect(path + ".1").NotTo(BeAnExistingFile())
+		Expect(evicted.Value()).To(Equal(uint64(1)))
+
+		Eventually(func() int64 {
+			_, entries := deadLetter.Stats()
+			return entries
+		}, time.Second).Should(BeZero())
+		Expect(evicted.Value()).To(Equal(uint64(2)))
+		content, err := os.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(content).To(BeEmpty())
+	})
+
+	It("appends the events of each index to their own file", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		deadLetter, err := NewDeadLetterFiles(path, &DeadLetterConfig{})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err, count := deadLetter.Write([]map[string]interface{}{
+			{"event": "a", "index": "audit"},
+			{"event": "b", "index": "main"},
+			{"event": "c", "index": "audit"},
+			{"event": "d"},
+			{"event": "e", "index": "../escape"},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(count).To(Equal(uint64(5)))
+		Ω(deadLetter.Close()).Should(Succeed())
+
+		content, err := os.ReadFile(path + ".audit")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"a\",\"index\":\"audit\"}\n{\"event\":\"c\",\"index\":\"audit\"}\n"))
+		content, err = os.ReadFile(path + ".main")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"b\",\"index\":\"main\"}\n"))
+		content, err = os.ReadFile(path + "._default")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"d\"}\n"))
+		content, err = os.ReadFile(path + "._invalid")
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(string(content)).To(Equal("{\"event\":\"e\",\"index\":\"../escape\"}\n"))
+		Expect(path).NotTo(BeAnExistingFile())
+	})
+
+	It("counts the entries of the existing files of the indexes", func() {
+		path := filepath.Join(dir, "dead-letter.json")
+		Ω(os.WriteFile(path+".audit", []byte("{\"event\":\"b\"}\n"), 0600)).Should(Succeed())
+		Ω(os.WriteFile(path+".audit.1", []byte("{\"event\":\"a\"}\n"), 0600)).Should(Succeed())
+		Ω(os.WriteFile(path+".main", []byte("{\"event\":\"c\"}\n"), 0600)).Should(Succeed())
+
+		deadLetter, err := NewDeadLetterFiles(path, &DeadLetterConfig{MaxFiles: 1})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer deadLetter.Close()
+
+		size, entries := deadLetter.Stats()
+		Expect(size).To(Equal(int64(42)))
+		Expect(entries).To(Equal(int64(3)))
+	})
+
+	It("fails when the file can't be opened", func() {
+		_, err := NewDeadLetterFile(filepath.Join(dir, "missing", "dead-letter.json"), &DeadLetterConfig{})
+		Ω(err).Should(HaveOccurred())
+	})
+})
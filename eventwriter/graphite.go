@@ -0,0 +1,100 @@
+package eventwriter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type GraphiteConfig struct {
+	Host    string // carbon plaintext endpoint, host:port
+	Timeout time.Duration
+	Debug   bool
+
+	Logger lager.Logger
+}
+
+// graphiteClient writes events as Graphite plaintext lines. Every event must have
+// a "name", a numeric "value" and a "time" in seconds
+type graphiteClient struct {
+	config *GraphiteConfig
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func NewGraphite(config *GraphiteConfig) Writer {
+	return &graphiteClient{
+		config: config,
+	}
+}
+
+func (g *graphiteClient) Write(events []map[string]interface{}) (error, uint64) {
+	body := new(bytes.Buffer)
+	var count uint64
+	for _, event := range events {
+		name, ok := event["name"].(string)
+		if !ok || name == "" {
+			continue
+		}
+		value, ok := event["value"].(float64)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(body, "%s %s %d\n", name, strconv.FormatFloat(value, 'f', -1, 64), event["time"])
+		count++
+	}
+
+	if body.Len() == 0 {
+		return nil, 0
+	}
+
+	if g.config.Debug {
+		fmt.Print(body.String())
+		return nil, count
+	}
+
+	return g.send(body.Bytes()), count
+}
+
+// send writes the lines on a persistent connection which is re-established on the
+// next write after a failure
+func (g *graphiteClient) send(body []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.config.Host, g.config.Timeout)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+
+	if g.config.Timeout > 0 {
+		g.conn.SetWriteDeadline(time.Now().Add(g.config.Timeout))
+	}
+	if _, err := g.conn.Write(body); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (g *graphiteClient) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
@@ -0,0 +1,73 @@
+package eventwriter_test
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+var _ = Describe("Graphite", func() {
+	var (
+		listener net.Listener
+		received chan string
+		config   *GraphiteConfig
+	)
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+
+		received = make(chan string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			body, _ := io.ReadAll(conn)
+			received <- string(body)
+		}()
+
+		config = &GraphiteConfig{
+			Host:    listener.Addr().String(),
+			Timeout: time.Second,
+			Logger:  lager.NewLogger("test"),
+		}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("writes plaintext lines", func() {
+		writer := NewGraphite(config)
+		err, sent := writer.Write([]map[string]interface{}{
+			{"name": "cf.gorouter.latency", "value": 12.5, "time": int64(1467040874)},
+			{"name": "cf.gorouter.requests", "value": float64(42), "time": int64(1467040875)},
+			{"name": "cf.invalid", "value": "NaN", "time": int64(1467040875)},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sent).To(Equal(uint64(2)))
+
+		listener.Close()
+		writer.(io.Closer).Close()
+		Eventually(received).Should(Receive(Equal("cf.gorouter.latency 12.5 1467040874\ncf.gorouter.requests 42 1467040875\n")))
+	})
+
+	It("returns an error when the host is unreachable", func() {
+		listener.Close()
+		writer := NewGraphite(config)
+		err, _ := writer.Write([]map[string]interface{}{
+			{"name": "cf.gorouter.latency", "value": 12.5, "time": int64(1467040874)},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,122 @@
+package eventwriter
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cfhttp"
+	"code.cloudfoundry.org/lager"
+)
+
+// HEC error code of events sent to an index which doesn't exist or isn't allowed for the token
+const hecIncorrectIndexCode = 7
+
+type IndexCreatorConfig struct {
+	Endpoint string // Splunk management endpoint, for example https://splunk:8089
+	User     string
+	Password string
+	SkipSSL  bool
+
+	// SkipSSL only applies until then when set, certificates are verified afterwards
+	SkipSSLUntil time.Time
+
+	// A failed creation is returned without calling the API again until then
+	RetryInterval time.Duration
+
+	Logger lager.Logger
+}
+
+// IndexCreator creates missing indexes with the Splunk management REST API. Every
+// index is created at most once, failed creations are tried again after the retry
+// interval. It is shared by all writers
+type IndexCreator struct {
+	httpClient *http.Client
+	config     *IndexCreatorConfig
+
+	lock    sync.Mutex
+	created map[string]bool
+	failed  map[string]failedCreation
+}
+
+func NewIndexCreator(config *IndexCreatorConfig) *IndexCreator {
+	httpClient := cfhttp.NewClient()
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipSSL, MinVersion: tls.VersionTLS12}
+	if config.SkipSSL && !config.SkipSSLUntil.IsZero() {
+		verifyAfter(tlsConfig, config.SkipSSLUntil)
+	}
+	httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+
+	return &IndexCreator{
+		httpClient: httpClient,
+		config:     config,
+		created:    make(map[string]bool),
+		failed:     make(map[string]failedCreation),
+	}
+}
+
+type failedCreation struct {
+	err error
+	at  time.Time
+}
+
+// Create creates the index. An index which already exists is not an error. Once
+// the index is created, later calls with the same index return nil right away.
+// The error of a failed creation is returned by later calls until the retry
+// interval has passed, so a permanent error doesn't call the API for every batch
+func (c *IndexCreator) Create(index string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.created[index] {
+		return nil
+	}
+	if failed, ok := c.failed[index]; ok && time.Since(failed.at) < c.config.RetryInterval {
+		return failed.err
+	}
+
+	err := c.create(index)
+	if err != nil {
+		c.failed[index] = failedCreation{err: err, at: time.Now()}
+		c.config.Logger.Error("Failed to create index", err, lager.Data{"index": index})
+		return err
+	}
+	delete(c.failed, index)
+	c.created[index] = true
+	c.config.Logger.Info("Created index", lager.Data{"index": index})
+	return nil
+}
+
+func (c *IndexCreator) create(index string) error {
+	if index == "" {
+		return errors.New("no index name")
+	}
+
+	form := url.Values{}
+	form.Set("name", index)
+	endpoint := fmt.Sprintf("%s/services/data/indexes", c.config.Endpoint)
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.config.User, c.config.Password)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode > 299 && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("Non-ok response code [%d] from splunk management API: %s", resp.StatusCode, responseBody)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package eventwriter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+var _ = Describe("IndexCreator", func() {
+	var (
+		hec, management *httptest.Server
+		created         atomic.Value
+		creations       int32
+		requests        int32
+		config          *SplunkConfig
+	)
+
+	BeforeEach(func() {
+		created.Store("")
+		atomic.StoreInt32(&creations, 0)
+		atomic.StoreInt32(&requests, 0)
+
+		management = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			user, password, _ := request.BasicAuth()
+			if request.URL.Path != "/services/data/indexes" || user != "admin" || password != "secret" {
+				writer.WriteHeader(401)
+				return
+			}
+			atomic.AddInt32(&creations, 1)
+			created.Store(request.FormValue("name"))
+			writer.WriteHeader(201)
+		}))
+
+		hec = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if created.Load() != "tenant_a" {
+				writer.WriteHeader(400)
+				writer.Write([]byte(`{"text":"Incorrect index","code":7,"invalid-event-number":1}`))
+			}
+		}))
+
+		config = &SplunkConfig{
+			Host:   hec.URL,
+			Token:  "token",
+			Logger: lager.NewLogger("test"),
+			IndexCreator: NewIndexCreator(&IndexCreatorConfig{
+				Endpoint: management.URL,
+				User:     "admin",
+				Password: "secret",
+				Logger:   lager.NewLogger("test"),
+			}),
+		}
+	})
+
+	AfterEach(func() {
+		hec.Close()
+		management.Close()
+	})
+
+	It("creates the missing index and sends the events again", func() {
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{
+			{"event": "test", "index": "main"},
+			{"event": "test", "index": "tenant_a"},
+		})
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.Load()).To(Equal("tenant_a"))
+	})
+
+	It("doesn't create indexes without an index creator", func() {
+		config.IndexCreator = nil
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{
+			{"event": "test", "index": "main"},
+			{"event": "test", "index": "tenant_a"},
+		})
+
+		Expect(err).To(HaveOccurred())
+		Expect(atomic.LoadInt32(&creations)).To(Equal(int32(0)))
+	})
+
+	It("only creates an index once", func() {
+		client := NewSplunk(config)
+		events := []map[string]interface{}{
+			{"event": "test", "index": "main"},
+			{"event": "test", "index": "tenant_a"},
+		}
+
+		err, _ := client.Write(events)
+		Expect(err).NotTo(HaveOccurred())
+		err, _ = client.Write(events)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.IndexCreator.Create("tenant_a")).To(Succeed())
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+	})
+
+	Context("when the creation fails", func() {
+		BeforeEach(func() {
+			config.IndexCreator = NewIndexCreator(&IndexCreatorConfig{
+				Endpoint:      management.URL,
+				User:          "admin",
+				Password:      "wrong",
+				Logger:        lager.NewLogger("test"),
+				RetryInterval: 200 * time.Millisecond,
+			})
+		})
+
+		It("doesn't try again within the retry interval", func() {
+			client := NewSplunk(config)
+			events := []map[string]interface{}{
+				{"event": "test", "index": "main"},
+				{"event": "test", "index": "tenant_a"},
+			}
+
+			err, _ := client.Write(events)
+			Expect(err).To(HaveOccurred())
+			err, _ = client.Write(events)
+			Expect(err).To(HaveOccurred())
+			Expect(config.IndexCreator.Create("tenant_a")).To(HaveOccurred())
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		})
+
+		It("tries again after the retry interval", func() {
+			Expect(config.IndexCreator.Create("tenant_a")).To(HaveOccurred())
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+
+			time.Sleep(250 * time.Millisecond)
+			Expect(config.IndexCreator.Create("tenant_a")).To(HaveOccurred())
+			Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+			Expect(atomic.LoadInt32(&creations)).To(Equal(int32(0)))
+		})
+	})
+})
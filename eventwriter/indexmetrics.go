@@ -0,0 +1,37 @@
+package eventwriter
+
+import (
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+// defaultIndexLabel labels the events sent to the default index of the token
+const defaultIndexLabel = "default"
+
+// IndexMetrics counts the events and bytes delivered by the writers sharing it per
+// destination index, in the splunk.events.sent.<index> and splunk.bytes.sent.<index>
+// metrics. At most limit indexes get their own counters, the others are counted in
+// the .other counters
+type IndexMetrics struct {
+	events *monitoring.CounterVec
+	bytes  *monitoring.CounterVec
+}
+
+func NewIndexMetrics(limit int, metrics *monitoring.Metrics) *IndexMetrics {
+	return &IndexMetrics{
+		events: metrics.NewCounterVec("splunk.events.sent", limit),
+		bytes:  metrics.NewCounterVec("splunk.bytes.sent", limit),
+	}
+}
+
+// Add counts the events and the bytes of a delivered batch, "" is the default index
+// of the token
+func (m *IndexMetrics) Add(events map[string]int, bytes map[string]int) {
+	for index, count := range events {
+		label := index
+		if label == "" {
+			label = defaultIndexLabel
+		}
+		m.events.WithLabel(label).Add(uint64(count))
+		m.bytes.WithLabel(label).Add(uint64(bytes[index]))
+	}
+}
@@ -0,0 +1,26 @@
+package eventwriter_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+)
+
+var _ = Describe("IndexMetrics", func() {
+	It("counts the indexes over the limit as other", func() {
+		metrics := monitoring.NewMetrics()
+		indexMetrics := NewIndexMetrics(1, metrics)
+
+		indexMetrics.Add(map[string]int{"hot": 2}, map[string]int{"hot": 100})
+		indexMetrics.Add(map[string]int{"cold": 1, "hot": 1}, map[string]int{"cold": 30, "hot": 50})
+
+		Expect(metrics.Snapshot()).To(Equal(map[string]float64{
+			"splunk.events.sent.hot":   3,
+			"splunk.bytes.sent.hot":    150,
+			"splunk.events.sent.other": 1,
+			"splunk.bytes.sent.other":  30,
+		}))
+	})
+})
@@ -0,0 +1,83 @@
+package eventwriter
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Receipt describes a batch of events accepted by HEC
+type Receipt struct {
+	Events  int
+	Indexes map[string]int // events per destination index, "" is the default index of the token
+	Host    string
+	Latency time.Duration
+	AckID   *int64 // only returned by HEC when indexer acknowledgement is enabled
+	Channel string // HEC channel GUID of the writer with ChannelField
+}
+
+// ReceiptLogger logs a debug receipt of every batch delivered by the writers sharing
+// it, at most maxPerSecond receipts per second so tracing can't flood the logs.
+// Receipts over the limit are counted and reported by the next logged receipt
+type ReceiptLogger struct {
+	maxPerSecond int
+	logger       lager.Logger
+
+	lock       sync.Mutex
+	second     int64 // unix second of logged
+	logged     int
+	suppressed uint64
+}
+
+func NewReceiptLogger(maxPerSecond int, logger lager.Logger) *ReceiptLogger {
+	return &ReceiptLogger{
+		maxPerSecond: maxPerSecond,
+		logger:       logger,
+	}
+}
+
+// Log logs the receipt unless maxPerSecond receipts were already logged this second
+func (r *ReceiptLogger) Log(receipt Receipt, now time.Time) {
+	r.lock.Lock()
+	if second := now.Unix(); second != r.second {
+		r.second, r.logged = second, 0
+	}
+	if r.logged >= r.maxPerSecond {
+		r.suppressed++
+		r.lock.Unlock()
+		return
+	}
+	r.logged++
+	suppressed := r.suppressed
+	r.suppressed = 0
+	r.lock.Unlock()
+
+	indexes := make([]string, 0, len(receipt.Indexes))
+	for index := range receipt.Indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+
+	data := lager.Data{
+		"events":     receipt.Events,
+		"host":       receipt.Host,
+		"latency_ms": receipt.Latency.Milliseconds(),
+	}
+	if len(indexes) == 1 {
+		data["index"] = indexes[0]
+	} else {
+		data["indexes"] = receipt.Indexes
+	}
+	if receipt.AckID != nil {
+		data["ack_id"] = *receipt.AckID
+	}
+	if receipt.Channel != "" {
+		data["channel"] = receipt.Channel
+	}
+	if suppressed > 0 {
+		data["suppressed_receipts"] = suppressed
+	}
+	r.logger.Debug("Delivered batch", data)
+}
@@ -0,0 +1,87 @@
+package eventwriter_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+// receiptLogs returns the data of the receipts logged to the buffer
+func receiptLogs(buffer *bytes.Buffer) []map[string]interface{} {
+	var receipts []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var log struct {
+			Message string                 `json:"message"`
+			Data    map[string]interface{} `json:"data"`
+		}
+		Expect(json.Unmarshal([]byte(line), &log)).To(Succeed())
+		Expect(log.Message).To(HaveSuffix("Delivered batch"))
+		receipts = append(receipts, log.Data)
+	}
+	return receipts
+}
+
+var _ = Describe("ReceiptLogger", func() {
+	var (
+		buffer   *bytes.Buffer
+		receipts *ReceiptLogger
+	)
+
+	BeforeEach(func() {
+		buffer = new(bytes.Buffer)
+		logger := lager.NewLogger("test")
+		logger.RegisterSink(lager.NewWriterSink(buffer, lager.DEBUG))
+		receipts = NewReceiptLogger(2, logger)
+	})
+
+	It("logs receipts at debug level", func() {
+		ackID := int64(7)
+		receipts.Log(Receipt{
+			Events:  3,
+			Indexes: map[string]int{"main": 3},
+			Host:    "https://hec:8088",
+			Latency: 25 * time.Millisecond,
+			AckID:   &ackID,
+			Channel: "0a956421-f2e1-4215-9d88-d15633bb3023",
+		}, time.Now())
+		receipts.Log(Receipt{Events: 2, Indexes: map[string]int{"main": 1, "logs": 1}}, time.Now())
+
+		logs := receiptLogs(buffer)
+		Expect(logs).To(HaveLen(2))
+		Expect(logs[0]).To(Equal(map[string]interface{}{
+			"events":     float64(3),
+			"index":      "main",
+			"host":       "https://hec:8088",
+			"latency_ms": float64(25),
+			"ack_id":     float64(7),
+			"channel":    "0a956421-f2e1-4215-9d88-d15633bb3023",
+		}))
+		Expect(logs[1]["indexes"]).To(Equal(map[string]interface{}{"main": float64(1), "logs": float64(1)}))
+		Expect(logs[1]).ToNot(HaveKey("ack_id"))
+	})
+
+	It("reports the receipts suppressed over the limit", func() {
+		now := time.Unix(1000, 0)
+		for i := 0; i < 5; i++ {
+			receipts.Log(Receipt{Events: i}, now)
+		}
+		Expect(receiptLogs(buffer)).To(HaveLen(2))
+
+		receipts.Log(Receipt{Events: 5}, now.Add(time.Second))
+		logs := receiptLogs(buffer)
+		Expect(logs).To(HaveLen(3))
+		Expect(logs[2]["events"]).To(Equal(float64(5)))
+		Expect(logs[2]["suppressed_receipts"]).To(Equal(float64(3)))
+	})
+})
@@ -1,18 +1,32 @@
 package eventwriter
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/cfhttp"
 	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/google/uuid"
 )
 
+// DefaultHECPath is the path of the HEC collector of Splunk
+const DefaultHECPath = "/services/collector"
+
 type SplunkConfig struct {
 	Host    string
 	Token   string
@@ -21,51 +35,194 @@ type SplunkConfig struct {
 	SkipSSL bool
 	Debug   bool
 	Version string
+	Metrics *monitoring.Metrics
+
+	// SkipSSL only applies until then when set, certificates are verified afterwards
+	SkipSSLUntil time.Time
+
+	// Send the events after an event HEC rejects as invalid again, instead of failing
+	// the whole batch, as HEC indexes the events before the invalid one
+	SkipInvalidEvents bool
+
+	// Decompress the gzip response bodies the HTTP client leaves compressed, sent by
+	// gateways in front of HEC with an x-gzip or no content encoding
+	DecodeGzipResponses bool
+
+	// Name of the token in the splunk.token.<name>.* metrics, which aren't emitted when empty
+	TokenName string
+
+	TLSMinVersion   uint16   // TLS 1.2 when not set
+	TLSCipherSuites []uint16 // Go defaults when empty, only applies to TLS 1.2
+
+	// Path of the HEC collector, DefaultHECPath when empty, see ValidateHECPath
+	Path string
+
+	// Hosts to fail over to, in order of preference, when Host is unreachable
+	FailoverHosts     []string
+	FailoverThreshold int           // consecutive failures before failing over to the next host
+	FailbackInterval  time.Duration // how often to retry a more preferred host after failing over
+
+	// Creates the index of events rejected by HEC because the index doesn't exist
+	IndexCreator *IndexCreator
+
+	// Caps the request bodies buffered by all writers, optional
+	BufferLimiter *BufferLimiter
+
+	// Logs a receipt of every delivered batch, optional
+	Receipts *ReceiptLogger
+
+	// Counts the delivered events and bytes per index, optional
+	IndexMetrics *IndexMetrics
+
+	// Send the requests on a channel of the writer, whose GUID is also added to the
+	// _hec_channel field of events, to trace events to their channel when debugging
+	ChannelField bool
 
 	Logger lager.Logger
 }
 
 type splunkClient struct {
-	httpClient *http.Client
-	config     *SplunkConfig
+	httpClient   *http.Client
+	config       *SplunkConfig
+	bytesCounter *monitoring.Counter
+
+	// events skipped with SkipInvalidEvents
+	rejectedCounter *monitoring.Counter
+
+	// per token counters, nil without TokenName
+	tokenRequests  *monitoring.Counter
+	tokenThrottled *monitoring.Counter
+
+	// base URL of each host, which differs from the host for Unix domain sockets
+	urls map[string]string
+
+	// HEC channel GUID, empty without ChannelField
+	channel string
+
+	// set once the connections established before SkipSSLUntil are closed
+	verifying int32
+
+	// failover state, hosts[0] is the primary
+	lock         sync.Mutex
+	hosts        []string
+	active       int
+	failures     int
+	lastFailback time.Time
 }
 
 func NewSplunk(config *SplunkConfig) Writer {
 	httpClient := cfhttp.NewClient()
+	minVersion := config.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipSSL, MinVersion: tls.VersionTLS12},
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.SkipSSL,
+			MinVersion:         minVersion,
+			CipherSuites:       config.TLSCipherSuites,
+		},
+	}
+	if config.SkipSSL && !config.SkipSSLUntil.IsZero() {
+		verifyAfter(tr.TLSClientConfig, config.SkipSSLUntil)
 	}
 	httpClient.Transport = tr
 
-	return &splunkClient{
-		httpClient: httpClient,
-		config:     config,
+	hosts := append([]string{config.Host}, config.FailoverHosts...)
+	urls, sockets := hostURLs(hosts)
+	if len(sockets) > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if path, ok := sockets[addr]; ok {
+				return dialer.DialContext(ctx, "unix", path)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
 	}
+
+	if config.Metrics == nil {
+		config.Metrics = monitoring.NewMetrics()
+	}
+	if config.Path == "" {
+		config.Path = DefaultHECPath
+	}
+
+	client := &splunkClient{
+		httpClient:   httpClient,
+		config:       config,
+		bytesCounter: config.Metrics.NewCounter("splunk.bytes.sent"),
+		hosts:        hosts,
+		urls:         urls,
+	}
+	if config.ChannelField {
+		client.channel = uuid.New().String()
+	}
+	if config.SkipInvalidEvents {
+		client.rejectedCounter = config.Metrics.NewCounter("splunk.events.rejected")
+	}
+	if config.TokenName != "" {
+		client.tokenRequests = config.Metrics.NewCounter(fmt.Sprintf("splunk.token.%s.requests", config.TokenName))
+		client.tokenThrottled = config.Metrics.NewCounter(fmt.Sprintf("splunk.token.%s.throttled", config.TokenName))
+	}
+	return client
+}
+
+// eventFields returns a new fields map of the event, the configured Fields in place of
+// the fields of the event when set, with the _hec_channel of the writer. The fields
+// of the event and the configured Fields may be shared, so neither is modified
+func (s *splunkClient) eventFields(event map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if len(s.config.Fields) > 0 {
+		for name, value := range s.config.Fields {
+			fields[name] = value
+		}
+	} else if eventFields, ok := event["fields"].(map[string]interface{}); ok {
+		for name, value := range eventFields {
+			fields[name] = value
+		}
+	}
+	if s.channel != "" {
+		fields["_hec_channel"] = s.channel
+	}
+	return fields
 }
 
 func (s *splunkClient) Write(events []map[string]interface{}) (error, uint64) {
 	bodyBuffer := new(bytes.Buffer)
 	count := uint64(len(events))
-	for i, event := range events {
+	// events of the body, without those which can't be marshalled, as numbered by HEC
+	sent := make([]map[string]interface{}, 0, len(events))
+	var indexes, indexBytes map[string]int
+	if s.config.Receipts != nil || s.config.IndexMetrics != nil {
+		indexes = make(map[string]int)
+		indexBytes = make(map[string]int)
+	}
+	for _, event := range events {
 
 		if _, ok := event["index"]; !ok {
-			if event["event"].(map[string]interface{})["info_splunk_index"] != nil {
-				event["index"] = event["event"].(map[string]interface{})["info_splunk_index"]
+			if fields, ok := event["event"].(map[string]interface{}); ok && fields["info_splunk_index"] != nil {
+				event["index"] = fields["info_splunk_index"]
 			} else if s.config.Index != "" {
 				event["index"] = s.config.Index
 			}
 		}
 
-		if len(s.config.Fields) > 0 {
-			event["fields"] = s.config.Fields
+		if len(s.config.Fields) > 0 || s.channel != "" {
+			event["fields"] = s.eventFields(event)
 		}
 
 		eventJson, err := json.Marshal(event)
 		if err == nil {
-			bodyBuffer.Write(eventJson)
-			if i < len(events)-1 {
+			if indexes != nil {
+				index, _ := event["index"].(string)
+				indexes[index]++
+				indexBytes[index] += len(eventJson)
+			}
+			if len(sent) > 0 {
 				bodyBuffer.Write([]byte("\n\n"))
 			}
+			bodyBuffer.Write(eventJson)
+			sent = append(sent, event)
 		} else {
 			s.config.Logger.Error("Error marshalling event", err,
 				lager.Data{
@@ -80,40 +237,445 @@ func (s *splunkClient) Write(events []map[string]interface{}) (error, uint64) {
 		return s.dump(bodyString), count
 	} else {
 		bodyBytes := bodyBuffer.Bytes()
-		return s.send(&bodyBytes), count
+		held := int64(len(bodyBytes))
+		if s.config.BufferLimiter != nil {
+			s.config.BufferLimiter.Acquire(held)
+			defer func() { s.config.BufferLimiter.Release(held) }()
+		}
+
+		start := time.Now()
+		host, resp, err := s.send(&bodyBytes)
+		if err != nil && s.config.IndexCreator != nil && s.createMissingIndex(sent, err) {
+			start = time.Now()
+			host, resp, err = s.send(&bodyBytes)
+		}
+		var rejected []map[string]interface{}
+		if err != nil && s.config.SkipInvalidEvents {
+			host, resp, rejected, err = s.skipInvalidEvents(sent, host, err, &held)
+			count -= uint64(len(rejected))
+		}
+		if err == nil && s.config.Receipts != nil {
+			now := time.Now()
+			s.config.Receipts.Log(Receipt{
+				Events:  int(count),
+				Indexes: indexes,
+				Host:    host,
+				Latency: now.Sub(start),
+				AckID:   resp.AckID,
+				Channel: s.channel,
+			}, now)
+		}
+		if err == nil && s.config.IndexMetrics != nil {
+			s.config.IndexMetrics.Add(indexes, indexBytes)
+		}
+		if err == nil && len(rejected) > 0 {
+			return &RejectedEventsError{Events: rejected}, count
+		}
+		return err, count
+	}
+}
+
+// send posts the events to the active host and returns the host which accepted them.
+// When failover hosts are configured, the primary is tried again at every
+// FailbackInterval after failing over
+func (s *splunkClient) send(postBody *[]byte) (string, *hecResponse, error) {
+	s.enforceVerification()
+	host, failback := s.host()
+	if failback {
+		if resp, err := s.post(s.hosts[0], postBody); err == nil {
+			s.failBack()
+			return s.hosts[0], resp, nil
+		}
+	}
+
+	resp, err := s.post(host, postBody)
+	s.recordResult(host, err)
+	return host, resp, err
+}
+
+// enforceVerification closes the connections established without verifying the
+// certificate of HEC once SkipSSLUntil has passed, so no events are sent on them
+func (s *splunkClient) enforceVerification() {
+	if s.config.SkipSSLUntil.IsZero() || time.Now().Before(s.config.SkipSSLUntil) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&s.verifying, 0, 1) {
+		s.httpClient.CloseIdleConnections()
+		s.config.Logger.Info("SkipSSL expired, verifying the certificates of HEC", lager.Data{"host": s.config.Host})
 	}
 }
 
-func (s *splunkClient) send(postBody *[]byte) error {
-	endpoint := fmt.Sprintf("%s/services/collector", s.config.Host)
+// host returns the active host and whether the primary should be retried first
+func (s *splunkClient) host() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active == 0 || time.Since(s.lastFailback) < s.config.FailbackInterval {
+		return s.hosts[s.active], false
+	}
+	s.lastFailback = time.Now()
+	return s.hosts[s.active], true
+}
+
+func (s *splunkClient) failBack() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.config.Logger.Info("Failing back to primary HEC host", lager.Data{"host": s.hosts[0], "from": s.hosts[s.active]})
+	s.active = 0
+	s.failures = 0
+}
+
+// recordResult advances to the next host after FailoverThreshold consecutive failures
+func (s *splunkClient) recordResult(host string, err error) {
+	if len(s.hosts) == 1 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if host != s.hosts[s.active] {
+		// Another goroutine already failed over
+		return
+	}
+
+	if err == nil {
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.failures < s.config.FailoverThreshold {
+		return
+	}
+
+	next := (s.active + 1) % len(s.hosts)
+	s.config.Logger.Error("Failing over to next HEC host", err, lager.Data{"host": s.hosts[next], "from": host})
+	s.active = next
+	s.failures = 0
+	s.lastFailback = time.Now()
+}
+
+// hecResponse is the body of a successful HEC response, only decoded for receipts
+type hecResponse struct {
+	AckID *int64 `json:"ackId"`
+}
+
+func (s *splunkClient) post(host string, postBody *[]byte) (*hecResponse, error) {
+	endpoint := s.urls[host] + s.config.Path
 	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(*postBody))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Authorization", fmt.Sprintf("Splunk %s", s.config.Token))
+	if s.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
 	//Add app headers for HEC telemetry
 	req.Header.Set("__splunk_app_name", "Splunk Firehose Nozzle")
 	req.Header.Set("__splunk_app_version", s.config.Version)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if s.tokenRequests != nil {
+		s.tokenRequests.Add(1)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			s.tokenThrottled.Add(1)
+		}
+	}
+
+	body := s.responseBody(resp)
 	if resp.StatusCode > 299 {
-		responseBody, _ := io.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf("Non-ok response code [%d] from splunk: %s", resp.StatusCode, responseBody))
-	} else {
-		//Draining the response buffer, so that the same connection can be reused the next time
-		_, err := io.Copy(io.Discard, resp.Body)
-		if err != nil {
-			s.config.Logger.Error("Error discarding response body", err)
+		responseBody, _ := io.ReadAll(body)
+		return nil, &responseError{statusCode: resp.StatusCode, body: responseBody}
+	}
+
+	hecResp := &hecResponse{}
+	if s.config.Receipts != nil {
+		// An undecodable body only loses the ackId of the receipt
+		json.NewDecoder(body).Decode(hecResp)
+	}
+	//Draining the response buffer, so that the same connection can be reused the next time
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		s.config.Logger.Error("Error discarding response body", err)
+	}
+	s.bytesCounter.Add(uint64(len(*postBody)))
+
+	return hecResp, nil
+}
+
+// gzipMagic starts gzip streams, while HEC responses are JSON or plain text
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// responseBody returns the body of the HEC response, decompressed when it's still
+// gzip-compressed and DecodeGzipResponses is set. The HTTP client only decompresses
+// the responses with a gzip content encoding, which it asked for
+func (s *splunkClient) responseBody(resp *http.Response) io.Reader {
+	if !s.config.DecodeGzipResponses {
+		return resp.Body
+	}
+
+	body := bufio.NewReader(resp.Body)
+	if magic, _ := body.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return body
+	}
+	decoded, err := gzip.NewReader(body)
+	if err != nil {
+		s.config.Logger.Error("Failed to decompress HEC response", err)
+		return body
+	}
+	return decoded
+}
+
+// unixSocketScheme prefixes hosts which are Unix domain sockets speaking HTTP, for
+// example unix:///var/run/splunk/hec.sock
+const unixSocketScheme = "unix://"
+
+// ValidateHECPath checks that path is an absolute URL path, without query, fragment
+// or trailing slash, to which the subpaths of the collector, like /health, are appended
+func ValidateHECPath(path string) error {
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return fmt.Errorf("HEC path %q must start with / and not end with /", path)
+	}
+	if strings.ContainsAny(path, "?#% \t\r\n") {
+		return fmt.Errorf("HEC path %q must not contain a query, a fragment, escapes or whitespace", path)
+	}
+	for _, segment := range strings.Split(path[1:], "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("HEC path %q must not contain empty, . or .. segments", path)
 		}
 	}
+	return nil
+}
+
+// PlainHTTPHost returns whether the host is reached over plain HTTP, without TLS,
+// which is only meant for a local development Splunk
+func PlainHTTPHost(host string) bool {
+	return strings.HasPrefix(strings.ToLower(host), "http://")
+}
+
+// hostURLs returns the base URL of each host, hosts without a scheme are reached over
+// HTTPS. Unix domain socket hosts are given a placeholder http URL, whose address is
+// mapped to the path of the socket
+func hostURLs(hosts []string) (map[string]string, map[string]string) {
+	urls := make(map[string]string, len(hosts))
+	sockets := make(map[string]string)
+	for i, host := range hosts {
+		if !strings.HasPrefix(host, unixSocketScheme) {
+			urls[host] = host
+			if !strings.Contains(host, "://") {
+				if u, err := url.Parse("https://" + host); err == nil && u.Hostname() != "" {
+					urls[host] = u.String()
+				}
+			}
+			continue
+		}
+
+		name := fmt.Sprintf("unix-socket-%d", i)
+		urls[host] = "http://" + name
+		sockets[name+":80"] = strings.TrimPrefix(host, unixSocketScheme)
+	}
+	return urls, sockets
+}
+
+// ParseTLSVersion parses a TLS version, either "1.2" or "1.3". Older versions are rejected
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version [%s], expected 1.2 or 1.3", version)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, for example
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Unknown and insecure suites are rejected
+func ParseCipherSuites(names string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite [%s]", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// responseError is a non-ok response from HEC
+type responseError struct {
+	statusCode int
+	body       []byte
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("Non-ok response code [%d] from splunk: %s", e.statusCode, e.body)
+}
+
+// RejectedEventsError is returned by Write with SkipInvalidEvents when HEC rejected some
+// of the events as invalid, once the other events were accepted, so the caller can
+// keep the rejected events, for example in a dead letter file
+type RejectedEventsError struct {
+	Events []map[string]interface{}
+}
+
+func (e *RejectedEventsError) Error() string {
+	return fmt.Sprintf("%d events rejected by HEC", len(e.Events))
+}
+
+// hecError is the body of a HEC error response
+type hecError struct {
+	Text               string `json:"text"`
+	Code               int    `json:"code"`
+	InvalidEventNumber *int   `json:"invalid-event-number"`
+}
+
+// invalidEvent returns the HEC error of the response and the number of the event of
+// the batch of n events HEC rejected, or false when no single event was rejected
+func invalidEvent(err error, n int) (hecError, int, bool) {
+	var respErr *responseError
+	var hecErr hecError
+	if !errors.As(err, &respErr) || json.Unmarshal(respErr.body, &hecErr) != nil {
+		return hecErr, 0, false
+	}
+	if hecErr.InvalidEventNumber == nil || *hecErr.InvalidEventNumber < 0 || *hecErr.InvalidEventNumber >= n {
+		return hecErr, 0, false
+	}
+	return hecErr, *hecErr.InvalidEventNumber, true
+}
+
+// createMissingIndex creates the index of the event HEC rejected because of an incorrect
+// index. It returns true when the index was created and the events can be sent again
+func (s *splunkClient) createMissingIndex(events []map[string]interface{}, err error) bool {
+	hecErr, invalid, ok := invalidEvent(err, len(events))
+	if !ok || hecErr.Code != hecIncorrectIndexCode {
+		return false
+	}
+
+	index, _ := events[invalid]["index"].(string)
+	return s.config.IndexCreator.Create(index) == nil
+}
+
+// skipInvalidEvents sends the events after the event HEC rejected as invalid again, until
+// HEC accepts them or fails for another reason. HEC indexes the events before the invalid
+// one. The bodies sent again are part of the body of held bytes acquired from the
+// BufferLimiter, which is reduced to them. It returns the result of the last request and
+// the rejected events
+func (s *splunkClient) skipInvalidEvents(events []map[string]interface{}, host string, err error, held *int64) (string, *hecResponse, []map[string]interface{}, error) {
+	var resp *hecResponse
+	var rejected []map[string]interface{}
+	for {
+		hecErr, invalid, ok := invalidEvent(err, len(events))
+		if !ok {
+			return host, resp, rejected, err
+		}
+
+		rejected = append(rejected, events[invalid])
+		s.rejectedCounter.Add(1)
+		index, _ := events[invalid]["index"].(string)
+		sourcetype, _ := events[invalid]["sourcetype"].(string)
+		s.config.Logger.Error("Skipping event rejected by HEC", nil, lager.Data{
+			"reason":     hecErr.Text,
+			"code":       hecErr.Code,
+			"index":      index,
+			"sourcetype": sourcetype,
+		})
+
+		events = events[invalid+1:]
+		if len(events) == 0 {
+			return host, &hecResponse{}, rejected, nil
+		}
+		body := encodeEvents(events)
+		if s.config.BufferLimiter != nil {
+			s.config.BufferLimiter.Release(*held - int64(len(body)))
+			*held = int64(len(body))
+		}
+		host, resp, err = s.send(&body)
+	}
+}
+
+// encodeEvents returns the request body of the events, events which can't be
+// marshalled are left out
+func encodeEvents(events []map[string]interface{}) []byte {
+	encoded := make([][]byte, 0, len(events))
+	for _, event := range events {
+		if eventJson, err := json.Marshal(event); err == nil {
+			encoded = append(encoded, eventJson)
+		}
+	}
+	return bytes.Join(encoded, []byte("\n\n"))
+}
+
+// WarmUp establishes a keep-alive connection to every HEC host, the failover hosts
+// included, by querying the HEC health endpoint, so the TLS handshake is done before
+// the first batch of events is sent to any of them. The result is logged per host.
+// It returns nil when a host responded, and the error of the first host otherwise
+func (s *splunkClient) WarmUp() error {
+	if s.config.Debug {
+		return nil
+	}
+
+	var firstErr error
+	healthy := false
+	for _, host := range s.hosts {
+		if err := s.warmUpHost(host); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		healthy = true
+	}
+	if healthy {
+		return nil
+	}
+	return firstErr
+}
+
+func (s *splunkClient) warmUpHost(host string) error {
+	endpoint := s.urls[host] + s.config.Path + "/health"
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "keep-alive")
+	req.Header.Set("Authorization", fmt.Sprintf("Splunk %s", s.config.Token))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		s.config.Logger.Error("Failed to warm up HEC connection", err, lager.Data{"host": host})
+		return err
+	}
+	defer resp.Body.Close()
+
+	//Draining the response buffer, so that the connection is kept in the pool
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode > 299 {
+		err = fmt.Errorf("Non-ok response code [%d] from splunk health endpoint", resp.StatusCode)
+		s.config.Logger.Error("Failed to warm up HEC connection", err, lager.Data{"host": host})
+		return err
+	}
 
+	s.config.Logger.Info("Warmed up HEC connection", lager.Data{"host": host})
 	return nil
 }
 
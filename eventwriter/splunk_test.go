@@ -1,11 +1,20 @@
 package eventwriter_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 
@@ -13,6 +22,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
 )
 
 var _ = Describe("Splunk", func() {
@@ -197,6 +207,16 @@ var _ = Describe("Splunk", func() {
 			Expect(string(capturedBody)).To(Equal(expectedPayload))
 		})
 
+		It("sets index for events without event fields", func() {
+			config.Index = "index_metrics"
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": "metric"}}
+			err, _ := client.Write(events)
+
+			Expect(err).To(BeNil())
+			Expect(string(capturedBody)).To(Equal(`{"event":"metric","index":"index_metrics"}`))
+		})
+
 		It("adds fields to splunk payload", func() {
 			fields := map[string]string{
 				"foo":   "bar",
@@ -227,6 +247,86 @@ var _ = Describe("Splunk", func() {
 
 		})
 
+		It("sends events on the channel of the writer", func() {
+			config.ChannelField = true
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": "a", "fields": map[string]interface{}{"env": "dev"}}}
+			err, _ := client.Write(events)
+			Expect(err).To(BeNil())
+
+			channel := capturedRequest.Header.Get("X-Splunk-Request-Channel")
+			Expect(channel).To(HaveLen(36))
+			Expect(string(capturedBody)).To(Equal(fmt.Sprintf(`{"event":"a","fields":{"_hec_channel":"%s","env":"dev"}}`, channel)))
+
+			// Each writer has its own channel
+			NewSplunk(config).Write(events)
+			Expect(capturedRequest.Header.Get("X-Splunk-Request-Channel")).NotTo(Equal(channel))
+		})
+
+		It("adds the channel to the configured fields without modifying them", func() {
+			config.ChannelField = true
+			config.Fields = map[string]string{"env": "prod"}
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": "a", "fields": map[string]interface{}{"env": "dev"}}, {"event": "b"}}
+			err, _ := client.Write(events)
+			Expect(err).To(BeNil())
+
+			channel := capturedRequest.Header.Get("X-Splunk-Request-Channel")
+			Expect(string(capturedBody)).To(Equal(fmt.Sprintf(
+				`{"event":"a","fields":{"_hec_channel":"%s","env":"prod"}}`+"\n\n"+`{"event":"b","fields":{"_hec_channel":"%s","env":"prod"}}`, channel, channel)))
+			Expect(config.Fields).To(Equal(map[string]string{"env": "prod"}))
+		})
+
+		It("sends events without a channel by default", func() {
+			client := NewSplunk(config)
+			err, _ := client.Write([]map[string]interface{}{{"event": "a", "fields": map[string]interface{}{}}})
+			Expect(err).To(BeNil())
+
+			Expect(capturedRequest.Header).NotTo(HaveKey("X-Splunk-Request-Channel"))
+			Expect(string(capturedBody)).To(Equal(`{"event":"a","fields":{}}`))
+		})
+
+		It("counts bytes sent", func() {
+			config.Metrics = monitoring.NewMetrics()
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": map[string]interface{}{"greeting": "hello world"}}}
+			err, _ := client.Write(events)
+
+			Expect(err).To(BeNil())
+			Expect(config.Metrics.NewCounter("splunk.bytes.sent").Value()).To(Equal(uint64(len(capturedBody))))
+		})
+
+		It("counts requests per token", func() {
+			config.Metrics = monitoring.NewMetrics()
+			config.TokenName = "2"
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": map[string]interface{}{"greeting": "hello world"}}}
+			err, _ := client.Write(events)
+
+			Expect(err).To(BeNil())
+			Expect(config.Metrics.NewCounter("splunk.token.2.requests").Value()).To(Equal(uint64(1)))
+			Expect(config.Metrics.NewCounter("splunk.token.2.throttled").Value()).To(Equal(uint64(0)))
+		})
+
+		It("counts events and bytes sent per index", func() {
+			config.Metrics = monitoring.NewMetrics()
+			config.IndexMetrics = NewIndexMetrics(10, config.Metrics)
+			client := NewSplunk(config)
+			events := []map[string]interface{}{
+				{"index": "hot", "event": "a"},
+				{"index": "hot", "event": "b"},
+				{"event": "c"},
+			}
+			err, _ := client.Write(events)
+
+			Expect(err).To(BeNil())
+			snapshot := config.Metrics.Snapshot()
+			Expect(snapshot["splunk.events.sent.hot"]).To(Equal(float64(2)))
+			Expect(snapshot["splunk.events.sent.default"]).To(Equal(float64(1)))
+			Expect(snapshot["splunk.bytes.sent.hot"]).To(Equal(float64(len(`{"event":"a","index":"hot"}`) * 2)))
+			Expect(snapshot["splunk.bytes.sent.default"]).To(Equal(float64(len(`{"event":"c"}`))))
+		})
+
 		It("Writes to correct endpoint", func() {
 			client := NewSplunk(config)
 			events := []map[string]interface{}{}
@@ -236,6 +336,27 @@ var _ = Describe("Splunk", func() {
 			Expect(capturedRequest.URL.Path).To(Equal("/services/collector"))
 		})
 
+		It("writes to the configured HEC path", func() {
+			config.Path = "/gateway/hec"
+			client := NewSplunk(config)
+			err, _ := client.Write([]map[string]interface{}{})
+			Expect(err).To(BeNil())
+			Expect(capturedRequest.URL.Path).To(Equal("/gateway/hec"))
+
+			err = client.(WarmUpWriter).WarmUp()
+			Expect(err).To(BeNil())
+			Expect(capturedRequest.URL.Path).To(Equal("/gateway/hec/health"))
+		})
+
+		It("warms up the connection with the health endpoint", func() {
+			client := NewSplunk(config).(WarmUpWriter)
+			err := client.WarmUp()
+
+			Expect(err).To(BeNil())
+			Expect(capturedRequest.Method).To(Equal("GET"))
+			Expect(capturedRequest.URL.Path).To(Equal("/services/collector/health"))
+		})
+
 		It("Writes to stdout in debug without error", func() {
 			config.Debug = true
 			client := NewSplunk(config)
@@ -256,6 +377,26 @@ var _ = Describe("Splunk", func() {
 		Expect(err.Error()).To(ContainSubstring("protocol"))
 	})
 
+	It("sends over HTTPS to hosts without a scheme", func() {
+		testServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte("{}"))
+		}))
+		defer testServer.Close()
+
+		config.Host = strings.TrimPrefix(testServer.URL, "https://")
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{{"event": "a"}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("detects plain HTTP hosts", func() {
+		Expect(PlainHTTPHost("http://localhost:8088")).To(BeTrue())
+		Expect(PlainHTTPHost("HTTP://localhost:8088")).To(BeTrue())
+		Expect(PlainHTTPHost("https://localhost:8088")).To(BeFalse())
+		Expect(PlainHTTPHost("localhost:8088")).To(BeFalse())
+		Expect(PlainHTTPHost("unix:///var/run/splunk/hec.sock")).To(BeFalse())
+	})
+
 	It("Returns error on non-2xx response", func() {
 		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			writer.WriteHeader(500)
@@ -271,6 +412,352 @@ var _ = Describe("Splunk", func() {
 		Expect(err.Error()).To(ContainSubstring("500"))
 	})
 
+	It("counts throttled requests per token", func() {
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(429)
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		config.Metrics = monitoring.NewMetrics()
+		config.TokenName = "1"
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{})
+
+		Expect(err).To(MatchError(ContainSubstring("429")))
+		Expect(config.Metrics.NewCounter("splunk.token.1.requests").Value()).To(Equal(uint64(1)))
+		Expect(config.Metrics.NewCounter("splunk.token.1.throttled").Value()).To(Equal(uint64(1)))
+	})
+
+	It("logs a receipt of delivered batches", func() {
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(`{"text":"Success","code":0,"ackId":42}`))
+		}))
+		defer testServer.Close()
+
+		buffer := new(bytes.Buffer)
+		receiptLogger := lager.NewLogger("test")
+		receiptLogger.RegisterSink(lager.NewWriterSink(buffer, lager.DEBUG))
+		config.Host = testServer.URL
+		config.Index = "main"
+		config.Receipts = NewReceiptLogger(10, receiptLogger)
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{{"event": "a"}, {"event": "b"}})
+		Expect(err).ToNot(HaveOccurred())
+
+		logs := receiptLogs(buffer)
+		Expect(logs).To(HaveLen(1))
+		Expect(logs[0]["events"]).To(Equal(float64(2)))
+		Expect(logs[0]["index"]).To(Equal("main"))
+		Expect(logs[0]["host"]).To(Equal(testServer.URL))
+		Expect(logs[0]["ack_id"]).To(Equal(float64(42)))
+	})
+
+	It("skips the events HEC rejects as invalid", func() {
+		var bodies []string
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			bodies = append(bodies, string(body))
+			for i, event := range strings.Split(string(body), "\n\n") {
+				if strings.Contains(event, "bad") {
+					writer.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(writer, `{"text":"Invalid data format","code":6,"invalid-event-number":%d}`, i)
+					return
+				}
+			}
+			writer.Write([]byte(`{"text":"Success","code":0}`))
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		config.SkipInvalidEvents = true
+		config.Metrics = monitoring.NewMetrics()
+		client := NewSplunk(config)
+		err, sent := client.Write([]map[string]interface{}{{"event": "a"}, {"event": "bad"}, {"event": "c"}, {"event": "bad"}})
+
+		var rejected *RejectedEventsError
+		Expect(errors.As(err, &rejected)).To(BeTrue())
+		Expect(rejected.Events).To(Equal([]map[string]interface{}{{"event": "bad"}, {"event": "bad"}}))
+		Expect(sent).To(Equal(uint64(2)))
+		Expect(bodies).To(Equal([]string{
+			`{"event":"a"}` + "\n\n" + `{"event":"bad"}` + "\n\n" + `{"event":"c"}` + "\n\n" + `{"event":"bad"}`,
+			`{"event":"c"}` + "\n\n" + `{"event":"bad"}`,
+		}))
+		Expect(config.Metrics.Snapshot()["splunk.events.rejected"]).To(Equal(float64(2)))
+	})
+
+	It("numbers the skipped events as sent, and holds the events sent again in the buffer", func() {
+		limiter := NewBufferLimiter(1<<20, monitoring.NewMetrics())
+		var buffered []int64
+		var bodies []string
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			bodies = append(bodies, string(body))
+			buffered = append(buffered, limiter.Buffered())
+			if strings.Contains(string(body), "bad") {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(`{"text":"Invalid data format","code":6,"invalid-event-number":1}`))
+			}
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		config.SkipInvalidEvents = true
+		config.BufferLimiter = limiter
+		// The event which can't be marshalled isn't in the body
+		err, _ := NewSplunk(config).Write([]map[string]interface{}{{"event": "a"}, {"event": make(chan int)}, {"event": "bad"}, {"event": "c"}})
+
+		var rejected *RejectedEventsError
+		Expect(errors.As(err, &rejected)).To(BeTrue())
+		Expect(rejected.Events).To(Equal([]map[string]interface{}{{"event": "bad"}}))
+		Expect(bodies).To(HaveLen(2))
+		Expect(bodies[1]).To(Equal(`{"event":"c"}`))
+		Expect(buffered).To(Equal([]int64{int64(len(bodies[0])), int64(len(bodies[1]))}))
+		Expect(limiter.Buffered()).To(BeZero())
+	})
+
+	It("decodes gzip responses the client left compressed", func() {
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			if !strings.Contains(string(body), "bad") {
+				return
+			}
+			writer.Header().Set("Content-Encoding", "x-gzip")
+			writer.WriteHeader(http.StatusBadRequest)
+			compressed := gzip.NewWriter(writer)
+			compressed.Write([]byte(`{"text":"Invalid data format","code":6,"invalid-event-number":1}`))
+			compressed.Close()
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		config.SkipInvalidEvents = true
+		events := []map[string]interface{}{{"event": "a"}, {"event": "bad"}, {"event": "c"}}
+		err, _ := NewSplunk(config).Write(events)
+		Expect(err).To(HaveOccurred())
+
+		config.DecodeGzipResponses = true
+		err, sent := NewSplunk(config).Write(events)
+		Expect(err).To(BeAssignableToTypeOf(&RejectedEventsError{}))
+		Expect(sent).To(Equal(uint64(2)))
+	})
+
+	It("reads the ackId of gzip responses", func() {
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			compressed := gzip.NewWriter(writer)
+			compressed.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+			compressed.Close()
+		}))
+		defer testServer.Close()
+
+		buffer := new(bytes.Buffer)
+		receiptLogger := lager.NewLogger("test")
+		receiptLogger.RegisterSink(lager.NewWriterSink(buffer, lager.DEBUG))
+		config.Host = testServer.URL
+		config.Receipts = NewReceiptLogger(10, receiptLogger)
+		config.DecodeGzipResponses = true
+		err, _ := NewSplunk(config).Write([]map[string]interface{}{{"event": "a"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(receiptLogs(buffer)[0]["ack_id"]).To(Equal(float64(7)))
+	})
+
+	It("fails the batch on invalid events by default", func() {
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(`{"text":"Invalid data format","code":6,"invalid-event-number":0}`))
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		err, _ := NewSplunk(config).Write([]map[string]interface{}{{"event": "bad"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("writes to a Unix domain socket host", func() {
+		dir, err := os.MkdirTemp("", "hec")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+
+		socket := filepath.Join(dir, "hec.sock")
+		listener, err := net.Listen("unix", socket)
+		Expect(err).To(BeNil())
+
+		var paths []string
+		testServer = httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			paths = append(paths, request.URL.Path)
+			writer.Write([]byte("{}"))
+		}))
+		testServer.Listener = listener
+		testServer.Start()
+		defer testServer.Close()
+
+		config.Host = "unix://" + socket
+		client := NewSplunk(config)
+		Expect(client.(WarmUpWriter).WarmUp()).To(Succeed())
+		err, _ = client.Write([]map[string]interface{}{{"event": "hello"}})
+
+		Expect(err).To(BeNil())
+		Expect(paths).To(Equal([]string{"/services/collector/health", "/services/collector"}))
+	})
+
+	It("Returns error on failed warm up", func() {
+		testServer = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(503)
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		client := NewSplunk(config).(WarmUpWriter)
+		err := client.WarmUp()
+
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("503"))
+	})
+
+	Context("failover hosts", func() {
+		var (
+			primary, secondary         *httptest.Server
+			primaryHealthy             int32
+			primaryHits, secondaryHits int32
+		)
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&primaryHealthy, 0)
+			atomic.StoreInt32(&primaryHits, 0)
+			atomic.StoreInt32(&secondaryHits, 0)
+
+			primary = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				atomic.AddInt32(&primaryHits, 1)
+				if atomic.LoadInt32(&primaryHealthy) == 0 {
+					writer.WriteHeader(503)
+				}
+			}))
+			secondary = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				atomic.AddInt32(&secondaryHits, 1)
+			}))
+
+			config.Host = primary.URL
+			config.FailoverHosts = []string{secondary.URL}
+			config.FailoverThreshold = 2
+			config.FailbackInterval = time.Hour
+		})
+
+		AfterEach(func() {
+			primary.Close()
+			secondary.Close()
+		})
+
+		It("warms up every host", func() {
+			client := NewSplunk(config).(WarmUpWriter)
+			Expect(client.WarmUp()).To(Succeed())
+			Expect(atomic.LoadInt32(&primaryHits)).To(Equal(int32(1)))
+			Expect(atomic.LoadInt32(&secondaryHits)).To(Equal(int32(1)))
+
+			secondary.Close()
+			err := client.WarmUp()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("503"))
+			Expect(atomic.LoadInt32(&primaryHits)).To(Equal(int32(2)))
+		})
+
+		It("fails over after consecutive failures only", func() {
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": "test"}}
+
+			err, _ := client.Write(events)
+			Expect(err).To(HaveOccurred())
+			err, _ = client.Write(events)
+			Expect(err).To(HaveOccurred())
+			Expect(atomic.LoadInt32(&secondaryHits)).To(Equal(int32(0)))
+
+			err, _ = client.Write(events)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(atomic.LoadInt32(&primaryHits)).To(Equal(int32(2)))
+			Expect(atomic.LoadInt32(&secondaryHits)).To(Equal(int32(1)))
+		})
+
+		It("fails back when the primary recovers", func() {
+			config.FailbackInterval = time.Millisecond
+			client := NewSplunk(config)
+			events := []map[string]interface{}{{"event": "test"}}
+
+			client.Write(events)
+			client.Write(events)
+
+			atomic.StoreInt32(&primaryHealthy, 1)
+			time.Sleep(10 * time.Millisecond)
+
+			err, _ := client.Write(events)
+			Expect(err).NotTo(HaveOccurred())
+			err, _ = client.Write(events)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(atomic.LoadInt32(&primaryHits)).To(Equal(int32(4)))
+			Expect(atomic.LoadInt32(&secondaryHits)).To(Equal(int32(0)))
+		})
+	})
+
+	It("Returns error when the server doesn't support the TLS min version", func() {
+		testServer = httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+		testServer.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+		testServer.StartTLS()
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		config.TLSMinVersion = tls.VersionTLS13
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{})
+
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("protocol version"))
+	})
+
+	It("verifies certificates once SkipSSL expires", func() {
+		testServer = httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(`{"text":"Success","code":0}`))
+		}))
+		defer testServer.Close()
+
+		config.Host = testServer.URL
+		config.SkipSSLUntil = time.Now().Add(100 * time.Millisecond)
+		client := NewSplunk(config)
+		err, _ := client.Write([]map[string]interface{}{{"event": "a"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		time.Sleep(150 * time.Millisecond)
+		err, _ = client.Write([]map[string]interface{}{{"event": "b"}})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+	})
+
+	It("parses TLS versions", func() {
+		version, err := ParseTLSVersion("1.3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal(uint16(tls.VersionTLS13)))
+
+		_, err = ParseTLSVersion("1.1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("parses cipher suites and rejects unknown names", func() {
+		suites, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(suites).To(Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}))
+
+		_, err = ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseCipherSuites("TLS_UNKNOWN")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("validates HEC paths", func() {
+		Expect(ValidateHECPath(DefaultHECPath)).To(Succeed())
+		Expect(ValidateHECPath("/gateway/hec")).To(Succeed())
+
+		for _, path := range []string{"", "services/collector", "/services/collector/", "/", "/hec?x=1", "/a//b", "/a/../b", "/a b"} {
+			Expect(ValidateHECPath(path)).NotTo(Succeed(), path)
+		}
+	})
+
 	It("Returns error from http client", func() {
 		config.Host = "foo://example.com"
 		client := NewSplunk(config)
@@ -0,0 +1,100 @@
+package eventwriter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// DefaultWebhookTemplate renders a Slack compatible message
+const DefaultWebhookTemplate = `{"text": {{printf "%v event from %v/%v: %v" .event_type .job .job_index .msg | json}}}`
+
+type WebhookConfig struct {
+	URL      string
+	Template *template.Template // rendered with the event fields to build the request body
+	Timeout  time.Duration
+	SkipSSL  bool
+
+	// SkipSSL only applies until then when set, certificates are verified afterwards
+	SkipSSLUntil time.Time
+
+	Logger lager.Logger
+}
+
+// ParseWebhookTemplate parses a text/template of the JSON request body. The json
+// function encodes a value as JSON, for example {"text": {{.msg | json}}}
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultWebhookTemplate
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}).Parse(text)
+}
+
+// webhookClient posts one request per event to the webhook
+type webhookClient struct {
+	httpClient *http.Client
+	config     *WebhookConfig
+}
+
+func NewWebhook(config *WebhookConfig) Writer {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipSSL}
+	if config.SkipSSL && !config.SkipSSLUntil.IsZero() {
+		verifyAfter(tlsConfig, config.SkipSSLUntil)
+	}
+	httpClient := &http.Client{
+		Timeout: config.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	return &webhookClient{
+		httpClient: httpClient,
+		config:     config,
+	}
+}
+
+func (w *webhookClient) Write(events []map[string]interface{}) (error, uint64) {
+	var lastErr error
+	var count uint64
+	for _, event := range events {
+		if err := w.post(event); err != nil {
+			lastErr = err
+			continue
+		}
+		count++
+	}
+	return lastErr, count
+}
+
+func (w *webhookClient) post(event map[string]interface{}) error {
+	body := new(bytes.Buffer)
+	if err := w.config.Template.Execute(body, event); err != nil {
+		return err
+	}
+
+	resp, err := w.httpClient.Post(w.config.URL, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
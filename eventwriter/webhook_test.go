@@ -0,0 +1,69 @@
+package eventwriter_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+var _ = Describe("Webhook", func() {
+	var (
+		server *httptest.Server
+		bodies chan string
+		status int
+		config *WebhookConfig
+	)
+
+	BeforeEach(func() {
+		bodies = make(chan string, 10)
+		status = 200
+		server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			bodies <- string(body)
+			writer.WriteHeader(status)
+		}))
+
+		tmpl, err := ParseWebhookTemplate("")
+		Ω(err).ShouldNot(HaveOccurred())
+		config = &WebhookConfig{
+			URL:      server.URL,
+			Template: tmpl,
+			Timeout:  time.Second,
+			Logger:   lager.NewLogger("test"),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("posts the rendered template of every event", func() {
+		events := []map[string]interface{}{
+			{"event_type": "Error", "job": "api", "job_index": "0", "msg": `connection "refused"`},
+		}
+		err, sent := NewWebhook(config).Write(events)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(sent).To(Equal(uint64(1)))
+		Expect(<-bodies).To(MatchJSON(`{"text": "Error event from api/0: connection \"refused\""}`))
+	})
+
+	It("returns an error on an unsuccessful response", func() {
+		status = 500
+		err, sent := NewWebhook(config).Write([]map[string]interface{}{{"msg": "down"}})
+		Ω(err).Should(HaveOccurred())
+		Expect(sent).To(Equal(uint64(0)))
+	})
+
+	It("rejects invalid templates", func() {
+		_, err := ParseWebhookTemplate(`{"text": {{.msg}`)
+		Ω(err).Should(HaveOccurred())
+	})
+})
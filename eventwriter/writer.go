@@ -3,3 +3,8 @@ package eventwriter
 type Writer interface {
 	Write([]map[string]interface{}) (error, uint64)
 }
+
+// WarmUpWriter is implemented by writers which can establish their connections ahead of the first write
+type WarmUpWriter interface {
+	WarmUp() error
+}
@@ -36,4 +36,5 @@ func main() {
 	if err != nil {
 		logger.Error("Failed to run splunk-firehose-nozzle", err)
 	}
+	os.Exit(splunknozzle.ExitCode(err))
 }
@@ -0,0 +1,175 @@
+package monitoring
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+)
+
+// Reasons events are dropped for
+const (
+	DropSampled    = "sampled"     // by SAMPLE_RATIOS, HTTP_SAMPLE_RATES or CONTAINER_METRIC_MAX_SAMPLE_RATE
+	DropFiltered   = "filtered"    // by EVENT_FILTER
+	DropIgnoredApp = "ignored_app" // apps with F2S_DISABLE_LOGGING
+	DropUnenriched = "unenriched"  // by REQUIRE_ENRICHMENT
+	DropMalformed  = "malformed"   // envelopes without their sub-event
+	DropCompacted  = "compacted"   // by COMPACT_CONTAINER_METRICS
+	DropOversized  = "oversized"   // by LOG_MAX_CHARS or LOG_MAX_LINES
+	DropDuplicate  = "duplicate"   // by DEDUP_WINDOW
+	DropSuppressed = "suppressed"  // by SUPPRESS_INACTIVE_CONTAINER_METRICS
+	DropQueueFull  = "queue_full"
+	DropExpired    = "expired"     // by MAX_QUEUE_AGE
+	DropSendFailed = "send_failed" // after the last retry
+)
+
+// dropsPrefix names the counters of dropped events, splunk.drops.<reason>.<event_type>
+const dropsPrefix = "splunk.drops."
+
+// More than the number of event types
+const maxDropLabels = 16
+
+// DropCounter counts the events dropped for a reason per event type
+type DropCounter struct {
+	counters *CounterVec
+}
+
+// NewDropCounter creates the counter of the events dropped for the reason
+func (m *Metrics) NewDropCounter(reason string) *DropCounter {
+	return &DropCounter{counters: m.NewCounterVec(dropsPrefix+reason, maxDropLabels)}
+}
+
+// Add counts delta dropped events of the event type
+func (d *DropCounter) Add(eventType string, delta uint64) {
+	d.counters.WithLabel(eventType).Add(delta)
+}
+
+// dropKey is a reason and event type of dropped events
+type dropKey struct {
+	reason    string
+	eventType string
+}
+
+// drops returns the number of dropped events by reason and event type
+func (m *Metrics) drops() map[dropKey]uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	drops := make(map[dropKey]uint64)
+	for name, counter := range m.counters {
+		if !strings.HasPrefix(name, dropsPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(name, dropsPrefix), ".", 2)
+		if len(parts) == 2 {
+			drops[dropKey{reason: parts[0], eventType: parts[1]}] = counter.Value()
+		}
+	}
+	return drops
+}
+
+type DropSummaryConfig struct {
+	Interval time.Duration
+	Index    string
+	Hostname string
+	Logger   lager.Logger
+}
+
+// DropSummary periodically sends an event per reason and event type of the events
+// dropped since the previous summary
+type DropSummary struct {
+	metrics *Metrics
+	writer  Writer
+	config  *DropSummaryConfig
+	last    map[dropKey]uint64
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewDropSummary(metrics *Metrics, writer Writer, config *DropSummaryConfig) *DropSummary {
+	return &DropSummary{
+		metrics: metrics,
+		writer:  writer,
+		config:  config,
+		last:    metrics.drops(),
+		closing: make(chan struct{}),
+	}
+}
+
+func (s *DropSummary) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *DropSummary) Stop() {
+	close(s.closing)
+	s.wg.Wait()
+}
+
+func (s *DropSummary) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *DropSummary) flush() {
+	drops := s.metrics.drops()
+	keys := make([]dropKey, 0, len(drops))
+	for key := range drops {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].reason != keys[j].reason {
+			return keys[i].reason < keys[j].reason
+		}
+		return keys[i].eventType < keys[j].eventType
+	})
+
+	now := utils.NanoSecondsToSeconds(time.Now().UnixNano())
+	var events []map[string]interface{}
+	for _, key := range keys {
+		count := drops[key] - s.last[key]
+		if count == 0 {
+			continue
+		}
+
+		event := map[string]interface{}{
+			"time":       now,
+			"host":       s.config.Hostname,
+			"source":     "splunk_nozzle",
+			"sourcetype": "cf:splunknozzle:drops",
+			"event": map[string]interface{}{
+				"reason":     key.reason,
+				"event_type": key.eventType,
+				"count":      count,
+				"interval":   s.config.Interval.String(),
+			},
+		}
+		if s.config.Index != "" {
+			event["index"] = s.config.Index
+		}
+		events = append(events, event)
+	}
+	s.last = drops
+
+	if len(events) == 0 {
+		return
+	}
+	if err, _ := s.writer.Write(events); err != nil {
+		s.config.Logger.Error("Failed to send drop summary events", err)
+	}
+}
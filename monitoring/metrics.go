@@ -0,0 +1,214 @@
+package monitoring
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.value, delta)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Histogram counts observations into buckets. Bucket counts are cumulative, the
+// bucket of an upper bound counts all observations less than or equal to the bound
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64 // one per bound and one for +Inf
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := append([]float64(nil), bounds...)
+	sort.Float64s(sorted)
+	return &Histogram{
+		bounds: sorted,
+		counts: make([]uint64, len(sorted)+1),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.bounds)]++
+	h.lock.Unlock()
+}
+
+// Buckets returns the cumulative count of every bucket, named le_<bound> and le_inf
+func (h *Histogram) Buckets() map[string]uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	buckets := make(map[string]uint64, len(h.counts))
+	for i, bound := range h.bounds {
+		buckets["le_"+strconv.FormatFloat(bound, 'f', -1, 64)] = h.counts[i]
+	}
+	buckets["le_inf"] = h.counts[len(h.bounds)]
+	return buckets
+}
+
+// CounterVec is a family of counters named <prefix>.<label>. At most limit labels
+// get their own counter, later labels are counted in <prefix>.other
+type CounterVec struct {
+	metrics *Metrics
+	prefix  string
+	limit   int
+
+	lock     sync.RWMutex
+	counters map[string]*Counter
+	other    *Counter
+}
+
+// NewCounterVec creates a counter family with at most limit labels
+func (m *Metrics) NewCounterVec(prefix string, limit int) *CounterVec {
+	return &CounterVec{
+		metrics:  m,
+		prefix:   prefix,
+		limit:    limit,
+		counters: make(map[string]*Counter),
+	}
+}
+
+// WithLabel returns the counter of the label. Dots in the label are replaced with
+// underscores so the label is a single metric name segment
+func (v *CounterVec) WithLabel(label string) *Counter {
+	v.lock.RLock()
+	c, ok := v.counters[label]
+	v.lock.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if c, ok := v.counters[label]; ok {
+		return c
+	}
+	if len(v.counters) >= v.limit {
+		if v.other == nil {
+			v.other = v.metrics.NewCounter(v.prefix + ".other")
+		}
+		return v.other
+	}
+
+	c = v.metrics.NewCounter(v.prefix + "." + strings.ReplaceAll(label, ".", "_"))
+	v.counters[label] = c
+	return c
+}
+
+type sampledHistogram struct {
+	histogram *Histogram
+	fn        func() float64
+}
+
+// Metrics is a registry of named counters and gauges emitted by the MetricsMonitor
+type Metrics struct {
+	lock       sync.RWMutex
+	counters   map[string]*Counter
+	gauges     map[string]func() float64
+	histograms map[string]sampledHistogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   make(map[string]*Counter),
+		gauges:     make(map[string]func() float64),
+		histograms: make(map[string]sampledHistogram),
+	}
+}
+
+// NewCounter registers a counter with the given name. If the counter is already
+// registered, the existing one is returned
+func (m *Metrics) NewCounter(name string) *Counter {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if c, ok := m.counters[name]; ok {
+		return c
+	}
+	c := &Counter{}
+	m.counters[name] = c
+	return c
+}
+
+// RegisterGauge registers a gauge whose value is sampled by calling fn
+func (m *Metrics) RegisterGauge(name string, fn func() float64) {
+	m.lock.Lock()
+	m.gauges[name] = fn
+	m.lock.Unlock()
+}
+
+// RegisterGaugeHistogram registers a histogram of the values of a gauge, which is
+// sampled by calling fn at every Sample. Each bucket is a metric named <name>.le_<bound>
+func (m *Metrics) RegisterGaugeHistogram(name string, bounds []float64, fn func() float64) {
+	m.lock.Lock()
+	m.histograms[name] = sampledHistogram{histogram: NewHistogram(bounds), fn: fn}
+	m.lock.Unlock()
+}
+
+// Sample observes the current value of the gauges of all registered histograms
+func (m *Metrics) Sample() {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for _, h := range m.histograms {
+		h.histogram.Observe(h.fn())
+	}
+}
+
+// Names returns the sorted names of all registered metrics
+func (m *Metrics) Names() []string {
+	m.lock.RLock()
+	names := make([]string, 0, len(m.counters)+len(m.gauges))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	for name := range m.gauges {
+		names = append(names, name)
+	}
+	for name, h := range m.histograms {
+		for bucket := range h.histogram.Buckets() {
+			names = append(names, name+"."+bucket)
+		}
+	}
+	m.lock.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// Snapshot returns the current value of all registered metrics
+func (m *Metrics) Snapshot() map[string]float64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	values := make(map[string]float64, len(m.counters)+len(m.gauges))
+	for name, c := range m.counters {
+		values[name] = float64(c.Value())
+	}
+	for name, fn := range m.gauges {
+		values[name] = fn()
+	}
+	for name, h := range m.histograms {
+		for bucket, count := range h.histogram.Buckets() {
+			values[name+"."+bucket] = float64(count)
+		}
+	}
+	return values
+}
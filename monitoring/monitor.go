@@ -0,0 +1,192 @@
+package monitoring
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+)
+
+// Writer sends events to Splunk, it is satisfied by eventwriter.Writer
+type Writer interface {
+	Write([]map[string]interface{}) (error, uint64)
+}
+
+type MetricsMonitorConfig struct {
+	Interval       time.Duration
+	SampleInterval time.Duration // how often histograms are sampled, Interval when not set
+	Selected       []string      // patterns of the names of the metrics sent, all metrics when empty
+	Index          string
+	Hostname       string
+	Logger         lager.Logger
+
+	// Metrics aren't sent while Suspended returns true, such as while the event HEC
+	// is failing, so the monitor doesn't add to the failing requests
+	Suspended func() bool
+}
+
+// MetricsMonitor periodically sends all registered metrics to a Splunk metrics index.
+// All metrics of an interval are packed into a single HEC request
+type MetricsMonitor struct {
+	metrics *Metrics
+	writer  Writer
+	config  *MetricsMonitorConfig
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	suspended        bool     // only accessed by run
+	suspendedCounter *Counter // nil without Suspended
+}
+
+// ParseMetricPatterns parses a comma separated list of metric names, in which * matches
+// any characters, for example splunk.events.*,firehose.healthy
+func ParseMetricPatterns(patterns string) ([]string, error) {
+	var parsed []string
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid metric name pattern [%s]: %s", pattern, err)
+		}
+		parsed = append(parsed, pattern)
+	}
+	return parsed, nil
+}
+
+// matchMetric returns whether the metric name matches one of the patterns
+func matchMetric(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func NewMetricsMonitor(metrics *Metrics, writer Writer, config *MetricsMonitorConfig) *MetricsMonitor {
+	m := &MetricsMonitor{
+		metrics: metrics,
+		writer:  writer,
+		config:  config,
+		closing: make(chan struct{}),
+	}
+	if config.Suspended != nil {
+		m.suspendedCounter = metrics.NewCounter("monitoring.flushes.suspended")
+	}
+	return m
+}
+
+// Start logs the Selected patterns which match no registered metric, as they may be
+// misspelled, and starts sending the metrics
+func (m *MetricsMonitor) Start() {
+	names := m.metrics.Names()
+	for _, pattern := range m.config.Selected {
+		matched := false
+		for _, name := range names {
+			if matchMetric([]string{pattern}, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			m.config.Logger.Info("Monitoring metric pattern matches no registered metric", lager.Data{"pattern": pattern})
+		}
+	}
+
+	m.wg.Add(1)
+	go m.run()
+}
+
+func (m *MetricsMonitor) Stop() {
+	close(m.closing)
+	m.wg.Wait()
+}
+
+func (m *MetricsMonitor) run() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	sampleInterval := m.config.SampleInterval
+	if sampleInterval <= 0 {
+		sampleInterval = m.config.Interval
+	}
+	sampleTicker := time.NewTicker(sampleInterval)
+	defer sampleTicker.Stop()
+
+	for {
+		select {
+		case <-sampleTicker.C:
+			m.metrics.Sample()
+		case <-ticker.C:
+			if !m.suspend() {
+				m.flush()
+			}
+		case <-m.closing:
+			return
+		}
+	}
+}
+
+// suspend returns whether the metrics of the interval aren't sent, logging when the
+// monitor is suspended and resumed
+func (m *MetricsMonitor) suspend() bool {
+	if m.config.Suspended == nil {
+		return false
+	}
+
+	suspended := m.config.Suspended()
+	if suspended != m.suspended {
+		m.suspended = suspended
+		if suspended {
+			m.config.Logger.Info("Suspending monitoring metrics while HEC is failing")
+		} else {
+			m.config.Logger.Info("Resuming monitoring metrics")
+		}
+	}
+	if suspended {
+		m.suspendedCounter.Add(1)
+	}
+	return suspended
+}
+
+// flush sends a snapshot of all metrics as one multiple-metric HEC event
+func (m *MetricsMonitor) flush() {
+	snapshot := m.metrics.Snapshot()
+	if len(snapshot) == 0 {
+		return
+	}
+
+	fields := make(map[string]interface{}, len(snapshot))
+	for name, value := range snapshot {
+		if len(m.config.Selected) == 0 || matchMetric(m.config.Selected, name) {
+			fields["metric_name:"+name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+
+	event := map[string]interface{}{
+		"time":       utils.NanoSecondsToSeconds(time.Now().UnixNano()),
+		"host":       m.config.Hostname,
+		"source":     "splunk_nozzle",
+		"sourcetype": "cf:splunknozzle:metrics",
+		"event":      "metric",
+		"fields":     fields,
+	}
+	if m.config.Index != "" {
+		event["index"] = m.config.Index
+	}
+
+	if err, _ := m.writer.Write([]map[string]interface{}{event}); err != nil {
+		m.config.Logger.Error("Failed to send monitoring metrics", err, lager.Data{"metrics": len(snapshot)})
+	}
+}
@@ -0,0 +1,299 @@
+package monitoring_test
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
+)
+
+var _ = Describe("Monitoring", func() {
+	var (
+		metrics *Metrics
+	)
+
+	BeforeEach(func() {
+		metrics = NewMetrics()
+	})
+
+	Context("Metrics", func() {
+		It("returns the same counter for the same name", func() {
+			c := metrics.NewCounter("events.sent")
+			c.Add(2)
+			metrics.NewCounter("events.sent").Add(3)
+
+			Expect(c.Value()).To(Equal(uint64(5)))
+		})
+
+		It("snapshots counters and gauges", func() {
+			metrics.NewCounter("events.sent").Add(7)
+			metrics.RegisterGauge("queue.depth", func() float64 { return 42 })
+
+			Expect(metrics.Names()).To(Equal([]string{"events.sent", "queue.depth"}))
+			Expect(metrics.Snapshot()).To(Equal(map[string]float64{"events.sent": 7, "queue.depth": 42}))
+		})
+
+		It("bounds the labels of counter vectors", func() {
+			orgs := metrics.NewCounterVec("events.org", 2)
+			for _, org := range []string{"org-a", "org.b", "org-a", "org-c", "org-d"} {
+				orgs.WithLabel(org).Add(1)
+			}
+
+			Expect(metrics.Snapshot()).To(Equal(map[string]float64{
+				"events.org.org-a": 2,
+				"events.org.org_b": 1,
+				"events.org.other": 2,
+			}))
+		})
+
+		It("samples gauge histograms into cumulative buckets", func() {
+			depth := 0.0
+			metrics.RegisterGaugeHistogram("queue.depth", []float64{100, 10}, func() float64 { return depth })
+
+			for _, d := range []float64{5, 10, 50, 500} {
+				depth = d
+				metrics.Sample()
+			}
+
+			Expect(metrics.Snapshot()).To(Equal(map[string]float64{
+				"queue.depth.le_10":  2,
+				"queue.depth.le_100": 3,
+				"queue.depth.le_inf": 4,
+			}))
+		})
+	})
+
+	Context("MetricsMonitor", func() {
+		var (
+			writer  *testing.EventWriterMock
+			monitor *MetricsMonitor
+		)
+
+		BeforeEach(func() {
+			writer = &testing.EventWriterMock{}
+			config := &MetricsMonitorConfig{
+				Interval: time.Millisecond * 10,
+				Index:    "metrics",
+				Hostname: "localhost",
+				Logger:   lager.NewLogger("test"),
+			}
+			monitor = NewMetricsMonitor(metrics, writer, config)
+		})
+
+		It("sends all metrics of an interval as one event", func() {
+			metrics.NewCounter("events.sent").Add(1)
+			metrics.NewCounter("events.dropped").Add(2)
+
+			monitor.Start()
+			Eventually(writer.CapturedEvents).ShouldNot(BeEmpty())
+			monitor.Stop()
+
+			event := writer.CapturedEvents()[0]
+			Expect(event["event"]).To(Equal("metric"))
+			Expect(event["index"]).To(Equal("metrics"))
+			Expect(event["fields"]).To(Equal(map[string]interface{}{
+				"metric_name:events.sent":    float64(1),
+				"metric_name:events.dropped": float64(2),
+			}))
+		})
+
+		It("sends only the selected metrics", func() {
+			metrics.NewCounter("splunk.events.sent").Add(1)
+			metrics.NewCounter("splunk.events.dropped").Add(2)
+			metrics.NewCounter("splunk.retries").Add(3)
+
+			buffer := new(bytes.Buffer)
+			logger := lager.NewLogger("test")
+			logger.RegisterSink(lager.NewWriterSink(buffer, lager.INFO))
+			selected, err := ParseMetricPatterns("splunk.events.s*, splunk.retries,firehose.healthy")
+			Ω(err).ShouldNot(HaveOccurred())
+			monitor = NewMetricsMonitor(metrics, writer, &MetricsMonitorConfig{
+				Interval: time.Millisecond * 10,
+				Selected: selected,
+				Logger:   logger,
+			})
+
+			monitor.Start()
+			Eventually(writer.CapturedEvents).ShouldNot(BeEmpty())
+			monitor.Stop()
+
+			Expect(writer.CapturedEvents()[0]["fields"]).To(Equal(map[string]interface{}{
+				"metric_name:splunk.events.sent": float64(1),
+				"metric_name:splunk.retries":     float64(3),
+			}))
+			Expect(buffer.String()).To(ContainSubstring(`"pattern":"firehose.healthy"`))
+			Expect(buffer.String()).NotTo(ContainSubstring(`"pattern":"splunk.retries"`))
+		})
+
+		It("doesn't send metrics while suspended", func() {
+			var suspended int32 = 1
+			metrics.NewCounter("splunk.events.sent").Add(1)
+			monitor = NewMetricsMonitor(metrics, writer, &MetricsMonitorConfig{
+				Interval: time.Millisecond * 10,
+				Logger:   lager.NewLogger("test"),
+				Suspended: func() bool {
+					return atomic.LoadInt32(&suspended) == 1
+				},
+			})
+
+			monitor.Start()
+			Consistently(writer.CapturedEvents, 50*time.Millisecond).Should(BeEmpty())
+			Expect(metrics.Snapshot()["monitoring.flushes.suspended"]).To(BeNumerically(">=", 1))
+
+			atomic.StoreInt32(&suspended, 0)
+			Eventually(writer.CapturedEvents).ShouldNot(BeEmpty())
+			monitor.Stop()
+			Expect(writer.CapturedEvents()[0]["fields"]).To(HaveKeyWithValue("metric_name:splunk.events.sent", float64(1)))
+		})
+
+		It("rejects invalid metric patterns", func() {
+			_, err := ParseMetricPatterns("splunk.events.[")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("doesn't send anything without metrics", func() {
+			monitor.Start()
+			time.Sleep(time.Millisecond * 50)
+			monitor.Stop()
+
+			Expect(writer.CapturedEvents()).To(BeEmpty())
+		})
+	})
+
+	Context("Summary", func() {
+		var (
+			writer  *testing.EventWriterMock
+			summary *Summary
+		)
+
+		BeforeEach(func() {
+			writer = &testing.EventWriterMock{}
+			metrics.NewCounter("splunk.events.sent").Add(100)
+			config := &SummaryConfig{
+				Interval: time.Millisecond * 20,
+				Index:    "audit",
+				Hostname: "localhost",
+				Logger:   lager.NewLogger("test"),
+			}
+			summary = NewSummary(metrics, writer, config)
+		})
+
+		It("reports counts since the previous summary", func() {
+			metrics.NewCounter("splunk.events.sent").Add(10)
+			metrics.NewCounter("splunk.bytes.sent").Add(2048)
+			metrics.NewCounter("splunk.retries").Add(1)
+
+			summary.Start()
+			Eventually(writer.CapturedEvents).Should(HaveLen(2))
+			summary.Stop()
+
+			events := writer.CapturedEvents()
+			Expect(events[0]["index"]).To(Equal("audit"))
+			Expect(events[0]["sourcetype"]).To(Equal("cf:splunknozzle:summary"))
+
+			first := events[0]["event"].(map[string]interface{})
+			Expect(first["events_sent"]).To(Equal(uint64(10)))
+			Expect(first["bytes_sent"]).To(Equal(uint64(2048)))
+			Expect(first["retries"]).To(Equal(uint64(1)))
+			Expect(first["events_dropped"]).To(Equal(uint64(0)))
+
+			second := events[1]["event"].(map[string]interface{})
+			Expect(second["events_sent"]).To(Equal(uint64(0)))
+		})
+	})
+
+	Context("DropSummary", func() {
+		var (
+			writer      *testing.EventWriterMock
+			dropSummary *DropSummary
+		)
+
+		BeforeEach(func() {
+			writer = &testing.EventWriterMock{}
+			metrics.NewDropCounter(DropFiltered).Add("LogMessage", 100)
+			config := &DropSummaryConfig{
+				Interval: time.Millisecond * 20,
+				Index:    "audit",
+				Hostname: "localhost",
+				Logger:   lager.NewLogger("test"),
+			}
+			dropSummary = NewDropSummary(metrics, writer, config)
+		})
+
+		It("reports drops by reason and event type since the previous summary", func() {
+			metrics.NewDropCounter(DropQueueFull).Add("ValueMetric", 3)
+			metrics.NewDropCounter(DropFiltered).Add("LogMessage", 2)
+			metrics.NewDropCounter(DropFiltered).Add("Error", 1)
+
+			dropSummary.Start()
+			Eventually(writer.CapturedEvents).Should(HaveLen(3))
+			Consistently(writer.CapturedEvents, 100*time.Millisecond).Should(HaveLen(3))
+			dropSummary.Stop()
+
+			events := writer.CapturedEvents()
+			Expect(events[0]["index"]).To(Equal("audit"))
+			Expect(events[0]["sourcetype"]).To(Equal("cf:splunknozzle:drops"))
+
+			var drops []map[string]interface{}
+			for _, event := range events {
+				e := event["event"].(map[string]interface{})
+				delete(e, "interval")
+				drops = append(drops, e)
+			}
+			Expect(drops).To(Equal([]map[string]interface{}{
+				{"reason": "filtered", "event_type": "Error", "count": uint64(1)},
+				{"reason": "filtered", "event_type": "LogMessage", "count": uint64(2)},
+				{"reason": "queue_full", "event_type": "ValueMetric", "count": uint64(3)},
+			}))
+			Expect(metrics.Snapshot()).To(HaveKeyWithValue("splunk.drops.filtered.LogMessage", float64(102)))
+		})
+	})
+
+	Context("SamplingAudit", func() {
+		It("reports the sampling decisions and effective rate since the previous audit", func() {
+			writer := &testing.EventWriterMock{}
+			ratios := metrics.NewSamplingCounter(SamplerRatios)
+			ratios.Add("LogMessage", false)
+			config := &SamplingAuditConfig{
+				Interval: time.Millisecond * 20,
+				Index:    "audit",
+				Hostname: "localhost",
+				Logger:   lager.NewLogger("test"),
+			}
+			samplingAudit := NewSamplingAudit(metrics, writer, config)
+
+			ratios.Add("LogMessage", true)
+			for i := 0; i < 3; i++ {
+				ratios.Add("LogMessage", false)
+			}
+			metrics.NewSamplingCounter(SamplerHttpStatus).Add("HttpStartStop", true)
+
+			samplingAudit.Start()
+			Eventually(writer.CapturedEvents).Should(HaveLen(2))
+			Consistently(writer.CapturedEvents, 100*time.Millisecond).Should(HaveLen(2))
+			samplingAudit.Stop()
+
+			events := writer.CapturedEvents()
+			Expect(events[0]["index"]).To(Equal("audit"))
+			Expect(events[0]["sourcetype"]).To(Equal("cf:splunknozzle:sampling"))
+
+			var audits []map[string]interface{}
+			for _, event := range events {
+				e := event["event"].(map[string]interface{})
+				delete(e, "interval")
+				audits = append(audits, e)
+			}
+			Expect(audits).To(Equal([]map[string]interface{}{
+				{"sampler": "http_sample_rates", "event_type": "HttpStartStop", "kept": uint64(1), "dropped": uint64(0), "effective_rate": float64(1)},
+				{"sampler": "sample_ratios", "event_type": "LogMessage", "kept": uint64(1), "dropped": uint64(3), "effective_rate": 0.25},
+			}))
+			Expect(metrics.Snapshot()).To(HaveKeyWithValue("splunk.sampling.sample_ratios.dropped.LogMessage", float64(4)))
+		})
+	})
+})
@@ -0,0 +1,190 @@
+package monitoring
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+)
+
+// Samplers of events, named by their setting
+const (
+	SamplerRatios          = "sample_ratios"                    // SAMPLE_RATIOS
+	SamplerHttpStatus      = "http_sample_rates"                // HTTP_SAMPLE_RATES
+	SamplerContainerMetric = "container_metric_max_sample_rate" // CONTAINER_METRIC_MAX_SAMPLE_RATE
+)
+
+// samplingPrefix names the counters of sampled events,
+// splunk.sampling.<sampler>.<kept|dropped>.<event_type>
+const samplingPrefix = "splunk.sampling."
+
+// SamplingCounter counts the events kept and dropped by a sampler per event type
+type SamplingCounter struct {
+	kept    *CounterVec
+	dropped *CounterVec
+}
+
+// NewSamplingCounter creates the counter of the events seen by the sampler
+func (m *Metrics) NewSamplingCounter(sampler string) *SamplingCounter {
+	return &SamplingCounter{
+		kept:    m.NewCounterVec(samplingPrefix+sampler+".kept", maxDropLabels),
+		dropped: m.NewCounterVec(samplingPrefix+sampler+".dropped", maxDropLabels),
+	}
+}
+
+// Add counts an event of the event type kept or dropped by the sampler
+func (c *SamplingCounter) Add(eventType string, kept bool) {
+	if kept {
+		c.kept.WithLabel(eventType).Add(1)
+	} else {
+		c.dropped.WithLabel(eventType).Add(1)
+	}
+}
+
+// samplingKey is a sampler and event type of sampled events
+type samplingKey struct {
+	sampler   string
+	eventType string
+}
+
+// samplingCounts are the events kept and dropped by a sampler
+type samplingCounts struct {
+	kept    uint64
+	dropped uint64
+}
+
+// sampling returns the number of events kept and dropped by sampler and event type
+func (m *Metrics) sampling() map[samplingKey]samplingCounts {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	sampling := make(map[samplingKey]samplingCounts)
+	for name, counter := range m.counters {
+		if !strings.HasPrefix(name, samplingPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(name, samplingPrefix), ".", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		key := samplingKey{sampler: parts[0], eventType: parts[2]}
+		counts := sampling[key]
+		switch parts[1] {
+		case "kept":
+			counts.kept = counter.Value()
+		case "dropped":
+			counts.dropped = counter.Value()
+		}
+		sampling[key] = counts
+	}
+	return sampling
+}
+
+type SamplingAuditConfig struct {
+	Interval time.Duration
+	Index    string
+	Hostname string
+	Logger   lager.Logger
+}
+
+// SamplingAudit periodically sends an event per sampler and event type with the
+// events kept and dropped since the previous audit and the effective sample rate
+type SamplingAudit struct {
+	metrics *Metrics
+	writer  Writer
+	config  *SamplingAuditConfig
+	last    map[samplingKey]samplingCounts
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewSamplingAudit(metrics *Metrics, writer Writer, config *SamplingAuditConfig) *SamplingAudit {
+	return &SamplingAudit{
+		metrics: metrics,
+		writer:  writer,
+		config:  config,
+		last:    metrics.sampling(),
+		closing: make(chan struct{}),
+	}
+}
+
+func (s *SamplingAudit) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *SamplingAudit) Stop() {
+	close(s.closing)
+	s.wg.Wait()
+}
+
+func (s *SamplingAudit) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *SamplingAudit) flush() {
+	sampling := s.metrics.sampling()
+	keys := make([]samplingKey, 0, len(sampling))
+	for key := range sampling {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].sampler != keys[j].sampler {
+			return keys[i].sampler < keys[j].sampler
+		}
+		return keys[i].eventType < keys[j].eventType
+	})
+
+	now := utils.NanoSecondsToSeconds(time.Now().UnixNano())
+	var events []map[string]interface{}
+	for _, key := range keys {
+		kept := sampling[key].kept - s.last[key].kept
+		dropped := sampling[key].dropped - s.last[key].dropped
+		if kept+dropped == 0 {
+			continue
+		}
+
+		event := map[string]interface{}{
+			"time":       now,
+			"host":       s.config.Hostname,
+			"source":     "splunk_nozzle",
+			"sourcetype": "cf:splunknozzle:sampling",
+			"event": map[string]interface{}{
+				"sampler":        key.sampler,
+				"event_type":     key.eventType,
+				"kept":           kept,
+				"dropped":        dropped,
+				"effective_rate": float64(kept) / float64(kept+dropped),
+				"interval":       s.config.Interval.String(),
+			},
+		}
+		if s.config.Index != "" {
+			event["index"] = s.config.Index
+		}
+		events = append(events, event)
+	}
+	s.last = sampling
+
+	if len(events) == 0 {
+		return
+	}
+	if err, _ := s.writer.Write(events); err != nil {
+		s.config.Logger.Error("Failed to send sampling audit events", err)
+	}
+}
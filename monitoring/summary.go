@@ -0,0 +1,103 @@
+package monitoring
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+)
+
+// summaryCounters maps the summary event fields to the counters they report
+var summaryCounters = map[string]string{
+	"events_sent":    "splunk.events.sent",
+	"bytes_sent":     "splunk.bytes.sent",
+	"retries":        "splunk.retries",
+	"events_dropped": "splunk.events.dropped",
+}
+
+type SummaryConfig struct {
+	Interval time.Duration
+	Index    string
+	Hostname string
+	Logger   lager.Logger
+}
+
+// Summary periodically sends an event with the number of events, bytes, retries
+// and drops since the previous summary event
+type Summary struct {
+	metrics *Metrics
+	writer  Writer
+	config  *SummaryConfig
+	last    map[string]uint64
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewSummary(metrics *Metrics, writer Writer, config *SummaryConfig) *Summary {
+	last := make(map[string]uint64, len(summaryCounters))
+	for field, name := range summaryCounters {
+		last[field] = metrics.NewCounter(name).Value()
+	}
+
+	return &Summary{
+		metrics: metrics,
+		writer:  writer,
+		config:  config,
+		last:    last,
+		closing: make(chan struct{}),
+	}
+}
+
+func (s *Summary) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *Summary) Stop() {
+	close(s.closing)
+	s.wg.Wait()
+}
+
+func (s *Summary) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *Summary) flush() {
+	e := map[string]interface{}{
+		"interval": s.config.Interval.String(),
+	}
+	for field, name := range summaryCounters {
+		value := s.metrics.NewCounter(name).Value()
+		e[field] = value - s.last[field]
+		s.last[field] = value
+	}
+
+	event := map[string]interface{}{
+		"time":       utils.NanoSecondsToSeconds(time.Now().UnixNano()),
+		"host":       s.config.Hostname,
+		"source":     "splunk_nozzle",
+		"sourcetype": "cf:splunknozzle:summary",
+		"event":      e,
+	}
+	if s.config.Index != "" {
+		event["index"] = s.config.Index
+	}
+
+	if err, _ := s.writer.Write([]map[string]interface{}{event}); err != nil {
+		s.config.Logger.Error("Failed to send summary event", err)
+	}
+}
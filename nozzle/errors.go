@@ -0,0 +1,67 @@
+package nozzle
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+)
+
+// Classes of the errors read from the firehose
+const (
+	ErrorClassNonRetry     = "non_retry"    // the consumer doesn't retry, such as an invalid endpoint
+	ErrorClassMaxRetries   = "max_retries"  // the consumer gave up after its retries
+	ErrorClassUnauthorized = "unauthorized" // the token was rejected
+	ErrorClassClosed       = "closed"       // the connection was closed by the server
+	ErrorClassOther        = "other"
+)
+
+// ErrorClasses are all the error classes
+var ErrorClasses = []string{ErrorClassNonRetry, ErrorClassMaxRetries, ErrorClassUnauthorized, ErrorClassClosed, ErrorClassOther}
+
+// ParseErrorClasses parses a comma separated list of error classes
+func ParseErrorClasses(list string) (map[string]bool, error) {
+	classes := make(map[string]bool)
+	for _, class := range strings.Split(list, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		if class == "" {
+			continue
+		}
+		if !validErrorClass(class) {
+			return nil, fmt.Errorf("unknown firehose error class %q, valid classes are %s", class, strings.Join(ErrorClasses, ", "))
+		}
+		classes[class] = true
+	}
+	return classes, nil
+}
+
+func validErrorClass(class string) bool {
+	for _, c := range ErrorClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorClass returns the class of an error read from the firehose
+func ErrorClass(err error) string {
+	if retryErr, ok := err.(noaaerrors.RetryError); ok {
+		err = retryErr.Err
+	}
+
+	switch err.(type) {
+	case noaaerrors.NonRetryError:
+		return ErrorClassNonRetry
+	case *noaaerrors.UnauthorizedError:
+		return ErrorClassUnauthorized
+	case *websocket.CloseError:
+		return ErrorClassClosed
+	}
+	if err == consumer.ErrMaxRetriesReached {
+		return ErrorClassMaxRetries
+	}
+	return ErrorClassOther
+}
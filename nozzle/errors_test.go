@@ -0,0 +1,38 @@
+package nozzle_test
+
+import (
+	"errors"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/nozzle"
+)
+
+var _ = Describe("ErrorClass", func() {
+	It("classifies the firehose errors", func() {
+		Expect(ErrorClass(noaaerrors.NewNonRetryError(errors.New("bad endpoint")))).To(Equal(ErrorClassNonRetry))
+		Expect(ErrorClass(consumer.ErrMaxRetriesReached)).To(Equal(ErrorClassMaxRetries))
+		Expect(ErrorClass(noaaerrors.NewUnauthorizedError("expired token"))).To(Equal(ErrorClassUnauthorized))
+		Expect(ErrorClass(&websocket.CloseError{Code: websocket.CloseGoingAway})).To(Equal(ErrorClassClosed))
+		Expect(ErrorClass(noaaerrors.NewRetryError(&websocket.CloseError{Code: websocket.CloseGoingAway}))).To(Equal(ErrorClassClosed))
+		Expect(ErrorClass(errors.New("boom"))).To(Equal(ErrorClassOther))
+	})
+})
+
+var _ = Describe("ParseErrorClasses", func() {
+	It("parses a comma separated list", func() {
+		classes, err := ParseErrorClasses(" Non_Retry, unauthorized,")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(classes).To(Equal(map[string]bool{ErrorClassNonRetry: true, ErrorClassUnauthorized: true}))
+	})
+
+	It("rejects unknown classes", func() {
+		_, err := ParseErrorClasses("non_retry,timeout")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -2,19 +2,48 @@ package nozzle
 
 import (
 	"code.cloudfoundry.org/lager"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventrouter"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsource"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gorilla/websocket"
 )
 
 type Config struct {
 	Logger                lager.Logger
 	StatusMonitorInterval time.Duration
+	Metrics               *monitoring.Metrics
+
+	// Alarm when no event is received for MaxDisconnectDuration after a firehose
+	// error, 0 disables. OnDisconnectAlarm is optional
+	MaxDisconnectDuration time.Duration
+	OnDisconnectAlarm     func(disconnectedFor time.Duration, err error)
+
+	// Reconnect to the firehose when no event is received for StallTimeout while
+	// connected, 0 disables
+	StallTimeout time.Duration
+
+	// Read the firehose again after ReconnectDelay, doubled on every consecutive
+	// attempt up to maxReconnectDelay, when the consumer gives up on an error whose
+	// class isn't in FatalErrors. Start returns on fatal errors, and on every error
+	// when ReconnectDelay is 0
+	ReconnectDelay time.Duration
+	FatalErrors    map[string]bool
+
+	// Route the events in RouteWorkers goroutines, fed by a buffer of RouteBuffer
+	// events, so slow routing, such as app metadata lookups with SYNC_SEND, doesn't
+	// hold up the reads of the firehose. Events are routed as they are read when 0
+	RouteWorkers int
+	RouteBuffer  int
 }
 
+// maxReconnectDelay bounds the backoff of ReconnectDelay
+const maxReconnectDelay = 5 * time.Minute
+
 // Nozzle reads events from eventsource.Source and routes events
 // to targets by using eventrouter.Router
 type Nozzle struct {
@@ -22,30 +51,96 @@ type Nozzle struct {
 	eventRouter eventrouter.Router
 	config      *Config
 
-	closing chan struct{}
-	closed  chan struct{}
+	closing   chan struct{}
+	closed    chan struct{}
+	receiving chan struct{} // closed on the first event, see Receiving
+
+	receivedCounter  *monitoring.Counter
+	stallCounter     *monitoring.Counter
+	reconnectCounter *monitoring.Counter
+	errorCounters    map[string]*monitoring.Counter // per error class
+
+	// disconnect alarm state, only accessed by Start except healthy
+	disconnectedAt time.Time
+	alarmTimer     *time.Timer
+	alarmed        bool
+	healthy        int32 // atomic, 0 while the disconnect alarm is raised
+
+	// stall watchdog, only accessed by Start
+	stallTimer *time.Timer
+
+	// consecutive reconnects after the consumer gave up, only accessed by Start
+	reconnects int
+
+	// events read and waiting to be routed, nil without RouteWorkers
+	routing   chan *events.Envelope
+	routingWg sync.WaitGroup
 }
 
 func New(eventSource eventsource.Source, eventRouter eventrouter.Router, config *Config) *Nozzle {
-	return &Nozzle{
-		eventRouter: eventRouter,
-		eventSource: eventSource,
-		config:      config,
-		closing:     make(chan struct{}, 1),
-		closed:      make(chan struct{}, 1),
+	if config.Metrics == nil {
+		config.Metrics = monitoring.NewMetrics()
+	}
+
+	f := &Nozzle{
+		eventRouter:     eventRouter,
+		eventSource:     eventSource,
+		config:          config,
+		closing:         make(chan struct{}, 1),
+		closed:          make(chan struct{}, 1),
+		receiving:       make(chan struct{}),
+		receivedCounter: config.Metrics.NewCounter("firehose.events.received"),
+		stallCounter:    config.Metrics.NewCounter("firehose.stalls"),
+		healthy:         1,
+
+		reconnectCounter: config.Metrics.NewCounter("firehose.reconnects"),
+		errorCounters:    make(map[string]*monitoring.Counter, len(ErrorClasses)),
+	}
+	for _, class := range ErrorClasses {
+		f.errorCounters[class] = config.Metrics.NewCounter("firehose.errors." + class)
 	}
+	config.Metrics.RegisterGauge("firehose.healthy", func() float64 {
+		return float64(atomic.LoadInt32(&f.healthy))
+	})
+	if config.RouteWorkers > 0 {
+		f.routing = make(chan *events.Envelope, config.RouteBuffer)
+		config.Metrics.RegisterGauge("firehose.events.routing", func() float64 {
+			return float64(len(f.routing))
+		})
+	}
+	return f
+}
+
+// Healthy returns false while the firehose has been disconnected for longer than
+// MaxDisconnectDuration
+func (f *Nozzle) Healthy() bool {
+	return atomic.LoadInt32(&f.healthy) == 1
+}
+
+// Receiving returns a channel closed once the first event is read from the source
+func (f *Nozzle) Receiving() <-chan struct{} {
+	return f.receiving
 }
 
 func (f *Nozzle) Start() error {
+	defer close(f.closed)
+
 	err := f.eventSource.Open()
 	if err != nil {
 		return err
 	}
 
-	defer close(f.closed)
+	defer f.stopAlarm()
+	defer f.stopStall()
+	if f.routing != nil {
+		f.startRouting()
+		// The events read are routed before Close returns
+		defer f.stopRouting()
+	}
 
 	var lastErr error
 	events, errs := f.eventSource.Read()
+	f.resetStall()
 	if f.config.StatusMonitorInterval > time.Second*0 {
 		var receivedCount uint64 = 0
 		timer := time.NewTimer(f.config.StatusMonitorInterval)
@@ -62,19 +157,38 @@ func (f *Nozzle) Start() error {
 			select {
 			case event, ok := <-events:
 				if !ok {
-					f.config.Logger.Info("Give up after retries. Firehose consumer is going to exit")
-					return lastErr
+					if events, errs, ok = f.reconnect(lastErr); !ok {
+						return f.exitErr(lastErr)
+					}
+					break
 				}
 				atomic.AddUint64(&receivedCount, uint64(1))
-				if err := f.eventRouter.Route(event); err != nil {
-					f.config.Logger.Error("Failed to route event", err)
-				}
+				f.receivedCounter.Add(1)
+				// The errors before the firehose recovered aren't reported on exit
+				lastErr = nil
+				f.connected()
+				f.resetStall()
+				f.route(event)
 
-			case lastErr = <-errs:
+			case err, ok := <-errs:
+				if !ok {
+					// Closed along with the events once the consumer gives up
+					errs = nil
+					break
+				}
+				lastErr = err
 				f.handleError(lastErr)
+				f.disconnected()
+				f.stopStall()
+
+			case <-f.alarm():
+				f.raiseAlarm(lastErr)
+
+			case <-f.stall():
+				events, errs = f.restart()
 
 			case <-f.closing:
-				return lastErr
+				return nil
 			}
 		}
 	} else {
@@ -82,36 +196,245 @@ func (f *Nozzle) Start() error {
 			select {
 			case event, ok := <-events:
 				if !ok {
-					f.config.Logger.Info("Give up after retries. Firehose consumer is going to exit")
-					return lastErr
+					if events, errs, ok = f.reconnect(lastErr); !ok {
+						return f.exitErr(lastErr)
+					}
+					break
 				}
+				f.receivedCounter.Add(1)
+				// The errors before the firehose recovered aren't reported on exit
+				lastErr = nil
+				f.connected()
+				f.resetStall()
 
-				if err := f.eventRouter.Route(event); err != nil {
-					f.config.Logger.Error("Failed to route event", err)
-				}
+				f.route(event)
 
-			case lastErr = <-errs:
+			case err, ok := <-errs:
+				if !ok {
+					// Closed along with the events once the consumer gives up
+					errs = nil
+					break
+				}
+				lastErr = err
 				f.handleError(lastErr)
+				f.disconnected()
+				f.stopStall()
+
+			case <-f.alarm():
+				f.raiseAlarm(lastErr)
+
+			case <-f.stall():
+				events, errs = f.restart()
 
 			case <-f.closing:
-				return lastErr
+				return nil
 			}
 		}
 	}
 }
 
+// route routes the event, or queues it for the routing goroutines with RouteWorkers
+func (f *Nozzle) route(event *events.Envelope) {
+	if f.routing != nil {
+		f.routing <- event
+		return
+	}
+	if err := f.eventRouter.Route(event); err != nil {
+		f.config.Logger.Error("Failed to route event", err)
+	}
+}
+
+func (f *Nozzle) startRouting() {
+	for i := 0; i < f.config.RouteWorkers; i++ {
+		f.routingWg.Add(1)
+		go func() {
+			defer f.routingWg.Done()
+			for event := range f.routing {
+				if err := f.eventRouter.Route(event); err != nil {
+					f.config.Logger.Error("Failed to route event", err)
+				}
+			}
+		}()
+	}
+}
+
+// stopRouting waits until the queued events are routed
+func (f *Nozzle) stopRouting() {
+	close(f.routing)
+	f.routingWg.Wait()
+}
+
+// Close stops Start, even when the source fails to close, for example without open
+// connections while reconnecting, and returns the error of the source
 func (f *Nozzle) Close() error {
+	// Closing first, so the errors of closing the source aren't reported by Start
+	close(f.closing)
 	err := f.eventSource.Close()
-	if err != nil {
+
+	<-f.closed
+	return err
+}
+
+// exitErr returns the error Start exits with once reading stopped: nil when closing,
+// as the errors seen while reconnecting aren't failures of a normal shutdown
+func (f *Nozzle) exitErr(err error) error {
+	select {
+	case <-f.closing:
+		return nil
+	default:
 		return err
 	}
+}
 
-	close(f.closing)
-	<-f.closed
-	return nil
+// disconnected arms the disconnect alarm on the first error since the last event
+func (f *Nozzle) disconnected() {
+	if f.config.MaxDisconnectDuration <= 0 || !f.disconnectedAt.IsZero() {
+		return
+	}
+	f.disconnectedAt = time.Now()
+	f.alarmTimer = time.NewTimer(f.config.MaxDisconnectDuration)
+}
+
+// connected disarms or clears the disconnect alarm, and resets the reconnect backoff,
+// once events are received again
+func (f *Nozzle) connected() {
+	f.reconnects = 0
+	select {
+	case <-f.receiving:
+	default:
+		close(f.receiving)
+	}
+	if f.disconnectedAt.IsZero() {
+		return
+	}
+	if f.alarmed {
+		f.config.Logger.Info("Reconnected to Firehose", lager.Data{"disconnected_for": time.Since(f.disconnectedAt).String()})
+		atomic.StoreInt32(&f.healthy, 1)
+		f.alarmed = false
+	}
+	f.stopAlarm()
+	f.disconnectedAt = time.Time{}
+}
+
+// alarm returns the channel of the armed alarm, nil blocks forever when disarmed
+func (f *Nozzle) alarm() <-chan time.Time {
+	if f.alarmTimer == nil {
+		return nil
+	}
+	return f.alarmTimer.C
+}
+
+func (f *Nozzle) stopAlarm() {
+	if f.alarmTimer != nil {
+		f.alarmTimer.Stop()
+		f.alarmTimer = nil
+	}
+}
+
+// raiseAlarm reports a sustained outage. The consumer keeps reconnecting
+func (f *Nozzle) raiseAlarm(err error) {
+	f.alarmTimer = nil
+	f.alarmed = true
+	atomic.StoreInt32(&f.healthy, 0)
+
+	disconnectedFor := time.Since(f.disconnectedAt)
+	f.config.Logger.Error("CRITICAL: Unable to reconnect to Firehose", err, lager.Data{
+		"disconnected_for":        disconnectedFor.String(),
+		"max_disconnect_duration": f.config.MaxDisconnectDuration.String(),
+	})
+	if f.config.OnDisconnectAlarm != nil {
+		f.config.OnDisconnectAlarm(disconnectedFor, err)
+	}
+}
+
+// resetStall rearms the stall watchdog, an event or a reconnect was just seen
+func (f *Nozzle) resetStall() {
+	if f.config.StallTimeout <= 0 {
+		return
+	}
+	if f.stallTimer == nil {
+		f.stallTimer = time.NewTimer(f.config.StallTimeout)
+		return
+	}
+	if !f.stallTimer.Stop() {
+		select {
+		case <-f.stallTimer.C:
+		default:
+		}
+	}
+	f.stallTimer.Reset(f.config.StallTimeout)
+}
+
+// stall returns the channel of the armed stall watchdog, nil blocks forever when disarmed
+func (f *Nozzle) stall() <-chan time.Time {
+	if f.stallTimer == nil {
+		return nil
+	}
+	return f.stallTimer.C
+}
+
+// stopStall disarms the stall watchdog while the consumer reconnects on its own
+func (f *Nozzle) stopStall() {
+	if f.stallTimer != nil {
+		f.stallTimer.Stop()
+		f.stallTimer = nil
+	}
+}
+
+// restart drops the stalled connection and reads the firehose over a new one
+func (f *Nozzle) restart() (<-chan *events.Envelope, <-chan error) {
+	f.stallCounter.Add(1)
+	f.config.Logger.Info("No event received from Firehose, reconnecting", lager.Data{"stall_timeout": f.config.StallTimeout.String()})
+
+	f.stallTimer = nil
+	if err := f.eventSource.Close(); err != nil {
+		f.config.Logger.Error("Failed to close stalled Firehose connection", err)
+	}
+	events, errs := f.eventSource.Read()
+	f.resetStall()
+	return events, errs
+}
+
+// reconnect reads the firehose again after the reconnect delay, once the consumer
+// gave up on a recoverable error. It returns false when the error is fatal, and when
+// the nozzle is closed meanwhile
+func (f *Nozzle) reconnect(err error) (<-chan *events.Envelope, <-chan error, bool) {
+	class := ErrorClass(err)
+	if err == nil || f.config.ReconnectDelay <= 0 || f.config.FatalErrors[class] {
+		f.config.Logger.Info("Give up after retries. Firehose consumer is going to exit", lager.Data{"error_class": class})
+		return nil, nil, false
+	}
+
+	delay := f.config.ReconnectDelay
+	for i := 0; i < f.reconnects && delay < maxReconnectDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+	f.reconnects++
+	f.reconnectCounter.Add(1)
+	f.config.Logger.Error("Firehose consumer gave up, reconnecting", err, lager.Data{"error_class": class, "delay": delay.String()})
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-f.closing:
+		return nil, nil, false
+	}
+
+	if err := f.eventSource.Close(); err != nil {
+		f.config.Logger.Error("Failed to close Firehose connection", err)
+	}
+	events, errs := f.eventSource.Read()
+	f.resetStall()
+	return events, errs, true
 }
 
 func (f *Nozzle) handleError(err error) {
+	f.errorCounters[ErrorClass(err)].Add(1)
+
 	closeErr, ok := err.(*websocket.CloseError)
 	if !ok {
 		f.config.Logger.Error("Error while reading from the firehose", err)
@@ -1,11 +1,15 @@
 package nozzle_test
 
 import (
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
 	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/nozzle"
+	"github.com/cloudfoundry/noaa/consumer"
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gorilla/websocket"
 
@@ -68,13 +72,16 @@ var _ = Describe("Nozzle", func() {
 		})
 	})
 
+	var metrics *monitoring.Metrics
 	prepare := func(closeErr int, statusMonitorInterval time.Duration) func() {
 		return func() {
 			eventSource = testing.NewMemoryEventSourceMock(-1, int64(10), closeErr)
 			eventRouter = testing.NewEventRouterMock(false)
+			metrics = monitoring.NewMetrics()
 			config := &Config{
 				Logger:                lager.NewLogger("test"),
 				StatusMonitorInterval: statusMonitorInterval,
+				Metrics:               metrics,
 			}
 			nozzle = New(eventSource, eventRouter, config)
 		}
@@ -91,12 +98,14 @@ var _ = Describe("Nozzle", func() {
 			time.Sleep(time.Second)
 			nozzle.Close()
 
-			err := <-done
-			if ce, ok := err.(*websocket.CloseError); ok {
-				Expect(ce.Code).To(Equal(closeErr))
-			} else {
-				Expect(err).To(Equal(testing.MockupErr))
+			// The error is handled, the events received after it mean the firehose recovered
+			Expect(<-done).To(BeNil())
+			class := ErrorClassOther
+			if closeErr > 0 {
+				class = ErrorClassClosed
 			}
+			Expect(metrics.Snapshot()["firehose.errors."+class]).To(Equal(float64(1)))
+			Expect(eventRouter.Events()).To(HaveLen(10))
 		}
 	}
 
@@ -213,4 +222,301 @@ var _ = Describe("Nozzle", func() {
 		})
 	})
 
+	Context("When MaxDisconnectDuration is provided", func() {
+		var (
+			source *channelSource
+			alarms chan time.Duration
+		)
+
+		BeforeEach(func() {
+			source = &channelSource{events: make(chan *events.Envelope), errs: make(chan error)}
+			eventRouter = testing.NewEventRouterMock(false)
+			alarms = make(chan time.Duration, 1)
+			config := &Config{
+				Logger:                lager.NewLogger("test"),
+				MaxDisconnectDuration: 100 * time.Millisecond,
+				OnDisconnectAlarm: func(disconnectedFor time.Duration, err error) {
+					Expect(err).To(Equal(testing.MockupErr))
+					alarms <- disconnectedFor
+				},
+			}
+			nozzle = New(source, eventRouter, config)
+			go nozzle.Start()
+		})
+
+		AfterEach(func() {
+			nozzle.Close()
+		})
+
+		It("raises the alarm until events are received again", func() {
+			source.errs <- testing.MockupErr
+			source.errs <- testing.MockupErr
+			Expect(nozzle.Healthy()).To(BeTrue())
+
+			var disconnectedFor time.Duration
+			Eventually(alarms).Should(Receive(&disconnectedFor))
+			Expect(disconnectedFor).To(BeNumerically(">=", 100*time.Millisecond))
+			Expect(nozzle.Healthy()).To(BeFalse())
+
+			source.events <- &events.Envelope{}
+			Eventually(nozzle.Healthy).Should(BeTrue())
+		})
+
+		It("doesn't raise the alarm when reconnected in time", func() {
+			source.errs <- testing.MockupErr
+			source.events <- &events.Envelope{}
+			Consistently(alarms, 300*time.Millisecond).ShouldNot(Receive())
+			Expect(nozzle.Healthy()).To(BeTrue())
+		})
+	})
+
+	Context("When StallTimeout is provided", func() {
+		var (
+			source  *reconnectingSource
+			metrics *monitoring.Metrics
+		)
+
+		BeforeEach(func() {
+			source = &reconnectingSource{}
+			eventRouter = testing.NewEventRouterMock(false)
+			metrics = monitoring.NewMetrics()
+			config := &Config{
+				Logger:       lager.NewLogger("test"),
+				Metrics:      metrics,
+				StallTimeout: 100 * time.Millisecond,
+			}
+			nozzle = New(source, eventRouter, config)
+			go nozzle.Start()
+			Eventually(source.Reads).Should(Equal(1))
+		})
+
+		AfterEach(func() {
+			nozzle.Close()
+		})
+
+		It("reconnects when no event is received", func() {
+			Eventually(source.Reads).Should(BeNumerically(">=", 2))
+			Expect(metrics.Snapshot()["firehose.stalls"]).To(BeNumerically(">=", 1))
+
+			source.Current().events <- &events.Envelope{}
+			Eventually(eventRouter.Events).Should(HaveLen(1))
+		})
+
+		It("doesn't reconnect while events are received", func() {
+			for i := 0; i < 5; i++ {
+				source.Current().events <- &events.Envelope{}
+				time.Sleep(50 * time.Millisecond)
+			}
+			Expect(source.Reads()).To(Equal(1))
+			Expect(metrics.Snapshot()["firehose.stalls"]).To(BeZero())
+		})
+
+		It("doesn't reconnect while disconnected", func() {
+			source.Current().errs <- testing.MockupErr
+			Consistently(source.Reads, 300*time.Millisecond).Should(Equal(1))
+		})
+	})
+
+	Context("When ReconnectDelay is provided", func() {
+		var (
+			source  *reconnectingSource
+			metrics *monitoring.Metrics
+			done    chan error
+		)
+
+		giveUp := func(err error) {
+			current := source.Current()
+			current.errs <- err
+			close(current.errs)
+			close(current.events)
+		}
+
+		BeforeEach(func() {
+			source = &reconnectingSource{}
+			eventRouter = testing.NewEventRouterMock(false)
+			metrics = monitoring.NewMetrics()
+			config := &Config{
+				Logger:         lager.NewLogger("test"),
+				Metrics:        metrics,
+				ReconnectDelay: 10 * time.Millisecond,
+				FatalErrors:    map[string]bool{ErrorClassNonRetry: true},
+			}
+			nozzle = New(source, eventRouter, config)
+			done = make(chan error, 1)
+			go func(n *Nozzle, done chan<- error) { done <- n.Start() }(nozzle, done)
+			Eventually(source.Reads).Should(Equal(1))
+		})
+
+		AfterEach(func() {
+			nozzle.Close()
+		})
+
+		It("reconnects when the consumer gives up on a recoverable error", func() {
+			giveUp(consumer.ErrMaxRetriesReached)
+			Eventually(source.Reads).Should(Equal(2))
+			Expect(metrics.Snapshot()["firehose.errors.max_retries"]).To(Equal(float64(1)))
+			Expect(metrics.Snapshot()["firehose.reconnects"]).To(Equal(float64(1)))
+
+			source.Current().events <- &events.Envelope{}
+			Eventually(eventRouter.Events).Should(HaveLen(1))
+			Consistently(done).ShouldNot(Receive())
+		})
+
+		It("exits on a fatal error", func() {
+			giveUp(noaaerrors.NewNonRetryError(testing.MockupErr))
+			Eventually(done).Should(Receive(HaveOccurred()))
+			Expect(source.Reads()).To(Equal(1))
+			Expect(metrics.Snapshot()["firehose.errors.non_retry"]).To(Equal(float64(1)))
+		})
+	})
+
+	Context("When closing", func() {
+		var (
+			source *reconnectingSource
+			done   chan error
+		)
+
+		BeforeEach(func() {
+			source = &reconnectingSource{}
+			eventRouter = testing.NewEventRouterMock(false)
+			config := &Config{
+				Logger:         lager.NewLogger("test"),
+				ReconnectDelay: time.Minute,
+			}
+			nozzle = New(source, eventRouter, config)
+			done = make(chan error, 1)
+			go func(n *Nozzle, done chan<- error) { done <- n.Start() }(nozzle, done)
+			Eventually(source.Reads).Should(Equal(1))
+		})
+
+		It("doesn't report the errors the firehose recovered from", func() {
+			source.Current().errs <- testing.MockupErr
+			source.Current().events <- &events.Envelope{}
+			Eventually(eventRouter.Events).Should(HaveLen(1))
+
+			Expect(nozzle.Close()).To(Succeed())
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("doesn't report the errors while reconnecting", func() {
+			current := source.Current()
+			current.errs <- consumer.ErrMaxRetriesReached
+			close(current.events)
+
+			Expect(nozzle.Close()).To(Succeed())
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("stops when the source fails to close", func() {
+			source.closeErr = testing.MockupErr
+
+			Expect(nozzle.Close()).To(Equal(testing.MockupErr))
+			Eventually(done).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("When RouteWorkers is provided", func() {
+		var (
+			source  *channelSource
+			router  *blockingRouter
+			metrics *monitoring.Metrics
+		)
+
+		BeforeEach(func() {
+			source = &channelSource{events: make(chan *events.Envelope), errs: make(chan error)}
+			router = &blockingRouter{EventRouterMock: testing.NewEventRouterMock(false), release: make(chan struct{})}
+			metrics = monitoring.NewMetrics()
+			config := &Config{
+				Logger:       lager.NewLogger("test"),
+				Metrics:      metrics,
+				RouteWorkers: 2,
+				RouteBuffer:  10,
+			}
+			nozzle = New(source, router, config)
+			go nozzle.Start()
+		})
+
+		It("keeps reading while the events are routed", func() {
+			for i := 0; i < 12; i++ {
+				Eventually(source.events).Should(BeSent(&events.Envelope{}))
+			}
+			// 2 events are being routed, the others wait in the buffer
+			Eventually(func() float64 { return metrics.Snapshot()["firehose.events.received"] }).Should(Equal(float64(12)))
+			Eventually(func() float64 { return metrics.Snapshot()["firehose.events.routing"] }).Should(Equal(float64(10)))
+			Expect(router.Events()).To(BeEmpty())
+
+			close(router.release)
+			Eventually(router.Events).Should(HaveLen(12))
+			nozzle.Close()
+		})
+
+		It("routes the buffered events before closing", func() {
+			for i := 0; i < 5; i++ {
+				Eventually(source.events).Should(BeSent(&events.Envelope{}))
+			}
+
+			closed := make(chan struct{})
+			go func() {
+				nozzle.Close()
+				close(closed)
+			}()
+			Consistently(closed, 100*time.Millisecond).ShouldNot(BeClosed())
+
+			close(router.release)
+			Eventually(closed).Should(BeClosed())
+			Expect(router.Events()).To(HaveLen(5))
+		})
+	})
 })
+
+// blockingRouter is an event router which routes the events once released
+type blockingRouter struct {
+	*testing.EventRouterMock
+	release chan struct{}
+}
+
+func (r *blockingRouter) Route(msg *events.Envelope) error {
+	<-r.release
+	return r.EventRouterMock.Route(msg)
+}
+
+// channelSource is an event source whose events and errors are sent by the test
+type channelSource struct {
+	events chan *events.Envelope
+	errs   chan error
+}
+
+func (s *channelSource) Open() error  { return nil }
+func (s *channelSource) Close() error { return nil }
+func (s *channelSource) Read() (<-chan *events.Envelope, <-chan error) {
+	return s.events, s.errs
+}
+
+// reconnectingSource is an event source which opens new channels on every Read
+type reconnectingSource struct {
+	lock     sync.Mutex
+	reads    []*channelSource
+	closeErr error
+}
+
+func (s *reconnectingSource) Open() error  { return nil }
+func (s *reconnectingSource) Close() error { return s.closeErr }
+func (s *reconnectingSource) Read() (<-chan *events.Envelope, <-chan error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := &channelSource{events: make(chan *events.Envelope), errs: make(chan error)}
+	s.reads = append(s.reads, c)
+	return c.Read()
+}
+
+func (s *reconnectingSource) Reads() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.reads)
+}
+
+func (s *reconnectingSource) Current() *channelSource {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reads[len(s.reads)-1]
+}
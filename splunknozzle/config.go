@@ -1,12 +1,19 @@
 package splunknozzle
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsource"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/nozzle"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
@@ -18,35 +25,167 @@ type Config struct {
 	ClientID     string `json:"-"`
 	ClientSecret string `json:"-"`
 
-	SplunkToken        string `json:"-"`
-	SplunkHost         string `json:"splunk-host"`
-	SplunkIndex        string `json:"splunk-index"`
-	SplunkLoggingIndex string `json:"splunk-logging-index"`
+	SplunkToken         string `json:"-"`
+	SplunkTokens        string `json:"-"`
+	OrgHecTokens        string `json:"-"`
+	SplunkHost          string `json:"splunk-host"`
+	SplunkIndex         string `json:"splunk-index"`
+	SplunkLoggingIndex  string `json:"splunk-logging-index"`
+	SplunkMetricIndex   string `json:"splunk-metric-index"`
+	DropNozzleLogs      bool   `json:"drop-nozzle-logs"`
+	NozzleLogSampleRate int    `json:"nozzle-log-sample-rate"`
+
+	AutoCreateIndex              bool          `json:"auto-create-index"`
+	AutoCreateIndexRetryInterval time.Duration `json:"auto-create-index-retry-interval"`
+	SplunkManagementURL          string        `json:"splunk-management-url"`
+	SplunkManagementUser         string        `json:"-"`
+	SplunkManagementPassword     string        `json:"-"`
 
 	JobHost string `json:"job-host"`
 
-	SkipSSLCF      bool          `json:"skip-ssl-cf"`
-	SkipSSLSplunk  bool          `json:"skip-ssl-splunk"`
-	SubscriptionID string        `json:"subscription-id"`
-	KeepAlive      time.Duration `json:"keep-alive"`
-
-	AddAppInfo         string        `json:"add-app-info"`
-	IgnoreMissingApps  bool          `json:"ignore-missing-apps"`
-	MissingAppCacheTTL time.Duration `json:"missing-app-cache-ttl"`
-	AppCacheTTL        time.Duration `json:"app-cache-ttl"`
-	OrgSpaceCacheTTL   time.Duration `json:"org-space-cache-ttl"`
-	AppLimits          int           `json:"app-limits"`
-	AddTags            bool          `json:"add-tags"`
-
-	BoltDBPath   string `json:"boltdb-path"`
-	WantedEvents string `json:"wanted-events"`
-	ExtraFields  string `json:"extra-fields"`
-
-	FlushInterval time.Duration `json:"flush-interval"`
-	QueueSize     int           `json:"queue-size"`
-	BatchSize     int           `json:"batch-size"`
-	Retries       int           `json:"retries"`
-	HecWorkers    int           `json:"hec-workers"`
+	SkipSSLCF       bool          `json:"skip-ssl-cf"`
+	SkipSSLSplunk   bool          `json:"skip-ssl-splunk"`
+	SkipSSLExpiry   time.Duration `json:"skip-ssl-splunk-expiry"`
+	AllowPlainHTTP  bool          `json:"allow-plain-http-splunk"`
+	TLSMinVersion   string        `json:"tls-min-version"`
+	TLSCipherSuites string        `json:"tls-cipher-suites"`
+	SubscriptionID  string        `json:"subscription-id"`
+	KeepAlive       time.Duration `json:"keep-alive"`
+
+	StartupRetries       int           `json:"startup-retries"`
+	StartupRetryInterval time.Duration `json:"startup-retry-interval"`
+	StartupDeadline      time.Duration `json:"startup-deadline"`
+
+	MaxDisconnectDuration time.Duration `json:"max-disconnect-duration"`
+	DisconnectAlertEvent  bool          `json:"disconnect-alert-event"`
+	StallTimeout          time.Duration `json:"stall-timeout"`
+
+	FirehoseReconnectDelay time.Duration `json:"firehose-reconnect-delay"`
+	FirehoseFatalErrors    string        `json:"firehose-fatal-errors"`
+	RouteWorkers           int           `json:"route-workers"`
+	RouteBufferSize        int           `json:"route-buffer-size"`
+	ShutdownTimeout        time.Duration `json:"shutdown-timeout"`
+
+	SourceType        string `json:"source-type"`
+	SyntheticRate     int    `json:"synthetic-rate"`
+	SyntheticEventMix string `json:"synthetic-event-mix"`
+	SyntheticSeed     int64  `json:"synthetic-seed"`
+
+	AddAppInfo              string        `json:"add-app-info"`
+	IgnoreMissingApps       bool          `json:"ignore-missing-apps"`
+	MissingAppCacheTTL      time.Duration `json:"missing-app-cache-ttl"`
+	AppCacheTTL             time.Duration `json:"app-cache-ttl"`
+	OrgSpaceCacheTTL        time.Duration `json:"org-space-cache-ttl"`
+	OrgCacheTTL             time.Duration `json:"org-cache-ttl"`
+	SpaceCacheTTL           time.Duration `json:"space-cache-ttl"`
+	QuotaCacheTTL           time.Duration `json:"quota-cache-ttl"`
+	CacheWriteInterval      time.Duration `json:"boltdb-write-interval"`
+	SnapshotInterval        time.Duration `json:"cache-snapshot-interval"`
+	AppLimits               int           `json:"app-limits"`
+	AddTags                 bool          `json:"add-tags"`
+	BoshInstanceField       string        `json:"bosh-instance-id-field"`
+	AddCpuCores             bool          `json:"add-cpu-cores"`
+	CpuEntitlementMBPerCore int           `json:"cpu-entitlement-mb-per-core"`
+	AddVcapRequestId        bool          `json:"add-vcap-request-id"`
+	RequireEnrichment       bool          `json:"require-enrichment"`
+	QuarantineIndex         string        `json:"quarantine-index"`
+	AddSequence             bool          `json:"add-sequence"`
+	AddSchemaVersion        bool          `json:"add-schema-version"`
+	AddSubscriptionID       bool          `json:"add-subscription-id"`
+	AppKey                  string        `json:"app-key"`
+	AppKeySalt              string        `json:"-"`
+	AddRouteField           bool          `json:"add-route-field"`
+
+	BoltDBPath         string        `json:"boltdb-path"`
+	CacheSnapshotPath  string        `json:"cache-snapshot-path"`
+	WantedEvents       string        `json:"wanted-events"`
+	ExtraFields        string        `json:"extra-fields"`
+	IndexExtraFields   string        `json:"index-extra-fields"`
+	MaxExtraFieldBytes int           `json:"max-extra-field-bytes"`
+	AddK8sMetadata     bool          `json:"add-k8s-metadata"`
+	MessageTypeIndexes string        `json:"message-type-indexes"`
+	IndexMappings      string        `json:"index-mappings"`
+	EventMappingFile   string        `json:"event-mapping-file"`
+	IndexBatching      string        `json:"index-batching"`
+	SplitByIndex       bool          `json:"hec-split-by-index"`
+	DeadLetterFile     string        `json:"dead-letter-file"`
+	DeadLetterMaxBytes int64         `json:"dead-letter-max-bytes"`
+	DeadLetterMaxFiles int           `json:"dead-letter-max-files"`
+	DeadLetterMaxAge   time.Duration `json:"dead-letter-max-age"`
+	DeadLetterPerIndex bool          `json:"dead-letter-per-index"`
+	ClassQueues        string        `json:"class-queues"`
+	CheckIndexes       bool          `json:"check-indexes"`
+	LogFieldExtractors string        `json:"log-field-extractors"`
+	HttpSampleRates    string        `json:"http-sample-rates"`
+	SampleRatios       string        `json:"sample-ratios"`
+
+	ParseJsonLogs         bool   `json:"parse-json-logs"`
+	JsonLogFieldPrefix    string `json:"json-log-field-prefix"`
+	JsonLogFieldCollision string `json:"json-log-field-collision"`
+	JsonLogMaxBytes       int    `json:"json-log-max-bytes"`
+	JsonLogMaxDepth       int    `json:"json-log-max-depth"`
+
+	LogTimestampFormat string `json:"log-timestamp-format"`
+	LogTimestampAsTime bool   `json:"log-timestamp-as-time"`
+	Base64BinaryLogs   bool   `json:"base64-binary-logs"`
+
+	LogMaxChars int    `json:"log-max-chars"`
+	LogMaxLines int    `json:"log-max-lines"`
+	LogOverflow string `json:"log-overflow"`
+
+	ContainerMetricMaxSampleRate uint64  `json:"container-metric-max-sample-rate"`
+	ContainerMetricCpuDelta      float64 `json:"container-metric-cpu-delta"`
+	ContainerMetricMemoryDelta   float64 `json:"container-metric-memory-delta"`
+	ContainerMultiMetric         bool    `json:"container-multi-metric"`
+	EventFilter                  string  `json:"event-filter"`
+	PriorityRules                string  `json:"priority-rules"`
+	PriorityField                string  `json:"priority-field"`
+
+	SuppressInactiveContainerMetrics bool          `json:"suppress-inactive-container-metrics"`
+	AppStateMaxAge                   time.Duration `json:"app-state-max-age"`
+
+	FlushInterval  time.Duration `json:"flush-interval"`
+	QueueSize      int           `json:"queue-size"`
+	MaxQueueAge    time.Duration `json:"max-queue-age"`
+	BatchSize      int           `json:"batch-size"`
+	Retries        int           `json:"retries"`
+	HecWorkers     int           `json:"hec-workers"`
+	SyncSend       bool          `json:"sync-send"`
+	HecWarmUp      bool          `json:"hec-warm-up"`
+	MaxBufferBytes int64         `json:"max-buffer-bytes"`
+
+	MinHecWorkers    int           `json:"min-hec-workers"`
+	MaxHecWorkers    int           `json:"max-hec-workers"`
+	HecScaleInterval time.Duration `json:"hec-scale-interval"`
+	HecScaleLatency  time.Duration `json:"hec-scale-latency"`
+
+	RetryBudget       int    `json:"retry-budget"`
+	RetryBudgetPolicy string `json:"retry-budget-policy"`
+	SkipInvalidEvents bool   `json:"hec-skip-invalid-events"`
+	DecodeGzip        bool   `json:"hec-decode-gzip-responses"`
+
+	CompactContainerMetrics bool `json:"compact-container-metrics"`
+	MemoryAwareSizing       bool `json:"memory-aware-sizing"`
+	CounterResetLimit       int  `json:"counter-reset-limit"`
+	AddIngestTime           bool `json:"add-ingest-time"`
+	AddDeliveryTime         bool `json:"add-delivery-time"`
+
+	ReorderWindow     time.Duration `json:"reorder-window"`
+	ReorderBufferSize int           `json:"reorder-buffer-size"`
+	DedupWindow       time.Duration `json:"dedup-window"`
+	DedupMaxEntries   int           `json:"dedup-max-entries"`
+
+	HecPath              string        `json:"hec-path"`
+	HecFailoverHosts     string        `json:"hec-failover-hosts"`
+	HecFailoverThreshold int           `json:"hec-failover-threshold"`
+	HecFailbackInterval  time.Duration `json:"hec-failback-interval"`
+
+	GraphiteHost   string `json:"graphite-host"`
+	GraphitePrefix string `json:"graphite-prefix"`
+
+	AlertWebhookURL        string `json:"-"` // webhook URLs usually embed a secret
+	AlertWebhookTemplate   string `json:"alert-webhook-template"`
+	AlertWebhookPriorities string `json:"alert-webhook-priorities"`
 
 	Version string `json:"version"`
 	Branch  string `json:"branch"`
@@ -54,11 +193,32 @@ type Config struct {
 	BuildOS string `json:"buildos"`
 
 	TraceLogging          bool          `json:"trace-logging"`
+	TraceAppGUIDs         string        `json:"trace-app-guids"`
+	DeliveryReceiptLimit  int           `json:"delivery-receipt-limit"`
+	AddChannelField       bool          `json:"add-hec-channel-field"`
 	Debug                 bool          `json:"debug"`
 	StatusMonitorInterval time.Duration `json:"mem-queue-monitor-interval"`
 	DropWarnThreshold     int           `json:"drop-warn-threshold"`
+	LifecycleEvents       bool          `json:"lifecycle-events"`
+	LookupFailureInterval time.Duration `json:"lookup-failure-interval"`
+	MetricsSampleInterval time.Duration `json:"metrics-sample-interval"`
+	MonitoringMetrics     string        `json:"monitoring-metrics"`
+	MonitoringSuspendAt   int           `json:"monitoring-suspend-at"`
+	OrgSpaceMetricsLimit  int           `json:"org-space-metrics-limit"`
+	IndexMetricsLimit     int           `json:"index-metrics-limit"`
+	WorkerMetrics         bool          `json:"worker-metrics"`
+	SummaryInterval       time.Duration `json:"summary-interval"`
+	SummaryIndex          string        `json:"summary-index"`
+	DropSummaryInterval   time.Duration `json:"drop-summary-interval"`
+	DropSummaryIndex      string        `json:"drop-summary-index"`
+	SamplingAuditInterval time.Duration `json:"sampling-audit-interval"`
+	SamplingAuditIndex    string        `json:"sampling-audit-index"`
 }
 
+// envPrefixVar names the environment variable with the prefix of the names of the
+// environment variables of all other settings
+const envPrefixVar = "ENV_PREFIX"
+
 func NewConfigFromCmdFlags(version, branch, commit, buildos string) *Config {
 	c := &Config{}
 
@@ -67,80 +227,351 @@ func NewConfigFromCmdFlags(version, branch, commit, buildos string) *Config {
 	c.Commit = commit
 	c.BuildOS = buildos
 
+	// Lets the nozzle run alongside tools reading the same variable names,
+	// for example SPLUNK_TOKEN is read from NOZZLE_SPLUNK_TOKEN with NOZZLE_
+	envPrefix := os.Getenv(envPrefixVar)
+
 	kingpin.Version(version)
 	kingpin.Flag("api-endpoint", "API endpoint address").
-		OverrideDefaultFromEnvar("API_ENDPOINT").Required().StringVar(&c.ApiEndpoint)
+		OverrideDefaultFromEnvar(envPrefix + "API_ENDPOINT").Required().StringVar(&c.ApiEndpoint)
 	kingpin.Flag("user", "Admin user.").
-		OverrideDefaultFromEnvar("API_USER").StringVar(&c.User)
+		OverrideDefaultFromEnvar(envPrefix + "API_USER").StringVar(&c.User)
 	kingpin.Flag("password", "Admin password.").
-		OverrideDefaultFromEnvar("API_PASSWORD").StringVar(&c.Password)
+		OverrideDefaultFromEnvar(envPrefix + "API_PASSWORD").StringVar(&c.Password)
 	kingpin.Flag("client-id", "Client ID.").
-		OverrideDefaultFromEnvar("CLIENT_ID").Required().StringVar(&c.ClientID)
+		OverrideDefaultFromEnvar(envPrefix + "CLIENT_ID").Required().StringVar(&c.ClientID)
 	kingpin.Flag("client-secret", "Client secret.").
-		OverrideDefaultFromEnvar("CLIENT_SECRET").Required().StringVar(&c.ClientSecret)
+		OverrideDefaultFromEnvar(envPrefix + "CLIENT_SECRET").Required().StringVar(&c.ClientSecret)
 
 	kingpin.Flag("splunk-host", "Splunk HTTP event collector host").
-		OverrideDefaultFromEnvar("SPLUNK_HOST").Required().StringVar(&c.SplunkHost)
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_HOST").Required().StringVar(&c.SplunkHost)
 	kingpin.Flag("splunk-token", "Splunk HTTP event collector token").
-		OverrideDefaultFromEnvar("SPLUNK_TOKEN").Required().StringVar(&c.SplunkToken)
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_TOKEN").Required().StringVar(&c.SplunkToken)
+	kingpin.Flag("splunk-tokens", "Comma separated list of additional Splunk HTTP event collector tokens, used round-robin by the writers").
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_TOKENS").Default("").StringVar(&c.SplunkTokens)
+	kingpin.Flag("org-hec-tokens", "JSON object mapping org GUIDs to the HEC token their events are sent with, for tenant isolation. Requires OrgGuid in add-app-info").
+		OverrideDefaultFromEnvar(envPrefix + "ORG_HEC_TOKENS").Default("").StringVar(&c.OrgHecTokens)
 	kingpin.Flag("splunk-index", "Splunk index").
-		OverrideDefaultFromEnvar("SPLUNK_INDEX").Required().StringVar(&c.SplunkIndex)
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_INDEX").Required().StringVar(&c.SplunkIndex)
 	kingpin.Flag("splunk-logging-index", "Splunk logging index").
-		OverrideDefaultFromEnvar("SPLUNK_LOGGING_INDEX").StringVar(&c.SplunkLoggingIndex)
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_LOGGING_INDEX").StringVar(&c.SplunkLoggingIndex)
+	kingpin.Flag("splunk-metric-index", "Splunk metrics index for the nozzle's monitoring metrics").
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_METRIC_INDEX").StringVar(&c.SplunkMetricIndex)
+	kingpin.Flag("drop-nozzle-logs", "Don't forward nozzle's own log events to Splunk").
+		OverrideDefaultFromEnvar(envPrefix + "DROP_NOZZLE_LOGS").Default("false").BoolVar(&c.DropNozzleLogs)
+	kingpin.Flag("nozzle-log-sample-rate", "Forward 1 of every N nozzle's own info and debug log events. Errors are always forwarded").
+		OverrideDefaultFromEnvar(envPrefix + "NOZZLE_LOG_SAMPLE_RATE").Default("1").IntVar(&c.NozzleLogSampleRate)
+	kingpin.Flag("auto-create-index", "Create indexes which don't exist with the Splunk management API when HEC rejects events").
+		OverrideDefaultFromEnvar(envPrefix + "AUTO_CREATE_INDEX").Default("false").BoolVar(&c.AutoCreateIndex)
+	kingpin.Flag("auto-create-index-retry-interval", "Wait this long before trying again to create an index whose creation failed").
+		OverrideDefaultFromEnvar(envPrefix + "AUTO_CREATE_INDEX_RETRY_INTERVAL").Default("5m").DurationVar(&c.AutoCreateIndexRetryInterval)
+	kingpin.Flag("splunk-management-url", "Splunk management API endpoint, example: https://splunk:8089").
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_MANAGEMENT_URL").Default("").StringVar(&c.SplunkManagementURL)
+	kingpin.Flag("splunk-management-user", "Splunk management API user allowed to create indexes").
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_MANAGEMENT_USER").Default("").StringVar(&c.SplunkManagementUser)
+	kingpin.Flag("splunk-management-password", "Splunk management API password").
+		OverrideDefaultFromEnvar(envPrefix + "SPLUNK_MANAGEMENT_PASSWORD").Default("").StringVar(&c.SplunkManagementPassword)
 
 	kingpin.Flag("job-host", "Job host to tag nozzle's own log events").
-		OverrideDefaultFromEnvar("JOB_HOST").Default("").StringVar(&c.JobHost)
+		OverrideDefaultFromEnvar(envPrefix + "JOB_HOST").Default("").StringVar(&c.JobHost)
 
 	kingpin.Flag("skip-ssl-validation-cf", "Skip cert validation (for dev environments").
-		OverrideDefaultFromEnvar("SKIP_SSL_VALIDATION_CF").Default("false").BoolVar(&c.SkipSSLCF)
+		OverrideDefaultFromEnvar(envPrefix + "SKIP_SSL_VALIDATION_CF").Default("false").BoolVar(&c.SkipSSLCF)
 	kingpin.Flag("skip-ssl-validation-splunk", "Skip cert validation (for dev environments").
-		OverrideDefaultFromEnvar("SKIP_SSL_VALIDATION_SPLUNK").Default("false").BoolVar(&c.SkipSSLSplunk)
+		OverrideDefaultFromEnvar(envPrefix + "SKIP_SSL_VALIDATION_SPLUNK").Default("false").BoolVar(&c.SkipSSLSplunk)
+	kingpin.Flag("skip-ssl-validation-splunk-expiry", "Only skip the cert validation of Splunk for this duration after startup, for bootstrapping. Never expires when 0s").
+		OverrideDefaultFromEnvar(envPrefix + "SKIP_SSL_VALIDATION_SPLUNK_EXPIRY").Default("0s").DurationVar(&c.SkipSSLExpiry)
+	kingpin.Flag("allow-plain-http-splunk", "Allow http:// HEC hosts, which are reached without TLS (for local dev environments)").
+		OverrideDefaultFromEnvar(envPrefix + "ALLOW_PLAIN_HTTP_SPLUNK").Default("false").BoolVar(&c.AllowPlainHTTP)
+	kingpin.Flag("tls-min-version", "Minimum TLS version of the connections to Splunk, 1.2 or 1.3").
+		OverrideDefaultFromEnvar(envPrefix + "TLS_MIN_VERSION").Default("1.2").StringVar(&c.TLSMinVersion)
+	kingpin.Flag("tls-cipher-suites", "Comma separated list of TLS cipher suites allowed for the connections to Splunk, Go defaults when empty").
+		OverrideDefaultFromEnvar(envPrefix + "TLS_CIPHER_SUITES").Default("").StringVar(&c.TLSCipherSuites)
 	kingpin.Flag("subscription-id", "Id for the subscription.").
-		OverrideDefaultFromEnvar("FIREHOSE_SUBSCRIPTION_ID").Default("splunk-firehose").StringVar(&c.SubscriptionID)
+		OverrideDefaultFromEnvar(envPrefix + "FIREHOSE_SUBSCRIPTION_ID").Default("splunk-firehose").StringVar(&c.SubscriptionID)
 	kingpin.Flag("firehose-keep-alive", "Keep Alive duration for the firehose consumer").
-		OverrideDefaultFromEnvar("FIREHOSE_KEEP_ALIVE").Default("25s").DurationVar(&c.KeepAlive)
+		OverrideDefaultFromEnvar(envPrefix + "FIREHOSE_KEEP_ALIVE").Default("25s").DurationVar(&c.KeepAlive)
+	kingpin.Flag("startup-retries", "Retry the initial CF API authentication up to N times with exponential backoff before exiting").
+		OverrideDefaultFromEnvar(envPrefix + "STARTUP_RETRIES").Default("0").IntVar(&c.StartupRetries)
+	kingpin.Flag("startup-retry-interval", "Delay before the first retry of the initial CF API authentication, doubled at every retry up to 1m").
+		OverrideDefaultFromEnvar(envPrefix + "STARTUP_RETRY_INTERVAL").Default("5s").DurationVar(&c.StartupRetryInterval)
+	kingpin.Flag("startup-deadline", "Exit when the nozzle isn't started within this duration, naming the startup step which stalled. 0 disables").
+		OverrideDefaultFromEnvar(envPrefix + "STARTUP_DEADLINE").Default("0s").DurationVar(&c.StartupDeadline)
+	kingpin.Flag("max-disconnect-duration", "Raise an alarm when the firehose can't be reconnected within this duration. 0 disables").
+		OverrideDefaultFromEnvar(envPrefix + "MAX_DISCONNECT_DURATION").Default("0s").DurationVar(&c.MaxDisconnectDuration)
+	kingpin.Flag("disconnect-alert-event", "Also send an alert event to Splunk when the max-disconnect-duration alarm is raised").
+		OverrideDefaultFromEnvar(envPrefix + "DISCONNECT_ALERT_EVENT").Default("false").BoolVar(&c.DisconnectAlertEvent)
+	kingpin.Flag("stall-timeout", "Reconnect to the firehose when no event is received within this duration while connected. 0 disables").
+		OverrideDefaultFromEnvar(envPrefix + "STALL_TIMEOUT").Default("0s").DurationVar(&c.StallTimeout)
+	kingpin.Flag("firehose-reconnect-delay", "Read the firehose again after this delay, doubled at every consecutive attempt up to 5m, when the consumer gives up on a recoverable error. 0 exits on every error").
+		OverrideDefaultFromEnvar(envPrefix + "FIREHOSE_RECONNECT_DELAY").Default("5s").DurationVar(&c.FirehoseReconnectDelay)
+	kingpin.Flag("firehose-fatal-errors", fmt.Sprintf("Comma separated list of the firehose error classes the nozzle exits on. Valid classes are %s", strings.Join(nozzle.ErrorClasses, ", "))).
+		OverrideDefaultFromEnvar(envPrefix + "FIREHOSE_FATAL_ERRORS").Default(nozzle.ErrorClassNonRetry).StringVar(&c.FirehoseFatalErrors)
+	kingpin.Flag("route-workers", "Route the events read from the firehose in this many goroutines, so slow routing doesn't hold up the reads. 0 routes them as they are read").
+		OverrideDefaultFromEnvar(envPrefix + "ROUTE_WORKERS").Default("0").IntVar(&c.RouteWorkers)
+	kingpin.Flag("route-buffer-size", "Events read from the firehose buffered for the route-workers").
+		OverrideDefaultFromEnvar(envPrefix + "ROUTE_BUFFER_SIZE").Default("10000").IntVar(&c.RouteBufferSize)
+	kingpin.Flag("shutdown-timeout", "How long the nozzle waits on shutdown for the queued events to be sent to Splunk before abandoning them. 0 waits until they are sent").
+		OverrideDefaultFromEnvar(envPrefix + "SHUTDOWN_TIMEOUT").Default("0s").DurationVar(&c.ShutdownTimeout)
+
+	kingpin.Flag("source-type", "Where the events come from, the firehose or synthetic events generated by the nozzle to load test Splunk without a firehose").
+		OverrideDefaultFromEnvar(envPrefix+"SOURCE_TYPE").Default(eventsource.SourceFirehose).EnumVar(&c.SourceType, eventsource.SourceFirehose, eventsource.SourceSynthetic)
+	kingpin.Flag("synthetic-rate", "Events generated per second by the synthetic source").
+		OverrideDefaultFromEnvar(envPrefix + "SYNTHETIC_RATE").Default("1000").IntVar(&c.SyntheticRate)
+	kingpin.Flag("synthetic-event-mix", "Comma separated list of event type and weight pairs generated by the synthetic source, for example LogMessage:80,ContainerMetric:20").
+		OverrideDefaultFromEnvar(envPrefix + "SYNTHETIC_EVENT_MIX").Default(eventsource.DefaultSyntheticMix).StringVar(&c.SyntheticEventMix)
+	kingpin.Flag("synthetic-seed", "Seed of the synthetic source, which generates the same events for the same seed").
+		OverrideDefaultFromEnvar(envPrefix + "SYNTHETIC_SEED").Default("1").Int64Var(&c.SyntheticSeed)
 
 	kingpin.Flag("add-app-info", fmt.Sprintf("Comma separated list of app metadata to enrich event. Valid options are %s", events.AuthorizedMetadata())).
-		OverrideDefaultFromEnvar("ADD_APP_INFO").Default("").StringVar(&c.AddAppInfo)
+		OverrideDefaultFromEnvar(envPrefix + "ADD_APP_INFO").Default("").StringVar(&c.AddAppInfo)
 	kingpin.Flag("ignore-missing-app", "If app is missing, stop repeatedly querying app info from Cloud Foundry foundation").
-		OverrideDefaultFromEnvar("IGNORE_MISSING_APP").Default("true").BoolVar(&c.IgnoreMissingApps)
+		OverrideDefaultFromEnvar(envPrefix + "IGNORE_MISSING_APP").Default("true").BoolVar(&c.IgnoreMissingApps)
 	kingpin.Flag("missing-app-cache-invalidate-ttl", "How frequently the missing app info cache invalidates").
-		OverrideDefaultFromEnvar("MISSING_APP_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.MissingAppCacheTTL)
+		OverrideDefaultFromEnvar(envPrefix + "MISSING_APP_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.MissingAppCacheTTL)
 	kingpin.Flag("app-cache-invalidate-ttl", "How frequently the app info local cache invalidates").
-		OverrideDefaultFromEnvar("APP_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.AppCacheTTL)
+		OverrideDefaultFromEnvar(envPrefix + "APP_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.AppCacheTTL)
 	kingpin.Flag("org-space-cache-invalidate-ttl", "How frequently the org and space cache invalidates").
-		OverrideDefaultFromEnvar("ORG_SPACE_CACHE_INVALIDATE_TTL").Default("72h").DurationVar(&c.OrgSpaceCacheTTL)
+		OverrideDefaultFromEnvar(envPrefix + "ORG_SPACE_CACHE_INVALIDATE_TTL").Default("72h").DurationVar(&c.OrgSpaceCacheTTL)
+	kingpin.Flag("org-cache-invalidate-ttl", "How frequently the org cache invalidates. Uses org-space-cache-invalidate-ttl when 0s").
+		OverrideDefaultFromEnvar(envPrefix + "ORG_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.OrgCacheTTL)
+	kingpin.Flag("space-cache-invalidate-ttl", "How frequently the space cache invalidates. Uses org-space-cache-invalidate-ttl when 0s").
+		OverrideDefaultFromEnvar(envPrefix + "SPACE_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.SpaceCacheTTL)
+	kingpin.Flag("quota-cache-invalidate-ttl", "How frequently the names of the org and space quotas are listed again. Uses org-space-cache-invalidate-ttl when 0s").
+		OverrideDefaultFromEnvar(envPrefix + "QUOTA_CACHE_INVALIDATE_TTL").Default("0s").DurationVar(&c.QuotaCacheTTL)
 	kingpin.Flag("app-limits", "Restrict to APP_LIMITS most updated apps per request when populating the app metadata cache").
-		OverrideDefaultFromEnvar("APP_LIMITS").Default("0").IntVar(&c.AppLimits)
+		OverrideDefaultFromEnvar(envPrefix + "APP_LIMITS").Default("0").IntVar(&c.AppLimits)
 	kingpin.Flag("add-tags", "Add additional tags from envelope. (Default: false)").
-		OverrideDefaultFromEnvar("ADD_TAGS").Default("false").BoolVar(&c.AddTags)
+		OverrideDefaultFromEnvar(envPrefix + "ADD_TAGS").Default("false").BoolVar(&c.AddTags)
+	kingpin.Flag("bosh-instance-id-field", "Name of the field set to the BOSH instance id tag of envelopes when present. Disabled when empty").
+		OverrideDefaultFromEnvar(envPrefix + "BOSH_INSTANCE_ID_FIELD").Default("").StringVar(&c.BoshInstanceField)
+	kingpin.Flag("add-cpu-cores", "Add cpu_cores, the CPU usage in cores, to ContainerMetric events").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_CPU_CORES").Default("false").BoolVar(&c.AddCpuCores)
+	kingpin.Flag("cpu-entitlement-mb-per-core", "MB of instance memory entitled to one CPU core on the Diego cells, used by add-cpu-cores to normalize the CPU usage. 0 when unknown").
+		OverrideDefaultFromEnvar(envPrefix + "CPU_ENTITLEMENT_MB_PER_CORE").Default("0").IntVar(&c.CpuEntitlementMBPerCore)
+	kingpin.Flag("add-vcap-request-id", "Add vcap_request_id, the gorouter's X-Vcap-Request-Id, to HttpStartStop events").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_VCAP_REQUEST_ID").Default("false").BoolVar(&c.AddVcapRequestId)
+	kingpin.Flag("require-enrichment", "Drop app events missing any of the app metadata fields selected by add-app-info").
+		OverrideDefaultFromEnvar(envPrefix + "REQUIRE_ENRICHMENT").Default("false").BoolVar(&c.RequireEnrichment)
+	kingpin.Flag("quarantine-index", "Send app events missing any of the app metadata fields selected by add-app-info to this index instead of dropping or mixing them with the attributed events").
+		OverrideDefaultFromEnvar(envPrefix + "QUARANTINE_INDEX").Default("").StringVar(&c.QuarantineIndex)
+	kingpin.Flag("add-sequence", "Add a monotonically increasing nozzle_sequence field to break ties between events with the same timestamp").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_SEQUENCE").Default("false").BoolVar(&c.AddSequence)
+	kingpin.Flag("add-schema-version", "Add a nozzle_schema_version field with the version of the layout of events, so consumers can detect format changes").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_SCHEMA_VERSION").Default("false").BoolVar(&c.AddSchemaVersion)
+	kingpin.Flag("add-subscription-id", "Add a subscription-id field with the firehose subscription ID, to separate the events of nozzles with different subscriptions").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_SUBSCRIPTION_ID").Default("false").BoolVar(&c.AddSubscriptionID)
+	kingpin.Flag("app-key", "Add an app_key field with a salted hash of the app GUID to the events of apps, to group them without the GUID: off, add alongside cf_app_id, or replace cf_app_id").
+		OverrideDefaultFromEnvar(envPrefix+"APP_KEY").Default(eventsink.AppKeyOff).EnumVar(&c.AppKey, eventsink.AppKeyOff, eventsink.AppKeyAdd, eventsink.AppKeyReplace)
+	kingpin.Flag("app-key-salt", "Secret salt of the app_key hash, required with --app-key").
+		OverrideDefaultFromEnvar(envPrefix + "APP_KEY_SALT").Default("").StringVar(&c.AppKeySalt)
+	kingpin.Flag("add-route-field", "Add a _route field with the destination index of events, the rule which selected it and the filters the events passed. For debugging").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_ROUTE_FIELD").Default("false").BoolVar(&c.AddRouteField)
 
 	kingpin.Flag("boltdb-path", "Bolt Database path ").
-		Default("cache.db").OverrideDefaultFromEnvar("BOLTDB_PATH").StringVar(&c.BoltDBPath)
+		Default("cache.db").OverrideDefaultFromEnvar(envPrefix + "BOLTDB_PATH").StringVar(&c.BoltDBPath)
+	kingpin.Flag("boltdb-write-interval", "Buffer app metadata upserts in memory and write them to the Bolt database in a single transaction at this interval. Writes through when 0s").
+		OverrideDefaultFromEnvar(envPrefix + "BOLTDB_WRITE_INTERVAL").Default("0s").DurationVar(&c.CacheWriteInterval)
+	kingpin.Flag("cache-snapshot-path", "Path of a JSON snapshot of the app metadata cache, imported on startup when the Bolt database is empty").
+		OverrideDefaultFromEnvar(envPrefix + "CACHE_SNAPSHOT_PATH").Default("").StringVar(&c.CacheSnapshotPath)
+	kingpin.Flag("cache-snapshot-interval", "How often the app metadata cache snapshot is written, in addition to on shutdown. Only written on shutdown when 0s").
+		OverrideDefaultFromEnvar(envPrefix + "CACHE_SNAPSHOT_INTERVAL").Default("5m").DurationVar(&c.SnapshotInterval)
 	kingpin.Flag("events", fmt.Sprintf("Comma separated list of events you would like. Valid options are %s", events.AuthorizedEvents())).
-		OverrideDefaultFromEnvar("EVENTS").Default("ValueMetric,CounterEvent,ContainerMetric").StringVar(&c.WantedEvents)
+		OverrideDefaultFromEnvar(envPrefix + "EVENTS").Default("ValueMetric,CounterEvent,ContainerMetric").StringVar(&c.WantedEvents)
 	kingpin.Flag("extra-fields", "Extra fields you want to annotate your events with, example: '--extra-fields=env:dev,something:other ").
-		OverrideDefaultFromEnvar("EXTRA_FIELDS").Default("").StringVar(&c.ExtraFields)
+		OverrideDefaultFromEnvar(envPrefix + "EXTRA_FIELDS").Default("").StringVar(&c.ExtraFields)
+	kingpin.Flag("index-extra-fields", "Extra fields only added to events sent to an index, as a JSON object, example: '{\"app_index\": {\"team\": \"payments\"}}'").
+		OverrideDefaultFromEnvar(envPrefix + "INDEX_EXTRA_FIELDS").Default("").StringVar(&c.IndexExtraFields)
+	kingpin.Flag("max-extra-field-bytes", "Maximum size of the value of an extra field, since extra fields are added to every event. 0 disables the limit").
+		OverrideDefaultFromEnvar(envPrefix + "MAX_EXTRA_FIELD_BYTES").Default("0").IntVar(&c.MaxExtraFieldBytes)
+	kingpin.Flag("add-k8s-metadata", "Add the pod name, namespace and node of the nozzle from the POD_NAME, POD_NAMESPACE and NODE_NAME environment variables to every event").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_K8S_METADATA").Default("false").BoolVar(&c.AddK8sMetadata)
+	kingpin.Flag("message-type-indexes", "JSON object of LogMessage message type, OUT or ERR, to the index its log lines are sent to").
+		OverrideDefaultFromEnvar(envPrefix + "MESSAGE_TYPE_INDEXES").Default("").StringVar(&c.MessageTypeIndexes)
+	kingpin.Flag("index-mappings", "JSON array of rules routing the events of apps to an index, the first matching rule wins, example: '[{\"by\": \"app_name_regex\", \"match\": \"^prod-\", \"index\": \"prod_logs\"}]'").
+		OverrideDefaultFromEnvar(envPrefix + "INDEX_MAPPINGS").Default("").StringVar(&c.IndexMappings)
+	kingpin.Flag("event-mapping-file", "Path of a JSON file of the event types to send, replacing --events, to their index and sourcetype, example: '{\"LogMessage\": {\"index\": \"cf_logs\", \"sourcetype\": \"cf:app\"}}'").
+		OverrideDefaultFromEnvar(envPrefix + "EVENT_MAPPING_FILE").Default("").StringVar(&c.EventMappingFile)
+	kingpin.Flag("index-batching", "Flush interval, batch size, retries and dead lettering of the events sent to an index, as a JSON object, example: '{\"alerts\": {\"flush_interval\": \"1s\", \"batch_size\": 10, \"retries\": 20, \"dead_letter\": true}}'").
+		OverrideDefaultFromEnvar(envPrefix + "INDEX_BATCHING").Default("").StringVar(&c.IndexBatching)
+	kingpin.Flag("hec-split-by-index", "Send the events of each destination index in their own HEC requests, instead of setting the index per event of a request").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_SPLIT_BY_INDEX").Default("false").BoolVar(&c.SplitByIndex)
+	kingpin.Flag("dead-letter-file", "File the events of the index-batching indexes with dead_letter are appended to, one JSON event per line, when dropped after the last retry").
+		OverrideDefaultFromEnvar(envPrefix + "DEAD_LETTER_FILE").Default("").StringVar(&c.DeadLetterFile)
+	kingpin.Flag("dead-letter-max-bytes", "Size of the dead-letter-file in bytes past which it is rotated, 0 never rotates it").
+		OverrideDefaultFromEnvar(envPrefix + "DEAD_LETTER_MAX_BYTES").Default("0").Int64Var(&c.DeadLetterMaxBytes)
+	kingpin.Flag("dead-letter-max-files", "Rotated dead-letter-files kept, the oldest is removed beyond it, 0 empties the file instead of rotating it").
+		OverrideDefaultFromEnvar(envPrefix + "DEAD_LETTER_MAX_FILES").Default("5").IntVar(&c.DeadLetterMaxFiles)
+	kingpin.Flag("dead-letter-max-age", "Remove the dead-letter-files whose newest event is older, 0 keeps them").
+		OverrideDefaultFromEnvar(envPrefix + "DEAD_LETTER_MAX_AGE").Default("0s").DurationVar(&c.DeadLetterMaxAge)
+	kingpin.Flag("dead-letter-per-index", "Append the dropped events of each destination index to their own dead-letter-file, named dead-letter-file.<index>").
+		OverrideDefaultFromEnvar(envPrefix + "DEAD_LETTER_PER_INDEX").Default("false").BoolVar(&c.DeadLetterPerIndex)
+	kingpin.Flag("class-queues", "JSON object of event class (errors, logs or metrics) to the size and drop policy of a separate queue, example: '{\"metrics\": {\"queue_size\": 5000, \"drop\": \"oldest\"}}'").
+		OverrideDefaultFromEnvar(envPrefix + "CLASS_QUEUES").Default("").StringVar(&c.ClassQueues)
+	kingpin.Flag("check-indexes", "Send a probe event to each mapped index at startup and report the indexes which reject it").
+		OverrideDefaultFromEnvar(envPrefix + "CHECK_INDEXES").Default("false").BoolVar(&c.CheckIndexes)
+	kingpin.Flag("log-field-extractors", "JSON array of regular expressions whose named capture groups are extracted from log messages as event fields, example: '[\"trace_id=(?P<trace_id>\\\\w+)\"]'").
+		OverrideDefaultFromEnvar(envPrefix + "LOG_FIELD_EXTRACTORS").Default("").StringVar(&c.LogFieldExtractors)
+	kingpin.Flag("parse-json-logs", "Merge the keys of LogMessage bodies which are JSON objects into the event fields").
+		OverrideDefaultFromEnvar(envPrefix + "PARSE_JSON_LOGS").Default("false").BoolVar(&c.ParseJsonLogs)
+	kingpin.Flag("json-log-field-prefix", "Prefix of the fields merged from JSON log messages").
+		OverrideDefaultFromEnvar(envPrefix + "JSON_LOG_FIELD_PREFIX").Default("").StringVar(&c.JsonLogFieldPrefix)
+	kingpin.Flag("json-log-field-collision", "Whether the fields merged from JSON log messages are dropped (keep), overwrite the fields which are already set but those the nozzle relies on (overwrite), or are renamed with a json_ prefix (prefix)").
+		OverrideDefaultFromEnvar(envPrefix+"JSON_LOG_FIELD_COLLISION").Default(events.JsonLogCollisionKeep).EnumVar(&c.JsonLogFieldCollision,
+		events.JsonLogCollisionKeep, events.JsonLogCollisionOverwrite, events.JsonLogCollisionPrefix)
+	kingpin.Flag("json-log-max-bytes", "JSON log messages larger than this are not merged. 0 is unlimited").
+		OverrideDefaultFromEnvar(envPrefix + "JSON_LOG_MAX_BYTES").Default("65536").IntVar(&c.JsonLogMaxBytes)
+	kingpin.Flag("json-log-max-depth", "JSON log messages nested deeper than this are not merged. 0 is unlimited").
+		OverrideDefaultFromEnvar(envPrefix + "JSON_LOG_MAX_DEPTH").Default("10").IntVar(&c.JsonLogMaxDepth)
+	kingpin.Flag("log-timestamp-format", "Go time layout of timestamps prefixing log messages, which are stripped, example: '2006-01-02T15:04:05.000Z07:00'. Disabled when empty").
+		OverrideDefaultFromEnvar(envPrefix + "LOG_TIMESTAMP_FORMAT").Default("").StringVar(&c.LogTimestampFormat)
+	kingpin.Flag("log-timestamp-as-time", "Use the timestamp stripped from log messages as the event time instead of the envelope time").
+		OverrideDefaultFromEnvar(envPrefix + "LOG_TIMESTAMP_AS_TIME").Default("false").BoolVar(&c.LogTimestampAsTime)
+	kingpin.Flag("base64-binary-logs", "Send log messages which aren't valid UTF-8 base64 encoded in a msg_base64 field instead of replacing their invalid bytes").
+		OverrideDefaultFromEnvar(envPrefix + "BASE64_BINARY_LOGS").Default("false").BoolVar(&c.Base64BinaryLogs)
+	kingpin.Flag("log-max-chars", "Maximum number of characters of a log message, longer messages are handled by --log-overflow. 0 disables the limit").
+		OverrideDefaultFromEnvar(envPrefix + "LOG_MAX_CHARS").Default("0").IntVar(&c.LogMaxChars)
+	kingpin.Flag("log-max-lines", "Maximum number of lines of a log message, longer messages are handled by --log-overflow. 0 disables the limit").
+		OverrideDefaultFromEnvar(envPrefix + "LOG_MAX_LINES").Default("0").IntVar(&c.LogMaxLines)
+	kingpin.Flag("log-overflow", "What happens to the log messages over --log-max-chars or --log-max-lines: truncate, drop or split").
+		OverrideDefaultFromEnvar(envPrefix+"LOG_OVERFLOW").Default(eventsink.LogOverflowTruncate).EnumVar(&c.LogOverflow, eventsink.LogOverflowTruncate, eventsink.LogOverflowDrop, eventsink.LogOverflowSplit)
+	kingpin.Flag("event-filter", "Expression over event fields, only events for which it is true are sent, example: 'event_type != \"LogMessage\" || cf_org_name != \"sandbox\"'").
+		OverrideDefaultFromEnvar(envPrefix + "EVENT_FILTER").Default("").StringVar(&c.EventFilter)
+	kingpin.Flag("priority-rules", "JSON array of rules setting the priority field of matching events, the first matching rule wins, example: '[{\"event_type\": \"Error\", \"priority\": \"high\"}]'").
+		OverrideDefaultFromEnvar(envPrefix + "PRIORITY_RULES").Default("").StringVar(&c.PriorityRules)
+	kingpin.Flag("priority-field", "Name of the field set by the priority rules").
+		OverrideDefaultFromEnvar(envPrefix + "PRIORITY_FIELD").Default("priority").StringVar(&c.PriorityField)
+	kingpin.Flag("http-sample-rates", "Keep 1 of every N HttpStartStop events per status class, example: '--http-sample-rates=2xx:10,3xx:10'").
+		OverrideDefaultFromEnvar(envPrefix + "HTTP_SAMPLE_RATES").Default("").StringVar(&c.HttpSampleRates)
+	kingpin.Flag("sample-ratios", "Keep a ratio of the events per event type, consistently per app, example: '--sample-ratios=ContainerMetric=0.1,ValueMetric=0.25'").
+		OverrideDefaultFromEnvar(envPrefix + "SAMPLE_RATIOS").Default("").StringVar(&c.SampleRatios)
+	kingpin.Flag("container-metric-max-sample-rate", "Sample ContainerMetric events of app instances with stable usage down to 1 of every N events. 0 disables the sampling").
+		OverrideDefaultFromEnvar(envPrefix + "CONTAINER_METRIC_MAX_SAMPLE_RATE").Default("0").Uint64Var(&c.ContainerMetricMaxSampleRate)
+	kingpin.Flag("container-metric-cpu-delta", "Change of CPU usage, in percentage points, which resets the sampling of an app instance").
+		OverrideDefaultFromEnvar(envPrefix + "CONTAINER_METRIC_CPU_DELTA").Default("5").Float64Var(&c.ContainerMetricCpuDelta)
+	kingpin.Flag("container-metric-memory-delta", "Change of memory usage, in percent, which resets the sampling of an app instance").
+		OverrideDefaultFromEnvar(envPrefix + "CONTAINER_METRIC_MEMORY_DELTA").Default("10").Float64Var(&c.ContainerMetricMemoryDelta)
+	kingpin.Flag("suppress-inactive-container-metrics", "Drop ContainerMetric events of apps known to be stopped and of instance indexes beyond the instances of the app").
+		OverrideDefaultFromEnvar(envPrefix + "SUPPRESS_INACTIVE_CONTAINER_METRICS").Default("false").BoolVar(&c.SuppressInactiveContainerMetrics)
+	kingpin.Flag("app-state-max-age", "Maximum age of the cached app state and instances trusted to suppress ContainerMetric events").
+		OverrideDefaultFromEnvar(envPrefix + "APP_STATE_MAX_AGE").Default("5m").DurationVar(&c.AppStateMaxAge)
+	kingpin.Flag("container-multi-metric", "Send ContainerMetric events as multiple-metric HEC events to splunk-metric-index").
+		OverrideDefaultFromEnvar(envPrefix + "CONTAINER_MULTI_METRIC").Default("false").BoolVar(&c.ContainerMultiMetric)
 
 	kingpin.Flag("flush-interval", "Every interval flushes to Splunk Http Event Collector server").
-		OverrideDefaultFromEnvar("FLUSH_INTERVAL").Default("5s").DurationVar(&c.FlushInterval)
+		OverrideDefaultFromEnvar(envPrefix + "FLUSH_INTERVAL").Default("5s").DurationVar(&c.FlushInterval)
 	kingpin.Flag("consumer-queue-size", "Consumer queue buffer size").
-		OverrideDefaultFromEnvar("CONSUMER_QUEUE_SIZE").Default("10000").IntVar(&c.QueueSize)
+		OverrideDefaultFromEnvar(envPrefix + "CONSUMER_QUEUE_SIZE").Default("10000").IntVar(&c.QueueSize)
+	kingpin.Flag("max-queue-age", "Maximum time an event waits in the consumer queue before it is dropped instead of sent. 0 disables").
+		OverrideDefaultFromEnvar(envPrefix + "MAX_QUEUE_AGE").Default("0s").DurationVar(&c.MaxQueueAge)
 	kingpin.Flag("hec-batch-size", "Batchsize of the events pushing to HEC").
-		OverrideDefaultFromEnvar("HEC_BATCH_SIZE").Default("100").IntVar(&c.BatchSize)
+		OverrideDefaultFromEnvar(envPrefix + "HEC_BATCH_SIZE").Default("100").IntVar(&c.BatchSize)
 	kingpin.Flag("hec-retries", "Number of retries before dropping events").
-		OverrideDefaultFromEnvar("HEC_RETRIES").Default("5").IntVar(&c.Retries)
+		OverrideDefaultFromEnvar(envPrefix + "HEC_RETRIES").Default("5").IntVar(&c.Retries)
+	kingpin.Flag("retry-budget", "Maximum number of HEC retries per second of all workers, so they don't pile on a flapping HEC. 0 disables the budget").
+		OverrideDefaultFromEnvar(envPrefix + "RETRY_BUDGET").Default("0").IntVar(&c.RetryBudget)
+	kingpin.Flag("retry-budget-policy", "What happens to the batches retried over the retry-budget: defer waits for the budget, drop drops them").
+		OverrideDefaultFromEnvar(envPrefix+"RETRY_BUDGET_POLICY").Default(eventsink.RetryBudgetDefer).EnumVar(&c.RetryBudgetPolicy, eventsink.RetryBudgetDefer, eventsink.RetryBudgetDrop)
+	kingpin.Flag("hec-skip-invalid-events", "Skip the events HEC rejects as invalid and send the rest of their batch again, instead of retrying the whole batch").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_SKIP_INVALID_EVENTS").Default("false").BoolVar(&c.SkipInvalidEvents)
+	kingpin.Flag("hec-decode-gzip-responses", "Decompress the gzip-compressed HEC responses the HTTP client doesn't, sent by some gateways in front of HEC, to read their error and ack bodies").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_DECODE_GZIP_RESPONSES").Default("true").BoolVar(&c.DecodeGzip)
 	kingpin.Flag("hec-workers", "How many workers (concurrency) when post data to HEC").
-		OverrideDefaultFromEnvar("HEC_WORKERS").Default("8").IntVar(&c.HecWorkers)
+		OverrideDefaultFromEnvar(envPrefix + "HEC_WORKERS").Default("8").IntVar(&c.HecWorkers)
+	kingpin.Flag("min-hec-workers", "With max-hec-workers, minimum number of HEC workers kept running when idle").
+		OverrideDefaultFromEnvar(envPrefix + "MIN_HEC_WORKERS").Default("1").IntVar(&c.MinHecWorkers)
+	kingpin.Flag("max-hec-workers", "Scale the HEC workers between min-hec-workers and this number on the load instead of running hec-workers. 0 disables the scaling").
+		OverrideDefaultFromEnvar(envPrefix + "MAX_HEC_WORKERS").Default("0").IntVar(&c.MaxHecWorkers)
+	kingpin.Flag("hec-scale-interval", "How often the number of HEC workers is adjusted").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_SCALE_INTERVAL").Default("10s").DurationVar(&c.HecScaleInterval)
+	kingpin.Flag("hec-scale-latency", "Also start a HEC worker when events are queued and HEC requests take longer than this on average. 0 only scales on the queue depth").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_SCALE_LATENCY").Default("0s").DurationVar(&c.HecScaleLatency)
+	kingpin.Flag("memory-aware-sizing", "Cap the consumer queue size and the HEC batch size to the container memory limit").
+		OverrideDefaultFromEnvar(envPrefix + "MEMORY_AWARE_SIZING").Default("true").BoolVar(&c.MemoryAwareSizing)
+	kingpin.Flag("compact-container-metrics", "Sample ContainerMetric by keeping only the latest event per app instance in each batch").
+		OverrideDefaultFromEnvar(envPrefix + "COMPACT_CONTAINER_METRICS").Default("false").BoolVar(&c.CompactContainerMetrics)
+	kingpin.Flag("counter-reset-limit", "Mark CounterEvent events whose total decreased with counter_reset and drop their delta, tracking up to N counters. 0 disables the detection").
+		OverrideDefaultFromEnvar(envPrefix + "COUNTER_RESET_LIMIT").Default("0").IntVar(&c.CounterResetLimit)
+	kingpin.Flag("add-ingest-time", "Add a nozzle_ingest_time field with the time the nozzle received events").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_INGEST_TIME").Default("false").BoolVar(&c.AddIngestTime)
+	kingpin.Flag("add-delivery-time", "Add a nozzle_delivery_time field with the time the nozzle sent events to HEC").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_DELIVERY_TIME").Default("false").BoolVar(&c.AddDeliveryTime)
+	kingpin.Flag("reorder-window", "Hold events for this duration and send them in timestamp order. 0 disables the reordering").
+		OverrideDefaultFromEnvar(envPrefix + "REORDER_WINDOW").Default("0s").DurationVar(&c.ReorderWindow)
+	kingpin.Flag("reorder-buffer-size", "Maximum number of events held by the reorder-window, all held events are sent early when reached").
+		OverrideDefaultFromEnvar(envPrefix + "REORDER_BUFFER_SIZE").Default("10000").IntVar(&c.ReorderBufferSize)
+	kingpin.Flag("dedup-window", "Drop the events identical to an event received within this duration, such as the ones redelivered after a reconnect. 0 disables the deduplication").
+		OverrideDefaultFromEnvar(envPrefix + "DEDUP_WINDOW").Default("0s").DurationVar(&c.DedupWindow)
+	kingpin.Flag("dedup-max-entries", "Maximum number of events remembered by the dedup-window, the least recently seen are forgotten first").
+		OverrideDefaultFromEnvar(envPrefix + "DEDUP_MAX_ENTRIES").Default("100000").IntVar(&c.DedupMaxEntries)
+	kingpin.Flag("sync-send", "Block the firehose consumer until each batch is delivered to HEC instead of queueing events").
+		OverrideDefaultFromEnvar(envPrefix + "SYNC_SEND").Default("false").BoolVar(&c.SyncSend)
+	kingpin.Flag("max-buffer-bytes", "Maximum bytes of request bodies buffered by all HEC workers. Workers wait when the limit is reached. 0 is unlimited").
+		OverrideDefaultFromEnvar(envPrefix + "MAX_BUFFER_BYTES").Default("0").Int64Var(&c.MaxBufferBytes)
+	kingpin.Flag("hec-warm-up", "Establish the connections of all HEC workers at startup before reading from the firehose").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_WARM_UP").Default("false").BoolVar(&c.HecWarmUp)
+	kingpin.Flag("hec-path", "Path of the HEC collector, for gateways exposing HEC at a non-standard path. The health endpoint is its /health subpath").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_PATH").Default(eventwriter.DefaultHECPath).StringVar(&c.HecPath)
+	kingpin.Flag("hec-failover-hosts", "Comma separated list of HEC hosts to fail over to, in order of preference, when splunk-host is unreachable").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_FAILOVER_HOSTS").Default("").StringVar(&c.HecFailoverHosts)
+	kingpin.Flag("hec-failover-threshold", "Number of consecutive failed requests before failing over to the next HEC host").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_FAILOVER_THRESHOLD").Default("3").IntVar(&c.HecFailoverThreshold)
+	kingpin.Flag("hec-failback-interval", "How often to retry the primary HEC host after failing over").
+		OverrideDefaultFromEnvar(envPrefix + "HEC_FAILBACK_INTERVAL").Default("1m").DurationVar(&c.HecFailbackInterval)
+
+	kingpin.Flag("graphite-host", "Carbon plaintext endpoint (host:port) ValueMetric and CounterEvent are also sent to. Disabled when empty").
+		OverrideDefaultFromEnvar(envPrefix + "GRAPHITE_HOST").Default("").StringVar(&c.GraphiteHost)
+	kingpin.Flag("graphite-prefix", "Prefix of the Graphite metric names").
+		OverrideDefaultFromEnvar(envPrefix + "GRAPHITE_PREFIX").Default("cf").StringVar(&c.GraphitePrefix)
+	kingpin.Flag("alert-webhook-url", "Webhook URL Error events are also posted to, for example a Slack or PagerDuty webhook. Disabled when empty").
+		OverrideDefaultFromEnvar(envPrefix + "ALERT_WEBHOOK_URL").Default("").StringVar(&c.AlertWebhookURL)
+	kingpin.Flag("alert-webhook-template", "Go template of the JSON body posted to the alert webhook, rendered with the event fields").
+		OverrideDefaultFromEnvar(envPrefix + "ALERT_WEBHOOK_TEMPLATE").Default("").StringVar(&c.AlertWebhookTemplate)
+	kingpin.Flag("alert-webhook-priorities", "Comma separated list of priorities, set by priority-rules, of events also posted to the alert webhook").
+		OverrideDefaultFromEnvar(envPrefix + "ALERT_WEBHOOK_PRIORITIES").Default("").StringVar(&c.AlertWebhookPriorities)
 
 	kingpin.Flag("enable-event-tracing", "Enable event trace logging: Adds splunk trace logging fields to events. uuid, subscription-id, nozzle event counter").
-		OverrideDefaultFromEnvar("ENABLE_EVENT_TRACING").Default("false").BoolVar(&c.TraceLogging)
+		OverrideDefaultFromEnvar(envPrefix + "ENABLE_EVENT_TRACING").Default("false").BoolVar(&c.TraceLogging)
+	kingpin.Flag("trace-app-guids", "Comma separated list of app GUIDs, with event tracing only the events of these apps get the trace logging fields").
+		OverrideDefaultFromEnvar(envPrefix + "TRACE_APP_GUIDS").Default("").StringVar(&c.TraceAppGUIDs)
+	kingpin.Flag("delivery-receipt-limit", "With event tracing, log a debug receipt of every delivered batch, at most this many per second. 0 disables").
+		OverrideDefaultFromEnvar(envPrefix + "DELIVERY_RECEIPT_LIMIT").Default("0").IntVar(&c.DeliveryReceiptLimit)
+	kingpin.Flag("add-hec-channel-field", "Send the events of each HEC worker on its own channel and add the channel GUID in a _hec_channel field. For debugging").
+		OverrideDefaultFromEnvar(envPrefix + "ADD_HEC_CHANNEL_FIELD").Default("false").BoolVar(&c.AddChannelField)
 	kingpin.Flag("debug", "Enable debug mode: forward to standard out instead of splunk").
-		OverrideDefaultFromEnvar("DEBUG").Default("false").BoolVar(&c.Debug)
+		OverrideDefaultFromEnvar(envPrefix + "DEBUG").Default("false").BoolVar(&c.Debug)
 	kingpin.Flag("status-monitor-interval", "Print information for monitoring at every interval").
-		OverrideDefaultFromEnvar("STATUS_MONITOR_INTERVAL").Default("0s").DurationVar(&c.StatusMonitorInterval)
+		OverrideDefaultFromEnvar(envPrefix + "STATUS_MONITOR_INTERVAL").Default("0s").DurationVar(&c.StatusMonitorInterval)
 	kingpin.Flag("drop-warn-threshold", "Log error with dropped events count at each threshold count due to slow downstream").
-		OverrideDefaultFromEnvar("DROP_WARN_THRESHOLD").Default("1000").IntVar(&c.DropWarnThreshold)
+		OverrideDefaultFromEnvar(envPrefix + "DROP_WARN_THRESHOLD").Default("1000").IntVar(&c.DropWarnThreshold)
+	kingpin.Flag("lifecycle-events", "Send an event to Splunk when the nozzle has started and when it stops gracefully").
+		OverrideDefaultFromEnvar(envPrefix + "LIFECYCLE_EVENTS").Default("false").BoolVar(&c.LifecycleEvents)
+	kingpin.Flag("metrics-sample-interval", "How often the queue depth is sampled for the queue depth histogram of the monitoring metrics").
+		OverrideDefaultFromEnvar(envPrefix + "METRICS_SAMPLE_INTERVAL").Default("1s").DurationVar(&c.MetricsSampleInterval)
+	kingpin.Flag("monitoring-metrics", "Comma separated list of the names of the monitoring metrics sent to the metric index, * matches any characters. All metrics when empty").
+		OverrideDefaultFromEnvar(envPrefix + "MONITORING_METRICS").Default("").StringVar(&c.MonitoringMetrics)
+	kingpin.Flag("monitoring-suspend-at", "Don't send the monitoring metrics after this many consecutive failed event HEC requests, until a request succeeds again. 0 disables").
+		OverrideDefaultFromEnvar(envPrefix + "MONITORING_SUSPEND_AT").Default("0").IntVar(&c.MonitoringSuspendAt)
+	kingpin.Flag("org-space-metrics-limit", "Count events per org and space for up to N orgs and N spaces in the monitoring metrics, others are counted as other. 0 disables the counts").
+		OverrideDefaultFromEnvar(envPrefix + "ORG_SPACE_METRICS_LIMIT").Default("0").IntVar(&c.OrgSpaceMetricsLimit)
+	kingpin.Flag("index-metrics-limit", "Count the events and bytes sent per destination index for up to N indexes in the monitoring metrics, others are counted as other. 0 disables the counts").
+		OverrideDefaultFromEnvar(envPrefix + "INDEX_METRICS_LIMIT").Default("0").IntVar(&c.IndexMetricsLimit)
+	kingpin.Flag("worker-metrics", "Count the requests, events, errors and latency of each HEC worker in the monitoring metrics").
+		OverrideDefaultFromEnvar(envPrefix + "WORKER_METRICS").Default("false").BoolVar(&c.WorkerMetrics)
+	kingpin.Flag("lookup-failure-interval", "Send at most one diagnostic event per interval when app metadata lookups fail. 0s disables the events").
+		OverrideDefaultFromEnvar(envPrefix + "LOOKUP_FAILURE_INTERVAL").Default("1m").DurationVar(&c.LookupFailureInterval)
+	kingpin.Flag("summary-interval", "Send a summary event of events sent, bytes, retries and drops at every interval").
+		OverrideDefaultFromEnvar(envPrefix + "SUMMARY_INTERVAL").Default("0s").DurationVar(&c.SummaryInterval)
+	kingpin.Flag("summary-index", "Splunk index for the summary events").
+		OverrideDefaultFromEnvar(envPrefix + "SUMMARY_INDEX").Default("").StringVar(&c.SummaryIndex)
+	kingpin.Flag("drop-summary-interval", "Send an event per reason and event type of the events dropped at every interval").
+		OverrideDefaultFromEnvar(envPrefix + "DROP_SUMMARY_INTERVAL").Default("0s").DurationVar(&c.DropSummaryInterval)
+	kingpin.Flag("drop-summary-index", "Splunk index for the drop summary events").
+		OverrideDefaultFromEnvar(envPrefix + "DROP_SUMMARY_INDEX").Default("").StringVar(&c.DropSummaryIndex)
+	kingpin.Flag("sampling-audit-interval", "Send an event per sampler and event type with the events kept and dropped and the effective sample rate at every interval").
+		OverrideDefaultFromEnvar(envPrefix + "SAMPLING_AUDIT_INTERVAL").Default("0s").DurationVar(&c.SamplingAuditInterval)
+	kingpin.Flag("sampling-audit-index", "Splunk index for the sampling audit events").
+		OverrideDefaultFromEnvar(envPrefix + "SAMPLING_AUDIT_INDEX").Default("").StringVar(&c.SamplingAuditIndex)
 
 	kingpin.Parse()
 	c.ApiEndpoint = strings.TrimSpace(c.ApiEndpoint)
@@ -154,3 +585,11 @@ func (c *Config) ToMap() map[string]interface{} {
 	json.Unmarshal(data, &r)
 	return r
 }
+
+// Hash returns a short hash of the configuration without its secrets, to tell which
+// nozzle instances run with the same configuration
+func (c *Config) Hash() string {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
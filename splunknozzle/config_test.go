@@ -112,6 +112,27 @@ var _ = Describe("Config", func() {
 			Expect(c.DropWarnThreshold).To(Equal(100))
 		})
 
+		It("reads the environment variables with the prefix", func() {
+			os.Clearenv()
+			os.Setenv("ENV_PREFIX", "NOZZLE_")
+			os.Setenv("NOZZLE_API_ENDPOINT", "api.prefixed.com")
+			os.Setenv("NOZZLE_CLIENT_ID", "client123")
+			os.Setenv("NOZZLE_CLIENT_SECRET", "secret123")
+			os.Setenv("NOZZLE_SPLUNK_TOKEN", "prefixedtoken")
+			os.Setenv("NOZZLE_SPLUNK_HOST", "splunk.prefixed.com")
+			os.Setenv("NOZZLE_SPLUNK_INDEX", "prefixed_index")
+			os.Setenv("NOZZLE_HEC_WORKERS", "3")
+			os.Setenv("HEC_WORKERS", "5")
+
+			c := NewConfigFromCmdFlags(version, branch, commit, buildos)
+
+			Expect(c.ApiEndpoint).To(Equal("api.prefixed.com"))
+			Expect(c.SplunkToken).To(Equal("prefixedtoken"))
+			Expect(c.SplunkHost).To(Equal("splunk.prefixed.com"))
+			Expect(c.SplunkIndex).To(Equal("prefixed_index"))
+			Expect(c.HecWorkers).To(Equal(3))
+		})
+
 		It("check defaults", func() {
 			c := NewConfigFromCmdFlags(version, branch, commit, buildos)
 
@@ -0,0 +1,38 @@
+package splunknozzle
+
+import (
+	"errors"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+)
+
+// Exit codes of the nozzle, so orchestrators can tell how it stopped
+const (
+	ExitClean           = 0 // all events were sent to Splunk
+	ExitError           = 1 // any other error, such as an invalid configuration
+	ExitEventsAbandoned = 2 // events were abandoned while draining
+	ExitFirehoseFailed  = 3 // the firehose consumer failed
+	ExitStartupDeadline = 4 // the nozzle wasn't started within STARTUP_DEADLINE
+)
+
+// ErrFirehoseFailed is returned by Run when the nozzle stops on a firehose consumer error
+var ErrFirehoseFailed = errors.New("firehose consumer failed")
+
+// ErrStartupDeadline is returned by Run when the nozzle isn't started within STARTUP_DEADLINE
+var ErrStartupDeadline = errors.New("startup deadline exceeded")
+
+// ExitCode returns the exit code of the nozzle for the error returned by Run
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitClean
+	case errors.Is(err, ErrFirehoseFailed):
+		return ExitFirehoseFailed
+	case errors.Is(err, eventsink.ErrEventsAbandoned):
+		return ExitEventsAbandoned
+	case errors.Is(err, ErrStartupDeadline):
+		return ExitStartupDeadline
+	default:
+		return ExitError
+	}
+}
@@ -0,0 +1,110 @@
+package splunknozzle
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/cache"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/events"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+)
+
+// MappedIndexes returns the indexes the nozzle is configured to send events to: the
+// default, metric, logging, summary, sampling audit and quarantine indexes, the indexes of INDEX_EXTRA_FIELDS,
+// INDEX_BATCHING, MESSAGE_TYPE_INDEXES and EVENT_MAPPING_FILE, and the SPLUNK_INDEX of
+// the cached apps
+func (s *SplunkFirehoseNozzle) MappedIndexes(appCache cache.Cache) []string {
+	seen := make(map[string]bool)
+	add := func(index string) {
+		if index != "" {
+			seen[index] = true
+		}
+	}
+
+	add(s.config.SplunkIndex)
+	add(s.config.SplunkMetricIndex)
+	add(s.config.SplunkLoggingIndex)
+	add(s.config.SummaryIndex)
+	add(s.config.DropSummaryIndex)
+	add(s.config.SamplingAuditIndex)
+	add(s.config.QuarantineIndex)
+
+	indexExtraFields, _ := events.ParseIndexExtraFields(s.config.IndexExtraFields)
+	for index := range indexExtraFields {
+		add(index)
+	}
+	indexBatching, _ := eventsink.ParseIndexBatchConfigs(s.config.IndexBatching)
+	for index := range indexBatching {
+		add(index)
+	}
+	messageTypeIndexes, _ := events.ParseMessageTypeIndexes(s.config.MessageTypeIndexes)
+	for _, index := range messageTypeIndexes {
+		add(index)
+	}
+	indexMappings, _ := events.ParseIndexMappings(s.config.IndexMappings)
+	for _, mapping := range indexMappings {
+		add(mapping.Index)
+	}
+	eventMappings, _ := events.ReadEventMappings(s.config.EventMappingFile)
+	for _, mapping := range eventMappings {
+		add(mapping.Index)
+	}
+
+	apps, err := appCache.GetAllApps()
+	if err != nil {
+		s.logger.Error("Failed to list the apps for the index check", err)
+	}
+	for _, app := range apps {
+		if index, ok := app.CfAppEnv["SPLUNK_INDEX"].(string); ok {
+			add(index)
+		}
+	}
+
+	indexes := make([]string, 0, len(seen))
+	for index := range seen {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+	return indexes
+}
+
+// CheckIndexes sends a probe event to each index and returns the errors of the
+// indexes which rejected it, for example because they don't exist or the HEC token
+// isn't allowed to write to them
+func (s *SplunkFirehoseNozzle) CheckIndexes(newWriter WriterFactory, indexes []string) map[string]error {
+	rejected := make(map[string]error)
+	for _, index := range indexes {
+		probe := map[string]interface{}{
+			"time":       strconv.FormatInt(time.Now().Unix(), 10),
+			"host":       s.config.JobHost,
+			"source":     "splunk-firehose-nozzle",
+			"sourcetype": "cf:splunknozzle:probe",
+			"index":      index,
+			"event":      map[string]interface{}{"message": "index check at startup"},
+		}
+		if err, _ := newWriter(index).Write([]map[string]interface{}{probe}); err != nil {
+			rejected[index] = err
+		}
+	}
+	return rejected
+}
+
+// checkIndexes logs the result of CheckIndexes for the mapped indexes
+func (s *SplunkFirehoseNozzle) checkIndexes(appCache cache.Cache, newWriter WriterFactory) {
+	indexes := s.MappedIndexes(appCache)
+	rejected := s.CheckIndexes(newWriter, indexes)
+	if len(rejected) == 0 {
+		s.logger.Info("Index check passed", lager.Data{"indexes": indexes})
+		return
+	}
+
+	errs := make(map[string]string, len(rejected))
+	for index, err := range rejected {
+		errs[index] = err.Error()
+	}
+	s.logger.Error("Index check failed", fmt.Errorf("%d of %d indexes rejected the probe event", len(rejected), len(indexes)),
+		lager.Data{"indexes": indexes, "rejected": errs})
+}
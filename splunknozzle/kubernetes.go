@@ -0,0 +1,26 @@
+package splunknozzle
+
+import (
+	"os"
+)
+
+// kubernetesEnv maps the environment variables usually set from the Kubernetes
+// downward API in the pod spec to the fields they are added to events as
+var kubernetesEnv = map[string]string{
+	"POD_NAME":      "k8s_pod_name",
+	"POD_NAMESPACE": "k8s_namespace",
+	"NODE_NAME":     "k8s_node_name",
+}
+
+// AddKubernetesFields adds the pod name, namespace and node of the nozzle, read from
+// the downward API environment variables, to the extra fields. Unset variables and
+// fields already in the extra fields are skipped
+func AddKubernetesFields(extraFields map[string]string) {
+	for env, field := range kubernetesEnv {
+		value := os.Getenv(env)
+		if _, ok := extraFields[field]; ok || value == "" {
+			continue
+		}
+		extraFields[field] = value
+	}
+}
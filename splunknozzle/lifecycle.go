@@ -0,0 +1,45 @@
+package splunknozzle
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
+)
+
+// Lifecycles of the nozzle sent by LifecycleEvent
+const (
+	LifecycleStarted = "started"
+	LifecycleStopped = "stopped"
+)
+
+// LifecycleEvent sends an event marking that the nozzle has started or is stopping,
+// so the boundaries of its data can be told apart in the index during deploys
+func (s *SplunkFirehoseNozzle) LifecycleEvent(writer eventwriter.Writer, lifecycle string) {
+	now := time.Now()
+	fields := map[string]interface{}{
+		"lifecycle":       lifecycle,
+		"uuid":            s.uuid,
+		"config_hash":     s.config.Hash(),
+		"version":         s.config.Version,
+		"subscription_id": s.config.SubscriptionID,
+	}
+	if lifecycle == LifecycleStarted {
+		s.started = now
+	} else if !s.started.IsZero() {
+		fields["uptime"] = now.Sub(s.started).String()
+	}
+
+	event := map[string]interface{}{
+		"time":       utils.NanoSecondsToSeconds(now.UnixNano()),
+		"host":       s.config.JobHost,
+		"source":     "splunk_nozzle",
+		"sourcetype": "cf:splunknozzle:lifecycle",
+		"event":      fields,
+	}
+	if err, _ := writer.Write([]map[string]interface{}{event}); err != nil {
+		s.logger.Error("Failed to send nozzle lifecycle event", err, lager.Data{"lifecycle": lifecycle})
+	}
+}
@@ -0,0 +1,89 @@
+package splunknozzle
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	// Rough memory held per queued or batched event, envelope and parsed fields
+	estimatedEventBytes = 4 * 1024
+
+	// Limits above this are reported by cgroup v1 for unlimited containers
+	unlimitedMemory = 1 << 60
+)
+
+// cgroupMemoryFiles are the memory limit files of cgroup v2 and v1, relative to the
+// cgroup filesystem root
+var cgroupMemoryFiles = []string{"memory.max", "memory/memory.limit_in_bytes"}
+
+// CgroupMemoryLimit returns the memory limit of the container from the cgroup
+// filesystem at root, usually /sys/fs/cgroup. It returns false when unlimited or
+// unknown
+func CgroupMemoryLimit(root string) (uint64, bool) {
+	for _, file := range cgroupMemoryFiles {
+		content, err := os.ReadFile(filepath.Join(root, file))
+		if err != nil {
+			continue
+		}
+
+		value := strings.TrimSpace(string(content))
+		if value == "max" {
+			return 0, false
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || limit == 0 || limit >= unlimitedMemory {
+			return 0, false
+		}
+		return limit, true
+	}
+	return 0, false
+}
+
+// ApplyMemoryLimit caps the consumer queue size and the batch size so the events they
+// hold use at most a quarter of the memory limit, half for the queue and half for
+// the batches of all HEC workers
+func (s *SplunkFirehoseNozzle) ApplyMemoryLimit(limit uint64) {
+	maxEvents := int(limit / 4 / estimatedEventBytes)
+
+	queueSize := maxEvents / 2
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	workers := s.config.HecWorkers
+	if s.config.MaxHecWorkers > 0 {
+		workers = s.config.MaxHecWorkers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	batchSize := maxEvents / 2 / workers
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	data := lager.Data{
+		"memory_limit":        limit,
+		"consumer_queue_size": s.config.QueueSize,
+		"hec_batch_size":      s.config.BatchSize,
+	}
+	if s.config.QueueSize <= queueSize && s.config.BatchSize <= batchSize {
+		s.logger.Info("Queue and batch sizes fit the memory limit", data)
+		return
+	}
+
+	if s.config.QueueSize > queueSize {
+		s.config.QueueSize = queueSize
+	}
+	if s.config.BatchSize > batchSize {
+		s.config.BatchSize = batchSize
+	}
+	data["derived_consumer_queue_size"] = s.config.QueueSize
+	data["derived_hec_batch_size"] = s.config.BatchSize
+	s.logger.Info("Capped queue and batch sizes to the memory limit", data)
+}
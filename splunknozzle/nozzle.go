@@ -1,8 +1,14 @@
 package splunknozzle
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/lager"
@@ -13,35 +19,107 @@ import (
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsource"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/monitoring"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/utils"
 
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/nozzle"
 	"github.com/google/uuid"
 )
 
 type SplunkFirehoseNozzle struct {
-	config *Config
-	logger lager.Logger
+	config  *Config
+	logger  lager.Logger
+	metrics *monitoring.Metrics
+	uuid    string    // of this nozzle instance, added to its events
+	started time.Time // when the started lifecycle event was sent
+
+	// HEC TLS settings, parsed by ParseTLSConfig
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	skipSSLUntil    time.Time // zero when SKIP_SSL_VALIDATION_SPLUNK doesn't expire
+
+	// atomic, 1 while the event HEC is failing with MONITORING_SUSPEND_AT
+	hecFailing int32
+
+	// shared by all writers, so INDEX_METRICS_LIMIT bounds the counters of the nozzle
+	indexMetrics *eventwriter.IndexMetrics
+
+	// shared by the writers of all tokens, including ORG_HEC_TOKENS, so MAX_BUFFER_BYTES
+	// caps the memory of the nozzle. Created once by initWriters
+	writersOnce   sync.Once
+	bufferLimiter *eventwriter.BufferLimiter
+	receipts      *eventwriter.ReceiptLogger
+	indexCreator  *eventwriter.IndexCreator
 }
 
+// skipSSLWarnInterval is how often the nozzle warns that the certificates of Splunk
+// aren't verified
+const skipSSLWarnInterval = 10 * time.Minute
+
 // create new function of type *SplunkFirehoseNozzle
 func NewSplunkFirehoseNozzle(config *Config, logger lager.Logger) *SplunkFirehoseNozzle {
-	return &SplunkFirehoseNozzle{
-		config: config,
-		logger: logger,
+	s := &SplunkFirehoseNozzle{
+		config:  config,
+		logger:  logger,
+		metrics: monitoring.NewMetrics(),
+		uuid:    uuid.New().String(),
+	}
+	if config.IndexMetricsLimit > 0 {
+		s.indexMetrics = eventwriter.NewIndexMetrics(config.IndexMetricsLimit, s.metrics)
 	}
+	return s
 }
 
 // EventRouter creates EventRouter object and setup routes for interested events
 func (s *SplunkFirehoseNozzle) EventRouter(cache cache.Cache, eventSink eventsink.Sink) (eventrouter.Router, error) {
+	httpSampleRates, err := events.ParseHttpStatusSampleRates(s.config.HttpSampleRates)
+	if err != nil {
+		s.logger.Error("Error at parsing HTTP sample rates", nil)
+		return nil, err
+	}
+
+	sampleRatios, err := events.ParseSampleRatios(s.config.SampleRatios)
+	if err != nil {
+		s.logger.Error("Error at parsing sample ratios", nil)
+		return nil, err
+	}
+
+	eventMappings, err := events.ReadEventMappings(s.config.EventMappingFile)
+	if err != nil {
+		s.logger.Error("Error at reading the event mapping file", nil)
+		return nil, err
+	}
+	wantedEvents := s.config.WantedEvents
+	if eventMappings != nil {
+		wantedEvents = events.MappedEventTypes(eventMappings)
+	}
+
 	LowerAddAppInfo := strings.ToLower(s.config.AddAppInfo)
 	config := &eventrouter.Config{
-		SelectedEvents: s.config.WantedEvents,
+		SelectedEvents: wantedEvents,
 		AddAppName:     strings.Contains(LowerAddAppInfo, "appname"),
 		AddOrgName:     strings.Contains(LowerAddAppInfo, "orgname"),
 		AddOrgGuid:     strings.Contains(LowerAddAppInfo, "orgguid"),
 		AddSpaceName:   strings.Contains(LowerAddAppInfo, "spacename"),
 		AddSpaceGuid:   strings.Contains(LowerAddAppInfo, "spaceguid"),
+		AddAppState:    strings.Contains(LowerAddAppInfo, "appstate"),
+		AddCreatedAt:   strings.Contains(LowerAddAppInfo, "appcreatedat"),
+		AddUpdatedAt:   strings.Contains(LowerAddAppInfo, "appupdatedat"),
+		AddOrgQuota:    strings.Contains(LowerAddAppInfo, "orgquota"),
+		AddSpaceQuota:  strings.Contains(LowerAddAppInfo, "spacequota"),
 		AddTags:        s.config.AddTags,
+
+		HttpStatusSampleRates: httpSampleRates,
+		SampleRatios:          sampleRatios,
+
+		ContainerMetricMaxSampleRate: s.config.ContainerMetricMaxSampleRate,
+		ContainerMetricCpuDelta:      s.config.ContainerMetricCpuDelta,
+		ContainerMetricMemoryDelta:   s.config.ContainerMetricMemoryDelta / 100,
+
+		SuppressInactiveContainerMetrics: s.config.SuppressInactiveContainerMetrics,
+		AppStateMaxAge:                   s.config.AppStateMaxAge,
+
+		Metrics: s.metrics,
 	}
 	return eventrouter.New(cache, eventSink, config)
 }
@@ -60,6 +138,40 @@ func (s *SplunkFirehoseNozzle) PCFClient() (*cfclient.Client, error) {
 	return cfclient.NewClient(cfConfig)
 }
 
+// Longest delay between retries of the initial CF API authentication
+const maxStartupRetryInterval = time.Minute
+
+// PCFClientWithRetries retries PCFClient up to StartupRetries times with exponential
+// backoff, so a CF API briefly unavailable during a platform deploy doesn't stop the
+// nozzle. It gives up early when shutdownChan receives a signal
+func (s *SplunkFirehoseNozzle) PCFClientWithRetries(shutdownChan chan os.Signal) (*cfclient.Client, error) {
+	interval := s.config.StartupRetryInterval
+	for attempt := 1; ; attempt++ {
+		client, err := s.PCFClient()
+		if err == nil || attempt > s.config.StartupRetries {
+			if err != nil && s.config.StartupRetries > 0 {
+				err = fmt.Errorf("failed to authenticate with the CF API after %d attempts: %v", attempt, err)
+			}
+			return client, err
+		}
+
+		s.logger.Error("Failed to authenticate with the CF API, retrying", err, lager.Data{
+			"attempt":  attempt,
+			"retry_in": interval.String(),
+		})
+		select {
+		case <-shutdownChan:
+			return nil, fmt.Errorf("interrupted while retrying to authenticate with the CF API: %v", err)
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > maxStartupRetryInterval {
+			interval = maxStartupRetryInterval
+		}
+	}
+}
+
 // AppCache creates in-memory cache or boltDB cache
 func (s *SplunkFirehoseNozzle) AppCache(client cache.AppClient) (cache.Cache, error) {
 	if s.config.AddAppInfo != "" {
@@ -69,32 +181,247 @@ func (s *SplunkFirehoseNozzle) AppCache(client cache.AppClient) (cache.Cache, er
 			MissingAppCacheTTL: s.config.MissingAppCacheTTL,
 			AppCacheTTL:        s.config.AppCacheTTL,
 			OrgSpaceCacheTTL:   s.config.OrgSpaceCacheTTL,
+			OrgCacheTTL:        s.config.OrgCacheTTL,
+			SpaceCacheTTL:      s.config.SpaceCacheTTL,
+			WriteInterval:      s.config.CacheWriteInterval,
+			SnapshotPath:       s.config.CacheSnapshotPath,
+			SnapshotInterval:   s.config.SnapshotInterval,
 			Logger:             s.logger,
 		}
+		lowerAddAppInfo := strings.ToLower(s.config.AddAppInfo)
+		c.ResolveQuotas = strings.Contains(lowerAddAppInfo, "orgquota") || strings.Contains(lowerAddAppInfo, "spacequota")
+		c.QuotaCacheTTL = s.config.QuotaCacheTTL
 		return cache.NewBoltdb(client, &c)
 	}
 
 	return cache.NewNoCache(), nil
 }
 
+// ParseTLSConfig validates the HEC TLS min version and cipher suites used by the writers,
+// and that HEC hosts are only reached over plain HTTP with ALLOW_PLAIN_HTTP_SPLUNK
+func (s *SplunkFirehoseNozzle) ParseTLSConfig() error {
+	hosts := append([]string{s.config.SplunkHost}, strings.Split(s.config.HecFailoverHosts, ",")...)
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); !eventwriter.PlainHTTPHost(host) {
+			continue
+		}
+		if !s.config.AllowPlainHTTP {
+			return fmt.Errorf("HEC host %s uses plain HTTP, which is only allowed for local development with ALLOW_PLAIN_HTTP_SPLUNK", host)
+		}
+		s.logger.Info("WARNING: ALLOW_PLAIN_HTTP_SPLUNK is set, events are sent to Splunk without TLS", lager.Data{"host": host})
+	}
+
+	minVersion, err := eventwriter.ParseTLSVersion(s.config.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+
+	cipherSuites, err := eventwriter.ParseCipherSuites(s.config.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+
+	s.tlsMinVersion = minVersion
+	s.tlsCipherSuites = cipherSuites
+	if s.config.SkipSSLSplunk && s.config.SkipSSLExpiry > 0 {
+		s.skipSSLUntil = time.Now().Add(s.config.SkipSSLExpiry)
+	}
+	return nil
+}
+
+// WarnSkipSSL logs a warning at every interval while the certificates of Splunk
+// aren't verified, until SKIP_SSL_VALIDATION_SPLUNK expires or done is closed
+func (s *SplunkFirehoseNozzle) WarnSkipSSL(interval time.Duration, done <-chan struct{}) {
+	if !s.config.SkipSSLSplunk {
+		return
+	}
+
+	var expired <-chan time.Time
+	if !s.skipSSLUntil.IsZero() {
+		timer := time.NewTimer(time.Until(s.skipSSLUntil))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		data := lager.Data{}
+		if !s.skipSSLUntil.IsZero() {
+			data["expires_at"] = s.skipSSLUntil.UTC().Format(time.RFC3339)
+		}
+		s.logger.Info("WARNING: SKIP_SSL_VALIDATION_SPLUNK is set, the certificates of Splunk are not verified", data)
+
+		select {
+		case <-ticker.C:
+		case <-expired:
+			s.logger.Info("SKIP_SSL_VALIDATION_SPLUNK expired, the certificates of Splunk are verified")
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// WriterFactory creates eventwriter.Writer objects which send events to the given default index
+type WriterFactory func(index string) eventwriter.Writer
+
+// WriterFactory creates the WriterFactory shared by the event sink, the metrics monitor and the summary
+func (s *SplunkFirehoseNozzle) WriterFactory() WriterFactory {
+	return s.tokenWriterFactory(s.tokens())
+}
+
+// initWriters creates the buffer limiter, delivery receipts and index creator shared by
+// the writers of all tokens, once the TLS config is parsed
+func (s *SplunkFirehoseNozzle) initWriters() {
+	s.writersOnce.Do(func() {
+		s.bufferLimiter = eventwriter.NewBufferLimiter(s.config.MaxBufferBytes, s.metrics)
+
+		if s.config.TraceLogging && s.config.DeliveryReceiptLimit > 0 {
+			s.receipts = eventwriter.NewReceiptLogger(s.config.DeliveryReceiptLimit, s.logger)
+		}
+
+		if s.config.AutoCreateIndex {
+			s.indexCreator = eventwriter.NewIndexCreator(&eventwriter.IndexCreatorConfig{
+				Endpoint: s.config.SplunkManagementURL,
+				User:     s.config.SplunkManagementUser,
+				Password: s.config.SplunkManagementPassword,
+				SkipSSL:  s.config.SkipSSLSplunk,
+				Logger:   s.logger,
+
+				SkipSSLUntil:  s.skipSSLUntil,
+				RetryInterval: s.config.AutoCreateIndexRetryInterval,
+			})
+		}
+	})
+}
+
+// tokenWriterFactory creates a WriterFactory assigning the tokens to the writers round-robin
+func (s *SplunkFirehoseNozzle) tokenWriterFactory(tokens []string) WriterFactory {
+	var failoverHosts []string
+	for _, host := range strings.Split(s.config.HecFailoverHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			failoverHosts = append(failoverHosts, host)
+		}
+	}
+
+	var lock sync.Mutex
+	next := 0
+
+	s.initWriters()
+
+	return func(index string) eventwriter.Writer {
+		lock.Lock()
+		token := next
+		next = (next + 1) % len(tokens)
+		lock.Unlock()
+
+		// Tokens are only named in metrics by their position, never by their value
+		var tokenName string
+		if len(tokens) > 1 {
+			tokenName = strconv.Itoa(token + 1)
+		}
+
+		writerConfig := &eventwriter.SplunkConfig{
+			Host:    s.config.SplunkHost,
+			Token:   tokens[token],
+			Index:   index,
+			SkipSSL: s.config.SkipSSLSplunk,
+			Debug:   s.config.Debug,
+			Logger:  s.logger,
+			Version: s.config.Version,
+			Metrics: s.metrics,
+
+			TokenName: tokenName,
+			Path:      s.config.HecPath,
+
+			TLSMinVersion:   s.tlsMinVersion,
+			TLSCipherSuites: s.tlsCipherSuites,
+			SkipSSLUntil:    s.skipSSLUntil,
+
+			SkipInvalidEvents:   s.config.SkipInvalidEvents,
+			DecodeGzipResponses: s.config.DecodeGzip,
+
+			FailoverHosts:     failoverHosts,
+			FailoverThreshold: s.config.HecFailoverThreshold,
+			FailbackInterval:  s.config.HecFailbackInterval,
+
+			IndexCreator:  s.indexCreator,
+			BufferLimiter: s.bufferLimiter,
+			Receipts:      s.receipts,
+			IndexMetrics:  s.indexMetrics,
+
+			ChannelField: s.config.AddChannelField,
+		}
+		return eventwriter.NewSplunk(writerConfig)
+	}
+}
+
+// tokens returns SPLUNK_TOKEN followed by the distinct SPLUNK_TOKENS
+func (s *SplunkFirehoseNozzle) tokens() []string {
+	tokens := []string{s.config.SplunkToken}
+	seen := map[string]bool{s.config.SplunkToken: true}
+	for _, token := range strings.Split(s.config.SplunkTokens, ",") {
+		if token = strings.TrimSpace(token); token != "" && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// OrgWriters creates a writer per org of ORG_HEC_TOKENS, which sends the events of the
+// org with the token of its tenant
+func (s *SplunkFirehoseNozzle) OrgWriters() (map[string]eventwriter.Writer, error) {
+	orgTokens, err := events.ParseOrgTokens(s.config.OrgHecTokens)
+	if err != nil || orgTokens == nil {
+		return nil, err
+	}
+
+	orgWriters := make(map[string]eventwriter.Writer, len(orgTokens))
+	for org, token := range orgTokens {
+		orgWriters[org] = s.tokenWriterFactory([]string{token})(s.config.SplunkIndex)
+	}
+	return orgWriters, nil
+}
+
+// deadLetterFile is the dead letter writer of the sink, a single file or one per index
+type deadLetterFile interface {
+	eventwriter.Writer
+	Stats() (int64, int64)
+}
+
+// deadLetterFiles opens the DEAD_LETTER_FILE, or its files per index with DEAD_LETTER_PER_INDEX
+func (s *SplunkFirehoseNozzle) deadLetterFiles() (deadLetterFile, error) {
+	config := &eventwriter.DeadLetterConfig{
+		MaxBytes: s.config.DeadLetterMaxBytes,
+		MaxFiles: s.config.DeadLetterMaxFiles,
+		MaxAge:   s.config.DeadLetterMaxAge,
+		Evicted:  s.metrics.NewCounter("splunk.events.dead_letter_evicted"),
+	}
+	if s.config.DeadLetterPerIndex {
+		return eventwriter.NewDeadLetterFiles(s.config.DeadLetterFile, config)
+	}
+	return eventwriter.NewDeadLetterFile(s.config.DeadLetterFile, config)
+}
+
 // EventSink creates std sink or Splunk sink
-func (s *SplunkFirehoseNozzle) EventSink(cache cache.Cache) (eventsink.Sink, error) {
+func (s *SplunkFirehoseNozzle) EventSink(cache cache.Cache, newWriter WriterFactory) (eventsink.Sink, error) {
 
 	// EventWriter for writing events
-	writerConfig := &eventwriter.SplunkConfig{
-		Host:    s.config.SplunkHost,
-		Token:   s.config.SplunkToken,
-		Index:   s.config.SplunkIndex,
-		SkipSSL: s.config.SkipSSLSplunk,
-		Debug:   s.config.Debug,
-		Logger:  s.logger,
-		Version: s.config.Version,
+	workers := s.config.HecWorkers
+	if s.config.MaxHecWorkers > 0 {
+		workers = s.config.MaxHecWorkers
 	}
-
 	var writers []eventwriter.Writer
-	for i := 0; i < s.config.HecWorkers+1; i++ {
-		splunkWriter := eventwriter.NewSplunk(writerConfig)
-		writers = append(writers, splunkWriter)
+	for i := 0; i < workers+1; i++ {
+		writers = append(writers, newWriter(s.config.SplunkIndex))
+	}
+
+	orgWriters, err := s.OrgWriters()
+	if err != nil {
+		s.logger.Error("Error at parsing org HEC tokens", nil)
+		return nil, err
 	}
 
 	parsedExtraFields, err := events.ParseExtraFields(s.config.ExtraFields)
@@ -102,34 +429,242 @@ func (s *SplunkFirehoseNozzle) EventSink(cache cache.Cache) (eventsink.Sink, err
 		s.logger.Error("Error at parsing extra fields", nil)
 		return nil, err
 	}
+	if s.config.AddK8sMetadata {
+		AddKubernetesFields(parsedExtraFields)
+	}
+
+	indexExtraFields, err := events.ParseIndexExtraFields(s.config.IndexExtraFields)
+	if err != nil {
+		s.logger.Error("Error at parsing index extra fields", nil)
+		return nil, err
+	}
+
+	if err = events.CheckExtraFieldSizes(parsedExtraFields, s.config.MaxExtraFieldBytes); err != nil {
+		err = fmt.Errorf("EXTRA_FIELDS: %w", err)
+	}
+	extraFieldIndexes := make([]string, 0, len(indexExtraFields))
+	for index := range indexExtraFields {
+		extraFieldIndexes = append(extraFieldIndexes, index)
+	}
+	sort.Strings(extraFieldIndexes)
+	for _, index := range extraFieldIndexes {
+		if err != nil {
+			break
+		}
+		if err = events.CheckExtraFieldSizes(indexExtraFields[index], s.config.MaxExtraFieldBytes); err != nil {
+			err = fmt.Errorf("INDEX_EXTRA_FIELDS of index [%s]: %w", index, err)
+		}
+	}
+	if err != nil {
+		s.logger.Error("Error at checking extra fields", err)
+		return nil, err
+	}
+
+	messageTypeIndexes, err := events.ParseMessageTypeIndexes(s.config.MessageTypeIndexes)
+	if err != nil {
+		s.logger.Error("Error at parsing message type indexes", nil)
+		return nil, err
+	}
+
+	indexMappings, err := events.ParseIndexMappings(s.config.IndexMappings)
+	if err != nil {
+		s.logger.Error("Error at parsing index mappings", nil)
+		return nil, err
+	}
+
+	eventMappings, err := events.ReadEventMappings(s.config.EventMappingFile)
+	if err != nil {
+		s.logger.Error("Error at reading the event mapping file", nil)
+		return nil, err
+	}
+
+	indexBatching, err := eventsink.ParseIndexBatchConfigs(s.config.IndexBatching)
+	if err != nil {
+		s.logger.Error("Error at parsing index batching", nil)
+		return nil, err
+	}
+
+	var deadLetter eventwriter.Writer
+	if s.config.DeadLetterFile != "" {
+		deadLetterFiles, err := s.deadLetterFiles()
+		if err != nil {
+			s.logger.Error("Error at opening the dead letter file", err)
+			return nil, err
+		}
+		s.metrics.RegisterGauge("splunk.dead_letter.bytes", func() float64 {
+			size, _ := deadLetterFiles.Stats()
+			return float64(size)
+		})
+		s.metrics.RegisterGauge("splunk.dead_letter.entries", func() float64 {
+			_, entries := deadLetterFiles.Stats()
+			return float64(entries)
+		})
+		deadLetter = deadLetterFiles
+	}
+
+	classQueues, err := eventsink.ParseClassQueueConfigs(s.config.ClassQueues)
+	if err != nil {
+		s.logger.Error("Error at parsing class queues", nil)
+		return nil, err
+	}
 
-	nozzleUUID := uuid.New().String()
+	fieldExtractors, err := events.ParseFieldExtractors(s.config.LogFieldExtractors)
+	if err != nil {
+		s.logger.Error("Error at parsing log field extractors", nil)
+		return nil, err
+	}
+
+	priorityRules, err := events.ParsePriorityRules(s.config.PriorityRules)
+	if err != nil {
+		s.logger.Error("Error at parsing priority rules", nil)
+		return nil, err
+	}
+
+	var filter *events.Filter
+	if strings.TrimSpace(s.config.EventFilter) != "" {
+		filter, err = events.CompileFilter(s.config.EventFilter)
+		if err != nil {
+			s.logger.Error("Error at compiling event filter", nil)
+			return nil, err
+		}
+	}
+
+	// Only used to name the router's filters in the _route field
+	httpSampleRates, err := events.ParseHttpStatusSampleRates(s.config.HttpSampleRates)
+	if err != nil {
+		s.logger.Error("Error at parsing HTTP sample rates", nil)
+		return nil, err
+	}
+	sampleRatios, err := events.ParseSampleRatios(s.config.SampleRatios)
+	if err != nil {
+		s.logger.Error("Error at parsing sample ratios", nil)
+		return nil, err
+	}
+
+	traceAppGUIDs := make(map[string]bool)
+	for _, appGUID := range strings.Split(s.config.TraceAppGUIDs, ",") {
+		if appGUID = strings.TrimSpace(appGUID); appGUID != "" {
+			traceAppGUIDs[appGUID] = true
+		}
+	}
 
 	sinkConfig := &eventsink.SplunkConfig{
-		FlushInterval:         s.config.FlushInterval,
-		QueueSize:             s.config.QueueSize,
-		BatchSize:             s.config.BatchSize,
-		Retries:               s.config.Retries,
-		Hostname:              s.config.JobHost,
-		SubscriptionID:        s.config.SubscriptionID,
-		TraceLogging:          s.config.TraceLogging,
-		ExtraFields:           parsedExtraFields,
-		UUID:                  nozzleUUID,
-		Logger:                s.logger,
-		LoggingIndex:          s.config.SplunkLoggingIndex,
-		StatusMonitorInterval: s.config.StatusMonitorInterval,
-		DropWarnThreshold:     s.config.DropWarnThreshold,
+		FlushInterval:           s.config.FlushInterval,
+		QueueSize:               s.config.QueueSize,
+		MaxQueueAge:             s.config.MaxQueueAge,
+		BatchSize:               s.config.BatchSize,
+		Retries:                 s.config.Retries,
+		RetryBudget:             s.config.RetryBudget,
+		RetryBudgetPolicy:       s.config.RetryBudgetPolicy,
+		LogMaxChars:             s.config.LogMaxChars,
+		LogMaxLines:             s.config.LogMaxLines,
+		LogOverflow:             s.config.LogOverflow,
+		Hostname:                s.config.JobHost,
+		SubscriptionID:          s.config.SubscriptionID,
+		TraceLogging:            s.config.TraceLogging,
+		TraceAppGUIDs:           traceAppGUIDs,
+		ExtraFields:             parsedExtraFields,
+		UUID:                    s.uuid,
+		Logger:                  s.logger,
+		LoggingIndex:            s.config.SplunkLoggingIndex,
+		StatusMonitorInterval:   s.config.StatusMonitorInterval,
+		DropWarnThreshold:       s.config.DropWarnThreshold,
+		SyncSend:                s.config.SyncSend,
+		DropNozzleLogs:          s.config.DropNozzleLogs,
+		NozzleLogSampleRate:     s.config.NozzleLogSampleRate,
+		Metrics:                 s.metrics,
+		WarmUp:                  s.config.HecWarmUp,
+		AddSequence:             s.config.AddSequence,
+		AddSchemaVersion:        s.config.AddSchemaVersion,
+		AddSubscriptionID:       s.config.AddSubscriptionID,
+		AppKeyMode:              s.config.AppKey,
+		AppKeySalt:              s.config.AppKeySalt,
+		AddIngestTime:           s.config.AddIngestTime,
+		AddDeliveryTime:         s.config.AddDeliveryTime,
+		AddRouteField:           s.config.AddRouteField,
+		Index:                   s.config.SplunkIndex,
+		IndexExtraFields:        indexExtraFields,
+		MaxExtraFieldBytes:      s.config.MaxExtraFieldBytes,
+		MessageTypeIndexes:      messageTypeIndexes,
+		IndexMappings:           indexMappings,
+		QuarantineIndex:         s.config.QuarantineIndex,
+		EventMappings:           eventMappings,
+		IndexBatching:           indexBatching,
+		SplitByIndex:            s.config.SplitByIndex,
+		DeadLetter:              deadLetter,
+		ClassQueues:             classQueues,
+		LookupFailureInterval:   s.config.LookupFailureInterval,
+		CompactContainerMetrics: s.config.CompactContainerMetrics,
+		OrgSpaceMetricsLimit:    s.config.OrgSpaceMetricsLimit,
+		WorkerMetrics:           s.config.WorkerMetrics,
+		ContainerMultiMetric:    s.config.ContainerMultiMetric,
+		CloseTimeout:            s.config.ShutdownTimeout,
+		MetricIndex:             s.config.SplunkMetricIndex,
+		CounterResetLimit:       s.config.CounterResetLimit,
+		MinWorkers:              s.config.MinHecWorkers,
+		MaxWorkers:              s.config.MaxHecWorkers,
+		ScaleInterval:           s.config.HecScaleInterval,
+		ScaleLatency:            s.config.HecScaleLatency,
+		OrgWriters:              orgWriters,
+	}
+	if s.config.MonitoringSuspendAt > 0 {
+		sinkConfig.HECFailureThreshold = s.config.MonitoringSuspendAt
+		sinkConfig.OnHECFailing = func(failing bool) {
+			if failing {
+				atomic.StoreInt32(&s.hecFailing, 1)
+			} else {
+				atomic.StoreInt32(&s.hecFailing, 0)
+			}
+		}
+	}
+
+	wantedEvents := s.config.WantedEvents
+	if eventMappings != nil {
+		wantedEvents = events.MappedEventTypes(eventMappings)
 	}
 
 	LowerAddAppInfo := strings.ToLower(s.config.AddAppInfo)
 	parseConfig := &eventsink.ParseConfig{
-		SelectedEvents: s.config.WantedEvents,
+		SelectedEvents: wantedEvents,
 		AddAppName:     strings.Contains(LowerAddAppInfo, "appname"),
 		AddOrgName:     strings.Contains(LowerAddAppInfo, "orgname"),
 		AddOrgGuid:     strings.Contains(LowerAddAppInfo, "orgguid"),
 		AddSpaceName:   strings.Contains(LowerAddAppInfo, "spacename"),
 		AddSpaceGuid:   strings.Contains(LowerAddAppInfo, "spaceguid"),
+		AddAppState:    strings.Contains(LowerAddAppInfo, "appstate"),
+		AddCreatedAt:   strings.Contains(LowerAddAppInfo, "appcreatedat"),
+		AddUpdatedAt:   strings.Contains(LowerAddAppInfo, "appupdatedat"),
+		AddOrgQuota:    strings.Contains(LowerAddAppInfo, "orgquota"),
+		AddSpaceQuota:  strings.Contains(LowerAddAppInfo, "spacequota"),
 		AddTags:        s.config.AddTags,
+		AddCpuCores:    s.config.AddCpuCores,
+
+		CpuEntitlementMBPerCore: s.config.CpuEntitlementMBPerCore,
+
+		AddVcapRequestId: s.config.AddVcapRequestId,
+
+		BoshInstanceField: s.config.BoshInstanceField,
+
+		RequireEnrichment: s.config.RequireEnrichment,
+
+		HttpStatusSampleRates:        httpSampleRates,
+		SampleRatios:                 sampleRatios,
+		ContainerMetricMaxSampleRate: s.config.ContainerMetricMaxSampleRate,
+
+		JsonLog:          s.config.ParseJsonLogs,
+		JsonLogPrefix:    s.config.JsonLogFieldPrefix,
+		JsonLogCollision: s.config.JsonLogFieldCollision,
+		JsonLogMaxBytes:  s.config.JsonLogMaxBytes,
+		JsonLogMaxDepth:  s.config.JsonLogMaxDepth,
+
+		LogTimestampLayout: s.config.LogTimestampFormat,
+		LogTimestampAsTime: s.config.LogTimestampAsTime,
+		Base64BinaryLogs:   s.config.Base64BinaryLogs,
+
+		FieldExtractors: fieldExtractors,
+		Filter:          filter,
+		PriorityRules:   priorityRules,
+		PriorityField:   s.config.PriorityField,
 	}
 
 	splunkSink := eventsink.NewSplunk(writers, sinkConfig, parseConfig, cache)
@@ -142,6 +677,96 @@ func (s *SplunkFirehoseNozzle) EventSink(cache cache.Cache) (eventsink.Sink, err
 	return splunkSink, nil
 }
 
+// GraphiteSink creates a sink which sends ValueMetric and CounterEvent to the Graphite host
+func (s *SplunkFirehoseNozzle) GraphiteSink() *eventsink.Graphite {
+	writerConfig := &eventwriter.GraphiteConfig{
+		Host:    s.config.GraphiteHost,
+		Timeout: time.Second * 5,
+		Debug:   s.config.Debug,
+		Logger:  s.logger,
+	}
+
+	sinkConfig := &eventsink.GraphiteConfig{
+		FlushInterval: s.config.FlushInterval,
+		QueueSize:     s.config.QueueSize,
+		BatchSize:     s.config.BatchSize,
+		Prefix:        s.config.GraphitePrefix,
+		Logger:        s.logger,
+	}
+
+	return eventsink.NewGraphite(eventwriter.NewGraphite(writerConfig), sinkConfig)
+}
+
+// ReorderSink creates a sink which holds events for the reorder window and writes them
+// to the sink in timestamp order
+func (s *SplunkFirehoseNozzle) ReorderSink(eventSink eventsink.Sink) *eventsink.Reorder {
+	reorderConfig := &eventsink.ReorderConfig{
+		Window:    s.config.ReorderWindow,
+		MaxEvents: s.config.ReorderBufferSize,
+		Metrics:   s.metrics,
+	}
+
+	return eventsink.NewReorder(eventSink, reorderConfig)
+}
+
+// DedupSink creates a sink which drops the events identical to an event written within
+// the dedup window
+func (s *SplunkFirehoseNozzle) DedupSink(eventSink eventsink.Sink) *eventsink.Dedup {
+	dedupConfig := &eventsink.DedupConfig{
+		Window:     s.config.DedupWindow,
+		MaxEntries: s.config.DedupMaxEntries,
+		Metrics:    s.metrics,
+	}
+
+	return eventsink.NewDedup(eventSink, dedupConfig)
+}
+
+// AlertWebhookSink creates a sink which posts Error events, and the events of the
+// configured priorities, to the alert webhook
+func (s *SplunkFirehoseNozzle) AlertWebhookSink() (*eventsink.Webhook, error) {
+	tmpl, err := eventwriter.ParseWebhookTemplate(s.config.AlertWebhookTemplate)
+	if err != nil {
+		s.logger.Error("Error at parsing alert webhook template", nil)
+		return nil, err
+	}
+
+	priorityRules, err := events.ParsePriorityRules(s.config.PriorityRules)
+	if err != nil {
+		s.logger.Error("Error at parsing priority rules", nil)
+		return nil, err
+	}
+
+	priorities := make(map[string]bool)
+	for _, priority := range strings.Split(s.config.AlertWebhookPriorities, ",") {
+		if priority = strings.TrimSpace(priority); priority != "" {
+			priorities[priority] = true
+		}
+	}
+
+	writerConfig := &eventwriter.WebhookConfig{
+		URL:      s.config.AlertWebhookURL,
+		Template: tmpl,
+		Timeout:  time.Second * 10,
+		SkipSSL:  s.config.SkipSSLSplunk,
+		Logger:   s.logger,
+
+		SkipSSLUntil: s.skipSSLUntil,
+	}
+
+	sinkConfig := &eventsink.WebhookConfig{
+		QueueSize:  s.config.QueueSize,
+		Priorities: priorities,
+		ParseConfig: &eventsink.ParseConfig{
+			AddTags:       s.config.AddTags,
+			PriorityRules: priorityRules,
+			PriorityField: s.config.PriorityField,
+		},
+		Logger: s.logger,
+	}
+
+	return eventsink.NewWebhook(eventwriter.NewWebhook(writerConfig), sinkConfig), nil
+}
+
 // EventSource creates eventsource.Source object which can read events from
 func (s *SplunkFirehoseNozzle) EventSource(pcfClient *cfclient.Client) *eventsource.Firehose {
 	config := &eventsource.FirehoseConfig{
@@ -154,24 +779,267 @@ func (s *SplunkFirehoseNozzle) EventSource(pcfClient *cfclient.Client) *eventsou
 	return eventsource.NewFirehose(pcfClient, config)
 }
 
+// SyntheticSource creates the eventsource.Source generating events for SOURCE_TYPE synthetic
+func (s *SplunkFirehoseNozzle) SyntheticSource() *eventsource.Synthetic {
+	// Validated by Run
+	mix, _ := eventsource.ParseSyntheticMix(s.config.SyntheticEventMix)
+	return eventsource.NewSynthetic(&eventsource.SyntheticConfig{
+		Rate: s.config.SyntheticRate,
+		Mix:  mix,
+		Seed: s.config.SyntheticSeed,
+	})
+}
+
 // Nozzle creates a Nozzle object which glues the event source and event router
-func (s *SplunkFirehoseNozzle) Nozzle(eventSource eventsource.Source, eventRouter eventrouter.Router) *nozzle.Nozzle {
+func (s *SplunkFirehoseNozzle) Nozzle(eventSource eventsource.Source, eventRouter eventrouter.Router, newWriter WriterFactory) *nozzle.Nozzle {
 	firehoseConfig := &nozzle.Config{
 		Logger:                s.logger,
 		StatusMonitorInterval: s.config.StatusMonitorInterval,
+		Metrics:               s.metrics,
+		MaxDisconnectDuration: s.config.MaxDisconnectDuration,
+		StallTimeout:          s.config.StallTimeout,
+		ReconnectDelay:        s.config.FirehoseReconnectDelay,
+		RouteWorkers:          s.config.RouteWorkers,
+		RouteBuffer:           s.config.RouteBufferSize,
+	}
+	// Validated by Run
+	firehoseConfig.FatalErrors, _ = nozzle.ParseErrorClasses(s.config.FirehoseFatalErrors)
+	if s.config.DisconnectAlertEvent {
+		firehoseConfig.OnDisconnectAlarm = s.disconnectAlert(newWriter(s.config.SplunkIndex))
 	}
 
 	return nozzle.New(eventSource, eventRouter, firehoseConfig)
 }
 
+// disconnectAlert returns a callback sending an alert event when the firehose can't be
+// reconnected within MAX_DISCONNECT_DURATION
+func (s *SplunkFirehoseNozzle) disconnectAlert(writer eventwriter.Writer) func(time.Duration, error) {
+	return func(disconnectedFor time.Duration, err error) {
+		alert := map[string]interface{}{
+			"alert":                   "firehose_disconnected",
+			"disconnected_for":        disconnectedFor.String(),
+			"max_disconnect_duration": s.config.MaxDisconnectDuration.String(),
+		}
+		if err != nil {
+			alert["error"] = err.Error()
+		}
+		event := map[string]interface{}{
+			"time":       utils.NanoSecondsToSeconds(time.Now().UnixNano()),
+			"host":       s.config.JobHost,
+			"source":     "splunk_nozzle",
+			"sourcetype": "cf:splunknozzle:alert",
+			"event":      alert,
+		}
+		if err, _ := writer.Write([]map[string]interface{}{event}); err != nil {
+			s.logger.Error("Failed to send firehose disconnect alert event", err)
+		}
+	}
+}
+
+// MetricsMonitor creates a monitoring.MetricsMonitor which sends the nozzle's metrics to the metrics index
+func (s *SplunkFirehoseNozzle) MetricsMonitor(newWriter WriterFactory) *monitoring.MetricsMonitor {
+	// Validated by Run
+	selected, _ := monitoring.ParseMetricPatterns(s.config.MonitoringMetrics)
+	monitorConfig := &monitoring.MetricsMonitorConfig{
+		Interval:       s.config.StatusMonitorInterval,
+		SampleInterval: s.config.MetricsSampleInterval,
+		Selected:       selected,
+		Index:          s.config.SplunkMetricIndex,
+		Hostname:       s.config.JobHost,
+		Logger:         s.logger,
+	}
+	if s.config.MonitoringSuspendAt > 0 {
+		monitorConfig.Suspended = func() bool {
+			return atomic.LoadInt32(&s.hecFailing) == 1
+		}
+	}
+
+	return monitoring.NewMetricsMonitor(s.metrics, newWriter(s.config.SplunkMetricIndex), monitorConfig)
+}
+
+// Summary creates a monitoring.Summary which periodically sends a summary event to the summary index
+func (s *SplunkFirehoseNozzle) Summary(newWriter WriterFactory) *monitoring.Summary {
+	summaryConfig := &monitoring.SummaryConfig{
+		Interval: s.config.SummaryInterval,
+		Index:    s.config.SummaryIndex,
+		Hostname: s.config.JobHost,
+		Logger:   s.logger,
+	}
+
+	return monitoring.NewSummary(s.metrics, newWriter(s.config.SplunkIndex), summaryConfig)
+}
+
+// DropSummary creates a monitoring.DropSummary which periodically sends the dropped events to the drop summary index
+func (s *SplunkFirehoseNozzle) DropSummary(newWriter WriterFactory) *monitoring.DropSummary {
+	dropSummaryConfig := &monitoring.DropSummaryConfig{
+		Interval: s.config.DropSummaryInterval,
+		Index:    s.config.DropSummaryIndex,
+		Hostname: s.config.JobHost,
+		Logger:   s.logger,
+	}
+
+	return monitoring.NewDropSummary(s.metrics, newWriter(s.config.SplunkIndex), dropSummaryConfig)
+}
+
+// SamplingAudit creates a monitoring.SamplingAudit which periodically sends the sampling decisions to the sampling audit index
+func (s *SplunkFirehoseNozzle) SamplingAudit(newWriter WriterFactory) *monitoring.SamplingAudit {
+	samplingAuditConfig := &monitoring.SamplingAuditConfig{
+		Interval: s.config.SamplingAuditInterval,
+		Index:    s.config.SamplingAuditIndex,
+		Hostname: s.config.JobHost,
+		Logger:   s.logger,
+	}
+
+	return monitoring.NewSamplingAudit(s.metrics, newWriter(s.config.SplunkIndex), samplingAuditConfig)
+}
+
 // Run creates all necessary objects, reading events from CF firehose and sending to target Splunk index
 // It runs forever until something goes wrong
 func (s *SplunkFirehoseNozzle) Run(shutdownChan chan os.Signal) error {
-	pcfClient, err := s.PCFClient()
+	err := s.ParseTLSConfig()
 	if err != nil {
-		s.logger.Error("Failed to get info from CF Server", nil)
+		s.logger.Error("Invalid HEC TLS configuration", err)
 		return err
 	}
+	s.initWriters()
+
+	if s.config.MemoryAwareSizing {
+		if limit, ok := CgroupMemoryLimit("/sys/fs/cgroup"); ok {
+			s.ApplyMemoryLimit(limit)
+		}
+	}
+
+	if s.config.HecPath != "" {
+		if err = eventwriter.ValidateHECPath(s.config.HecPath); err != nil {
+			s.logger.Error("Invalid HEC path", err)
+			return err
+		}
+	}
+
+	if s.config.MaxHecWorkers > 0 && (s.config.MinHecWorkers < 1 || s.config.MinHecWorkers > s.config.MaxHecWorkers || s.config.HecScaleInterval <= 0) {
+		err = errors.New("MIN_HEC_WORKERS must be between 1 and MAX_HEC_WORKERS, and HEC_SCALE_INTERVAL positive, when MAX_HEC_WORKERS is set")
+		s.logger.Error("Invalid HEC worker scaling configuration", err)
+		return err
+	}
+
+	if s.config.RouteWorkers < 0 || s.config.RouteBufferSize < 0 {
+		err = errors.New("ROUTE_WORKERS and ROUTE_BUFFER_SIZE must not be negative")
+		s.logger.Error("Invalid routing configuration", err)
+		return err
+	}
+
+	if s.config.AutoCreateIndex && s.config.SplunkManagementURL == "" {
+		err = errors.New("SPLUNK_MANAGEMENT_URL is required when AUTO_CREATE_INDEX is enabled")
+		s.logger.Error("Invalid index creation configuration", err)
+		return err
+	}
+
+	if _, err = nozzle.ParseErrorClasses(s.config.FirehoseFatalErrors); err != nil {
+		s.logger.Error("Invalid firehose fatal errors", err)
+		return err
+	}
+
+	if _, err = monitoring.ParseMetricPatterns(s.config.MonitoringMetrics); err != nil {
+		s.logger.Error("Invalid monitoring metrics", err)
+		return err
+	}
+
+	if strings.TrimSpace(s.config.OrgHecTokens) != "" && !strings.Contains(strings.ToLower(s.config.AddAppInfo), "orgguid") {
+		err = errors.New("OrgGuid in ADD_APP_INFO is required with ORG_HEC_TOKENS")
+		s.logger.Error("Invalid org HEC tokens configuration", err)
+		return err
+	}
+
+	// The events of the orgs would be sent with the default tokens
+	if strings.TrimSpace(s.config.OrgHecTokens) != "" && s.config.SyncSend {
+		err = errors.New("ORG_HEC_TOKENS can't be used with SYNC_SEND")
+		s.logger.Error("Invalid org HEC tokens configuration", err)
+		return err
+	}
+
+	if strings.TrimSpace(s.config.IndexMappings) != "" && !strings.Contains(strings.ToLower(s.config.AddAppInfo), "appname") {
+		err = errors.New("AppName in ADD_APP_INFO is required with INDEX_MAPPINGS")
+		s.logger.Error("Invalid index mappings configuration", err)
+		return err
+	}
+
+	indexBatching, _ := eventsink.ParseIndexBatchConfigs(s.config.IndexBatching)
+	for index, config := range indexBatching {
+		if config.DeadLetter && s.config.DeadLetterFile == "" {
+			err = fmt.Errorf("DEAD_LETTER_FILE is required for the dead_letter of index %q in INDEX_BATCHING", index)
+			s.logger.Error("Invalid index batching configuration", err)
+			return err
+		}
+	}
+
+	if s.config.DeadLetterMaxBytes < 0 {
+		err = errors.New("DEAD_LETTER_MAX_BYTES must not be negative")
+		s.logger.Error("Invalid dead letter configuration", err)
+		return err
+	}
+	if s.config.DeadLetterMaxFiles < 0 {
+		err = errors.New("DEAD_LETTER_MAX_FILES must not be negative")
+		s.logger.Error("Invalid dead letter configuration", err)
+		return err
+	}
+	if s.config.DeadLetterMaxAge < 0 {
+		err = errors.New("DEAD_LETTER_MAX_AGE must not be negative")
+		s.logger.Error("Invalid dead letter configuration", err)
+		return err
+	}
+
+	if s.config.AppKey != "" && s.config.AppKey != eventsink.AppKeyOff && s.config.AppKeySalt == "" {
+		err = errors.New("APP_KEY_SALT is required when APP_KEY is enabled")
+		s.logger.Error("Invalid app key configuration", err)
+		return err
+	}
+
+	if s.config.RequireEnrichment && strings.TrimSpace(s.config.AddAppInfo) == "" {
+		err = errors.New("ADD_APP_INFO is required when REQUIRE_ENRICHMENT is enabled")
+		s.logger.Error("Invalid enrichment configuration", err)
+		return err
+	}
+
+	if s.config.QuarantineIndex != "" && (strings.TrimSpace(s.config.AddAppInfo) == "" || s.config.RequireEnrichment) {
+		err = errors.New("QUARANTINE_INDEX requires ADD_APP_INFO, and can't be set with REQUIRE_ENRICHMENT which drops the events it would quarantine")
+		s.logger.Error("Invalid enrichment configuration", err)
+		return err
+	}
+
+	if s.config.SuppressInactiveContainerMetrics && (strings.TrimSpace(s.config.AddAppInfo) == "" || s.config.AppStateMaxAge <= 0) {
+		err = errors.New("ADD_APP_INFO and a positive APP_STATE_MAX_AGE are required when SUPPRESS_INACTIVE_CONTAINER_METRICS is enabled")
+		s.logger.Error("Invalid container metric suppression configuration", err)
+		return err
+	}
+
+	synthetic := s.config.SourceType == eventsource.SourceSynthetic
+	if synthetic {
+		if _, err = eventsource.ParseSyntheticMix(s.config.SyntheticEventMix); err != nil {
+			s.logger.Error("Invalid synthetic event mix", err)
+			return err
+		}
+		if s.config.SyntheticRate <= 0 || strings.TrimSpace(s.config.AddAppInfo) != "" {
+			err = errors.New("SYNTHETIC_RATE must be positive and ADD_APP_INFO empty with the synthetic source, as its apps don't exist in CF")
+			s.logger.Error("Invalid synthetic source configuration", err)
+			return err
+		}
+	}
+
+	st := newStartup(s.config.StartupDeadline)
+	defer st.done()
+
+	// The synthetic source runs without CF, its events aren't enriched
+	var pcfClient *cfclient.Client
+	if !synthetic {
+		err = st.step("authenticating with the CF API", func() (err error) {
+			pcfClient, err = s.PCFClientWithRetries(shutdownChan)
+			return err
+		})
+		if err != nil {
+			s.logger.Error("Failed to get info from CF Server", nil)
+			return err
+		}
+	}
 
 	appCache, err := s.AppCache(pcfClient)
 	if err != nil {
@@ -179,42 +1047,166 @@ func (s *SplunkFirehoseNozzle) Run(shutdownChan chan os.Signal) error {
 		return err
 	}
 
-	err = appCache.Open()
+	err = st.step("opening the app cache", appCache.Open)
 	if err != nil {
 		s.logger.Error("Failed to open App Cache", nil)
 		return err
 	}
 	defer appCache.Close()
 
-	eventSink, err := s.EventSink(appCache)
+	newWriter := s.WriterFactory()
+
+	if s.config.StartupDeadline > 0 && s.config.HecWarmUp {
+		var stopping bool
+		err = st.step("probing HEC", func() (err error) {
+			stopping, err = s.probeHEC(newWriter(s.config.SplunkIndex), st.expired, shutdownChan)
+			return err
+		})
+		if err != nil {
+			s.logger.Error("Failed to reach HEC", err)
+			return err
+		}
+		if stopping {
+			s.logger.Info("Splunk Nozzle is going to exit gracefully")
+			return nil
+		}
+	}
+
+	if s.config.CheckIndexes {
+		err = st.step("checking the indexes", func() error {
+			s.checkIndexes(appCache, newWriter)
+			return nil
+		})
+		if err != nil {
+			s.logger.Error("Failed to check the indexes", err)
+			return err
+		}
+	}
+
+	eventSink, err := s.EventSink(appCache, newWriter)
 	if err != nil {
 		s.logger.Error("Failed to create event sink", nil)
 		return err
 	}
+	splunkSink := eventSink
+
+	// Sent once the sink is open, whether or not the firehose ever delivers an event,
+	// and bookended by the stopped event on shutdown
+	var lifecycleWriter eventwriter.Writer
+	if s.config.LifecycleEvents {
+		lifecycleWriter = newWriter(s.config.SplunkIndex)
+		s.LifecycleEvent(lifecycleWriter, LifecycleStarted)
+	}
+
+	// Started once EventSink registered the logger sink, which isn't safe concurrently
+	// with logging
+	done := make(chan struct{})
+	defer close(done)
+	go s.WarnSkipSSL(skipSSLWarnInterval, done)
 
 	s.logger.Info("Running splunk-firehose-nozzle with following configuration variables ", s.config.ToMap())
 
+	if s.config.GraphiteHost != "" {
+		graphiteSink := s.GraphiteSink()
+		graphiteSink.Open()
+		eventSink = eventsink.NewMulti(eventSink, graphiteSink)
+	}
+
+	if s.config.AlertWebhookURL != "" {
+		alertSink, err := s.AlertWebhookSink()
+		if err != nil {
+			s.logger.Error("Failed to create alert webhook sink", nil)
+			return err
+		}
+		alertSink.Open()
+		eventSink = eventsink.NewMulti(eventSink, alertSink)
+	}
+
+	if s.config.ReorderWindow > time.Second*0 {
+		reorderSink := s.ReorderSink(eventSink)
+		reorderSink.Open()
+		eventSink = reorderSink
+	}
+
+	if s.config.DedupWindow > time.Second*0 {
+		dedupSink := s.DedupSink(eventSink)
+		dedupSink.Open()
+		eventSink = dedupSink
+	}
+
 	eventRouter, err := s.EventRouter(appCache, eventSink)
 	if err != nil {
 		s.logger.Error("Failed to create event router", nil)
 		return err
 	}
 
-	eventSource := s.EventSource(pcfClient)
-	noz := s.Nozzle(eventSource, eventRouter)
+	if s.config.StatusMonitorInterval > time.Second*0 && s.config.SplunkMetricIndex != "" {
+		metricsMonitor := s.MetricsMonitor(newWriter)
+		metricsMonitor.Start()
+		defer metricsMonitor.Stop()
+	}
+
+	if s.config.SummaryInterval > time.Second*0 {
+		summary := s.Summary(newWriter)
+		summary.Start()
+		defer summary.Stop()
+	}
+
+	if s.config.DropSummaryInterval > time.Second*0 {
+		dropSummary := s.DropSummary(newWriter)
+		dropSummary.Start()
+		defer dropSummary.Stop()
+	}
+
+	if s.config.SamplingAuditInterval > time.Second*0 {
+		samplingAudit := s.SamplingAudit(newWriter)
+		samplingAudit.Start()
+		defer samplingAudit.Stop()
+	}
+
+	var eventSource eventsource.Source
+	if synthetic {
+		eventSource = s.SyntheticSource()
+	} else {
+		eventSource = s.EventSource(pcfClient)
+	}
+	noz := s.Nozzle(eventSource, eventRouter, newWriter)
 
 	// Continuous Loop will run forever
+	sourceErr := make(chan error, 1)
 	go func() {
 		err := noz.Start()
 		if err != nil {
 			s.logger.Error("Firehose consumer exits with error", err)
 		}
+		sourceErr <- err
 		shutdownChan <- os.Interrupt
 	}()
 
-	<-shutdownChan
+	// Started once the firehose delivered an event
+	stopping, startErr := st.wait("reading the first firehose event", noz.Receiving(), shutdownChan)
+	st.done()
+	if startErr != nil {
+		s.logger.Error("Failed to start splunk-firehose-nozzle", startErr)
+	} else if !stopping {
+		<-shutdownChan
+	}
 
 	s.logger.Info("Splunk Nozzle is going to exit gracefully")
+	// Unblocks the firehose consumer writing to the sink with SYNC_SEND
+	if stopper, ok := splunkSink.(eventsink.Stopper); ok {
+		stopper.Stop()
+	}
 	noz.Close()
-	return eventSink.Close()
+	if lifecycleWriter != nil {
+		s.LifecycleEvent(lifecycleWriter, LifecycleStopped)
+	}
+	err = eventSink.Close()
+	if startErr != nil {
+		return startErr
+	}
+	if fatal := <-sourceErr; fatal != nil {
+		return fmt.Errorf("%w: %v", ErrFirehoseFailed, fatal)
+	}
+	return err
 }
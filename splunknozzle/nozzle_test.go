@@ -1,14 +1,26 @@
 package splunknozzle_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsink"
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventsource"
 	. "github.com/cloudfoundry-community/splunk-firehose-nozzle/splunknozzle"
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/testing"
+	"github.com/cloudfoundry/sonde-go/events"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -76,14 +88,359 @@ var _ = Describe("SplunkFirehoseNozzle", func() {
 
 	It("EventSink", func() {
 		c := testing.NewMemoryCacheMock()
-		_, err := noz.EventSink(c)
+		_, err := noz.EventSink(c, noz.WriterFactory())
 		Ω(err).ShouldNot(HaveOccurred())
 
 		config.Debug = true
-		_, err = noz.EventSink(c)
+		_, err = noz.EventSink(c, noz.WriterFactory())
 		Ω(err).ShouldNot(HaveOccurred())
 	})
 
+	It("EventSink fails on an invalid event filter", func() {
+		config.EventFilter = `event_type ==`
+		_, err := noz.EventSink(testing.NewMemoryCacheMock(), noz.WriterFactory())
+		Ω(err).Should(MatchError(ContainSubstring("invalid filter expression")))
+	})
+
+	It("EventSink fails naming the extra field over the maximum size", func() {
+		c := testing.NewMemoryCacheMock()
+		config.ExtraFields = "team:payments"
+		config.IndexExtraFields = `{"app_logs": {"owner": "someone@example.com"}}`
+		_, err := noz.EventSink(c, noz.WriterFactory())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config.MaxExtraFieldBytes = 10
+		_, err = noz.EventSink(c, noz.WriterFactory())
+		Ω(err).Should(MatchError("INDEX_EXTRA_FIELDS of index [app_logs]: value of extra field [owner] is 19 bytes, over the maximum of 10 bytes"))
+	})
+
+	It("sends lifecycle events", func() {
+		writer := &testing.EventWriterMock{}
+		noz.LifecycleEvent(writer, LifecycleStarted)
+		noz.LifecycleEvent(writer, LifecycleStopped)
+
+		events := writer.CapturedEvents()
+		Expect(events).To(HaveLen(2))
+		started, stopped := events[0]["event"].(map[string]interface{}), events[1]["event"].(map[string]interface{})
+		Expect(events[0]["sourcetype"]).To(Equal("cf:splunknozzle:lifecycle"))
+		Expect(started["lifecycle"]).To(Equal("started"))
+		Expect(started).NotTo(HaveKey("uptime"))
+		Expect(stopped["lifecycle"]).To(Equal("stopped"))
+		Expect(stopped).To(HaveKey("uptime"))
+		Expect(stopped["uuid"]).To(Equal(started["uuid"]))
+		Expect(stopped["config_hash"]).To(Equal(config.Hash()))
+	})
+
+	It("hashes the configuration without its secrets", func() {
+		hash := config.Hash()
+		config.SplunkToken = "another-token"
+		Expect(config.Hash()).To(Equal(hash))
+		config.SplunkIndex = "another-index"
+		Expect(config.Hash()).NotTo(Equal(hash))
+	})
+
+	It("WriterFactory", func() {
+		newWriter := noz.WriterFactory()
+		Expect(newWriter("main")).ToNot(BeNil())
+		Expect(newWriter("metrics")).ToNot(BeNil())
+	})
+
+	It("MetricsMonitor", func() {
+		config.SplunkMetricIndex = "metrics"
+		Expect(noz.MetricsMonitor(noz.WriterFactory())).ToNot(BeNil())
+	})
+
+	It("Summary", func() {
+		config.SummaryInterval = time.Minute
+		Expect(noz.Summary(noz.WriterFactory())).ToNot(BeNil())
+	})
+
+	It("GraphiteSink", func() {
+		config.GraphiteHost = "localhost:2003"
+		Expect(noz.GraphiteSink()).ToNot(BeNil())
+	})
+
+	It("AlertWebhookSink", func() {
+		config.AlertWebhookURL = "http://localhost:9999/alerts"
+		_, err := noz.AlertWebhookSink()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		config.AlertWebhookTemplate = "{{.msg"
+		_, err = noz.AlertWebhookSink()
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("CgroupMemoryLimit", func() {
+		root, err := os.MkdirTemp("", "cgroup")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(root)
+
+		_, ok := CgroupMemoryLimit(root)
+		Expect(ok).To(BeFalse())
+
+		Ω(os.MkdirAll(filepath.Join(root, "memory"), 0755)).Should(Succeed())
+		Ω(os.WriteFile(filepath.Join(root, "memory", "memory.limit_in_bytes"), []byte("9223372036854771712\n"), 0644)).Should(Succeed())
+		_, ok = CgroupMemoryLimit(root)
+		Expect(ok).To(BeFalse())
+
+		Ω(os.WriteFile(filepath.Join(root, "memory.max"), []byte("268435456\n"), 0644)).Should(Succeed())
+		limit, ok := CgroupMemoryLimit(root)
+		Expect(ok).To(BeTrue())
+		Expect(limit).To(Equal(uint64(268435456)))
+
+		Ω(os.WriteFile(filepath.Join(root, "memory.max"), []byte("max\n"), 0644)).Should(Succeed())
+		_, ok = CgroupMemoryLimit(root)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("ApplyMemoryLimit", func() {
+		noz.ApplyMemoryLimit(1 << 30)
+		Expect(config.QueueSize).To(Equal(1000))
+		Expect(config.BatchSize).To(Equal(100))
+
+		noz.ApplyMemoryLimit(8 << 20)
+		Expect(config.QueueSize).To(Equal(256))
+		Expect(config.BatchSize).To(Equal(32))
+	})
+
+	It("ParseTLSConfig", func() {
+		config.TLSMinVersion = "1.3"
+		Expect(noz.ParseTLSConfig()).To(Succeed())
+
+		config.TLSCipherSuites = "TLS_UNKNOWN"
+		Expect(noz.ParseTLSConfig()).ToNot(Succeed())
+	})
+
+	It("ParseTLSConfig only allows plain HTTP hosts explicitly", func() {
+		config.HecFailoverHosts = "https://dr:8088, http://localhost:8088"
+		Expect(noz.ParseTLSConfig()).To(MatchError(ContainSubstring("http://localhost:8088 uses plain HTTP")))
+
+		config.AllowPlainHTTP = true
+		Expect(noz.ParseTLSConfig()).To(Succeed())
+	})
+
+	It("Run requires the management URL to create indexes", func() {
+		config.AutoCreateIndex = true
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("SPLUNK_MANAGEMENT_URL")))
+	})
+
+	It("MappedIndexes", func() {
+		config.SplunkMetricIndex = "metrics"
+		config.IndexExtraFields = `{"app_logs": {"team": "payments"}}`
+		config.IndexBatching = `{"alerts": {"batch_size": 1}, "main": {"batch_size": 10}}`
+		config.MessageTypeIndexes = `{"ERR": "app_errors"}`
+		Expect(noz.MappedIndexes(testing.NewMemoryCacheMock())).To(Equal([]string{"alerts", "app_errors", "app_logs", "main", "metrics"}))
+
+		dir, err := os.MkdirTemp("", "mapping")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		config.EventMappingFile = filepath.Join(dir, "mapping.json")
+		Ω(os.WriteFile(config.EventMappingFile, []byte(`{"LogMessage": {"index": "cf_logs"}, "Error": {}}`), 0600)).Should(Succeed())
+		Expect(noz.MappedIndexes(testing.NewMemoryCacheMock())).To(ContainElement("cf_logs"))
+	})
+
+	It("warns while the certificates of Splunk aren't verified", func() {
+		buffer := new(bytes.Buffer)
+		logger.RegisterSink(lager.NewWriterSink(buffer, lager.INFO))
+		config.SkipSSLExpiry = 100 * time.Millisecond
+		Ω(noz.ParseTLSConfig()).Should(Succeed())
+
+		noz.WarnSkipSSL(30*time.Millisecond, make(chan struct{}))
+		Expect(strings.Count(buffer.String(), "the certificates of Splunk are not verified")).To(BeNumerically(">=", 2))
+		Expect(buffer.String()).To(ContainSubstring("expires_at"))
+		Expect(buffer.String()).To(ContainSubstring("SKIP_SSL_VALIDATION_SPLUNK expired"))
+	})
+
+	It("CheckIndexes", func() {
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var probe map[string]interface{}
+			json.NewDecoder(request.Body).Decode(&probe)
+			if probe["index"] != "main" {
+				writer.WriteHeader(400)
+				writer.Write([]byte(`{"text":"Incorrect index","code":7,"invalid-event-number":0}`))
+				return
+			}
+			writer.Write([]byte(`{"text":"Success","code":0}`))
+		}))
+		defer hec.Close()
+		config.SplunkHost = hec.URL
+
+		rejected := noz.CheckIndexes(noz.WriterFactory(), []string{"main", "missing"})
+		Expect(rejected).To(HaveLen(1))
+		Expect(rejected["missing"]).To(MatchError(ContainSubstring("Incorrect index")))
+	})
+
+	It("WriterFactory assigns tokens round-robin", func() {
+		var tokens []string
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			tokens = append(tokens, request.Header.Get("Authorization"))
+			writer.Write([]byte(`{"text":"Success","code":0}`))
+		}))
+		defer hec.Close()
+		config.SplunkHost = hec.URL
+		config.SplunkTokens = "token2, token,,token3"
+
+		newWriter := noz.WriterFactory()
+		for i := 0; i < 4; i++ {
+			err, _ := newWriter("main").Write([]map[string]interface{}{{"event": "hello"}})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(tokens).To(Equal([]string{"Splunk token", "Splunk token2", "Splunk token3", "Splunk token"}))
+	})
+
+	It("OrgWriters share the MAX_BUFFER_BYTES cap of the nozzle", func() {
+		received := make(chan string, 2)
+		release := make(chan struct{})
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			received <- request.Header.Get("Authorization")
+			<-release
+			writer.Write([]byte(`{"text":"Success","code":0}`))
+		}))
+		defer hec.Close()
+		defer close(release)
+		config.SplunkHost = hec.URL
+		config.OrgHecTokens = `{"org-a": "token-a", "org-b": "token-b"}`
+		config.MaxBufferBytes = 1
+
+		orgWriters, err := noz.OrgWriters()
+		Expect(err).ToNot(HaveOccurred())
+		for _, org := range []string{"org-a", "org-b"} {
+			go orgWriters[org].Write([]map[string]interface{}{{"event": "hello"}})
+		}
+
+		// The request of the second org waits until the first one completes
+		Eventually(received).Should(Receive())
+		Consistently(received, 200*time.Millisecond).ShouldNot(Receive())
+		release <- struct{}{}
+		Eventually(received).Should(Receive())
+	})
+
+	It("OrgWriters sends the events of each org with its token", func() {
+		var tokens []string
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			tokens = append(tokens, request.Header.Get("Authorization"))
+			writer.Write([]byte(`{"text":"Success","code":0}`))
+		}))
+		defer hec.Close()
+		config.SplunkHost = hec.URL
+		config.OrgHecTokens = `{"org-a": "token-a"}`
+
+		orgWriters, err := noz.OrgWriters()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(orgWriters).To(HaveLen(1))
+		err, _ = orgWriters["org-a"].Write([]map[string]interface{}{{"event": "hello"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tokens).To(Equal([]string{"Splunk token-a"}))
+
+		config.OrgHecTokens = `{"org-a": ""}`
+		_, err = noz.OrgWriters()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Run requires the org GUID for org HEC tokens", func() {
+		config.OrgHecTokens = `{"org-a": "token-a"}`
+		config.AddAppInfo = "AppName"
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("ORG_HEC_TOKENS")))
+	})
+
+	It("Run rejects org HEC tokens with sync send", func() {
+		config.OrgHecTokens = `{"org-a": "token-a"}`
+		config.AddAppInfo = "OrgGuid"
+		config.SyncSend = true
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("SYNC_SEND")))
+	})
+
+	It("Run requires the dead letter file for dead lettered indexes", func() {
+		config.IndexBatching = `{"compliance": {"retries": 20, "dead_letter": true}}`
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("DEAD_LETTER_FILE")))
+
+		config.IndexBatching = ""
+		config.DeadLetterMaxBytes = -1
+		err = noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("DEAD_LETTER_MAX_BYTES")))
+
+		config.DeadLetterMaxBytes = 0
+		config.DeadLetterMaxFiles = -1
+		err = noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("DEAD_LETTER_MAX_FILES")))
+	})
+
+	It("Run requires app info to require enrichment", func() {
+		config.RequireEnrichment = true
+		config.AddAppInfo = ""
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("ADD_APP_INFO")))
+	})
+
+	It("Run rejects a quarantine index with required enrichment", func() {
+		config.QuarantineIndex = "quarantine"
+		config.RequireEnrichment = true
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("QUARANTINE_INDEX")))
+	})
+
+	It("Run requires app info to suppress inactive container metrics", func() {
+		config.SuppressInactiveContainerMetrics = true
+		config.AppStateMaxAge = time.Minute
+		config.AddAppInfo = ""
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("SUPPRESS_INACTIVE_CONTAINER_METRICS")))
+	})
+
+	It("Run validates the synthetic source", func() {
+		config.SourceType = eventsource.SourceSynthetic
+		config.SyntheticRate = 100
+		config.SyntheticEventMix = "Error:1"
+		err := noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("Error")))
+
+		config.SyntheticEventMix = eventsource.DefaultSyntheticMix
+		config.AddAppInfo = "AppName"
+		err = noz.Run(make(chan os.Signal, 2))
+		Expect(err).To(MatchError(ContainSubstring("ADD_APP_INFO")))
+	})
+
+	It("ExitCode", func() {
+		Expect(ExitCode(nil)).To(Equal(ExitClean))
+		Expect(ExitCode(errors.New("invalid"))).To(Equal(ExitError))
+		Expect(ExitCode(fmt.Errorf("%w: 3 events dropped while draining", eventsink.ErrEventsAbandoned))).To(Equal(ExitEventsAbandoned))
+		Expect(ExitCode(fmt.Errorf("%w: closed", ErrFirehoseFailed))).To(Equal(ExitFirehoseFailed))
+		Expect(ExitCode(fmt.Errorf("%w: stalled", ErrStartupDeadline))).To(Equal(ExitStartupDeadline))
+	})
+
+	It("Run exits naming the startup step which stalls beyond the startup deadline", func() {
+		stalled := make(chan struct{})
+		cfAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-stalled
+		}))
+		defer cfAPI.Close()
+		// Released before closing the server, which waits for the stalled request
+		defer close(stalled)
+
+		config.ApiEndpoint = cfAPI.URL
+		config.StartupDeadline = 200 * time.Millisecond
+		err := noz.Run(make(chan os.Signal, 2))
+		Ω(errors.Is(err, ErrStartupDeadline)).Should(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("authenticating with the CF API stalled"))
+		Expect(ExitCode(err)).To(Equal(ExitStartupDeadline))
+	})
+
+	It("AddKubernetesFields", func() {
+		os.Setenv("POD_NAME", "nozzle-0")
+		os.Setenv("POD_NAMESPACE", "logging")
+		os.Unsetenv("NODE_NAME")
+		defer os.Unsetenv("POD_NAME")
+		defer os.Unsetenv("POD_NAMESPACE")
+
+		fields := map[string]string{"env": "dev", "k8s_namespace": "custom"}
+		AddKubernetesFields(fields)
+		Expect(fields).To(Equal(map[string]string{"env": "dev", "k8s_pod_name": "nozzle-0", "k8s_namespace": "custom"}))
+	})
+
 	It("PCFClient", func() {
 		port := 9911
 		cc := testing.NewCloudControllerMock(port)
@@ -127,19 +484,145 @@ var _ = Describe("SplunkFirehoseNozzle", func() {
 		Expect(f).ToNot(BeNil())
 	})
 
+	It("SyntheticSource", func() {
+		config.SyntheticRate = 1000
+		config.SyntheticEventMix = "LogMessage:1"
+		source := noz.SyntheticSource()
+		defer source.Close()
+
+		envelopes, _ := source.Read()
+		var envelope *events.Envelope
+		Eventually(envelopes).Should(Receive(&envelope))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_LogMessage))
+	})
+
 	It("Nozzle", func() {
 		src := testing.NewMemoryEventSourceMock(1, 10, -1)
 		router := testing.NewEventRouterMock(false)
-		n := noz.Nozzle(src, router)
+		n := noz.Nozzle(src, router, noz.WriterFactory())
 		Expect(n).ToNot(BeNil())
 	})
 
+	It("PCFClientWithRetries gives up after the retries", func() {
+		config.StartupRetries = 2
+		config.StartupRetryInterval = 10 * time.Millisecond
+		start := time.Now()
+		_, err := noz.PCFClientWithRetries(make(chan os.Signal, 1))
+		Ω(err).Should(MatchError(ContainSubstring("after 3 attempts")))
+		Expect(time.Since(start)).To(BeNumerically(">=", 30*time.Millisecond))
+	})
+
+	It("PCFClientWithRetries stops retrying on shutdown", func() {
+		config.StartupRetries = 2
+		config.StartupRetryInterval = time.Hour
+		shutdownChan := make(chan os.Signal, 1)
+		shutdownChan <- os.Interrupt
+		_, err := noz.PCFClientWithRetries(shutdownChan)
+		Ω(err).Should(MatchError(ContainSubstring("interrupted")))
+	})
+
 	It("Run without cloudcontroller, error out", func() {
 		shutdownChan := make(chan os.Signal, 2)
 		err := noz.Run(shutdownChan)
 		Ω(err).Should(HaveOccurred())
 	})
 
+	It("Run exits when the firehose delivers no event before the startup deadline", func() {
+		cc := testing.NewCloudControllerMock(9912)
+		go cc.Start()
+		defer cc.Stop()
+		Eventually(func() error {
+			_, err := http.Get("http://localhost:9912/v2/info")
+			return err
+		}).Should(Succeed())
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(`{"text":"HEC is healthy","code":17}`))
+		}))
+		defer hec.Close()
+
+		config.ApiEndpoint = "http://localhost:9912"
+		config.AddAppInfo = ""
+		config.SplunkHost = hec.URL
+		config.AllowPlainHTTP = true
+		config.HecWarmUp = true
+		config.StartupDeadline = 2 * time.Second
+		// The mock doesn't serve the firehose, so the nozzle never reads an event
+		err := noz.Run(make(chan os.Signal, 2))
+		Ω(errors.Is(err, ErrStartupDeadline)).Should(BeTrue(), fmt.Sprint(err))
+		Expect(err.Error()).To(ContainSubstring("reading the first firehose event stalled"))
+		Expect(err.Error()).To(ContainSubstring("probing HEC ("))
+		Expect(ExitCode(err)).To(Equal(ExitStartupDeadline))
+	})
+
+	It("Run exits cleanly when shut down while probing HEC", func() {
+		cc := testing.NewCloudControllerMock(9913)
+		go cc.Start()
+		defer cc.Stop()
+		Eventually(func() error {
+			_, err := http.Get("http://localhost:9913/v2/info")
+			return err
+		}).Should(Succeed())
+		shutdownChan := make(chan os.Signal, 2)
+		var probed sync.Once
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			probed.Do(func() { shutdownChan <- os.Interrupt })
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer hec.Close()
+
+		config.ApiEndpoint = "http://localhost:9913"
+		config.AddAppInfo = ""
+		config.SplunkHost = hec.URL
+		config.AllowPlainHTTP = true
+		config.HecWarmUp = true
+		config.StartupDeadline = 10 * time.Second
+		err := noz.Run(shutdownChan)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(ExitCode(err)).To(Equal(ExitClean))
+	})
+
+	It("Run sends the lifecycle events when the firehose delivers no event", func() {
+		cc := testing.NewCloudControllerMock(9914)
+		go cc.Start()
+		defer cc.Stop()
+		Eventually(func() error {
+			_, err := http.Get("http://localhost:9914/v2/info")
+			return err
+		}).Should(Succeed())
+		lifecycles := make(chan string, 10)
+		hec := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var event struct {
+				Sourcetype string                 `json:"sourcetype"`
+				Event      map[string]interface{} `json:"event"`
+			}
+			if json.NewDecoder(request.Body).Decode(&event) == nil && event.Sourcetype == "cf:splunknozzle:lifecycle" {
+				lifecycles <- fmt.Sprint(event.Event["lifecycle"])
+			}
+		}))
+		defer hec.Close()
+
+		config.ApiEndpoint = "http://localhost:9914"
+		config.AddAppInfo = ""
+		config.SplunkHost = hec.URL
+		config.AllowPlainHTTP = true
+		config.LifecycleEvents = true
+		shutdownChan := make(chan os.Signal, 2)
+		started := make(chan string, 1)
+		go func() {
+			select {
+			case lifecycle := <-lifecycles:
+				started <- lifecycle
+			case <-time.After(5 * time.Second):
+			}
+			shutdownChan <- os.Interrupt
+		}()
+		// The mock doesn't serve the firehose, so the nozzle never reads an event
+		err := noz.Run(shutdownChan)
+		Ω(err).ShouldNot(HaveOccurred())
+		Expect(started).To(Receive(Equal(LifecycleStarted)))
+		Expect(lifecycles).To(Receive(Equal(LifecycleStopped)))
+	})
+
 	It("Run with cloudcontroller", func() {
 		config.AddAppInfo = ""
 		port := 9911
@@ -156,7 +639,9 @@ var _ = Describe("SplunkFirehoseNozzle", func() {
 			time.Sleep(time.Second)
 			shutdownChan <- os.Interrupt
 		}()
+		// The mock doesn't serve the firehose, the shutdown while the consumer retries is clean
 		err := noz.Run(shutdownChan)
 		Ω(err).ShouldNot(HaveOccurred())
+		Expect(ExitCode(err)).To(Equal(ExitClean))
 	})
 })
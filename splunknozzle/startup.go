@@ -0,0 +1,124 @@
+package splunknozzle
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/splunk-firehose-nozzle/eventwriter"
+)
+
+// hecProbeInterval is how often the HEC health endpoint is queried until it responds
+// at startup
+const hecProbeInterval = time.Second
+
+// startup runs the steps of the nozzle startup within STARTUP_DEADLINE, so a nozzle
+// stalled on a step, such as authenticating with the CF API, reaching HEC or reading
+// the first event of the firehose, exits naming the step instead of hanging half
+// initialized
+type startup struct {
+	deadline time.Duration
+	started  time.Time
+	expired  chan struct{} // closed at the deadline, nil without deadline
+	timer    *time.Timer
+
+	lock      sync.Mutex
+	completed []string // completed steps with their durations
+}
+
+func newStartup(deadline time.Duration) *startup {
+	st := &startup{deadline: deadline, started: time.Now()}
+	if deadline > 0 {
+		st.expired = make(chan struct{})
+		st.timer = time.AfterFunc(deadline, func() { close(st.expired) })
+	}
+	return st
+}
+
+// step runs a startup step, and returns ErrStartupDeadline naming the step when the
+// deadline passes before it completes. The stalled step is left running, as the
+// nozzle exits
+func (st *startup) step(name string, fn func() error) error {
+	if st.expired == nil {
+		return fn()
+	}
+
+	stepStarted := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		st.complete(name, stepStarted)
+		return err
+	case <-st.expired:
+		return st.stalled(name, stepStarted)
+	}
+}
+
+// wait waits for ready as the last startup step, until the deadline or a shutdown
+// signal. It returns whether the nozzle is shutting down
+func (st *startup) wait(name string, ready <-chan struct{}, shutdownChan <-chan os.Signal) (bool, error) {
+	waitStarted := time.Now()
+	select {
+	case <-ready:
+		st.complete(name, waitStarted)
+		return false, nil
+	case <-shutdownChan:
+		return true, nil
+	case <-st.expired:
+		return false, st.stalled(name, waitStarted)
+	}
+}
+
+func (st *startup) complete(name string, stepStarted time.Time) {
+	st.lock.Lock()
+	st.completed = append(st.completed, fmt.Sprintf("%s (%s)", name, time.Since(stepStarted).Round(time.Millisecond)))
+	st.lock.Unlock()
+}
+
+// stalled returns the ErrStartupDeadline of the step, with the steps completed before it
+func (st *startup) stalled(name string, stepStarted time.Time) error {
+	st.lock.Lock()
+	completed := strings.Join(st.completed, ", ")
+	st.lock.Unlock()
+	if completed == "" {
+		completed = "none"
+	}
+	return fmt.Errorf("%w: %s stalled for %s after %s of startup, completed steps: %s", ErrStartupDeadline,
+		name, time.Since(stepStarted).Round(time.Millisecond), st.deadline, completed)
+}
+
+// done stops the deadline once the nozzle is started, or failed to start
+func (st *startup) done() {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
+
+// probeHEC queries the HEC health endpoint until it responds, so the nozzle doesn't
+// pass for started while it can't reach Splunk. It gives up when stop is closed, and
+// returns whether the nozzle is shutting down
+func (s *SplunkFirehoseNozzle) probeHEC(writer eventwriter.Writer, stop <-chan struct{}, shutdownChan chan os.Signal) (bool, error) {
+	w, ok := writer.(eventwriter.WarmUpWriter)
+	if !ok {
+		return false, nil
+	}
+	for {
+		err := w.WarmUp()
+		if err == nil {
+			return false, nil
+		}
+		select {
+		case <-stop:
+			return false, err
+		case <-shutdownChan:
+			return true, nil
+		case <-time.After(hecProbeInterval):
+		}
+	}
+}
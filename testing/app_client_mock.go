@@ -17,6 +17,10 @@ type AppClientMock struct {
 	appByGUIDCallCount      int
 	getOrgByGUIDCallCount   int
 	getSpaceByGUIDCallCount int
+	listQuotasCallCount     int
+
+	// Returned by ListOrgQuotas when set
+	QuotasErr error
 }
 
 func NewAppClientMock(n int) *AppClientMock {
@@ -66,11 +70,16 @@ func (m *AppClientMock) GetSpaceByGuid(spaceGUID string) (cfclient.Space, error)
 	var id int
 	fmt.Sscanf(spaceGUID, "cf_space_id_%d", &id)
 
-	return cfclient.Space{
+	space := cfclient.Space{
 		Guid:             spaceGUID,
 		Name:             fmt.Sprintf("cf_space_name_%d", id),
 		OrganizationGuid: fmt.Sprintf("cf_org_id_%d", id),
-	}, nil
+	}
+	// Only even spaces have a space quota
+	if id%2 == 0 {
+		space.QuotaDefinitionGuid = "cf_space_quota_id"
+	}
+	return space, nil
 }
 
 func (m *AppClientMock) GetOrgByGuid(orgGUID string) (cfclient.Org, error) {
@@ -83,11 +92,27 @@ func (m *AppClientMock) GetOrgByGuid(orgGUID string) (cfclient.Org, error) {
 	fmt.Sscanf(orgGUID, "cf_org_id_%d", &id)
 
 	return cfclient.Org{
-		Guid: orgGUID,
-		Name: fmt.Sprintf("cf_org_name_%d", id),
+		Guid:                orgGUID,
+		Name:                fmt.Sprintf("cf_org_name_%d", id),
+		QuotaDefinitionGuid: "cf_org_quota_id",
 	}, nil
 }
 
+func (m *AppClientMock) ListOrgQuotas() ([]cfclient.OrgQuota, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.listQuotasCallCount++
+	if m.QuotasErr != nil {
+		return nil, m.QuotasErr
+	}
+	return []cfclient.OrgQuota{{Guid: "cf_org_quota_id", Name: "cf_org_quota_name"}}, nil
+}
+
+func (m *AppClientMock) ListSpaceQuotas() ([]cfclient.SpaceQuota, error) {
+	return []cfclient.SpaceQuota{{Guid: "cf_space_quota_id", Name: "cf_space_quota_name"}}, nil
+}
+
 func (m *AppClientMock) CreateApp(appID, spaceID string) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -96,6 +121,7 @@ func (m *AppClientMock) CreateApp(appID, spaceID string) {
 		Guid:      appID,
 		Name:      appID,
 		SpaceGuid: spaceID,
+		State:     "STARTED",
 	}
 
 	m.apps[appID] = app
@@ -114,6 +140,9 @@ func getApps(n int) map[string]cfclient.App {
 			Guid:      fmt.Sprintf("cf_app_id_%d", i),
 			Name:      fmt.Sprintf("cf_app_name_%d", i),
 			SpaceGuid: fmt.Sprintf("cf_space_id_%d", i%50),
+			State:     "STARTED",
+			CreatedAt: "2016-06-08T16:41:45Z",
+			UpdatedAt: "2016-06-08T16:41:46Z",
 		}
 		apps[app.Guid] = app
 	}
@@ -144,6 +173,12 @@ func (m *AppClientMock) GetSpaceByGUIDCallCount() int {
 	return m.getSpaceByGUIDCallCount
 }
 
+func (m *AppClientMock) ListQuotasCallCount() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.listQuotasCallCount
+}
+
 func (m *AppClientMock) ResetCallCounts() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -152,4 +187,5 @@ func (m *AppClientMock) ResetCallCounts() {
 	m.appByGUIDCallCount = 0
 	m.getOrgByGUIDCallCount = 0
 	m.getSpaceByGUIDCallCount = 0
+	m.listQuotasCallCount = 0
 }
@@ -59,6 +59,7 @@ func (c *CloudControllerMock) Start() error {
 }
 
 func (c *CloudControllerMock) Stop() error {
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
 	return c.server.Shutdown(ctx)
 }
@@ -12,6 +12,7 @@ type EventWriterMock struct {
 	capturedEvents []map[string]interface{}
 	PostBatchFn    func(events []map[string]interface{}) error
 	ReturnErr      bool
+	warmedUp       bool
 }
 
 func (m *EventWriterMock) Write(events []map[string]interface{}) (error, uint64) {
@@ -42,3 +43,16 @@ func (m *EventWriterMock) CapturedEvents() []map[string]interface{} {
 
 	return events
 }
+
+func (m *EventWriterMock) WarmUp() error {
+	m.lock.Lock()
+	m.warmedUp = true
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *EventWriterMock) WarmedUp() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.warmedUp
+}
@@ -1,11 +1,20 @@
 package testing
 
 import (
+	"errors"
+	"time"
+
 	"github.com/cloudfoundry-community/splunk-firehose-nozzle/cache"
 )
 
 type MemoryCacheMock struct {
 	ignoreApp bool
+	ReturnErr bool
+
+	state       string
+	instances   int
+	refreshedAt int64
+	memory      int
 }
 
 func NewMemoryCacheMock() *MemoryCacheMock {
@@ -25,6 +34,10 @@ func (c *MemoryCacheMock) GetAllApps() (map[string]*cache.App, error) {
 }
 
 func (c *MemoryCacheMock) GetApp(appGuid string) (*cache.App, error) {
+	if c.ReturnErr {
+		return nil, errors.New("mockup error")
+	}
+
 	app := &cache.App{
 		Name:       "testing-app",
 		Guid:       "f964a41c-76ac-42c1-b2ba-663da3ec22d5",
@@ -33,6 +46,18 @@ func (c *MemoryCacheMock) GetApp(appGuid string) (*cache.App, error) {
 		OrgName:    "testing-org",
 		OrgGuid:    "f964a41c-76ac-42c1-b2ba-663da3ec22d7",
 		IgnoredApp: c.ignoreApp,
+		State:      "STARTED",
+		CreatedAt:  "2016-06-08T16:41:45Z",
+		Instances:  c.instances,
+		Memory:     c.memory,
+
+		RefreshedAt: c.refreshedAt,
+
+		OrgQuotaName: "testing-org-quota",
+	}
+
+	if c.state != "" {
+		app.State = c.state
 	}
 
 	return app, nil
@@ -41,3 +66,13 @@ func (c *MemoryCacheMock) GetApp(appGuid string) (*cache.App, error) {
 func (c *MemoryCacheMock) SetIgnoreApp(ignore bool) {
 	c.ignoreApp = ignore
 }
+
+func (c *MemoryCacheMock) SetAppMemory(memory int) {
+	c.memory = memory
+}
+
+func (c *MemoryCacheMock) SetAppState(state string, instances int, refreshedAt time.Time) {
+	c.state = state
+	c.instances = instances
+	c.refreshedAt = refreshedAt.Unix()
+}